@@ -94,6 +94,7 @@ var OpTable = make(map[string]OpInfo, 256)
 
 func init() {
 	for _, i := range []OpInfo{
+		{"ACL", FlagNotAllow, greater(1)},
 		{"APPEND", FlagWrite, equal(3)},
 		{"ASKING", FlagNotAllow, equal(2)},
 		{"AUTH", 0, equal(2)},
@@ -101,16 +102,18 @@ func init() {
 		{"BGSAVE", FlagNotAllow, greater(1)},
 		{"BITCOUNT", 0, greater(2)},
 		{"BITFIELD", FlagWrite, greater(2)},
+		{"BITFIELD_RO", 0, greater(2)},
 		{"BITOP", FlagWrite | FlagNotAllow, greater(4)},
 		{"BITPOS", 0, greater(3)},
-		{"BLPOP", FlagWrite | FlagNotAllow, greater(3)},
-		{"BRPOP", FlagWrite | FlagNotAllow, greater(3)},
-		{"BRPOPLPUSH", FlagWrite | FlagNotAllow, equal(4)},
+		{"BLMOVE", FlagWrite, equal(6)},
+		{"BLPOP", FlagWrite, greater(3)},
+		{"BRPOP", FlagWrite, greater(3)},
+		{"BRPOPLPUSH", FlagWrite, equal(4)},
 		{"CLIENT", FlagNotAllow, greater(1)},
 		{"CLUSTER", FlagNotAllow, greater(1)},
 		{"COMMAND", 0, greater(1)},
 		{"CONFIG", FlagNotAllow, greater(1)},
-		{"DBSIZE", FlagNotAllow, greater(1)},
+		{"DBSIZE", 0, equal(1)},
 		{"DEBUG", FlagNotAllow, greater(1)},
 		{"DECR", FlagWrite, equal(2)},
 		{"DECRBY", FlagWrite, equal(3)},
@@ -120,26 +123,39 @@ func init() {
 		{"ECHO", 0, equal(2)},
 		{"EVAL", FlagWrite, greater(3)},
 		{"EVALSHA", FlagWrite, greater(3)},
+		{"EVALSHA_RO", FlagNotAllow, greater(3)},
+		{"EVAL_RO", FlagNotAllow, greater(3)},
 		{"EXEC", FlagNotAllow, greater(1)},
 		{"EXISTS", 0, greater(2)},
 		{"EXPIRE", FlagWrite, equal(3)},
 		{"EXPIREAT", FlagWrite, equal(3)},
+		{"FCALL", FlagWrite, greater(3)},
+		{"FCALL_RO", FlagNotAllow, greater(3)},
 		{"FLUSHALL", FlagWrite | FlagNotAllow, greater(1)},
 		{"FLUSHDB", FlagWrite | FlagNotAllow, greater(1)},
+		{"FUNCTION", FlagNotAllow, greater(2)},
 		{"GEOADD", FlagWrite, greater(5)},
 		{"GEODIST", 0, greater(4)},
 		{"GEOHASH", 0, greater(3)},
 		{"GEOPOS", 0, greater(3)},
 		{"GEORADIUS", FlagWrite, greater(6)},
 		{"GEORADIUSBYMEMBER", FlagWrite, greater(5)},
+		{"GEOSEARCH", 0, greater(7)},
+		{"GEOSEARCHSTORE", FlagWrite | FlagNotAllow, greater(8)},
 		{"GET", 0, equal(2)},
 		{"GETBIT", 0, equal(3)},
 		{"GETRANGE", 0, equal(4)},
+		{"GETDEL", FlagWrite, equal(2)},
+		{"GETEX", FlagWrite, greater(2)},
 		{"GETSET", FlagWrite, equal(3)},
 		{"HDEL", FlagWrite, greater(3)},
 		{"HEXISTS", 0, equal(3)},
+		{"HEXPIRE", FlagWrite, greater(3)},
+		{"HEXPIREAT", FlagWrite, greater(3)},
+		{"HEXPIRETIME", 0, greater(5)},
 		{"HGET", 0, equal(3)},
 		{"HGETALL", 0, equal(2)},
+		{"HGETDEL", FlagWrite, greater(5)},
 		{"HINCRBY", FlagWrite, equal(4)},
 		{"HINCRBYFLOAT", FlagWrite, equal(4)},
 		{"HKEYS", 0, equal(2)},
@@ -147,10 +163,17 @@ func init() {
 		{"HMGET", 0, greater(3)},
 		{"HMSET", FlagWrite, greater(4)},
 		{"HOST:", FlagNotAllow, greater(1)},
+		{"HPERSIST", FlagWrite, greater(2)},
+		{"HPEXPIRE", FlagWrite, greater(6)},
+		{"HPEXPIREAT", FlagWrite, greater(6)},
+		{"HPEXPIRETIME", 0, greater(5)},
+		{"HPTTL", 0, greater(5)},
+		{"HRANDFIELD", 0, greater(2)},
 		{"HSCAN", FlagMasterOnly, greater(3)},
 		{"HSET", FlagWrite, greater(4)},
 		{"HSETNX", FlagWrite, equal(4)},
 		{"HSTRLEN", 0, equal(3)},
+		{"HTTL", 0, greater(2)},
 		{"HVALS", 0, equal(2)},
 		{"INCR", FlagWrite, equal(2)},
 		{"INCRBY", FlagWrite, equal(3)},
@@ -159,10 +182,14 @@ func init() {
 		{"KEYS", FlagNotAllow, greater(1)},
 		{"LASTSAVE", FlagNotAllow, greater(1)},
 		{"LATENCY", FlagNotAllow, greater(1)},
+		{"LCS", FlagNotAllow, greater(3)},
 		{"LINDEX", 0, equal(3)},
 		{"LINSERT", FlagWrite, equal(5)},
 		{"LLEN", 0, equal(2)},
+		{"LMOVE", FlagWrite, equal(5)},
+		{"LMPOP", FlagWrite | FlagNotAllow, greater(4)},
 		{"LPOP", FlagWrite, greater(2)},
+		{"LPOS", 0, greater(3)},
 		{"LPUSH", FlagWrite, greater(3)},
 		{"LPUSHX", FlagWrite, greater(3)},
 		{"LRANGE", 0, equal(4)},
@@ -201,7 +228,7 @@ func init() {
 		{"RENAME", FlagWrite | FlagNotAllow, greater(1)},
 		{"RENAMENX", FlagWrite | FlagNotAllow, greater(1)},
 		{"REPLCONF", FlagNotAllow, greater(1)},
-		{"RESTORE", FlagWrite | FlagNotAllow, greater(1)},
+		{"RESTORE", FlagWrite, greater(4)},
 		{"RESTORE-ASKING", FlagWrite | FlagNotAllow, greater(1)},
 		{"ROLE", FlagNotAllow, greater(1)},
 		{"RPOP", FlagWrite, equal(2)},
@@ -223,6 +250,7 @@ func init() {
 		{"SETRANGE", FlagWrite, equal(4)},
 		{"SHUTDOWN", FlagNotAllow, greater(1)},
 		{"SINTER", FlagNotAllow, equal(2)},
+		{"SINTERCARD", FlagNotAllow, greater(3)},
 		{"SINTERSTORE", FlagNotAllow, greater(3)},
 		{"SISMEMBER", 0, equal(3)},
 		{"SLAVEOF", FlagNotAllow, greater(1)},
@@ -250,6 +278,7 @@ func init() {
 		{"SLOTSSCAN", FlagMasterOnly | FlagNotAllow, greater(1)},
 		{"SLOWLOG", FlagNotAllow, greater(1)},
 		{"SMEMBERS", 0, equal(2)},
+		{"SMISMEMBER", 0, greater(3)},
 		{"SMOVE", FlagWrite | FlagNotAllow, greater(1)},
 		{"SORT", FlagWrite, greater(2)},
 		{"SPOP", FlagWrite, greater(2)},
@@ -261,6 +290,7 @@ func init() {
 		{"SUBSTR", 0, equal(4)},
 		{"SUNION", FlagNotAllow, greater(1)},
 		{"SUNIONSTORE", FlagWrite | FlagNotAllow, greater(1)},
+		{"SWAPDB", FlagWrite | FlagNotAllow, greater(1)},
 		{"SYNC", FlagNotAllow, greater(1)},
 		{"TIME", FlagNotAllow, greater(1)},
 		{"TOUCH", FlagWrite | FlagNotAllow, greater(1)},
@@ -0,0 +1,1057 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// Access control follows the ACL of Redis 6: a connection authenticates as a
+// user with AUTH [username] password, and every command it sends is checked
+// against the commands, key patterns and channel patterns of the user before
+// it is dispatched. The users are replicated state, ACL SETUSER and DELUSER
+// go through the Raft log and the table is carried by snapshots.
+//
+// The default user starts with --auth as its password, or none, and every
+// permission. The servers authenticate to each other as the default user
+// with --auth, so its password can not be changed and it stays enabled. The
+// commands called by scripts are checked against the user that runs the
+// script, which the write scripts carry in an ASUSER entry.
+func init() {
+	addConnCommand("ACL", connACL)
+	conf.AddWriteCommand("ACL", cmdACL)
+	conf.AddWriteCommand("ASUSER", cmdASUSER)
+	registerSnapshotSection("acl", acl.save, acl.load)
+
+	for name, flags := range commandTable {
+		if aclDataCommand(name) {
+			if flags&flagWrite != 0 {
+				aclCategories["write"] = append(aclCategories["write"], name)
+			} else {
+				aclCategories["read"] = append(aclCategories["read"], name)
+			}
+		}
+	}
+	for cat, names := range aclCategories {
+		sort.Strings(names)
+		for _, name := range names {
+			aclCommandCategories[name] = append(aclCommandCategories[name], cat)
+		}
+	}
+}
+
+var (
+	errWrongPass        = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errNoPermKey        = errors.New("NOPERM No permissions to access a key")
+	errNoPermChannel    = errors.New("NOPERM No permissions to access a channel")
+	errNoPermScriptKey  = errors.New("NOPERM No permissions to access a key that the script did not declare")
+	errDefaultUser      = errors.New("ERR The 'default' user cannot be removed")
+	errDefaultUserAuth  = errors.New("ERR The servers authenticate as the 'default' user with --auth, its password can not be changed and it can not be disabled")
+	errACLUsername      = errors.New("ERR Usernames can't contain spaces or null characters")
+	errACLSubcommand    = "ERR unknown subcommand '%s'. Try ACL HELP."
+	errACLRuleSyntax    = "Syntax error"
+	errACLRuleUnknown   = "Unknown command or category name in ACL"
+	errACLRuleHash      = "The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters"
+	errACLRuleSelectors = "Key permissions for reads or writes only, and selectors, are not supported"
+)
+
+// defaultUser is the user of the connections that have not authenticated.
+const defaultUser = "default"
+
+// aclCategories lists the commands of the categories of +@category rules.
+// read and write are completed at init with the commands of the data
+// categories, by their flags in the command table.
+var aclCategories = map[string][]string{
+	"keyspace": {"copy", "dbsize", "del", "dump", "exists", "expire", "expireat",
+		"expired", "expiretime", "flushall", "flushdb", "keys", "migrate", "move",
+		"pexpire", "pexpireat", "pexpiretime", "pttl", "randomkey", "rename",
+		"renamenx", "restore", "scan", "swapdb", "ttl", "type", "xscan"},
+	"string": {"append", "decr", "decrby", "get", "getdel", "getex", "getrange",
+		"getset", "incr", "incrby", "incrbyfloat", "lcs", "mget", "mset", "msetnx",
+		"psetex", "set", "setex", "setexat", "setnx", "setrange", "strlen"},
+	"bitmap": {"bitcount", "bitfield", "bitfield_ro", "bitop", "bitpos", "getbit",
+		"setbit"},
+	"hash": {"hclear", "hdel", "hexists", "hexpire", "hexpireat", "hexpired",
+		"hexpiretime", "hget", "hgetall", "hgetdel", "hincrby", "hincrbyfloat",
+		"hkeyexists", "hkeys", "hlen", "hmclear", "hmget", "hmset", "hpersist",
+		"hpexpire", "hpexpireat", "hpexpiretime", "hpttl", "hrandfield", "hscan",
+		"hset", "hsetnx", "hstrlen", "httl", "hvals", "xhscan"},
+	"list": {"blmove", "blpop", "brpop", "brpoplpush", "lclear", "lexpire",
+		"lexpireat", "lindex", "linsert", "lkeyexists", "llen", "lmclear", "lmove",
+		"lmpop", "lpop", "lpos", "lpush", "lpushx", "lrange", "lrem", "lset",
+		"ltrim", "lttl", "rpop", "rpoplpush", "rpush", "rpushx"},
+	"set": {"sadd", "scard", "sclear", "sdiff", "sdiffstore", "sexpire",
+		"sexpireat", "sinter", "sintercard", "sinterstore", "sismember",
+		"skeyexists", "smclear", "smembers", "smismember", "smove", "spersist",
+		"spop", "srandmember", "srem", "sscan", "sttl", "sunion", "sunionstore",
+		"xsscan"},
+	"sortedset": {"zadd", "zcard", "zclear", "zcount", "zincrby", "zinterstore",
+		"zlexcount", "zmscore", "zpopmax", "zpopmin", "zrandmember", "zrange",
+		"zrangebylex", "zrangebyscore", "zrangestore", "zrank", "zrem",
+		"zremrangebylex", "zremrangebyrank", "zremrangebyscore", "zrevrange",
+		"zrevrangebylex", "zrevrangebyscore", "zrevrank", "zscan", "zscore",
+		"zunionstore", "xzscan"},
+	"hyperloglog": {"pfadd", "pfcount", "pfmerge"},
+	"geo": {"geoadd", "geodist", "geohash", "geopos", "geosearch",
+		"geosearchstore"},
+	"stream": {"xack", "xadd", "xclaim", "xdel", "xgroup", "xlen", "xpending",
+		"xrange", "xread", "xreadgroup", "xrevrange", "xtrim"},
+	"pubsub": {"psubscribe", "publish", "pubsub", "punsubscribe", "spublish",
+		"ssubscribe", "subscribe", "sunsubscribe", "unsubscribe"},
+	"scripting": {"eval", "eval_ro", "evalsha", "evalsha_ro", "fcall", "fcall_ro",
+		"function", "script"},
+	"transaction": {"discard", "exec", "multi", "unwatch", "watch"},
+	"connection": {"auth", "client|getname", "client|id", "client|info",
+		"client|setinfo", "client|setname", "echo", "ping", "quit", "select"},
+	"admin": {"acl", "asuser", "client|kill", "client|list", "client|pause",
+		"client|unpause", "config", "expired", "hexpired", "migrate", "shutdown"},
+	"dangerous": {"acl", "asuser", "client|kill", "client|list", "client|pause",
+		"client|unpause", "config", "expired", "flushall", "flushdb", "hexpired",
+		"info", "keys", "migrate", "restore", "shutdown", "swapdb"},
+	"blocking": {"blmove", "blpop", "brpop", "brpoplpush", "xread",
+		"xreadgroup"},
+	"read":  {},
+	"write": {},
+}
+
+// aclCommandCategories are the categories of the commands, made at init.
+var aclCommandCategories = make(map[string][]string)
+
+// aclKnownCommand tells if name is a command of the rules, either in a
+// category or with its subcommands in the categories.
+func aclKnownCommand(name string) bool {
+	return aclCommandCategories[name] != nil || aclSubcommands[name]
+}
+
+// aclDataCommand tells if name is a command of the data categories, the
+// ones that are also in read or write.
+func aclDataCommand(name string) bool {
+	for _, cat := range []string{"keyspace", "string", "bitmap", "hash", "list",
+		"set", "sortedset", "hyperloglog", "geo", "stream"} {
+		for _, cmd := range aclCategories[cat] {
+			if cmd == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aclSubcommands are the commands whose subcommands can be allowed alone,
+// with +command|subcommand.
+var aclSubcommands = map[string]bool{
+	"acl": true, "client": true, "config": true, "function": true, "pubsub": true,
+	"script": true, "xgroup": true,
+}
+
+// aclKeySpecs are the positions of the keys of the commands checked against
+// the key patterns, for the commands whose only key is not args[1]. The
+// commands missing from the command table and from here have no key.
+var aclKeySpecs = map[string]keySpec{
+	"acl": {}, "asuser": {}, "auth": {}, "client": {}, "config": {}, "dbsize": {}, "discard": {},
+	"echo": {}, "exec": {}, "flushall": {}, "flushdb": {}, "function": {},
+	"info": {}, "keys": {}, "multi": {}, "ping": {}, "publish": {},
+	"pubsub": {}, "quit": {}, "randomkey": {}, "scan": {}, "script": {},
+	"select": {}, "shutdown": {}, "spublish": {}, "swapdb": {}, "unwatch": {},
+	"xscan": {},
+
+	"del":            {first: 1, last: -1, step: 1},
+	"exists":         {first: 1, last: -1, step: 1},
+	"expired":        {first: 1, last: -1, step: 1},
+	"lmclear":        {first: 1, last: -1, step: 1},
+	"hmclear":        {first: 1, last: -1, step: 1},
+	"smclear":        {first: 1, last: -1, step: 1},
+	"mget":           {first: 1, last: -1, step: 1},
+	"pfcount":        {first: 1, last: -1, step: 1},
+	"pfmerge":        {first: 1, last: -1, step: 1},
+	"sdiff":          {first: 1, last: -1, step: 1},
+	"sinter":         {first: 1, last: -1, step: 1},
+	"sunion":         {first: 1, last: -1, step: 1},
+	"sdiffstore":     {first: 1, last: -1, step: 1},
+	"sinterstore":    {first: 1, last: -1, step: 1},
+	"sunionstore":    {first: 1, last: -1, step: 1},
+	"watch":          {first: 1, last: -1, step: 1},
+	"mset":           {first: 1, last: -1, step: 2},
+	"msetnx":         {first: 1, last: -1, step: 2},
+	"hexpired":       {first: 1, last: -1, step: 3},
+	"bitop":          {first: 2, last: -1, step: 1},
+	"blpop":          {first: 1, last: -2, step: 1},
+	"brpop":          {first: 1, last: -2, step: 1},
+	"blmove":         {first: 1, last: 2, step: 1},
+	"brpoplpush":     {first: 1, last: 2, step: 1},
+	"copy":           {first: 1, last: 2, step: 1},
+	"geosearchstore": {first: 1, last: 2, step: 1},
+	"lcs":            {first: 1, last: 2, step: 1},
+	"lmove":          {first: 1, last: 2, step: 1},
+	"rename":         {first: 1, last: 2, step: 1},
+	"renamenx":       {first: 1, last: 2, step: 1},
+	"rpoplpush":      {first: 1, last: 2, step: 1},
+	"smove":          {first: 1, last: 2, step: 1},
+	"zrangestore":    {first: 1, last: 2, step: 1},
+	"xgroup":         {first: 2, last: 2, step: 1},
+	"lmpop":          {keys: lmpopKeys},
+	"sintercard":     {keys: numKeysAt(1)},
+	"zinterstore":    {keys: zstoreKeys},
+	"zunionstore":    {keys: zstoreKeys},
+	"xread":          {keys: xStreamsKeys},
+	"xreadgroup":     {keys: xStreamsKeys},
+	"eval":           {keys: scriptKeys},
+	"eval_ro":        {keys: scriptKeys},
+	"evalsha":        {keys: scriptKeys},
+	"evalsha_ro":     {keys: scriptKeys},
+	"fcall":          {keys: scriptKeys},
+	"fcall_ro":       {keys: scriptKeys},
+	"migrate":        {keys: migrateKeys},
+}
+
+// numKeysAt returns the keys function of the commands that have numkeys at
+// args[i], followed by the keys.
+func numKeysAt(i int) func(args []string) []string {
+	return func(args []string) []string {
+		if i >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n < 0 || i+1+n > len(args) {
+			return nil
+		}
+		return args[i+1 : i+1+n]
+	}
+}
+
+// zstoreKeys returns the destination and the source keys of ZINTERSTORE and
+// ZUNIONSTORE.
+func zstoreKeys(args []string) []string {
+	keys := numKeysAt(2)(args)
+	if keys == nil {
+		return nil
+	}
+	return append([]string{args[1]}, keys...)
+}
+
+func scriptKeys(args []string) []string {
+	if len(args) < 3 {
+		return nil
+	}
+	keys, _, err := scriptKeysArgs(args[2:])
+	if err != nil {
+		return nil
+	}
+	return keys
+}
+
+func migrateKeys(args []string) []string {
+	a, err := parseMigrateArgs(args)
+	if err != nil {
+		return nil
+	}
+	return a.keys
+}
+
+// commandKeys returns the keys of args checked against the key patterns.
+func commandKeys(args []string) []string {
+	if spec, ok := aclKeySpecs[args[0]]; ok {
+		return spec.modifiedKeys(args)
+	}
+	if _, ok := commandTable[args[0]]; ok || connCommands[args[0]] != nil {
+		return keySpec{first: 1, last: 1, step: 1}.modifiedKeys(args)
+	}
+	return nil
+}
+
+// commandChannels returns the channels of args checked against the channel
+// patterns. patterns is set when they are the patterns of PSUBSCRIBE, which
+// must be allowed literally.
+func commandChannels(args []string) (channels []string, patterns bool) {
+	switch args[0] {
+	case "publish", "spublish":
+		if len(args) > 1 {
+			return args[1:2], false
+		}
+	case "subscribe", "ssubscribe":
+		return args[1:], false
+	case "psubscribe":
+		return args[1:], true
+	}
+	return nil, false
+}
+
+// aclUser is a user of the ACL table. Users are never changed once in the
+// table, SETUSER replaces them, so that the connections can check their
+// commands without locking.
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // SHA-256 digests, in hex
+	keys      []string // key patterns
+	channels  []string // channel patterns
+	// all allows every command, but the ones of commands. commands
+	// allows or denies commands and command|subcommand, and rules are the
+	// command rules that made them, for ACL LIST.
+	all      bool
+	commands map[string]bool
+	rules    []string
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, commands: make(map[string]bool)}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.keys = append([]string(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	c.rules = append([]string(nil), u.rules...)
+	c.commands = make(map[string]bool, len(u.commands))
+	for name, allow := range u.commands {
+		c.commands[name] = allow
+	}
+	return &c
+}
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+func validPasswordHash(h string) bool {
+	if len(h) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range h {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func removeString(list []string, s string) []string {
+	for i, v := range list {
+		if v == s {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func addString(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// apply applies an ACL SETUSER rule to the user.
+func (u *aclUser) apply(rule string) error {
+	fail := func(reason string) error {
+		return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, reason)
+	}
+	if rule == "" {
+		return fail(errACLRuleSyntax)
+	}
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+	case "off":
+		u.enabled = false
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+	case "allkeys":
+		u.keys = []string{"*"}
+	case "resetkeys":
+		u.keys = nil
+	case "allchannels":
+		u.channels = []string{"*"}
+	case "resetchannels":
+		u.channels = nil
+	case "allcommands":
+		u.setAll(true)
+	case "nocommands":
+		u.setAll(false)
+	case "reset":
+		*u = *newACLUser(u.name)
+	default:
+		switch arg := rule[1:]; rule[0] {
+		case '>':
+			u.nopass = false
+			u.passwords = addString(u.passwords, hashPassword(arg))
+		case '<':
+			u.passwords = removeString(u.passwords, hashPassword(arg))
+		case '#', '!':
+			if !validPasswordHash(arg) {
+				return fail(errACLRuleHash)
+			}
+			if rule[0] == '#' {
+				u.nopass = false
+				u.passwords = addString(u.passwords, arg)
+			} else {
+				u.passwords = removeString(u.passwords, arg)
+			}
+		case '~':
+			if arg == "*" {
+				u.keys = []string{"*"}
+			} else if len(u.keys) != 1 || u.keys[0] != "*" {
+				u.keys = addString(u.keys, arg)
+			}
+		case '&':
+			if arg == "*" {
+				u.channels = []string{"*"}
+			} else if len(u.channels) != 1 || u.channels[0] != "*" {
+				u.channels = addString(u.channels, arg)
+			}
+		case '%', '(':
+			return fail(errACLRuleSelectors)
+		case '+', '-':
+			if msg := u.setCommand(rule[0] == '+', strings.ToLower(arg)); msg != "" {
+				return fail(msg)
+			}
+		default:
+			return fail(errACLRuleSyntax)
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) setAll(allow bool) {
+	u.all = allow
+	u.commands = make(map[string]bool)
+	u.rules = nil
+}
+
+// setCommand applies a +command, +command|subcommand or +@category rule, or
+// its - counterpart. It returns the reason of an invalid rule.
+func (u *aclUser) setCommand(allow bool, name string) string {
+	sign := "-"
+	if allow {
+		sign = "+"
+	}
+	if cat, ok := strings.CutPrefix(name, "@"); ok {
+		if cat == "all" {
+			u.setAll(allow)
+			return ""
+		}
+		names, ok := aclCategories[cat]
+		if !ok {
+			return errACLRuleUnknown
+		}
+		for _, name := range names {
+			u.allow(name, allow)
+		}
+		u.rules = append(u.rules, sign+name)
+		return ""
+	}
+	cmd, sub, hasSub := strings.Cut(name, "|")
+	if !aclKnownCommand(cmd) {
+		return errACLRuleUnknown
+	}
+	if hasSub && (!aclSubcommands[cmd] || sub == "" || strings.Contains(sub, "|")) {
+		return errACLRuleUnknown
+	}
+	u.allow(name, allow)
+	// the rule replaces the previous rules of the command
+	rules := u.rules[:0]
+	for _, rule := range u.rules {
+		if prev := rule[1:]; prev != name && (hasSub || !strings.HasPrefix(prev, name+"|")) {
+			rules = append(rules, rule)
+		}
+	}
+	u.rules = append(rules, sign+name)
+	return ""
+}
+
+// allow allows or denies a command, and all of its subcommands, or a
+// command|subcommand.
+func (u *aclUser) allow(name string, allow bool) {
+	if !strings.Contains(name, "|") {
+		for other := range u.commands {
+			if strings.HasPrefix(other, name+"|") {
+				delete(u.commands, other)
+			}
+		}
+	}
+	u.commands[name] = allow
+}
+
+func (u *aclUser) allowed(name, sub string) bool {
+	if sub != "" {
+		if allow, ok := u.commands[name+"|"+sub]; ok {
+			return allow
+		}
+	}
+	if allow, ok := u.commands[name]; ok {
+		return allow
+	}
+	return u.all
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || globMatch(pattern, s, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the NOPERM error of args, a command with a lowercase name,
+// when the user may not run it.
+func (u *aclUser) check(args []string) error {
+	var sub string
+	if len(args) > 1 && aclSubcommands[args[0]] {
+		sub = strings.ToLower(args[1])
+	}
+	if !u.allowed(args[0], sub) {
+		name := args[0]
+		if sub != "" {
+			name += "|" + sub
+		}
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", u.name, name)
+	}
+	for _, key := range commandKeys(args) {
+		if !matchAny(u.keys, key) {
+			return errNoPermKey
+		}
+	}
+	channels, patterns := commandChannels(args)
+	for _, channel := range channels {
+		allowed := matchAny(u.channels, channel)
+		if patterns {
+			allowed = containsString(u.channels, "*") || containsString(u.channels, channel)
+		}
+		if !allowed {
+			return errNoPermChannel
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate tells if pass opens the user.
+func (u *aclUser) authenticate(pass string) bool {
+	if !u.enabled {
+		return false
+	}
+	return u.nopass || containsString(u.passwords, hashPassword(pass))
+}
+
+// describe returns the rules that make the user, as listed by ACL LIST.
+func (u *aclUser) describe() []string {
+	var rules []string
+	if u.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, h := range u.passwords {
+		rules = append(rules, "#"+h)
+	}
+	for _, pattern := range u.keys {
+		rules = append(rules, "~"+pattern)
+	}
+	if len(u.channels) == 0 {
+		rules = append(rules, "resetchannels")
+	}
+	for _, pattern := range u.channels {
+		rules = append(rules, "&"+pattern)
+	}
+	return append(rules, u.commandRules()...)
+}
+
+func (u *aclUser) commandRules() []string {
+	rules := []string{"-@all"}
+	if u.all {
+		rules[0] = "+@all"
+	}
+	return append(rules, u.rules...)
+}
+
+// aclTable holds the users by name. It is only changed inside Apply and is
+// carried by snapshots.
+type aclTable struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+var acl = &aclTable{}
+
+// reset leaves the default user alone, with --auth as its password.
+func (t *aclTable) reset() {
+	u := newACLUser(defaultUser)
+	u.enabled, u.all = true, true
+	u.keys, u.channels = []string{"*"}, []string{"*"}
+	if conf.Auth == "" {
+		u.nopass = true
+	} else {
+		u.passwords = []string{hashPassword(conf.Auth)}
+	}
+	t.users = map[string]*aclUser{u.name: u}
+}
+
+// user returns the user name, or nil. The table starts with the default user
+// on first use, once --auth is known.
+func (t *aclTable) user(name string) *aclUser {
+	t.mu.RLock()
+	if t.users != nil {
+		u := t.users[name]
+		t.mu.RUnlock()
+		return u
+	}
+	t.mu.RUnlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.users == nil {
+		t.reset()
+	}
+	return t.users[name]
+}
+
+// sorted returns the users sorted by name.
+func (t *aclTable) sorted() []*aclUser {
+	t.user(defaultUser)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	users := make([]*aclUser, 0, len(t.users))
+	for _, u := range t.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users
+}
+
+// setUser applies rules to the user name, made when missing. No rule is
+// applied if one is invalid.
+func (t *aclTable) setUser(name string, rules []string) error {
+	if name == "" || strings.ContainsAny(name, " \x00") {
+		return errACLUsername
+	}
+	if name == defaultUser {
+		for _, rule := range rules {
+			if changesAuth(rule) {
+				return errDefaultUserAuth
+			}
+		}
+	}
+	u := t.user(name)
+	if u == nil {
+		u = newACLUser(name)
+	} else {
+		u = u.clone()
+	}
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	t.users[name] = u
+	t.mu.Unlock()
+	return nil
+}
+
+// changesAuth tells if rule changes the passwords of a user or disables it.
+func changesAuth(rule string) bool {
+	switch strings.ToLower(rule) {
+	case "off", "nopass", "resetpass", "reset":
+		return true
+	}
+	return rule != "" && strings.ContainsRune("><#!", rune(rule[0]))
+}
+
+func (t *aclTable) deleteUsers(names []string) (int, error) {
+	for _, name := range names {
+		if name == defaultUser {
+			return 0, errDefaultUser
+		}
+	}
+	t.user(defaultUser)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var n int
+	for _, name := range names {
+		if _, ok := t.users[name]; ok {
+			delete(t.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// save encodes the users, sorted by name, as their name followed by their
+// rules: uvarint count | (uvarint len | rule) ...
+func (t *aclTable) save() []byte {
+	var data []byte
+	for _, u := range t.sorted() {
+		fields := append([]string{u.name}, u.describe()...)
+		data = binary.AppendUvarint(data, uint64(len(fields)))
+		for _, field := range fields {
+			data = binary.AppendUvarint(data, uint64(len(field)))
+			data = append(data, field...)
+		}
+	}
+	return data
+}
+
+func (t *aclTable) load(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reset()
+	if data == nil {
+		return nil
+	}
+	users := make(map[string]*aclUser)
+	for len(data) > 0 {
+		n, sz := binary.Uvarint(data)
+		if sz <= 0 || n == 0 {
+			return uhaha.ErrCorrupt
+		}
+		data = data[sz:]
+		fields := make([]string, n)
+		for i := range fields {
+			l, sz := binary.Uvarint(data)
+			if sz <= 0 || uint64(len(data)-sz) < l {
+				return uhaha.ErrCorrupt
+			}
+			fields[i] = string(data[sz : sz+int(l)])
+			data = data[sz+int(l):]
+		}
+		u := newACLUser(fields[0])
+		for _, rule := range fields[1:] {
+			if err := u.apply(rule); err != nil {
+				return err
+			}
+		}
+		users[u.name] = u
+	}
+	if users[defaultUser] == nil {
+		return uhaha.ErrCorrupt
+	}
+	t.users = users
+	return nil
+}
+
+// auth authenticates the connection with AUTH [username] password.
+func (c *respConn) auth(args []string) (interface{}, error) {
+	name, pass := defaultUser, ""
+	switch len(args) {
+	case 2:
+		pass = args[1]
+	case 3:
+		name, pass = args[1], args[2]
+	default:
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	if u := acl.user(name); u == nil || !u.authenticate(pass) {
+		return nil, errWrongPass
+	}
+	c.user = name
+	return redcon.SimpleString("OK"), nil
+}
+
+// checkACL returns the error of args when the connection may not run it:
+// it is not authenticated, or its user has no permission. The connections
+// start as the default user when it needs no password.
+func (c *respConn) checkACL(args []string) error {
+	if c.user == "" {
+		if u := acl.user(defaultUser); u != nil && u.enabled && u.nopass {
+			c.user = defaultUser
+		} else {
+			return uhaha.ErrUnauthorized
+		}
+	}
+	u := acl.user(c.user)
+	if u == nil {
+		// the user was deleted, the connection must authenticate again
+		c.user = ""
+		return uhaha.ErrUnauthorized
+	}
+	return u.check(args)
+}
+
+// asUserCommands are the write commands the connections send in ASUSER
+// entries, the ones that run scripts.
+var asUserCommands = map[string]bool{"eval": true, "evalsha": true, "fcall": true, "exec": true}
+
+// userEntry returns the args of a write entry of the connection, in an ASUSER
+// entry when it runs scripts.
+func (c *respConn) userEntry(args []string) []string {
+	if !asUserCommands[args[0]] || c.user == "" {
+		return args
+	}
+	return append([]string{"asuser", c.user}, args...)
+}
+
+// scriptUser is the user of the running ASUSER entry, the commands called by
+// its scripts are checked against the user.
+var scriptUser string
+
+// cmdASUSER runs a command that runs scripts as the user. The entry is only
+// made by the connections, see userEntry.
+// Syntax: ASUSER username command [arg ...]
+func cmdASUSER(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	cmd, ok := commands[strings.ToLower(args[2])]
+	if !ok || !asUserCommands[cmd.name] {
+		return nil, uhaha.ErrUnknownCommand
+	}
+	scriptUser = args[1]
+	defer func() { scriptUser = "" }()
+	return cmd.fn(m, args[2:])
+}
+
+// scriptACL checks the commands called by a script against the user that runs
+// it. A user limited to some keys may only call commands on the keys the
+// script declares, which were checked when the script was sent.
+type scriptACL struct {
+	user *aclUser
+	keys map[string]bool
+}
+
+// newScriptACL returns the checks of a script that declares keys, run by the
+// command of m, a read command when read is set. The user of a read command
+// is the one of its connection, the user of a write comes from its ASUSER
+// entry. It returns nil when there is no user to check, for the scripts that
+// do not come from a connection.
+func newScriptACL(m uhaha.Machine, keys []string, read bool) *scriptACL {
+	name := scriptUser
+	if read {
+		name = ""
+		if c, ok := m.Context().(*respConn); ok {
+			name = c.user
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	a := &scriptACL{user: acl.user(name), keys: make(map[string]bool)}
+	for _, key := range keys {
+		a.keys[key] = true
+	}
+	return a
+}
+
+// check returns the error of args, a command with a lowercase name called by
+// the script.
+func (a *scriptACL) check(args []string) error {
+	if a.user == nil {
+		// the user was deleted before the script ran
+		return uhaha.ErrUnauthorized
+	}
+	if err := a.user.check(args); err != nil {
+		return err
+	}
+	if containsString(a.user.keys, "*") {
+		return nil
+	}
+	for _, key := range commandKeys(args) {
+		if !a.keys[key] {
+			return errNoPermScriptKey
+		}
+	}
+	return nil
+}
+
+// hashPasswordRules returns the args of ACL SETUSER with the clear text
+// passwords of the rules hashed, so that they never reach the log.
+func hashPasswordRules(args []string) []string {
+	hashed := append([]string(nil), args...)
+	for i := 3; i < len(hashed); i++ {
+		if rule := hashed[i]; rule != "" && (rule[0] == '>' || rule[0] == '<') {
+			sign := "#"
+			if rule[0] == '<' {
+				sign = "!"
+			}
+			hashed[i] = sign + hashPassword(rule[1:])
+		}
+	}
+	return hashed
+}
+
+// connACL runs the ACL subcommands that read the table on the node, and sends
+// the ones that change it, with the clear text passwords hashed.
+// Syntax: ACL SETUSER username [rule ...] | DELUSER username [username ...] |
+// LIST | USERS | GETUSER username | WHOAMI | CAT [category] |
+// DRYRUN username command [arg ...] | GENPASS [bits]
+func connACL(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	switch strings.ToLower(args[1]) {
+	case "setuser":
+		return c.sendRecv(s, hashPasswordRules(args)...)
+	case "deluser":
+		return c.sendRecv(s, args...)
+	case "whoami":
+		if len(args) != 2 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		return c.user, nil
+	case "genpass":
+		bits := 256
+		if len(args) > 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n <= 0 || n > 4096 {
+				return nil, errors.New("ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+			}
+			bits = n
+		}
+		b := make([]byte, (bits+7)/8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(b)[:(bits+3)/4], nil
+	}
+	return aclRead(args)
+}
+
+// cmdACL changes the users. It runs the subcommands that only read them too,
+// for transactions.
+// Syntax: ACL SETUSER username [rule ...] | DELUSER username [username ...]
+func cmdACL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	switch strings.ToLower(args[1]) {
+	case "setuser":
+		if len(args) < 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		if err := acl.setUser(args[2], args[3:]); err != nil {
+			return nil, err
+		}
+		return redcon.SimpleString("OK"), nil
+	case "deluser":
+		if len(args) < 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		n, err := acl.deleteUsers(args[2:])
+		if err != nil {
+			return nil, err
+		}
+		return redcon.SimpleInt(n), nil
+	}
+	return aclRead(args)
+}
+
+// aclRead runs the ACL subcommands that read the table.
+func aclRead(args []string) (interface{}, error) {
+	switch strings.ToLower(args[1]) {
+	case "list":
+		if len(args) != 2 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		var list []interface{}
+		for _, u := range acl.sorted() {
+			list = append(list, "user "+u.name+" "+strings.Join(u.describe(), " "))
+		}
+		return list, nil
+	case "users":
+		if len(args) != 2 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		var names []interface{}
+		for _, u := range acl.sorted() {
+			names = append(names, u.name)
+		}
+		return names, nil
+	case "getuser":
+		if len(args) != 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		u := acl.user(args[2])
+		if u == nil {
+			return nil, nil
+		}
+		flags := []interface{}{"off"}
+		if u.enabled {
+			flags[0] = "on"
+		}
+		if u.nopass {
+			flags = append(flags, "nopass")
+		}
+		passwords := []interface{}{}
+		for _, h := range u.passwords {
+			passwords = append(passwords, h)
+		}
+		var keys, channels []string
+		for _, pattern := range u.keys {
+			keys = append(keys, "~"+pattern)
+		}
+		for _, pattern := range u.channels {
+			channels = append(channels, "&"+pattern)
+		}
+		return []interface{}{
+			"flags", flags,
+			"passwords", passwords,
+			"commands", strings.Join(u.commandRules(), " "),
+			"keys", strings.Join(keys, " "),
+			"channels", strings.Join(channels, " "),
+		}, nil
+	case "cat":
+		switch len(args) {
+		case 2:
+			var cats []string
+			for cat := range aclCategories {
+				cats = append(cats, cat)
+			}
+			sort.Strings(cats)
+			return cats, nil
+		case 3:
+			names, ok := aclCategories[strings.ToLower(args[2])]
+			if !ok {
+				return nil, fmt.Errorf("ERR Unknown category '%s'", args[2])
+			}
+			return names, nil
+		}
+		return nil, uhaha.ErrWrongNumArgs
+	case "dryrun":
+		if len(args) < 4 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		u := acl.user(args[2])
+		if u == nil {
+			return nil, fmt.Errorf("ERR User '%s' not found", args[2])
+		}
+		cmd := append([]string{strings.ToLower(args[3])}, args[4:]...)
+		if !aclKnownCommand(cmd[0]) {
+			return nil, fmt.Errorf("ERR Command '%s' not found", args[3])
+		}
+		if err := u.check(cmd); err != nil {
+			return strings.TrimPrefix(err.Error(), "NOPERM "), nil
+		}
+		return redcon.SimpleString("OK"), nil
+	}
+	return nil, fmt.Errorf(errACLSubcommand, args[1])
+}
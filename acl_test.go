@@ -0,0 +1,377 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// userConn returns a client authenticated as user, closed at the end of the
+// test.
+func userConn(t *testing.T, user, pass string) *redis.Client {
+	getTestConn()
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:11001", Username: user, Password: pass})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func expectNoPerm(t *testing.T, err error) {
+	t.Helper()
+	if err == nil || !strings.HasPrefix(err.Error(), "NOPERM") {
+		t.Fatalf("expected NOPERM, got %v", err)
+	}
+}
+
+func TestACLCommandCategories(t *testing.T) {
+	for name := range commandTable {
+		if aclCommandCategories[name] == nil {
+			t.Errorf("command %s has no ACL category", name)
+		}
+	}
+}
+
+func TestACLUsers(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer c.Do(ctx, "acl", "deluser", "acl_alice")
+
+	if err := c.Do(ctx, "acl", "setuser", "acl_alice", "on", ">pass1", "~app:*", "&news",
+		"+@string", "-set", "+lpush").Err(); err != nil {
+		t.Fatal(err)
+	}
+	// the clear text password is not kept
+	list, err := c.Do(ctx, "acl", "list").StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []string{
+		"user acl_alice on #" + hashPassword("pass1") + " ~app:* &news -@all +@string -set +lpush",
+		"user default on nopass ~* &* +@all",
+	}) {
+		t.Fatal(list)
+	}
+	if v, err := c.Do(ctx, "acl", "users").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []string{"acl_alice", "default"}) {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "acl", "getuser", "acl_alice").Slice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 10 || v[5] != "-@all +@string -set +lpush" || v[7] != "~app:*" || v[9] != "&news" {
+		t.Fatal(v)
+	}
+	if err := c.Do(ctx, "acl", "getuser", "acl_none").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+
+	// the rules of SETUSER add to the user, and a later rule of a command
+	// replaces the previous ones
+	if err := c.Do(ctx, "acl", "setuser", "acl_alice", "+set", "resetkeys", "~other").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do(ctx, "acl", "getuser", "acl_alice").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[5] != "-@all +@string +lpush +set" || v[7] != "~other" {
+		t.Fatal(v)
+	}
+
+	// an invalid rule changes nothing
+	for _, rule := range []string{"+nosuchcommand", "+@nosuchcategory", "#abc", "%R~x", "bad", "+get|x"} {
+		if err := c.Do(ctx, "acl", "setuser", "acl_alice", "off", rule).Err(); err == nil {
+			t.Fatal(rule)
+		}
+	}
+	if v, err := c.Do(ctx, "acl", "getuser", "acl_alice").Slice(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v[1], []interface{}{"on"}) {
+		t.Fatal(v)
+	}
+	if err := c.Do(ctx, "acl", "setuser", "acl bob").Err(); err == nil {
+		t.Fatal("made a user with a space")
+	}
+
+	if v, err := c.Do(ctx, "acl", "whoami").Text(); err != nil || v != "default" {
+		t.Fatal(v, err)
+	}
+	if v, err := c.Do(ctx, "acl", "cat", "hyperloglog").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []string{"pfadd", "pfcount", "pfmerge"}) {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "acl", "genpass", 32).Text(); err != nil || len(v) != 8 {
+		t.Fatal(v, err)
+	}
+
+	if err := c.Do(ctx, "acl", "deluser", "default").Err(); err == nil {
+		t.Fatal("deleted the default user")
+	}
+	if n, err := c.Do(ctx, "acl", "deluser", "acl_alice", "acl_none").Int(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestACLPermissions(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer c.Do(ctx, "acl", "deluser", "acl_app")
+	if err := c.Do(ctx, "acl", "setuser", "acl_app", "on", ">apppass", "~app:*", "&app:*",
+		"+@string", "+@transaction", "+@pubsub", "-mset", "+config|get").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := userConn(t, "acl_app", "wrong").Ping(ctx).Err(); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Fatal(err)
+	}
+	app := userConn(t, "acl_app", "apppass")
+	if err := app.Set(ctx, "app:key", "v", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := app.Get(ctx, "app:key").Result(); err != nil || v != "v" {
+		t.Fatal(v, err)
+	}
+	if v, err := app.MGet(ctx, "app:key", "app:none").Result(); err != nil || len(v) != 2 {
+		t.Fatal(v, err)
+	}
+	expectNoPerm(t, app.Get(ctx, "other:key").Err())
+	expectNoPerm(t, app.MGet(ctx, "app:key", "other:key").Err())
+	expectNoPerm(t, app.MSet(ctx, "app:a", "1").Err())
+	expectNoPerm(t, app.LPush(ctx, "app:list", "a").Err())
+	expectNoPerm(t, app.FlushAll(ctx).Err())
+	expectNoPerm(t, app.Do(ctx, "acl", "setuser", "acl_app", "+@all").Err())
+	expectNoPerm(t, app.ConfigSet(ctx, "notify-keyspace-events", "").Err())
+	if err := app.ConfigGet(ctx, "notify-keyspace-events").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// channels
+	if err := app.Publish(ctx, "app:news", "m").Err(); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPerm(t, app.Publish(ctx, "other", "m").Err())
+	sub := app.Subscribe(ctx, "other")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err == nil {
+		t.Fatal("subscribed to a denied channel")
+	}
+	psub := app.PSubscribe(ctx, "app:*")
+	defer psub.Close()
+	if _, err := psub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a denied command aborts the transaction
+	_, err := app.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, "app:key", "tx", 0)
+		p.Set(ctx, "other:key", "tx", 0)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "EXECABORT") {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "app:key").Result(); err != nil || v != "v" {
+		t.Fatal(v, err)
+	}
+
+	// the changes apply to the authenticated connections
+	if err := c.Do(ctx, "acl", "setuser", "acl_app", "-get").Err(); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPerm(t, app.Get(ctx, "app:key").Err())
+	if err := c.Do(ctx, "acl", "setuser", "acl_app", "off").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := userConn(t, "acl_app", "apppass").Ping(ctx).Err(); err == nil {
+		t.Fatal("authenticated as a disabled user")
+	}
+	if err := c.Do(ctx, "acl", "deluser", "acl_app").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Set(ctx, "app:key", "v", 0).Err(); err == nil {
+		t.Fatal("ran a command as a deleted user")
+	}
+	c.Del(ctx, "app:key")
+}
+
+func TestACLDefaultUser(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	if err := c.Do(ctx, "acl", "setuser", "acl_admin", "on", ">admin", "~*", "&*", "+@all").Err(); err != nil {
+		t.Fatal(err)
+	}
+	admin := userConn(t, "acl_admin", "admin")
+	defer admin.Do(ctx, "acl", "deluser", "acl_admin")
+
+	// the servers authenticate as the default user with --auth
+	for _, rule := range []string{">defpass", "<x", "#" + hashPassword("x"), "resetpass", "nopass", "off", "reset"} {
+		if err := admin.Do(ctx, "acl", "setuser", "default", rule).Err(); err == nil || err.Error() != errDefaultUserAuth.Error() {
+			t.Fatal(rule, err)
+		}
+	}
+	cmds, _ := admin.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Do(ctx, "acl", "setuser", "default", "resetpass", ">defpass")
+		return nil
+	})
+	if len(cmds) != 1 || cmds[0].Err() == nil || cmds[0].Err().Error() != errDefaultUserAuth.Error() {
+		t.Fatal(cmds)
+	}
+	if err := admin.Do(ctx, "acl", "setuser", "default", "on", "~*", "+@all").Err(); err != nil {
+		t.Fatal(err)
+	}
+	anon := redis.NewClient(&redis.Options{Addr: "127.0.0.1:11001"})
+	defer anon.Close()
+	if err := anon.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACLSetUserInMulti(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer c.Do(ctx, "acl", "deluser", "acl_tx")
+
+	// the passwords are hashed before they are queued, the EXEC entry only
+	// carries their digests
+	want := []string{"acl", "setuser", "acl_tx", "#" + hashPassword("p1"), "!" + hashPassword("p2"), "on"}
+	if v := hashPasswordRules([]string{"acl", "setuser", "acl_tx", ">p1", "<p2", "on"}); !reflect.DeepEqual(v, want) {
+		t.Fatal(v)
+	}
+	if _, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Do(ctx, "acl", "setuser", "acl_tx", "on", ">p1", "+ping")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := userConn(t, "acl_tx", "p1").Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACLDryRun(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer c.Do(ctx, "acl", "deluser", "acl_dry")
+	if err := c.Do(ctx, "acl", "setuser", "acl_dry", "~dry:*", "+@read", "+eval").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []interface{}
+		want string
+	}{
+		{[]interface{}{"get", "dry:a"}, "OK"},
+		{[]interface{}{"zunionstore", "dry:a", 2, "dry:b", "dry:c"}, "User acl_dry has no permissions to run the 'zunionstore' command"},
+		{[]interface{}{"set", "dry:a", "v"}, "User acl_dry has no permissions to run the 'set' command"},
+		{[]interface{}{"sunion", "dry:a", "x"}, "No permissions to access a key"},
+		{[]interface{}{"eval", "return 1", 1, "dry:a"}, "OK"},
+		{[]interface{}{"eval", "return 1", 1, "x"}, "No permissions to access a key"},
+		{[]interface{}{"xread", "streams", "dry:a", "x", "0", "0"}, "No permissions to access a key"},
+	} {
+		args := append([]interface{}{"acl", "dryrun", "acl_dry"}, tc.args...)
+		if v, err := c.Do(ctx, args...).Text(); err != nil || v != tc.want {
+			t.Fatal(tc.args, v, err)
+		}
+	}
+	if err := c.Do(ctx, "acl", "dryrun", "acl_dry", "nosuch").Err(); err == nil {
+		t.Fatal("dry run of an unknown command")
+	}
+}
+
+func TestACLScripts(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer c.Do(ctx, "acl", "deluser", "acl_lua")
+	defer c.FunctionDelete(ctx, "acl_lib")
+	if err := c.Do(ctx, "acl", "setuser", "acl_lua", "on", ">p", "~lua:*", "&lua:*",
+		"+@scripting", "+@transaction", "+get", "+set", "+publish").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FunctionLoad(ctx, "#!lua name=acl_lib\n"+
+		"redis.register_function('acl_incr', function(keys) return redis.call('incr', keys[1]) end)").Err(); err != nil {
+		t.Fatal(err)
+	}
+	c.Set(ctx, "lua:other", "v", 0)
+	u := userConn(t, "acl_lua", "p")
+
+	if v, err := u.Eval(ctx, "redis.call('set', KEYS[1], 'v') return redis.call('get', KEYS[1])", []string{"lua:a"}).Text(); err != nil || v != "v" {
+		t.Fatal(v, err)
+	}
+	// the commands, keys and channels of the calls are checked, and the keys
+	// must be declared
+	for _, script := range []string{
+		"return redis.call('incr', KEYS[1])",
+		"return redis.call('get', 'lua:other')",
+		"return redis.call('get', 'secret')",
+		"return redis.call('publish', 'chan', 'm')",
+	} {
+		expectNoPerm(t, u.Eval(ctx, script, []string{"lua:a"}).Err())
+	}
+	expectNoPerm(t, u.EvalRO(ctx, "return redis.call('get', 'lua:other')", []string{"lua:a"}).Err())
+	if v, err := u.Eval(ctx, "return redis.pcall('get', 'lua:other').err", []string{"lua:a"}).Text(); err != nil ||
+		v != errNoPermScriptKey.Error() {
+		t.Fatal(v, err)
+	}
+	if err := u.Eval(ctx, "return redis.call('publish', 'lua:chan', 'm')", nil).Err(); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPerm(t, u.FCall(ctx, "acl_incr", []string{"lua:n"}).Err())
+	if _, err := u.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Eval(ctx, "return redis.call('incr', KEYS[1])", []string{"lua:n"})
+		return nil
+	}); err == nil || !strings.HasPrefix(err.Error(), "NOPERM") {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, "lua:n").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+
+	// the user allowed to, the same calls run
+	if err := c.Do(ctx, "acl", "setuser", "acl_lua", "+incr").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := u.FCall(ctx, "acl_incr", []string{"lua:n"}).Int(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+
+	// the default user keeps the scripts of Redis, on any key
+	if v, err := c.Eval(ctx, "return redis.call('get', 'lua:other')", nil).Text(); err != nil || v != "v" {
+		t.Fatal(v, err)
+	}
+	// ASUSER entries are only made by the connections
+	if err := c.Do(ctx, "asuser", "acl_lua", "eval", "return 1", 0).Err(); err == nil {
+		t.Fatal("sent an ASUSER entry")
+	}
+	if err := c.Eval(ctx, "return redis.call('asuser', 'default', 'eval', 'return 1', 0)", nil).Err(); err == nil {
+		t.Fatal("called ASUSER from a script")
+	}
+}
+
+func TestACLSnapshot(t *testing.T) {
+	getTestConn()
+	var table aclTable
+	table.reset()
+	if err := table.setUser("acl_snap", []string{"on", ">p", "~a b", "&c", "+@hash", "-hdel", "+acl|whoami"}); err != nil {
+		t.Fatal(err)
+	}
+	var loaded aclTable
+	if err := loaded.load(table.save()); err != nil {
+		t.Fatal(err)
+	}
+	want, got := table.users["acl_snap"], loaded.users["acl_snap"]
+	if !reflect.DeepEqual(got.describe(), want.describe()) || !reflect.DeepEqual(got.commands, want.commands) {
+		t.Fatal(got, want)
+	}
+	if !got.authenticate("p") || got.check([]string{"hget", "a b", "f"}) != nil || got.check([]string{"hdel", "a b", "f"}) == nil {
+		t.Fatal(got)
+	}
+	if err := loaded.load([]byte{1, 4, 'x'}); err == nil {
+		t.Fatal("loaded a corrupt table")
+	}
+	if loaded.users["default"] == nil {
+		t.Fatal("the default user was lost")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddWriteCommand("BITFIELD", cmdBITFIELD)
+	conf.AddReadCommand("BITFIELD_RO", cmdBITFIELDRO)
+}
+
+var (
+	errBitfieldType   = errors.New("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	errBitOffset      = errors.New("ERR bit offset is not an integer or out of range")
+	errOverflowType   = errors.New("ERR Invalid OVERFLOW type specified")
+	errBitfieldROOnly = errors.New("ERR BITFIELD_RO only supports the GET subcommand")
+)
+
+// bitfield overflow behaviors
+const (
+	bfWrap = iota
+	bfSat
+	bfFail
+)
+
+// bitfieldOp is a GET, SET or INCRBY subcommand of BITFIELD.
+type bitfieldOp struct {
+	op       string
+	signed   bool
+	bits     uint
+	offset   uint64
+	value    int64
+	overflow int
+}
+
+// parseBitfieldOps parses the subcommands of BITFIELD, only GET is allowed
+// when readOnly is true.
+func parseBitfieldOps(args []string, readOnly bool) ([]bitfieldOp, error) {
+	var ops []bitfieldOp
+	overflow := bfWrap
+	for i := 0; i < len(args); i++ {
+		op := strings.ToUpper(args[i])
+		var nargs int
+		switch op {
+		case "GET":
+			nargs = 2
+		case "SET", "INCRBY":
+			nargs = 3
+		case "OVERFLOW":
+			nargs = 1
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+		if i+nargs >= len(args) {
+			return nil, uhaha.ErrSyntax
+		}
+		if op == "OVERFLOW" {
+			switch strings.ToUpper(args[i+1]) {
+			case "WRAP":
+				overflow = bfWrap
+			case "SAT":
+				overflow = bfSat
+			case "FAIL":
+				overflow = bfFail
+			default:
+				return nil, errOverflowType
+			}
+			i++
+			continue
+		}
+		if readOnly && op != "GET" {
+			return nil, errBitfieldROOnly
+		}
+		bop := bitfieldOp{op: op, overflow: overflow}
+		var err error
+		if bop.signed, bop.bits, err = parseBitfieldType(args[i+1]); err != nil {
+			return nil, err
+		}
+		if bop.offset, err = parseBitfieldOffset(args[i+2], bop.bits); err != nil {
+			return nil, err
+		}
+		if op != "GET" {
+			if bop.value, err = strconv.ParseInt(args[i+3], 10, 64); err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+		}
+		ops = append(ops, bop)
+		i += nargs
+	}
+	return ops, nil
+}
+
+// parseBitfieldType parses an i1 to i64 or u1 to u63 encoding.
+func parseBitfieldType(arg string) (signed bool, bits uint, err error) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u' && arg[0] != 'I' && arg[0] != 'U') {
+		return false, 0, errBitfieldType
+	}
+	signed = arg[0] == 'i' || arg[0] == 'I'
+	n, err := strconv.ParseUint(arg[1:], 10, 8)
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, errBitfieldType
+	}
+	return signed, uint(n), nil
+}
+
+// parseBitfieldOffset parses a bit offset, or a #N offset in multiples of
+// bits. The field must fit in the largest ledis value.
+func parseBitfieldOffset(arg string, bits uint) (uint64, error) {
+	mul := uint64(1)
+	if strings.HasPrefix(arg, "#") {
+		mul = uint64(bits)
+		arg = arg[1:]
+	}
+	n, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || n > math.MaxUint64/mul {
+		return 0, errBitOffset
+	}
+	n *= mul
+	if n+uint64(bits) > uint64(ledis.MaxValueSize)*8 {
+		return 0, errBitOffset
+	}
+	return n, nil
+}
+
+// getBits returns the bits of p from offset as an unsigned integer, most
+// significant bit first. The bits past the end of p are zeros.
+func getBits(p []byte, offset uint64, bits uint) uint64 {
+	var v uint64
+	for j := uint(0); j < bits; j++ {
+		var b uint64
+		if i := offset >> 3; i < uint64(len(p)) {
+			b = uint64(p[i]>>(7-offset&7)) & 1
+		}
+		v = v<<1 | b
+		offset++
+	}
+	return v
+}
+
+// getSignedBits is getBits with the value read as two's complement.
+func getSignedBits(p []byte, offset uint64, bits uint) int64 {
+	v := getBits(p, offset, bits)
+	if bits < 64 && v&(1<<(bits-1)) != 0 {
+		v |= math.MaxUint64 << bits
+	}
+	return int64(v)
+}
+
+// setBits sets the bits of p from offset to the low bits of v, p must be
+// large enough.
+func setBits(p []byte, offset uint64, bits uint, v uint64) {
+	for j := uint(0); j < bits; j++ {
+		bit := byte(v>>(bits-1-j)) & 1
+		shift := 7 - offset&7
+		p[offset>>3] = p[offset>>3]&^(1<<shift) | bit<<shift
+		offset++
+	}
+}
+
+// unsignedOverflow adds incr to the unsigned value of a bits wide field. It
+// returns the result, wrapped or saturated, and whether it overflowed.
+func unsignedOverflow(value uint64, incr int64, bits uint, overflow int) (uint64, bool) {
+	max := uint64(1)<<bits - 1
+	switch {
+	case value > max || (incr > 0 && uint64(incr) > max-value):
+		if overflow == bfSat {
+			return max, true
+		}
+	case incr < 0 && uint64(-incr) > value:
+		if overflow == bfSat {
+			return 0, true
+		}
+	default:
+		return value + uint64(incr), false
+	}
+	return (value + uint64(incr)) & max, true
+}
+
+// signedOverflow is unsignedOverflow for a signed field.
+func signedOverflow(value, incr int64, bits uint, overflow int) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if bits < 64 {
+		max = 1<<(bits-1) - 1
+	}
+	min := -max - 1
+	sum := int64(uint64(value) + uint64(incr))
+	switch {
+	case value > max || (incr > 0 && value > max-incr):
+		if overflow == bfSat {
+			return max, true
+		}
+	case value < min || (incr < 0 && value < min-incr):
+		if overflow == bfSat {
+			return min, true
+		}
+	default:
+		return sum, false
+	}
+	if bits < 64 {
+		// sign extend the low bits
+		sum = sum << (64 - bits) >> (64 - bits)
+	}
+	return sum, true
+}
+
+// cmdBITFIELD reads and writes integer fields of arbitrary width in the
+// string stored at key. The string is written back once, when a SET or
+// INCRBY changed it.
+// Syntax: BITFIELD key [GET encoding offset | [OVERFLOW <WRAP | SAT | FAIL>]
+// <SET encoding offset value | INCRBY encoding offset increment> ...]
+func cmdBITFIELD(m uhaha.Machine, args []string) (interface{}, error) {
+	return bitfield(args, false)
+}
+
+// cmdBITFIELDRO is the read only variant of BITFIELD.
+// Syntax: BITFIELD_RO key [GET encoding offset ...]
+func cmdBITFIELDRO(m uhaha.Machine, args []string) (interface{}, error) {
+	return bitfield(args, true)
+}
+
+func bitfield(args []string, readOnly bool) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	ops, err := parseBitfieldOps(args[2:], readOnly)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(args[1])
+	p, err := ldb.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// like Redis the string grows to the largest written field, even when
+	// every write fails
+	var size uint64
+	for _, op := range ops {
+		if end := (op.offset + uint64(op.bits) + 7) >> 3; op.op != "GET" && end > size {
+			size = end
+		}
+	}
+	if size > uint64(len(p)) {
+		p = append(p, make([]byte, size-uint64(len(p)))...)
+	}
+
+	results := make([]interface{}, 0, len(ops))
+	for _, op := range ops {
+		if op.op == "GET" {
+			if op.signed {
+				results = append(results, redcon.SimpleInt(getSignedBits(p, op.offset, op.bits)))
+			} else {
+				results = append(results, redcon.SimpleInt(getBits(p, op.offset, op.bits)))
+			}
+			continue
+		}
+		var reply int64
+		var newValue uint64
+		var overflowed bool
+		if op.signed {
+			old := getSignedBits(p, op.offset, op.bits)
+			var v int64
+			if op.op == "INCRBY" {
+				v, overflowed = signedOverflow(old, op.value, op.bits, op.overflow)
+				reply = v
+			} else {
+				v, overflowed = signedOverflow(op.value, 0, op.bits, op.overflow)
+				reply = old
+			}
+			newValue = uint64(v)
+		} else {
+			old := getBits(p, op.offset, op.bits)
+			if op.op == "INCRBY" {
+				newValue, overflowed = unsignedOverflow(old, op.value, op.bits, op.overflow)
+				reply = int64(newValue)
+			} else {
+				newValue, overflowed = unsignedOverflow(uint64(op.value), 0, op.bits, op.overflow)
+				reply = int64(old)
+			}
+		}
+		if overflowed && op.overflow == bfFail {
+			results = append(results, nil)
+			continue
+		}
+		setBits(p, op.offset, op.bits, newValue)
+		results = append(results, redcon.SimpleInt(reply))
+	}
+
+	if size > 0 {
+		// GetSet overwrites the value without touching the TTL.
+		if _, err := ldb.GetSet(key, p); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// The connections of the node are kept by ID for the CLIENT command. What
+// CLIENT shows and does is local to the node: CLIENT LIST lists the
+// connections of the node, and CLIENT PAUSE only holds the clients connected
+// to it.
+func init() {
+	addConnCommand("CLIENT", connCLIENT)
+}
+
+var (
+	errNoSuchClient   = errors.New("ERR No such client")
+	errClientName     = errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+	errClientTimeout  = errors.New("ERR timeout is not an integer or out of range")
+	errClientType     = "ERR Unknown client type '%s'"
+	errClientSubcmd   = "ERR unknown subcommand '%s'. Try CLIENT HELP."
+	errClientSetInfo  = "ERR Unrecognized option '%s'"
+	errClientKillSkip = errors.New("ERR syntax error")
+)
+
+// nextClientID numbers the connections, from 1.
+var nextClientID atomic.Uint64
+
+// blockedClientNum counts the connections blocked by BLPOP and the like.
+var blockedClientNum atomic.Int64
+
+// clientStatus is the state of a connection shown by CLIENT LIST, updated by
+// every command of the connection.
+type clientStatus struct {
+	name    string
+	libName string
+	libVer  string
+	user    string
+	db      int
+	multi   int // the number of queued commands, -1 outside of MULTI
+	cmd     string
+	last    time.Time
+}
+
+// touch records the command args, run by the connection, in its status.
+func (c *respConn) touch(args []string) {
+	cmd := args[0]
+	if aclSubcommands[cmd] && len(args) > 1 {
+		cmd += "|" + strings.ToLower(args[1])
+	}
+	multi := -1
+	if c.tx.multi {
+		multi = len(c.tx.queue)
+	}
+	user := c.user
+	if user == "" {
+		user = defaultUser
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.user = user
+	c.status.db = c.db
+	c.status.multi = multi
+	c.status.cmd = cmd
+	c.status.last = time.Now()
+}
+
+// clientTable holds the open connections of the node by ID.
+type clientTable struct {
+	mu    sync.RWMutex
+	conns map[uint64]*respConn
+}
+
+var clients = &clientTable{conns: make(map[uint64]*respConn)}
+
+// add registers c, served on netConn, which is nil for the local connections
+// of uhaha.
+func (t *clientTable) add(c *respConn, netConn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.netConn = netConn
+	t.conns[c.id] = c
+}
+
+func (t *clientTable) remove(c *respConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c.id)
+}
+
+// sorted returns the connections sorted by ID.
+func (t *clientTable) sorted() []*respConn {
+	t.mu.RLock()
+	conns := make([]*respConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// subscriptions returns the numbers of channels, patterns and shard channels
+// the connection is subscribed to.
+func (c *respConn) subscriptions() (n [subKinds]int) {
+	c.mu.Lock()
+	sub := c.sub
+	c.mu.Unlock()
+	if sub == nil {
+		return n
+	}
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+	for kind := range n {
+		n[kind] = len(sub.names[kind])
+	}
+	return n
+}
+
+func (c *respConn) pubsub() bool {
+	n := c.subscriptions()
+	return n[subChannel]+n[subPattern]+n[subShard] > 0
+}
+
+func (c *respConn) laddr() string {
+	if c.netConn == nil {
+		return ""
+	}
+	return c.netConn.LocalAddr().String()
+}
+
+// describe returns the line of the connection in CLIENT LIST.
+func (c *respConn) describe() string {
+	c.mu.Lock()
+	st := c.status
+	c.mu.Unlock()
+	n := c.subscriptions()
+	var flags string
+	if n[subChannel]+n[subPattern]+n[subShard] > 0 {
+		flags += "P"
+	}
+	if st.multi >= 0 {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s "+
+		"db=%d sub=%d psub=%d ssub=%d multi=%d user=%s lib-name=%s lib-ver=%s cmd=%s",
+		c.id, c.addr, c.laddr(), st.name, int(now.Sub(c.created).Seconds()),
+		int(now.Sub(st.last).Seconds()), flags, st.db, n[subChannel], n[subPattern],
+		n[subShard], st.multi, st.user, st.libName, st.libVer, st.cmd)
+}
+
+// kill closes the connection, its goroutine cleans up once the read fails.
+func (c *respConn) kill() {
+	if c.netConn != nil {
+		c.netConn.Close()
+	}
+}
+
+// validClientName tells if name can be set with SETNAME or SETINFO.
+func validClientName(name string) bool {
+	for _, r := range name {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseClientType(s string) (pubsub bool, err error) {
+	switch strings.ToLower(s) {
+	case "normal":
+		return false, nil
+	case "pubsub":
+		return true, nil
+	}
+	return false, fmt.Errorf(errClientType, s)
+}
+
+// connCLIENT shows and changes the connections of the node.
+// Syntax: CLIENT ID | INFO | GETNAME | SETNAME name |
+// SETINFO LIB-NAME name | SETINFO LIB-VER version |
+// LIST [TYPE NORMAL|PUBSUB] [ID id [id ...]] |
+// KILL addr | KILL [ID id] [ADDR addr] [LADDR addr] [USER username]
+// [TYPE NORMAL|PUBSUB] [SKIPME YES|NO] [MAXAGE seconds] |
+// PAUSE timeout [WRITE|ALL] | UNPAUSE
+func connCLIENT(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	switch sub := strings.ToLower(args[1]); sub {
+	case "id", "info", "getname", "unpause":
+		if len(args) != 2 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		switch sub {
+		case "id":
+			return redcon.SimpleInt(c.id), nil
+		case "info":
+			return c.describe() + "\n", nil
+		case "getname":
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.status.name == "" {
+				return nil, nil
+			}
+			return c.status.name, nil
+		}
+		clientPause.unpause()
+		return redcon.SimpleString("OK"), nil
+	case "setname":
+		if len(args) != 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		if !validClientName(args[2]) {
+			return nil, errClientName
+		}
+		c.mu.Lock()
+		c.status.name = args[2]
+		c.mu.Unlock()
+		return redcon.SimpleString("OK"), nil
+	case "setinfo":
+		if len(args) != 4 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		if !validClientName(args[3]) {
+			return nil, fmt.Errorf("ERR %s cannot contain spaces, newlines or special characters.", args[2])
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		switch strings.ToLower(args[2]) {
+		case "lib-name":
+			c.status.libName = args[3]
+		case "lib-ver":
+			c.status.libVer = args[3]
+		default:
+			return nil, fmt.Errorf(errClientSetInfo, args[2])
+		}
+		return redcon.SimpleString("OK"), nil
+	case "list":
+		return clientList(args[2:])
+	case "kill":
+		return clientKill(c, args[2:])
+	case "pause":
+		if len(args) != 3 && len(args) != 4 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || ms < 0 {
+			return nil, errClientTimeout
+		}
+		all := true
+		if len(args) == 4 {
+			switch strings.ToLower(args[3]) {
+			case "write":
+				all = false
+			case "all":
+			default:
+				return nil, uhaha.ErrSyntax
+			}
+		}
+		clientPause.pause(time.Duration(ms)*time.Millisecond, all)
+		return redcon.SimpleString("OK"), nil
+	}
+	return nil, fmt.Errorf(errClientSubcmd, args[1])
+}
+
+// clientList lists the connections of the node.
+// Syntax: CLIENT LIST [TYPE NORMAL|PUBSUB] [ID id [id ...]]
+func clientList(args []string) (interface{}, error) {
+	var typ *bool
+	var ids map[uint64]bool
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "type") && i+1 < len(args):
+			pubsub, err := parseClientType(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			typ = &pubsub
+			i++
+		case strings.EqualFold(args[i], "id") && i+1 < len(args):
+			ids = make(map[uint64]bool)
+			for _, arg := range args[i+1:] {
+				id, err := strconv.ParseUint(arg, 10, 64)
+				if err != nil || id == 0 {
+					return nil, errors.New("ERR Invalid client ID")
+				}
+				ids[id] = true
+			}
+			i = len(args)
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+	var b strings.Builder
+	for _, c := range clients.sorted() {
+		if (typ != nil && c.pubsub() != *typ) || (ids != nil && !ids[c.id]) {
+			continue
+		}
+		b.WriteString(c.describe())
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// clientKill closes the connections of the node that match the filters,
+// except the one of self unless SKIPME is NO.
+// Syntax: CLIENT KILL addr | KILL [ID id] [ADDR addr] [LADDR addr]
+// [USER username] [TYPE NORMAL|PUBSUB] [SKIPME YES|NO] [MAXAGE seconds]
+func clientKill(self *respConn, args []string) (interface{}, error) {
+	if len(args) == 1 {
+		// the old form, that replies OK
+		for _, c := range clients.sorted() {
+			if c.addr == args[0] {
+				c.kill()
+				return redcon.SimpleString("OK"), nil
+			}
+		}
+		return nil, errNoSuchClient
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, uhaha.ErrSyntax
+	}
+	var filters []func(c *respConn) bool
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToLower(args[i]) {
+		case "id":
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || id == 0 {
+				return nil, errors.New("ERR client-id should be greater than 0")
+			}
+			filters = append(filters, func(c *respConn) bool { return c.id == id })
+		case "addr":
+			filters = append(filters, func(c *respConn) bool { return c.addr == value })
+		case "laddr":
+			filters = append(filters, func(c *respConn) bool { return c.laddr() == value })
+		case "user":
+			filters = append(filters, func(c *respConn) bool {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return c.status.user == value
+			})
+		case "type":
+			pubsub, err := parseClientType(value)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, func(c *respConn) bool { return c.pubsub() == pubsub })
+		case "skipme":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return nil, errClientKillSkip
+			}
+		case "maxage":
+			secs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || secs < 0 {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			maxAge := time.Duration(secs) * time.Second
+			filters = append(filters, func(c *respConn) bool { return time.Since(c.created) >= maxAge })
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+	var n int
+next:
+	for _, c := range clients.sorted() {
+		if skipMe && c == self {
+			continue
+		}
+		for _, match := range filters {
+			if !match(c) {
+				continue next
+			}
+		}
+		c.kill()
+		n++
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// pauseState is the CLIENT PAUSE of the node: until the deadline, the
+// commands sent by the clients wait, only the writes unless all is set.
+type pauseState struct {
+	mu       sync.Mutex
+	deadline time.Time
+	all      bool
+	done     chan struct{} // closed by UNPAUSE
+}
+
+var clientPause = &pauseState{done: make(chan struct{})}
+
+// pause pauses the clients for d. A pause in progress is extended, and
+// stays a pause of all the commands if it was one.
+func (p *pauseState) pause(d time.Duration, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deadline := time.Now().Add(d)
+	if time.Now().Before(p.deadline) {
+		all = all || p.all
+		if p.deadline.After(deadline) {
+			deadline = p.deadline
+		}
+	}
+	p.deadline, p.all = deadline, all
+}
+
+func (p *pauseState) unpause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = time.Time{}
+	close(p.done)
+	p.done = make(chan struct{})
+}
+
+// wait blocks the command args of a client while it is paused.
+func (p *pauseState) wait(args []string) {
+	for {
+		p.mu.Lock()
+		d := time.Until(p.deadline)
+		done := p.done
+		all := p.all
+		p.mu.Unlock()
+		if d <= 0 {
+			return
+		}
+		if !all {
+			if cmd, ok := commands[args[0]]; !ok || !cmd.write {
+				return
+			}
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-done:
+		}
+		t.Stop()
+	}
+}
@@ -0,0 +1,236 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// clientFields parses a line of CLIENT LIST.
+func clientFields(line string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+	return fields
+}
+
+func TestClientState(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	conn := c.Conn()
+	defer conn.Close()
+
+	id, err := conn.ClientID(ctx).Result()
+	if err != nil || id <= 0 {
+		t.Fatal(id, err)
+	}
+	if err := conn.ClientGetName(ctx).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if err := conn.ClientSetName(ctx, "worker-1").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := conn.ClientGetName(ctx).Result(); err != nil || v != "worker-1" {
+		t.Fatal(v, err)
+	}
+	if err := conn.Do(ctx, "client", "setname", "bad name").Err(); err == nil {
+		t.Fatal("set a name with a space")
+	}
+	if err := conn.Select(ctx, 3).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := conn.Do(ctx, "client", "info").Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := clientFields(info)
+	if fields["id"] != fmt.Sprint(id) || fields["name"] != "worker-1" || fields["db"] != "3" ||
+		fields["cmd"] != "select" || fields["flags"] != "N" || fields["user"] != "default" ||
+		fields["lib-name"] == "" || fields["multi"] != "-1" {
+		t.Fatal(info)
+	}
+
+	// CLIENT LIST shows the same connection, by its ID
+	list, err := c.Do(ctx, "client", "list", "id", id).Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(list, "\n"), "\n"); len(lines) != 1 ||
+		clientFields(lines[0])["name"] != "worker-1" {
+		t.Fatal(list)
+	}
+	if err := c.Do(ctx, "client", "list", "type", "master").Err(); err == nil {
+		t.Fatal("listed an unknown client type")
+	}
+	if err := c.Do(ctx, "client", "nosuch").Err(); err == nil {
+		t.Fatal("ran an unknown subcommand")
+	}
+}
+
+func TestClientListPubSub(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	sub := c.PSubscribe(ctx, "client_list_*")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := c.Do(ctx, "client", "list", "type", "pubsub").Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, line := range strings.Split(strings.TrimSuffix(list, "\n"), "\n") {
+		fields := clientFields(line)
+		if fields["flags"] != "P" {
+			t.Fatal(line)
+		}
+		if fields["psub"] == "1" && fields["cmd"] == "psubscribe" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal(list)
+	}
+
+	info := c.Info(ctx, "clients").Val()
+	if !strings.HasPrefix(info, "# Clients\r\n") || !strings.Contains(info, "connected_clients:") {
+		t.Fatal(info)
+	}
+	if strings.Contains(info, "pubsub_clients:0\r\n") {
+		t.Fatal(info)
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	victim := c.Conn()
+	defer victim.Close()
+	id, err := victim.ClientID(ctx).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := clientFields(victim.Do(ctx, "client", "info").Val().(string))["addr"]
+
+	if n, err := c.Do(ctx, "client", "kill", "id", id, "maxage", 3600).Int(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if n, err := c.Do(ctx, "client", "kill", "id", id).Int(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	for i := 0; ; i++ {
+		if v := c.Do(ctx, "client", "list", "id", id).Val(); v == "" {
+			break
+		} else if i == 100 {
+			t.Fatal(v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Do(ctx, "client", "kill", addr).Err(); err == nil || err.Error() != "ERR No such client" {
+		t.Fatal(err)
+	}
+
+	// the old form kills by address, and SKIPME keeps the caller
+	other := c.Conn()
+	defer other.Close()
+	addr = clientFields(other.Do(ctx, "client", "info").Val().(string))["addr"]
+	if err := c.Do(ctx, "client", "kill", addr).Err(); err != nil {
+		t.Fatal(err)
+	}
+	self := c.Conn()
+	defer self.Close()
+	addr = clientFields(self.Do(ctx, "client", "info").Val().(string))["addr"]
+	if n, err := self.Do(ctx, "client", "kill", "addr", addr).Int(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer clientPause.unpause()
+
+	if err := c.Do(ctx, "client", "pause", 300, "write").Err(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := c.Get(ctx, "client_pause").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatal("a read waited", d)
+	}
+	if err := c.Set(ctx, "client_pause", "v", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Fatal("a write did not wait", d)
+	}
+
+	// UNPAUSE releases the waiting clients. A pause of all the commands
+	// holds the commands of new connections too, so the pause and unpause
+	// are sent on a connection made before.
+	admin := c.Conn()
+	defer admin.Close()
+	if err := admin.Do(ctx, "client", "pause", 10000).Err(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- c.Del(ctx, "client_pause").Err() }()
+	select {
+	case err := <-done:
+		t.Fatal("a write ran while paused", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := admin.Do(ctx, "client", "unpause").Err(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a write still waits after UNPAUSE")
+	}
+	if err := c.Do(ctx, "client", "pause", "x").Err(); err == nil {
+		t.Fatal("paused with a timeout that is not a number")
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer c.Do(ctx, "acl", "deluser", "client_user")
+	if err := c.Do(ctx, "acl", "setuser", "client_user", "on", ">p", "+@connection").Err(); err != nil {
+		t.Fatal(err)
+	}
+	u := userConn(t, "client_user", "p")
+	if err := u.Do(ctx, "client", "id").Err(); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPerm(t, u.Do(ctx, "client", "list").Err())
+	expectNoPerm(t, u.Do(ctx, "client", "kill", "id", 1).Err())
+	if v, err := c.Do(ctx, "acl", "dryrun", "client_user", "client", "pause", "10").Text(); err != nil ||
+		v != "User client_user has no permissions to run the 'client|pause' command" {
+		t.Fatal(v, err)
+	}
+	if err := c.Do(ctx, "acl", "setuser", "client_user", "+client|list").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Do(ctx, "client", "list").Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import "fmt"
+
+// cmdFlag describes a command in the command table, like the router.OpTable
+// flags of the proxy.
+type cmdFlag uint32
+
+const (
+	// flagWrite commands modify the replicated state. They must be registered
+	// with AddWriteCommand so that they go through the Raft log and reach the
+	// followers.
+	flagWrite cmdFlag = 1 << iota
+)
+
+// commandTable has an entry for every command registered by the init
+// functions, keyed by lowercase command name. Registering a command that is
+// missing from the table, or as a read while it has flagWrite (or the other way
+// around), panics at startup.
+var commandTable = map[string]cmdFlag{
+	"acl":              flagWrite, // SETUSER and DELUSER, see connACL
+	"append":           flagWrite,
+	"asuser":           flagWrite, // only in the entries of the connections
+	"bitcount":         0,
+	"bitfield":         flagWrite,
+	"bitfield_ro":      0,
+	"bitop":            flagWrite,
+	"bitpos":           0,
+	"blmove":           flagWrite, // in transactions, see connBPOP
+	"blpop":            flagWrite,
+	"brpop":            flagWrite,
+	"brpoplpush":       flagWrite,
+	"copy":             flagWrite,
+	"dbsize":           0,
+	"decr":             flagWrite,
+	"decrby":           flagWrite,
+	"del":              flagWrite,
+	"dump":             0,
+	"eval":             flagWrite,
+	"eval_ro":          0,
+	"evalsha":          flagWrite,
+	"evalsha_ro":       0,
+	"exec":             flagWrite,
+	"exists":           0,
+	"expire":           flagWrite,
+	"expireat":         flagWrite,
+	"expired":          flagWrite,
+	"expiretime":       0,
+	"fcall":            flagWrite,
+	"fcall_ro":         0,
+	"flushall":         flagWrite,
+	"flushdb":          flagWrite,
+	"function":         flagWrite,
+	"geoadd":           flagWrite,
+	"geodist":          0,
+	"geohash":          0,
+	"geopos":           0,
+	"geosearch":        0,
+	"geosearchstore":   flagWrite,
+	"get":              0,
+	"getbit":           0,
+	"getdel":           flagWrite,
+	"getex":            flagWrite,
+	"getrange":         0,
+	"getset":           flagWrite,
+	"hclear":           flagWrite,
+	"hdel":             flagWrite,
+	"hexists":          0,
+	"hexpire":          flagWrite,
+	"hexpireat":        flagWrite,
+	"hexpired":         flagWrite,
+	"hexpiretime":      0,
+	"hget":             0,
+	"hgetall":          0,
+	"hgetdel":          flagWrite,
+	"hincrby":          flagWrite,
+	"hincrbyfloat":     flagWrite,
+	"hkeyexists":       0,
+	"hkeys":            0,
+	"hlen":             0,
+	"hmclear":          flagWrite,
+	"hmget":            0,
+	"hmset":            flagWrite,
+	"hpersist":         flagWrite,
+	"hpexpire":         flagWrite,
+	"hpexpireat":       flagWrite,
+	"hpexpiretime":     0,
+	"hpttl":            0,
+	"hrandfield":       0,
+	"hscan":            0,
+	"hset":             flagWrite,
+	"hsetnx":           flagWrite,
+	"hstrlen":          0,
+	"httl":             0,
+	"hvals":            0,
+	"incr":             flagWrite,
+	"incrby":           flagWrite,
+	"incrbyfloat":      flagWrite,
+	"info":             0,
+	"keys":             0,
+	"lclear":           flagWrite,
+	"lcs":              0,
+	"lexpire":          flagWrite,
+	"lexpireat":        flagWrite,
+	"lindex":           0,
+	"linsert":          flagWrite,
+	"lkeyexists":       0,
+	"llen":             0,
+	"lmclear":          flagWrite,
+	"lmove":            flagWrite,
+	"lmpop":            flagWrite,
+	"lpop":             flagWrite,
+	"lpos":             0,
+	"lpush":            flagWrite,
+	"lpushx":           flagWrite,
+	"lrange":           0,
+	"lrem":             flagWrite,
+	"lset":             flagWrite,
+	"ltrim":            flagWrite,
+	"lttl":             0,
+	"mget":             0,
+	"migrate":          0, // the machine only dumps the keys, see connMIGRATE
+	"mset":             flagWrite,
+	"move":             flagWrite,
+	"msetnx":           flagWrite,
+	"pexpire":          flagWrite,
+	"pexpireat":        flagWrite,
+	"pexpiretime":      0,
+	"pfadd":            flagWrite,
+	"pfcount":          0,
+	"pfmerge":          flagWrite,
+	"publish":          flagWrite,
+	"psetex":           flagWrite,
+	"pttl":             0,
+	"randomkey":        0,
+	"rename":           flagWrite,
+	"renamenx":         flagWrite,
+	"restore":          flagWrite,
+	"rpop":             flagWrite,
+	"rpoplpush":        flagWrite,
+	"rpush":            flagWrite,
+	"rpushx":           flagWrite,
+	"sadd":             flagWrite,
+	"scan":             0,
+	"scard":            0,
+	"sclear":           flagWrite,
+	"script":           flagWrite,
+	"sdiff":            0,
+	"sdiffstore":       flagWrite,
+	"select":           flagWrite, // SELECT entries, see connSELECT
+	"set":              flagWrite,
+	"setbit":           flagWrite,
+	"setex":            flagWrite,
+	"setexat":          flagWrite,
+	"setnx":            flagWrite,
+	"setrange":         flagWrite,
+	"sexpire":          flagWrite,
+	"sexpireat":        flagWrite,
+	"sinter":           0,
+	"sintercard":       0,
+	"sinterstore":      flagWrite,
+	"sismember":        0,
+	"skeyexists":       0,
+	"smclear":          flagWrite,
+	"smembers":         0,
+	"smismember":       0,
+	"smove":            flagWrite,
+	"spersist":         flagWrite,
+	"spop":             flagWrite,
+	"spublish":         flagWrite,
+	"srandmember":      0,
+	"srem":             flagWrite,
+	"sscan":            0,
+	"strlen":           0,
+	"sttl":             0,
+	"sunion":           0,
+	"sunionstore":      flagWrite,
+	"swapdb":           flagWrite,
+	"ttl":              0,
+	"type":             0,
+	"watch":            0,
+	"xack":             flagWrite,
+	"xadd":             flagWrite,
+	"xclaim":           flagWrite,
+	"xdel":             flagWrite,
+	"xgroup":           flagWrite,
+	"xhscan":           0,
+	"xlen":             0,
+	"xpending":         0,
+	"xrange":           0,
+	"xread":            0,
+	"xreadgroup":       flagWrite,
+	"xrevrange":        0,
+	"xscan":            0,
+	"xsscan":           0,
+	"xtrim":            flagWrite,
+	"xzscan":           0,
+	"zadd":             flagWrite,
+	"zcard":            0,
+	"zclear":           flagWrite,
+	"zcount":           0,
+	"zincrby":          flagWrite,
+	"zinterstore":      flagWrite,
+	"zlexcount":        0,
+	"zmscore":          0,
+	"zpopmax":          flagWrite,
+	"zpopmin":          flagWrite,
+	"zrandmember":      0,
+	"zrange":           0,
+	"zrangebylex":      0,
+	"zrangebyscore":    0,
+	"zrangestore":      flagWrite,
+	"zrank":            0,
+	"zrem":             flagWrite,
+	"zremrangebylex":   flagWrite,
+	"zremrangebyrank":  flagWrite,
+	"zremrangebyscore": flagWrite,
+	"zrevrange":        0,
+	"zrevrangebylex":   0,
+	"zrevrangebyscore": 0,
+	"zrevrank":         0,
+	"zscan":            0,
+	"zscore":           0,
+	"zunionstore":      flagWrite,
+}
+
+// checkCommand panics if the command is missing from the command table or is
+// registered as a write command while its flags say otherwise.
+func checkCommand(name string, write bool) {
+	flags, ok := commandTable[name]
+	if !ok {
+		panic(fmt.Sprintf("command %q is missing from the command table", name))
+	}
+	if (flags&flagWrite != 0) != write {
+		kind := "read"
+		if write {
+			kind = "write"
+		}
+		panic(fmt.Sprintf("command %q is registered as a %s command against the command table", name, kind))
+	}
+}
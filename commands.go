@@ -0,0 +1,201 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/tidwall/uhaha"
+)
+
+// config wraps the uhaha configuration so that every command registered by
+// the init functions is also recorded in the local command table. The table is
+// used to replay queued commands inside a single Raft entry (EXEC) and to
+// track which keys write commands modify (WATCH).
+type config struct {
+	uhaha.Config
+}
+
+type cmdFunc func(m uhaha.Machine, args []string) (interface{}, error)
+
+type command struct {
+	name  string
+	write bool
+	fn    cmdFunc
+}
+
+// commands is the local command table, keyed by lowercase command name.
+var commands = make(map[string]*command)
+
+// keySpec describes the positions of the keys modified by a write command:
+// args[first], args[first+step], ... up to args[last]. A negative last counts
+// from the end of args. flush marks commands that drop the whole keyspace and
+// keys, when set, extracts the keys of commands with a variable layout.
+type keySpec struct {
+	first, last, step int
+	flush             bool
+	keys              func(args []string) []string
+}
+
+// writeKeySpecs lists the write commands whose modified keys are not simply
+// args[1].
+var writeKeySpecs = map[string]keySpec{
+	"del":         {first: 1, last: -1, step: 1},
+	"expired":     {first: 1, last: -1, step: 1},
+	"mset":        {first: 1, last: -1, step: 2},
+	"msetnx":      {first: 1, last: -1, step: 2},
+	"bitop":       {first: 2, last: 2, step: 1},
+	"blpop":       {}, // the pops they run track their own keys
+	"brpop":       {},
+	"brpoplpush":  {},
+	"blmove":      {},
+	"rpoplpush":   {first: 1, last: 2, step: 1},
+	"lmove":       {first: 1, last: 2, step: 1},
+	"lmclear":     {first: 1, last: -1, step: 1},
+	"lmpop":       {keys: lmpopKeys},
+	"hmclear":     {first: 1, last: -1, step: 1},
+	"hexpired":    {first: 1, last: -1, step: 3},
+	"smclear":     {first: 1, last: -1, step: 1},
+	"smove":       {first: 1, last: 2, step: 1},
+	"flushall":    {flush: true},
+	"flushdb":     {flush: true},
+	"swapdb":      {flush: true},
+	"select":      {}, // so does the command of a SELECT entry
+	"exec":        {}, // the replayed commands track their own keys
+	"eval":        {}, // so do the commands called by the scripts
+	"evalsha":     {},
+	"script":      {},
+	"fcall":       {},
+	"function":    {},
+	"publish":     {},
+	"spublish":    {},
+	"sdiffstore":  {first: 1, last: 1, step: 1},
+	"sinterstore": {first: 1, last: 1, step: 1},
+	"sunionstore": {first: 1, last: 1, step: 1},
+	"rename":      {first: 1, last: 2, step: 1},
+	"renamenx":    {first: 1, last: 2, step: 1},
+	"copy":        {first: 2, last: 2, step: 1},
+	"xgroup":      {first: 2, last: 2, step: 1},
+	"xreadgroup":  {keys: xStreamsKeys},
+}
+
+func getKeySpec(name string) keySpec {
+	if spec, ok := writeKeySpecs[name]; ok {
+		return spec
+	}
+	return keySpec{first: 1, last: 1, step: 1}
+}
+
+// modifiedKeys returns the keys of args that are modified by the command.
+func (spec keySpec) modifiedKeys(args []string) []string {
+	if spec.keys != nil {
+		return spec.keys(args)
+	}
+	if spec.step <= 0 || spec.first >= len(args) {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	var keys []string
+	for i := spec.first; i <= last; i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+func (c *config) AddReadCommand(name string, fn cmdFunc) {
+	lname := strings.ToLower(name)
+	checkCommand(lname, false)
+	commands[lname] = &command{name: lname, fn: fn}
+	c.Config.AddReadCommand(name, connRead(fn))
+}
+
+// AddWriteCommand registers a write command. The expired keys of the command
+// are deleted before it runs. Successful writes bump the versions of the keys
+// they modify so that WATCH can detect them, and notify their keyspace events.
+func (c *config) AddWriteCommand(name string, fn cmdFunc) {
+	lname := strings.ToLower(name)
+	checkCommand(lname, true)
+	spec := getKeySpec(lname)
+	wfn := func(m uhaha.Machine, args []string) (interface{}, error) {
+		if lname != "expired" && lname != "hexpired" {
+			if err := expireIfNeeded(m, commandKeys(args)); err != nil {
+				return nil, err
+			}
+		}
+		var w *writeEvent
+		if !spec.flush && keyEvents[lname] != nil && notifying(notifyAll|notifyNew) {
+			w = &writeEvent{args: args, keys: spec.modifiedKeys(args)}
+			w.existed = keysExist(w.keys)
+		}
+		v, err := fn(m, args)
+		if err == nil {
+			if spec.flush {
+				keyVersions.flush()
+			} else {
+				keys := spec.modifiedKeys(args)
+				keyVersions.touch(keys...)
+				keyWaiters.signal(keys...)
+			}
+			if w != nil {
+				w.reply, w.exists = v, keysExist(w.keys)
+				notifyWrite(lname, w)
+			}
+		}
+		return v, err
+	}
+	commands[lname] = &command{name: lname, write: true, fn: wfn}
+	c.Config.AddWriteCommand(name, logEntry(wfn))
+}
+
+// waiterTable wakes up the clients blocked on keys (BLPOP...) when a write
+// command modifies one of them. It is local to each node and not part of the
+// replicated state.
+type waiterTable struct {
+	mu   sync.Mutex
+	keys map[string]map[chan struct{}]struct{}
+}
+
+var keyWaiters = &waiterTable{keys: make(map[string]map[chan struct{}]struct{})}
+
+// add returns a channel that receives a value once any of keys is modified.
+func (w *waiterTable) add(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		if w.keys[key] == nil {
+			w.keys[key] = make(map[chan struct{}]struct{})
+		}
+		w.keys[key][ch] = struct{}{}
+	}
+	return ch
+}
+
+func (w *waiterTable) remove(keys []string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		delete(w.keys[key], ch)
+		if len(w.keys[key]) == 0 {
+			delete(w.keys, key)
+		}
+	}
+}
+
+func (w *waiterTable) signal(keys ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		for ch := range w.keys[key] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	// Services without a sniff function are matched in registration order,
+	// so this one takes the client connections before the uhaha built-in
+	// redis service does.
+	conf.AddService("redis", nil, respServiceHandler)
+}
+
+// respConn is the state of a RESP client connection. It is created by
+// connOpened and is the uhaha context of every command sent by the
+// connection, read and intermediate commands get it from m.Context().
+type respConn struct {
+	id      uint64
+	addr    string
+	netConn net.Conn // nil until the connection is accepted
+	created time.Time
+	user    string // the ACL user, empty until authenticated
+	opts    uhaha.SendOptions
+	tx      txState
+	db      int // the database selected with SELECT
+
+	mu     sync.Mutex   // guards the fields read by the other connections
+	sub    *subscriber  // set once the connection is detached for pubsub
+	status clientStatus // shown by CLIENT LIST
+}
+
+func newRespConn(addr string) *respConn {
+	c := &respConn{id: nextClientID.Add(1), addr: addr, created: time.Now()}
+	c.status.user = defaultUser
+	c.status.multi = -1
+	c.status.last = c.created
+	c.opts.From = c
+	c.opts.Context = c
+	return c
+}
+
+func connOpened(addr string) (context interface{}, accept bool) {
+	atomic.AddInt64(&respClientNum, 1)
+	return newRespConn(addr), true
+}
+
+func connClosed(context interface{}, addr string) {
+	atomic.AddInt64(&respClientNum, -1)
+	if c, ok := context.(*respConn); ok {
+		clients.remove(c)
+	}
+}
+
+// connCommandFunc is a command handled by the RESP service itself instead of
+// the machine, because it needs the connection, e.g. to block it.
+type connCommandFunc func(s uhaha.Service, c *respConn, args []string) (interface{}, error)
+
+var connCommands = make(map[string]connCommandFunc)
+
+func addConnCommand(name string, fn connCommandFunc) {
+	connCommands[strings.ToLower(name)] = fn
+}
+
+// sendRecv sends a command on behalf of the connection and waits for its
+// response.
+func (c *respConn) sendRecv(s uhaha.Service, args ...string) (interface{}, error) {
+	clientPause.wait(args)
+	v, _, err := s.Send(c.entryArgs(args), &c.opts).Recv()
+	return v, err
+}
+
+// blockPollInterval bounds the time between two attempts of a blocked client,
+// in case a wakeup was missed, e.g. across a leader change.
+const blockPollInterval = time.Second
+
+// block calls try until it returns a non-nil result or an error, retrying
+// whenever a write modifies one of keys. try must only send normal commands,
+// so nothing ever blocks inside the Raft log. It returns nil when the timeout
+// expires, a zero timeout blocks forever.
+func block(keys []string, timeout time.Duration,
+	try func() (interface{}, error),
+) (interface{}, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	blockedClientNum.Add(1)
+	defer blockedClientNum.Add(-1)
+	wait := keyWaiters.add(keys)
+	defer keyWaiters.remove(keys, wait)
+	poll := time.NewTicker(blockPollInterval)
+	defer poll.Stop()
+
+	for {
+		if v, err := try(); err != nil || v != nil {
+			return v, err
+		}
+		select {
+		case <-wait:
+		case <-poll.C:
+		case <-deadline:
+			return nil, nil
+		}
+	}
+}
+
+type respQuitClose struct{}
+
+func respCommandToArgs(cmd redcon.Command) []string {
+	args := make([]string, len(cmd.Args))
+	args[0] = strings.ToLower(string(cmd.Args[0]))
+	for i := 1; i < len(cmd.Args); i++ {
+		args[i] = string(cmd.Args[i])
+	}
+	return args
+}
+
+// respServiceHandler serves the Redis protocol like the uhaha built-in
+// service, with the connection state needed by MULTI/EXEC/WATCH.
+func respServiceHandler(s uhaha.Service, ln net.Listener) {
+	go runExpireReaper(s)
+	accept := func(conn redcon.Conn) bool {
+		context, accept := s.Opened(conn.RemoteAddr())
+		if !accept {
+			return false
+		}
+		c, ok := context.(*respConn)
+		if !ok {
+			c = newRespConn(conn.RemoteAddr())
+		}
+		clients.add(c, conn.NetConn())
+		conn.SetContext(c)
+		return true
+	}
+	closed := func(conn redcon.Conn, err error) {
+		if conn.Context() == nil {
+			return
+		}
+		c := conn.Context().(*respConn)
+		if c.sub != nil {
+			// the subscriber serves the connection until it is closed
+			return
+		}
+		s.Closed(c.opts.Context, conn.RemoteAddr())
+	}
+	handle := func(conn redcon.Conn, cmd redcon.Command) {
+		c := conn.Context().(*respConn)
+		var args [][]string
+		args = append(args, respCommandToArgs(cmd))
+		for _, cmd := range conn.ReadPipeline() {
+			args = append(args, respCommandToArgs(cmd))
+		}
+		for i := range args {
+			if args[i][0] == "quit" {
+				break
+			}
+			if kind, subscribe := pubSubCommandKind(args[i][0]); kind < 0 || !subscribe {
+				continue
+			}
+			c.execArgs(s, conn, args[:i])
+			if c.checkACL(args[i]) != nil {
+				// the commands get the authentication or permission error
+				c.execArgs(s, conn, args[i:])
+				return
+			}
+			sub := newSubscriber(c, conn.Detach())
+			c.mu.Lock()
+			c.sub = sub
+			c.mu.Unlock()
+			go sub.serve(s, args[i:])
+			return
+		}
+		c.execArgs(s, conn, args)
+	}
+	s.Log().Fatal(redcon.Serve(ln, handle, accept, closed))
+}
+
+func (c *respConn) execArgs(s uhaha.Service, conn redcon.Conn, args [][]string) {
+	recvs := make([]uhaha.Receiver, len(args))
+	var close bool
+	for i, args := range args {
+		recvs[i] = c.send(s, args)
+		if args[0] == "quit" {
+			close = true
+			recvs = recvs[:i+1]
+			break
+		}
+	}
+	var filteredArgs [][]string
+	for i, r := range recvs {
+		resp, elapsed, err := r.Recv()
+		if err != nil {
+			if err == uhaha.ErrUnknownCommand {
+				err = fmt.Errorf("%s '%s'", err, args[i][0])
+			}
+			c.writeAny(s, conn, r.Args(), err)
+		} else {
+			switch v := resp.(type) {
+			case uhaha.FilterArgs:
+				filteredArgs = append(filteredArgs, v)
+			case respQuitClose:
+				c.writeAny(s, conn, r.Args(), redcon.SimpleString("OK"))
+				conn.Close()
+			default:
+				c.writeAny(s, conn, r.Args(), v)
+			}
+		}
+		s.Monitor().Send(uhaha.Message{
+			Addr:    conn.RemoteAddr(),
+			Args:    args[i],
+			Resp:    resp,
+			Err:     err,
+			Elapsed: elapsed,
+		})
+	}
+	if len(filteredArgs) > 0 && !close {
+		c.execArgs(s, conn, filteredArgs)
+	}
+}
+
+func (c *respConn) send(s uhaha.Service, args []string) uhaha.Receiver {
+	defer c.touch(args)
+	switch args[0] {
+	case "quit":
+		return uhaha.Response(args, respQuitClose{}, 0, nil)
+	case "auth":
+		v, err := c.auth(args)
+		return uhaha.Response(args, v, 0, err)
+	case "asuser":
+		// only made by userEntry
+		return uhaha.Response(args, nil, 0, uhaha.ErrUnknownCommand)
+	}
+	if err := c.checkACL(args); err != nil {
+		if c.tx.multi {
+			c.tx.dirty = true
+		}
+		return uhaha.Response(args, nil, 0, err)
+	}
+	if r := c.txCommand(s, args); r != nil {
+		return r
+	}
+	switch args[0] {
+	case "ping":
+		switch len(args) {
+		case 1:
+			return uhaha.Response(args, redcon.SimpleString("PONG"), 0, nil)
+		case 2:
+			return uhaha.Response(args, args[1], 0, nil)
+		}
+		return uhaha.Response(args, nil, 0, uhaha.ErrWrongNumArgs)
+	case "echo":
+		if len(args) != 2 {
+			return uhaha.Response(args, nil, 0, uhaha.ErrWrongNumArgs)
+		}
+		return uhaha.Response(args, args[1], 0, nil)
+	case "shutdown":
+		s.Log().Error("Shutting down")
+		os.Exit(0)
+	}
+	if fn, ok := connCommands[args[0]]; ok {
+		start := time.Now()
+		v, err := fn(s, c, args)
+		return uhaha.Response(args, v, time.Since(start), err)
+	}
+	clientPause.wait(args)
+	return s.Send(c.entryArgs(args), &c.opts)
+}
+
+func (c *respConn) writeAny(s uhaha.Service, conn redcon.Conn, args []string,
+	v interface{},
+) {
+	if rfilt := s.ResponseFilter(); rfilt != nil {
+		v = rfilt(s.Name(), c.opts.Context, args, v)
+	}
+	conn.WriteAny(v)
+}
@@ -12,8 +12,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/ledisdb/ledisdb/ledis"
-
 	"github.com/cenkalti/backoff/v4"
 	lediscfg "github.com/ledisdb/ledisdb/config"
 	"github.com/redis/go-redis/v9"
@@ -28,31 +26,7 @@ var (
 func getTestConn() *redis.Client {
 	log.SetOutput(os.Stderr)
 	f := func() {
-		conf.DataDir = "/tmp/icefiredb"
-		os.RemoveAll(conf.DataDir)
-		conf.DataDirReady = func(dir string) {
-			os.RemoveAll(filepath.Join(dir, "main.db"))
-
-			ldsCfg = lediscfg.NewConfigDefault()
-			ldsCfg.DataDir = filepath.Join(dir, "main.db")
-			ldsCfg.Databases = 1
-			ldsCfg.DBName = os.Getenv("DRIVER")
-			var err error
-			le, err = ledis.Open(ldsCfg)
-			if err != nil {
-				panic(err)
-			}
-
-			ldb, err = le.Select(0)
-			if err != nil {
-				panic(err)
-			}
-		}
-
-		conf.Snapshot = snapshot
-		conf.Restore = restore
-		fmt.Printf("start with Storage Engine: %s\n", os.Getenv("DRIVER"))
-		go uhaha.Main(conf)
+		startTestNode("/tmp/icefiredb")
 
 		testRedisClient = redis.NewClient(&redis.Options{
 			Addr: "127.0.0.1:11001",
@@ -71,3 +45,35 @@ func getTestConn() *redis.Client {
 	testConnOnce.Do(f)
 	return testRedisClient
 }
+
+// startTestNode starts a node of the configured cluster with a new data
+// directory.
+func startTestNode(dataDir string) {
+	conf.DataDir = dataDir
+	os.RemoveAll(conf.DataDir)
+	conf.DataDirReady = func(dir string) {
+		os.RemoveAll(filepath.Join(dir, "main.db"))
+
+		ldsCfg = lediscfg.NewConfigDefault()
+		ldsCfg.DataDir = filepath.Join(dir, "main.db")
+		ldsCfg.Databases = numDatabases
+		ldsCfg.TTLCheckInterval = ledisTTLCheckInterval
+		ldsCfg.DBName = os.Getenv("DRIVER")
+		var err error
+		le, err = openLedis(ldsCfg)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := openDatabases(le, numDatabases); err != nil {
+			panic(err)
+		}
+	}
+
+	conf.Snapshot = snapshot
+	conf.Restore = restore
+	conf.ConnOpened = connOpened
+	conf.ConnClosed = connClosed
+	fmt.Printf("start with Storage Engine: %s\n", os.Getenv("DRIVER"))
+	go uhaha.Main(conf.Config)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/ledisdb/ledisdb/store"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// The logical databases of Redis are ledis databases, which share the ledis
+// store and prefix their keys with their index. SELECT is a setting of the
+// connection: the reads run in the database of the connection, found in the
+// uhaha context, and the writes are sent as a SELECT entry that carries the
+// database index in the Raft log:
+//
+//	SELECT index command [arg ...]
+//
+// Connections of database 0 send their writes as they are.
+func init() {
+	addConnCommand("SELECT", connSELECT)
+	conf.AddWriteCommand("SELECT", cmdSELECT)
+	conf.AddWriteCommand("SWAPDB", cmdSWAPDB)
+	conf.AddWriteCommand("MOVE", cmdMOVE)
+	registerSnapshotSection("databases", databases.save, databases.load)
+}
+
+var errNotInteger = errors.New("ERR value is not an integer or out of range")
+
+// numDatabases is the number of logical databases, set with --databases.
+var numDatabases = 16
+
+// ldbs are the ledis databases by ledis index, opened at startup.
+var ldbs []*ledis.DB
+
+// dbTable maps the logical databases to the ledis databases, so that SWAPDB
+// only swaps two entries. It is part of the replicated state.
+type dbTable struct {
+	index []int
+}
+
+var databases dbTable
+
+// curDB is the logical index of ldb, the database of the running command.
+var curDB int
+
+// dbMu guards ldb and curDB. The log entries and the reads of databases other
+// than 0 hold it while ldb is switched, the reads of database 0 share it, so
+// that ldb is always database 0 outside of them.
+var dbMu sync.RWMutex
+
+// openDatabases opens the n ledis databases of l.
+func openDatabases(l *ledis.Ledis, n int) error {
+	ldbs = make([]*ledis.DB, n)
+	for i := range ldbs {
+		db, err := l.Select(i)
+		if err != nil {
+			return err
+		}
+		ldbs[i] = db
+	}
+	databases.reset()
+	useDB(0)
+	return nil
+}
+
+// useDB switches ldb to the logical database index.
+func useDB(index int) {
+	ldb = ldbs[databases.index[index]]
+	curDB = index
+}
+
+// inDB runs fn in the logical database index and switches back, for the
+// writes that span two databases. It must run in a log entry.
+func inDB(index int, fn func() error) error {
+	prev := curDB
+	useDB(index)
+	defer useDB(prev)
+	return fn()
+}
+
+// logEntry runs a command applied from the Raft log, in database 0 unless it
+// is a SELECT entry.
+func logEntry(fn cmdFunc) cmdFunc {
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		dbMu.Lock()
+		defer dbMu.Unlock()
+		defer useDB(0)
+		return fn(m, args)
+	}
+}
+
+// connRead runs a read command in the database selected by the connection.
+// A read of expired keys takes the write lock, the keys are hidden by a stage
+// of the store.
+func connRead(fn cmdFunc) cmdFunc {
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		c, _ := m.Context().(*respConn)
+		if c == nil || c.db == 0 {
+			dbMu.RLock()
+			expired, err := keysExpired(commandKeys(args), unixMilli(m.Now()))
+			if err != nil || !expired {
+				defer dbMu.RUnlock()
+				if err != nil {
+					return nil, err
+				}
+				return fn(m, args)
+			}
+			dbMu.RUnlock()
+			dbMu.Lock()
+			defer dbMu.Unlock()
+			return readUnexpired(fn, m, args)
+		}
+		dbMu.Lock()
+		defer dbMu.Unlock()
+		defer useDB(0)
+		useDB(c.db)
+		return readUnexpired(fn, m, args)
+	}
+}
+
+// dbEntry returns the log entry of the write args in the database index.
+func dbEntry(index int, args []string) []string {
+	if index == 0 {
+		return args
+	}
+	return append([]string{"select", strconv.Itoa(index)}, args...)
+}
+
+// entryArgs returns the args to send for the connection, with its database
+// index and its user when args is a write.
+func (c *respConn) entryArgs(args []string) []string {
+	if cmd, ok := commands[args[0]]; ok && cmd.write {
+		return dbEntry(c.db, c.userEntry(args))
+	}
+	return args
+}
+
+func parseDBIndex(s string) (int, error) {
+	index, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if index < 0 || index >= len(ldbs) {
+		return 0, errDBOutOfRange
+	}
+	return index, nil
+}
+
+// connSELECT changes the database of the connection
+// Syntax: SELECT index
+func connSELECT(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	index, err := parseDBIndex(args[1])
+	if err != nil {
+		return nil, err
+	}
+	c.db = index
+	return redcon.SimpleString("OK"), nil
+}
+
+// cmdSELECT runs a write command in the database index. Without a command,
+// as queued by a transaction or called by a script, it changes the database
+// of the commands that follow in the entry.
+// Syntax: SELECT index [command arg ...]
+func cmdSELECT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	index, err := parseDBIndex(args[1])
+	if err != nil {
+		return nil, err
+	}
+	useDB(index)
+	if len(args) == 2 {
+		return redcon.SimpleString("OK"), nil
+	}
+	cmd, ok := commands[strings.ToLower(args[2])]
+	if !ok || !cmd.write || cmd.name == "select" {
+		return nil, uhaha.ErrUnknownCommand
+	}
+	return cmd.fn(m, args[2:])
+}
+
+// cmdSWAPDB swaps two databases, the connections of one see the data of the
+// other right away
+// Syntax: SWAPDB index1 index2
+func cmdSWAPDB(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	a, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("ERR invalid first DB index")
+	}
+	b, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, errors.New("ERR invalid second DB index")
+	}
+	if a < 0 || a >= len(ldbs) || b < 0 || b >= len(ldbs) {
+		return nil, errDBOutOfRange
+	}
+	databases.index[a], databases.index[b] = databases.index[b], databases.index[a]
+	useDB(curDB)
+	return redcon.SimpleString("OK"), nil
+}
+
+// cmdMOVE moves key to another database, unless it exists there
+// Syntax: MOVE key db
+func cmdMOVE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	index, err := parseDBIndex(args[2])
+	if err != nil {
+		return nil, err
+	}
+	if index == curDB {
+		return nil, errSameObject
+	}
+	key := []byte(args[1])
+	types, err := keyTypesOf(key)
+	if err != nil || len(types) == 0 {
+		return redcon.SimpleInt(0), err
+	}
+	var exists bool
+	if err := inDB(index, func() error {
+		types, err := keyTypesOf(key)
+		exists = len(types) > 0
+		return err
+	}); err != nil || exists {
+		return redcon.SimpleInt(0), err
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	for _, kt := range types {
+		if err := kt.copyKey(wb, key, index, key); err != nil {
+			return nil, err
+		}
+		if err := kt.deleteKey(wb, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	notifyKeyspaceEvent(notifyGeneric, "move_from", args[1])
+	inDB(index, func() error {
+		notifyKeyspaceEvent(notifyNew, "new", args[1])
+		notifyKeyspaceEvent(notifyGeneric, "move_to", args[1])
+		return nil
+	})
+	return redcon.SimpleInt(1), nil
+}
+
+// storeDB returns the ledis store, shared by every database.
+func storeDB() *store.DB {
+	return ldbs[0].GetSDB()
+}
+
+func (t *dbTable) reset() {
+	t.index = make([]int, len(ldbs))
+	for i := range t.index {
+		t.index[i] = i
+	}
+}
+
+func (t *dbTable) save() []byte {
+	data := binary.AppendUvarint(nil, uint64(len(t.index)))
+	for _, index := range t.index {
+		data = binary.AppendUvarint(data, uint64(index))
+	}
+	return data
+}
+
+// load replaces the table. The snapshot may come from a node with fewer
+// databases, the others keep their own data.
+func (t *dbTable) load(data []byte) error {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	defer useDB(0)
+	t.reset()
+	if data == nil {
+		return nil
+	}
+	n, sz := binary.Uvarint(data)
+	if sz <= 0 {
+		return uhaha.ErrCorrupt
+	}
+	if n > uint64(len(t.index)) {
+		return fmt.Errorf("the snapshot has %d databases, more than --databases", n)
+	}
+	data = data[sz:]
+	seen := make([]bool, len(t.index))
+	for i := 0; i < int(n); i++ {
+		index, sz := binary.Uvarint(data)
+		if sz <= 0 || index >= n || seen[index] {
+			t.reset()
+			return uhaha.ErrCorrupt
+		}
+		seen[index] = true
+		t.index[i] = int(index)
+		data = data[sz:]
+	}
+	if len(data) > 0 {
+		t.reset()
+		return uhaha.ErrCorrupt
+	}
+	return nil
+}
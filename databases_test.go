@@ -0,0 +1,282 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// dbConn returns a client of the database db, closed at the end of the test.
+func dbConn(t *testing.T, db int) *redis.Client {
+	getTestConn()
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:11001", DB: db})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSelect(t *testing.T) {
+	c0, c1 := dbConn(t, 0), dbConn(t, 1)
+	ctx := context.Background()
+	c0.Del(ctx, "db_key", "db_list")
+	c1.Del(ctx, "db_key", "db_list")
+
+	c0.Set(ctx, "db_key", "zero", 0)
+	c1.Set(ctx, "db_key", "one", 0)
+	c1.RPush(ctx, "db_list", "a", "b")
+	if v, err := c0.Get(ctx, "db_key").Result(); err != nil || v != "zero" {
+		t.Fatal(v, err)
+	}
+	if v, err := c1.Get(ctx, "db_key").Result(); err != nil || v != "one" {
+		t.Fatal(v, err)
+	}
+	if n, err := c0.Exists(ctx, "db_list").Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if v, err := c1.LRange(ctx, "db_list", 0, -1).Result(); err != nil || !reflect.DeepEqual(v, []string{"a", "b"}) {
+		t.Fatal(v, err)
+	}
+
+	// the transactions and scripts run in the database of the connection,
+	// a SELECT in a transaction changes it for the rest of the transaction
+	// and after
+	tx := c1.Conn()
+	defer tx.Close()
+	if _, err := tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Incr(ctx, "db_n")
+		p.Select(ctx, 2)
+		p.Incr(ctx, "db_n")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tx.IncrBy(ctx, "db_n", 10).Result(); err != nil || v != 11 {
+		t.Fatal(v, err)
+	}
+	if err := c1.Eval(ctx, "return redis.call('append', KEYS[1], '!')", []string{"db_key"}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c1.Get(ctx, "db_key").Result(); err != nil || v != "one!" {
+		t.Fatal(v, err)
+	}
+	c2 := dbConn(t, 2)
+	for c, want := range map[*redis.Client]string{c1: "1", c2: "11"} {
+		if v, err := c.Get(ctx, "db_n").Result(); err != nil || v != want {
+			t.Fatal(v, err)
+		}
+		c.Del(ctx, "db_n")
+	}
+
+	conn := c0.Conn()
+	defer conn.Close()
+	if err := conn.Select(ctx, 1).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := conn.Get(ctx, "db_key").Result(); err != nil || v != "one!" {
+		t.Fatal(v, err)
+	}
+	if err := conn.Select(ctx, 16).Err(); err == nil {
+		t.Fatal("selected a database out of range")
+	}
+	if err := conn.Do(ctx, "select", "x").Err(); err == nil {
+		t.Fatal("selected a database that is not a number")
+	}
+	// a failed SELECT keeps the database
+	if v, err := conn.Get(ctx, "db_key").Result(); err != nil || v != "one!" {
+		t.Fatal(v, err)
+	}
+}
+
+func TestFlushDB(t *testing.T) {
+	c3, c4 := dbConn(t, 3), dbConn(t, 4)
+	ctx := context.Background()
+
+	c3.Set(ctx, "db_flush", "v", 0)
+	c3.HSet(ctx, "db_flush_hash", "f", "v")
+	c3.HExpire(ctx, "db_flush_hash", time.Hour, "f")
+	c4.Set(ctx, "db_flush", "v", 0)
+	if err := c3.FlushDB(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c3.DBSize(ctx).Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if n, err := c4.Exists(ctx, "db_flush").Result(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	c4.Del(ctx, "db_flush")
+}
+
+func TestSwapDB(t *testing.T) {
+	c5, c6 := dbConn(t, 5), dbConn(t, 6)
+	ctx := context.Background()
+	c5.Set(ctx, "db_swap", "five", 0)
+	c6.Set(ctx, "db_swap", "six", 0)
+	c6.Set(ctx, "db_swap6", "v", time.Hour)
+
+	if err := c5.Do(ctx, "swapdb", 5, 6).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c5.Get(ctx, "db_swap").Result(); err != nil || v != "six" {
+		t.Fatal(v, err)
+	}
+	if d, err := c5.TTL(ctx, "db_swap6").Result(); err != nil || d <= 0 {
+		t.Fatal(d, err)
+	}
+	if v, err := c6.Get(ctx, "db_swap").Result(); err != nil || v != "five" {
+		t.Fatal(v, err)
+	}
+	// the writes go to the swapped databases too
+	c6.Append(ctx, "db_swap", "!")
+	if err := c5.Do(ctx, "swapdb", 6, 5).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c5.Get(ctx, "db_swap").Result(); err != nil || v != "five!" {
+		t.Fatal(v, err)
+	}
+
+	if err := c5.Do(ctx, "swapdb", 5, 16).Err(); err == nil {
+		t.Fatal("swapped a database out of range")
+	}
+	if err := c5.Do(ctx, "swapdb", "x", 1).Err(); err == nil || err.Error() != "ERR invalid first DB index" {
+		t.Fatal(err)
+	}
+	c5.FlushDB(ctx)
+	c6.FlushDB(ctx)
+}
+
+func TestMove(t *testing.T) {
+	c0, c7 := dbConn(t, 0), dbConn(t, 7)
+	ctx := context.Background()
+	c0.Del(ctx, "db_move", "db_move_hash", "db_move_taken")
+	c7.Del(ctx, "db_move", "db_move_hash", "db_move_taken")
+
+	c0.Set(ctx, "db_move", "v", time.Hour)
+	if ok, err := c0.Move(ctx, "db_move", 7).Result(); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if n, err := c0.Exists(ctx, "db_move").Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if d, err := c7.TTL(ctx, "db_move").Result(); err != nil || d <= 0 {
+		t.Fatal(d, err)
+	}
+	c0.HSet(ctx, "db_move_hash", "f", "v", "g", "w")
+	c0.HExpire(ctx, "db_move_hash", time.Hour, "f")
+	if ok, err := c0.Move(ctx, "db_move_hash", 7).Result(); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if v, err := c7.HTTL(ctx, "db_move_hash", "f", "g").Result(); err != nil || v[0] <= 0 || v[1] != -1 {
+		t.Fatal(v, err)
+	}
+
+	// nothing is moved when the key is missing or exists in the target
+	if ok, err := c0.Move(ctx, "db_move_none", 7).Result(); err != nil || ok {
+		t.Fatal(ok, err)
+	}
+	c0.Set(ctx, "db_move_taken", "zero", 0)
+	c7.Set(ctx, "db_move_taken", "seven", 0)
+	if ok, err := c0.Move(ctx, "db_move_taken", 7).Result(); err != nil || ok {
+		t.Fatal(ok, err)
+	}
+	if v, err := c0.Get(ctx, "db_move_taken").Result(); err != nil || v != "zero" {
+		t.Fatal(v, err)
+	}
+	if err := c0.Move(ctx, "db_move_taken", 0).Err(); err == nil {
+		t.Fatal("moved a key to its own database")
+	}
+	c0.Del(ctx, "db_move_taken")
+	c7.FlushDB(ctx)
+}
+
+func TestCopyDB(t *testing.T) {
+	c0, c8 := dbConn(t, 0), dbConn(t, 8)
+	ctx := context.Background()
+	c0.Del(ctx, "db_copy")
+
+	c0.RPush(ctx, "db_copy", "a", "b")
+	if n, err := c0.Do(ctx, "copy", "db_copy", "db_copy", "db", 8).Int(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n, err := c0.Do(ctx, "copy", "db_copy", "db_copy", "db", 8).Int(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	c0.RPush(ctx, "db_copy", "c")
+	if n, err := c0.Do(ctx, "copy", "db_copy", "db_copy", "db", 8, "replace").Int(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if v, err := c8.LRange(ctx, "db_copy", 0, -1).Result(); err != nil || !reflect.DeepEqual(v, []string{"a", "b", "c"}) {
+		t.Fatal(v, err)
+	}
+	if err := c0.Do(ctx, "copy", "db_copy", "db_copy", "db", 0).Err(); err == nil {
+		t.Fatal("copied a key on itself")
+	}
+	c0.Del(ctx, "db_copy")
+	c8.FlushDB(ctx)
+}
+
+func TestNotifyDatabases(t *testing.T) {
+	c0, c9 := dbConn(t, 0), dbConn(t, 9)
+	ctx := context.Background()
+	if err := c0.ConfigSet(ctx, "notify-keyspace-events", "Kg$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	defer c0.ConfigSet(ctx, "notify-keyspace-events", "")
+
+	sub := c0.PSubscribe(ctx, "__keyspace@*__:ndb_*")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c9.Set(ctx, "ndb_key", "v", 0)
+	c9.Move(ctx, "ndb_key", 0)
+	c0.Del(ctx, "ndb_key")
+	expectEvents(t, sub,
+		"__keyspace@9__:ndb_key set",
+		"__keyspace@9__:ndb_key move_from",
+		"__keyspace@0__:ndb_key move_to",
+		"__keyspace@0__:ndb_key del")
+}
+
+func TestDatabasesSnapshot(t *testing.T) {
+	getTestConn()
+	var table dbTable
+	table.index = []int{1, 0, 2}
+	data := table.save()
+
+	defer func() {
+		dbMu.Lock()
+		databases.reset()
+		useDB(0)
+		dbMu.Unlock()
+	}()
+	if err := databases.load(data); err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]int{1, 0, 2}, databases.index[3:]...); !reflect.DeepEqual(databases.index, want) {
+		t.Fatal(databases.index)
+	}
+	for i := 3; i < len(databases.index); i++ {
+		if databases.index[i] != i {
+			t.Fatal(databases.index)
+		}
+	}
+	if ldb != ldbs[1] {
+		t.Fatal("database 0 is not the loaded one")
+	}
+
+	table.index = []int{1, 1}
+	if err := databases.load(table.save()); err == nil {
+		t.Fatal("loaded a table that is not a permutation")
+	}
+	table.index = make([]int, len(ldbs)+1)
+	if err := databases.load(table.save()); err == nil {
+		t.Fatal("loaded more databases than configured")
+	}
+}
@@ -96,7 +96,8 @@ func (db *DB) NewIterator() driver.IIterator {
 
 func (db *DB) NewSnapshot() (driver.ISnapshot, error) {
 	s := &Snapshot{
-		db: db.db,
+		db:  db.db,
+		txn: db.db.NewTransaction(false),
 	}
 	return s, nil
 }
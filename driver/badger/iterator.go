@@ -29,7 +29,9 @@ func (it *Iterator) Close() error {
 	if it.it != nil {
 		it.it.Close()
 		it.it = nil
-		it.txn.Discard()
+		if it.txn != nil {
+			it.txn.Discard()
+		}
 	}
 	return nil
 }
@@ -5,35 +5,33 @@ import (
 	"github.com/ledisdb/ledisdb/store/driver"
 )
 
+// Snapshot is a point-in-time view of the database, backed by a read-only
+// transaction opened when the snapshot is taken.
 type Snapshot struct {
-	db *badger.DB
+	db  *badger.DB
+	txn *badger.Txn
 }
 
 func (s *Snapshot) Get(key []byte) ([]byte, error) {
-	var val []byte
-	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
-		}
-		val, err = item.ValueCopy(nil)
-		return err
-	})
+	item, err := s.txn.Get(key)
 	if err == badger.ErrKeyNotFound {
 		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	return val, err
+	return item.ValueCopy(nil)
 }
 
 func (s *Snapshot) NewIterator() driver.IIterator {
-	tnx := s.db.NewTransaction(false)
+	// The iterator shares the snapshot transaction, which is discarded by
+	// Snapshot.Close rather than by the iterator.
 	it := &Iterator{
-		db:  s.db,
-		it:  tnx.NewIterator(badger.DefaultIteratorOptions),
-		txn: tnx,
+		db: s.db,
+		it: s.txn.NewIterator(badger.DefaultIteratorOptions),
 	}
 	return it
 }
 
 func (s *Snapshot) Close() {
+	s.txn.Discard()
 }
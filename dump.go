@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/redis/go-redis/v9"
+	"github.com/siddontang/rdb"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddReadCommand("DUMP", cmdDUMP)
+	conf.AddWriteCommand("RESTORE", cmdRESTORE)
+
+	// MIGRATE talks to the target cluster from the client connection. The
+	// machine side only dumps the keys, the source keys are then deleted in
+	// an EXEC entry that watches them.
+	addConnCommand("MIGRATE", connMIGRATE)
+	conf.AddReadCommand("MIGRATE", cmdMIGRATE)
+}
+
+var (
+	errBusyKey        = errors.New("BUSYKEY Target key name already exists.")
+	errInvalidTTL     = errors.New("ERR Invalid TTL value, must be >= 0")
+	errDumpPayload    = errors.New("ERR DUMP payload version or checksum are wrong")
+	errDumpStream     = errors.New("ERR DUMP is not supported for stream keys")
+	errMigrateTimeout = errors.New("IOERR error or timeout reading to target instance")
+	errMigrateChanged = errors.New("ERR source keys modified during MIGRATE, they were kept")
+	errDumpTypes      = "ERR key '%s' exists with several types, DUMP needs a single one"
+)
+
+// dumpKey returns the DUMP payload of key, nil if the key does not exist. A
+// key that exists with several ledis types cannot be dumped, since a payload
+// holds a single value.
+func dumpKey(key []byte) (*keyType, []byte, error) {
+	types, err := keyTypesOf(key)
+	if err != nil || len(types) == 0 {
+		return nil, nil, err
+	}
+	if len(types) > 1 {
+		return nil, nil, fmt.Errorf(errDumpTypes, key)
+	}
+	kt := types[0]
+	var data []byte
+	switch kt.expType {
+	case ledis.KVType:
+		data, err = ldb.Dump(key)
+	case ledis.ListType:
+		data, err = ldb.LDump(key)
+	case ledis.HashType:
+		data, err = ldb.HDump(key)
+	case ledis.SetType:
+		data, err = ldb.SDump(key)
+	case ledis.ZSetType:
+		data, err = ldb.ZDump(key)
+	default:
+		return nil, nil, errDumpStream
+	}
+	return kt, data, err
+}
+
+// cmdDUMP serializes the value stored at key in the Redis RDB format
+// Syntax: DUMP key
+func cmdDUMP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	_, data, err := dumpKey([]byte(args[1]))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// cmdRESTORE creates a key from a DUMP payload. The expire time is computed
+// from the machine time so that it is the same on every node.
+// Syntax: RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func cmdRESTORE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	ttl, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || ttl < 0 {
+		return nil, errInvalidTTL
+	}
+	var replace, absTTL bool
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			// no LRU/LFU eviction, the hints are ignored
+			if i+1 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			i++
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+
+	// the payload is checked before REPLACE deletes the key
+	if _, err := rdb.DecodeDump([]byte(args[3])); err != nil {
+		return nil, errDumpPayload
+	}
+	if replace {
+		wb := ldb.GetSDB().NewWriteBatch()
+		defer wb.Close()
+		if _, err := deleteKeyAllTypes(wb, key); err != nil {
+			return nil, err
+		}
+		if err := wb.Commit(); err != nil {
+			return nil, err
+		}
+	} else if types, err := keyTypesOf(key); err != nil {
+		return nil, err
+	} else if len(types) > 0 {
+		return nil, errBusyKey
+	}
+
+	nowMs := unixMilli(m.Now())
+	if absTTL && ttl > 0 {
+		if ttl <= nowMs {
+			// already expired
+			return redcon.SimpleString("OK"), nil
+		}
+		ttl -= nowMs
+	}
+	if err := ldb.Restore(key, 0, []byte(args[3])); err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		types, err := keyTypesOf(key)
+		if err != nil {
+			return nil, err
+		}
+		wb := ldb.GetSDB().NewWriteBatch()
+		defer wb.Close()
+		for _, kt := range types {
+			if err := setKeyPExpireAt(wb, kt, key, nowMs+ttl); err != nil {
+				return nil, err
+			}
+		}
+		if err := wb.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+// migrateArgs are the parsed arguments of
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+type migrateArgs struct {
+	addr               string
+	db                 int
+	timeout            time.Duration
+	copy, replace      bool
+	username, password string
+	keys               []string
+}
+
+func parseMigrateArgs(args []string) (*migrateArgs, error) {
+	if len(args) < 6 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	a := &migrateArgs{addr: net.JoinHostPort(args[1], args[2])}
+	var err error
+	if a.db, err = strconv.Atoi(args[4]); err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	a.timeout = time.Duration(timeout) * time.Millisecond
+	for i := 6; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			a.copy = true
+		case "REPLACE":
+			a.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			a.password = args[i+1]
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			a.username, a.password = args[i+1], args[i+2]
+			i += 2
+		case "KEYS":
+			if args[3] != "" {
+				return nil, errors.New("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			a.keys = args[i+1:]
+			i = len(args)
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+	if a.keys == nil {
+		a.keys = args[3:4]
+	}
+	return a, nil
+}
+
+// cmdMIGRATE dumps the keys of a MIGRATE command. It replies with the key
+// version sequence of the dump, to watch the keys, followed by a
+// [key, type, ttl, payload] array for each existing key.
+func cmdMIGRATE(m uhaha.Machine, args []string) (interface{}, error) {
+	a, err := parseMigrateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	dumps := []interface{}{strconv.FormatUint(keyVersions.seq, 10)}
+	for _, key := range a.keys {
+		kt, data, err := dumpKey([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		ttl, err := keyPTTL([]byte(key), m.Now())
+		if err != nil {
+			return nil, err
+		}
+		if ttl < 0 {
+			// no expire time, or expired while dumped
+			ttl = 0
+		}
+		dumps = append(dumps, []interface{}{key, kt.name, ttl, data})
+	}
+	return dumps, nil
+}
+
+// migrateClearCommands are the commands that delete a migrated key, by type.
+var migrateClearCommands = map[string]string{
+	"string": "del",
+	"list":   "lclear",
+	"hash":   "hclear",
+	"set":    "sclear",
+	"zset":   "zclear",
+}
+
+// connMIGRATE restores the keys on the target instance with RESTORE and then,
+// unless COPY is set, deletes them. The deletes are a transaction that
+// watches the keys since the dump, so a key written in between is kept
+// rather than lost.
+func connMIGRATE(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	a, err := parseMigrateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	v, err := c.sendRecv(s, args...)
+	if err != nil {
+		return nil, err
+	}
+	dumps, _ := v.([]interface{})
+	if len(dumps) < 2 {
+		return redcon.SimpleString("NOKEY"), nil
+	}
+	seq, err := strconv.ParseUint(dumps[0].(string), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	tx := txState{watchSeq: seq}
+
+	target := redis.NewClient(&redis.Options{
+		Addr:         a.addr,
+		Username:     a.username,
+		Password:     a.password,
+		DB:           a.db,
+		DialTimeout:  a.timeout,
+		ReadTimeout:  a.timeout,
+		WriteTimeout: a.timeout,
+		MaxRetries:   -1,
+	})
+	defer target.Close()
+	ctx := context.Background()
+	for _, d := range dumps[1:] {
+		d := d.([]interface{})
+		key, typ := d[0].(string), d[1].(string)
+		restore := []interface{}{"restore", key, d[2], d[3]}
+		if a.replace {
+			restore = append(restore, "replace")
+		}
+		if err = target.Do(ctx, restore...).Err(); err != nil {
+			var rerr redis.Error
+			if errors.As(err, &rerr) {
+				err = fmt.Errorf("ERR Target instance replied with error: %s", rerr.Error())
+			} else {
+				err = errMigrateTimeout
+			}
+			// the keys restored so far are still moved
+			break
+		}
+		tx.watched = append(tx.watched, key)
+		tx.queue = append(tx.queue, []string{migrateClearCommands[typ], key})
+	}
+	if !a.copy && len(tx.queue) > 0 {
+		v, derr := c.sendRecv(s, encodeExec(&tx)...)
+		if derr == nil && v == nil {
+			derr = errMigrateChanged
+		}
+		if err == nil {
+			err = derr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
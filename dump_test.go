@@ -0,0 +1,185 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tidwall/redcon"
+)
+
+func TestDumpRestore(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "dump_string", "v", 0)
+	c.RPush(ctx, "dump_list", "a", "b")
+	c.SAdd(ctx, "dump_set", "a", "b")
+	c.ZAdd(ctx, "dump_zset", redis.Z{Score: 1, Member: "a"}, redis.Z{Score: 2, Member: "b"})
+	c.HSet(ctx, "dump_hash", "f", "v")
+
+	for _, key := range []string{"dump_string", "dump_list", "dump_set", "dump_zset", "dump_hash"} {
+		payload, err := c.Dump(ctx, key).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Restore(ctx, key, 0, payload).Err(); err == nil {
+			t.Fatal("expected BUSYKEY")
+		}
+		if err := c.RestoreReplace(ctx, key, time.Hour, payload).Err(); err != nil {
+			t.Fatal(err)
+		}
+		restored := key + "_restored"
+		if err := c.Restore(ctx, restored, 0, payload).Err(); err != nil {
+			t.Fatal(err)
+		}
+		typ, err := c.Type(ctx, key).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := c.Type(ctx, restored).Result(); err != nil {
+			t.Fatal(err)
+		} else if v != typ {
+			t.Fatalf("%s: expected %s, got %s", restored, typ, v)
+		}
+		if v, err := c.Dump(ctx, restored).Result(); err != nil {
+			t.Fatal(err)
+		} else if v != payload {
+			t.Fatalf("%s: payloads differ", restored)
+		}
+	}
+	if d, err := c.TTL(ctx, "dump_string").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 0 {
+		t.Fatal(d)
+	}
+	if err := c.Dump(ctx, "dump_none").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if err := c.Restore(ctx, "dump_bad", 0, "garbage").Err(); err == nil {
+		t.Fatal("expected a payload error")
+	}
+
+	// a bad payload keeps the key REPLACE would delete
+	if err := c.RestoreReplace(ctx, "dump_string", 0, "garbage").Err(); err == nil {
+		t.Fatal("expected a payload error")
+	}
+	if v, err := c.Get(ctx, "dump_string").Result(); err != nil || v != "v" {
+		t.Fatal(v, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "migrate_string", "v", 0)
+	if v, err := c.Migrate(ctx, "127.0.0.1", "11001", "migrate_none", 0, time.Second).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "NOKEY" {
+		t.Fatal(v)
+	}
+
+	// migrating to the same cluster only works with COPY and REPLACE
+	if err := c.Do(ctx, "MIGRATE", "127.0.0.1", "11001", "migrate_string", 0, 1000).Err(); err == nil {
+		t.Fatal("expected BUSYKEY from the target")
+	}
+	if v, err := c.Do(ctx, "MIGRATE", "127.0.0.1", "11001", "", 0, 1000, "COPY", "REPLACE",
+		"KEYS", "migrate_string", "migrate_none").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "OK" {
+		t.Fatal(v)
+	}
+	if v, err := c.Get(ctx, "migrate_string").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+
+	if err := c.Do(ctx, "MIGRATE", "127.0.0.1", "1", "migrate_string", 0, 100).Err(); err == nil {
+		t.Fatal("expected an IOERR")
+	}
+
+	// a source key written between the dump and the delete is kept: here the
+	// write is the RESTORE itself, to the database 1 of the same cluster
+	if err := c.Do(ctx, "MIGRATE", "127.0.0.1", "11001", "migrate_string", 1, 1000).Err(); err == nil ||
+		err.Error() != errMigrateChanged.Error() {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "migrate_string").Result(); err != nil || v != "v" {
+		t.Fatal(v, err)
+	}
+	dbConn(t, 1).Del(ctx, "migrate_string")
+
+	// a key with several types cannot be dumped
+	c.RPush(ctx, "migrate_string", "a")
+	if err := c.Do(ctx, "MIGRATE", "127.0.0.1", "11001", "migrate_string", 1, 1000).Err(); err == nil ||
+		!strings.Contains(err.Error(), "several types") {
+		t.Fatal(err)
+	}
+	c.Do(ctx, "lclear", "migrate_string")
+}
+
+// restoreTarget serves RESTORE like the target instance of a MIGRATE, and
+// returns the keys it restored.
+func restoreTarget(t *testing.T) (addr string, restored func() []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var keys []string
+	srv := redcon.NewServer("", func(conn redcon.Conn, cmd redcon.Command) {
+		if !strings.EqualFold(string(cmd.Args[0]), "restore") {
+			conn.WriteError("ERR unknown command")
+			return
+		}
+		mu.Lock()
+		keys = append(keys, string(cmd.Args[1]))
+		mu.Unlock()
+		conn.WriteString("OK")
+	}, nil, nil)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), keys...)
+	}
+}
+
+func TestMigrateMove(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	addr, restored := restoreTarget(t)
+	host, port, _ := net.SplitHostPort(addr)
+
+	c.Set(ctx, "migrate_move", "v", 0)
+	c.HSet(ctx, "migrate_move_hash", "f", "v")
+	if v, err := c.Do(ctx, "MIGRATE", host, port, "", 0, 1000,
+		"KEYS", "migrate_move", "migrate_move_hash", "migrate_none").Result(); err != nil || v != "OK" {
+		t.Fatal(v, err)
+	}
+	if v := restored(); len(v) != 2 || v[0] != "migrate_move" || v[1] != "migrate_move_hash" {
+		t.Fatal(v)
+	}
+	if n, err := c.Exists(ctx, "migrate_move", "migrate_move_hash").Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+
+	// MIGRATE is not a command of transactions
+	_, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Migrate(ctx, host, port, "migrate_move", 0, time.Second)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "EXECABORT") {
+		t.Fatal(err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/IceFireDB/IceFireDB/driver/crdt"
 
+	"github.com/ledisdb/ledisdb/ledis"
 	rafthub "github.com/tidwall/uhaha"
 
 	"github.com/IceFireDB/IceFireDB/driver/hybriddb"
@@ -35,13 +36,25 @@ Basic options:
 Security options:
   --tls-cert path  : path to TLS certificate
   --tls-key path   : path to TLS private key
-  --auth auth      : cluster authorization,shared by all servers and clients
+  --auth auth      : cluster authorization,shared by all servers and clients.
+                     It is the initial password of the default ACL user,
+                     the servers authenticate with it as that user
 
 Networking options: 
   --advertise addr : advertise address  (default: network bound address)
 
 Store options: 
   --hot-cache-size int : memory cache capacity,unit:MB (default 1024)
+  --databases n    : number of databases, selected with SELECT (default: 16).
+                     Must be the same on every node of the cluster
+  --no-key-counts  : do not count the keys, DBSIZE and RANDOMKEY walk the
+                     keyspace instead. Saves the scan of the keys when the
+                     store is opened and a read on the writes of keys
+
+Events options:
+  --notify-keyspace-events classes : keyspace events sent to the subscribers of
+                     the node, like notify-keyspace-events of Redis, e.g. KEA
+                     (default: none). Also set with CONFIG SET
 
 Advanced options:
   --nosync         : turn off syncing data to disk after every write. This leads
@@ -100,6 +113,8 @@ func confInit(conf *rafthub.Config) {
 	}
 	var raftBackend string
 	var testNode string
+	var notifyEvents string
+	var noKeyCounts bool
 	flag.StringVar(&conf.Addr, "a", conf.Addr, "")
 	flag.StringVar(&conf.NodeID, "n", conf.NodeID, "")
 	flag.StringVar(&conf.DataDir, "d", conf.DataDir, "")
@@ -115,6 +130,9 @@ func confInit(conf *rafthub.Config) {
 	flag.StringVar(&conf.Auth, "auth", conf.Auth, "")
 	flag.StringVar(&conf.Advertise, "advertise", conf.Advertise, "")
 	flag.StringVar(&testNode, "t", "", "")
+	flag.StringVar(&notifyEvents, "notify-keyspace-events", "", "")
+	flag.IntVar(&numDatabases, "databases", numDatabases, "")
+	flag.BoolVar(&noKeyCounts, "no-key-counts", false, "")
 
 	flag.StringVar(&ipfs.IpfsDefaultConfig.EndPointConnection, "ipfs-endpoint", "", "")
 	flag.StringVar(&oss.OssDefaultConfig.EndPointConnection, "oss-endpoint", "", "")
@@ -169,6 +187,17 @@ func confInit(conf *rafthub.Config) {
 			"flag --tls-cert cannot be empty when --tls-key is provided\n")
 		os.Exit(1)
 	}
+	if numDatabases < 1 || numDatabases > ledis.MaxDatabases {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid --databases: must be between 1 and %d\n", ledis.MaxDatabases)
+		os.Exit(1)
+	}
+	keyCounts = !noKeyCounts
+	if flags, err := parseNotifyClasses(notifyEvents); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid --notify-keyspace-events: '%s'\n", notifyEvents)
+		os.Exit(1)
+	} else {
+		keyspaceEvents.Store(int64(flags))
+	}
 	if conf.Advertise != "" {
 		colon := strings.IndexByte(conf.Advertise, ':')
 		if colon == -1 {
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cupcake/rdb/crc64"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func init() {
+	// FUNCTION LOAD, DELETE, FLUSH and RESTORE change the libraries, so the
+	// whole command goes through the log, like SCRIPT.
+	conf.AddWriteCommand("FUNCTION", cmdFUNCTION)
+	conf.AddWriteCommand("FCALL", cmdFCALL)
+	conf.AddReadCommand("FCALL_RO", cmdFCALLRO)
+
+	registerSnapshotSection("functions", functions.save, functions.load)
+}
+
+var (
+	errNoFunction         = errors.New("ERR Function not found")
+	errNoLibrary          = errors.New("ERR Library not found")
+	errNoFunctions        = errors.New("ERR No functions registered")
+	errLibraryMetadata    = errors.New("ERR Missing library metadata")
+	errLibraryName        = errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	errFunctionName       = errors.New("ERR Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	errFunctionExists     = errors.New("ERR Function already exists in the library")
+	errFunctionFlag       = errors.New("ERR unknown flag given")
+	errFunctionWriteRO    = errors.New("ERR Can not execute a script with write flag using *_ro command.")
+	errFunctionPayload    = errors.New("ERR payload version or checksum are wrong")
+	errFunctionPolicy     = errors.New("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+	errFunctionSubcommand = "ERR unknown subcommand '%s'. Try FUNCTION HELP."
+)
+
+// functionFlags are the flags register_function accepts. Only no-writes
+// changes the way a function runs, the others are accepted for
+// compatibility.
+var functionFlags = map[string]bool{
+	"no-writes": true, "allow-oom": true, "allow-stale": true,
+	"no-cluster": true, "allow-cross-slot-keys": true,
+}
+
+// luaFunction is a function registered by a library.
+type luaFunction struct {
+	name     string
+	desc     string
+	flags    []string
+	noWrites bool
+}
+
+// functionLibrary is a library loaded by FUNCTION LOAD. Only its code is
+// stored, the Lua state of a function call is made from it.
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*luaFunction
+}
+
+// functionTable holds the libraries by name and their functions by name.
+// Like the script cache it is only changed inside Apply and is carried by
+// snapshots.
+type functionTable struct {
+	libs  map[string]*functionLibrary
+	funcs map[string]*functionLibrary
+}
+
+var functions = &functionTable{
+	libs:  make(map[string]*functionLibrary),
+	funcs: make(map[string]*functionLibrary),
+}
+
+// add adds lib to the table, replacing the library of the same name when
+// replace is true.
+func (t *functionTable) add(lib *functionLibrary, replace bool) error {
+	old := t.libs[lib.name]
+	if old != nil && !replace {
+		return fmt.Errorf("ERR Library '%s' already exists", lib.name)
+	}
+	for name := range lib.functions {
+		if other := t.funcs[name]; other != nil && other != old {
+			return fmt.Errorf("ERR Function %s already exists", name)
+		}
+	}
+	if old != nil {
+		t.delete(old)
+	}
+	t.libs[lib.name] = lib
+	for name := range lib.functions {
+		t.funcs[name] = lib
+	}
+	return nil
+}
+
+func (t *functionTable) delete(lib *functionLibrary) {
+	delete(t.libs, lib.name)
+	for name := range lib.functions {
+		delete(t.funcs, name)
+	}
+}
+
+func (t *functionTable) flush() {
+	t.libs = make(map[string]*functionLibrary)
+	t.funcs = make(map[string]*functionLibrary)
+}
+
+// sorted returns the libraries sorted by name.
+func (t *functionTable) sorted() []*functionLibrary {
+	libs := make([]*functionLibrary, 0, len(t.libs))
+	for _, lib := range t.libs {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// save encodes the code of the libraries, sorted by name:
+// uvarint len | code ...
+func (t *functionTable) save() []byte {
+	var data []byte
+	for _, lib := range t.sorted() {
+		data = binary.AppendUvarint(data, uint64(len(lib.code)))
+		data = append(data, lib.code...)
+	}
+	return data
+}
+
+func (t *functionTable) load(data []byte) error {
+	t.flush()
+	for len(data) > 0 {
+		n, sz := binary.Uvarint(data)
+		if sz <= 0 || uint64(len(data)-sz) < n {
+			return uhaha.ErrCorrupt
+		}
+		lib, err := loadLibrary(string(data[sz : sz+int(n)]))
+		if err != nil {
+			return uhaha.ErrCorrupt
+		}
+		if err := t.add(lib, false); err != nil {
+			return uhaha.ErrCorrupt
+		}
+		data = data[sz+int(n):]
+	}
+	return nil
+}
+
+// parseLibraryMetadata parses the "#!lua name=<library>" first line of the
+// code of a library.
+func parseLibraryMetadata(code string) (string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", errLibraryMetadata
+	}
+	line := code[2:]
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return "", errLibraryMetadata
+	}
+	if !strings.EqualFold(parts[0], "lua") {
+		return "", fmt.Errorf("ERR Engine '%s' not found", parts[0])
+	}
+	var name string
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "name=") {
+			return "", fmt.Errorf("ERR Invalid metadata value given: %s", part)
+		}
+		name = part[len("name="):]
+	}
+	if name == "" {
+		return "", errors.New("ERR Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", errLibraryName
+	}
+	return name, nil
+}
+
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// registeredFunction is a function registered while the code of a library
+// runs.
+type registeredFunction struct {
+	*luaFunction
+	callback *lua.LFunction
+}
+
+// runLibrary runs the code of a library in L and returns the functions it
+// registered with redis.register_function.
+func runLibrary(L *lua.LState, code string) (map[string]*registeredFunction, error) {
+	// the metadata line is not Lua, keep the line numbers of the errors
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		code = code[i:]
+	} else {
+		code = ""
+	}
+	registered := make(map[string]*registeredFunction)
+	raise := func(L *lua.LState, err error) {
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(err.Error()))
+		L.Error(t, 1)
+	}
+	redis := L.GetGlobal("redis").(*lua.LTable)
+	L.SetField(redis, "register_function", L.NewFunction(func(L *lua.LState) int {
+		f := &registeredFunction{luaFunction: &luaFunction{}}
+		switch v := L.Get(1).(type) {
+		case lua.LString:
+			f.name = string(v)
+			f.callback, _ = L.Get(2).(*lua.LFunction)
+		case *lua.LTable:
+			f.name = lua.LVAsString(v.RawGetString("function_name"))
+			f.callback, _ = v.RawGetString("callback").(*lua.LFunction)
+			f.desc = lua.LVAsString(v.RawGetString("description"))
+			if flags, ok := v.RawGetString("flags").(*lua.LTable); ok {
+				for i := 1; i <= flags.Len(); i++ {
+					flag := lua.LVAsString(flags.RawGetInt(i))
+					if !functionFlags[flag] {
+						raise(L, errFunctionFlag)
+					}
+					f.flags = append(f.flags, flag)
+					f.noWrites = f.noWrites || flag == "no-writes"
+				}
+			}
+		default:
+			raise(L, errors.New("ERR calling redis.register_function with a wrong argument"))
+		}
+		if !validFunctionName(f.name) {
+			raise(L, errFunctionName)
+		}
+		if f.callback == nil {
+			raise(L, errors.New("ERR callback must be a function"))
+		}
+		if registered[f.name] != nil {
+			raise(L, errFunctionExists)
+		}
+		registered[f.name] = f
+		return 0
+	}))
+
+	fn, err := L.LoadString(code)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling function: %s", err)
+	}
+	L.Push(fn)
+	if err := L.PCall(0, 0, nil); err != nil {
+		return nil, scriptError(L, err, "library")
+	}
+	return registered, nil
+}
+
+// loadLibrary runs the code of a library, without redis.call, to list its
+// functions.
+func loadLibrary(code string) (*functionLibrary, error) {
+	name, err := parseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+	L := newScriptState(nil, nil, true)
+	defer L.Close()
+	limitSteps(L)
+	registered, err := runLibrary(L, code)
+	if err != nil {
+		return nil, err
+	}
+	if len(registered) == 0 {
+		return nil, errNoFunctions
+	}
+	lib := &functionLibrary{name: name, code: code, functions: make(map[string]*luaFunction)}
+	for name, f := range registered {
+		lib.functions[name] = f.luaFunction
+	}
+	return lib, nil
+}
+
+// cmdFUNCTION manages the function libraries.
+// Syntax: FUNCTION LOAD [REPLACE] code | DELETE library | FLUSH [ASYNC | SYNC]
+// | LIST [LIBRARYNAME pattern] [WITHCODE] | DUMP
+// | RESTORE payload [FLUSH | APPEND | REPLACE]
+func cmdFUNCTION(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	switch strings.ToUpper(args[1]) {
+	case "LOAD":
+		return functionLoad(args[2:])
+	case "DELETE":
+		if len(args) != 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		lib := functions.libs[args[2]]
+		if lib == nil {
+			return nil, errNoLibrary
+		}
+		functions.delete(lib)
+		return redcon.SimpleString("OK"), nil
+	case "FLUSH":
+		if len(args) > 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		if len(args) == 3 && !strings.EqualFold(args[2], "ASYNC") && !strings.EqualFold(args[2], "SYNC") {
+			return nil, uhaha.ErrSyntax
+		}
+		functions.flush()
+		return redcon.SimpleString("OK"), nil
+	case "LIST":
+		return functionList(args[2:])
+	case "DUMP":
+		if len(args) != 2 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		return functionDump(), nil
+	case "RESTORE":
+		if len(args) != 3 && len(args) != 4 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		return functionRestore(args[2:])
+	}
+	return nil, fmt.Errorf(errFunctionSubcommand, args[1])
+}
+
+func functionLoad(args []string) (interface{}, error) {
+	var replace bool
+	if len(args) == 2 && strings.EqualFold(args[0], "REPLACE") {
+		replace = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	lib, err := loadLibrary(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := functions.add(lib, replace); err != nil {
+		return nil, err
+	}
+	return lib.name, nil
+}
+
+func functionList(args []string) (interface{}, error) {
+	var pattern string
+	var withCode bool
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			pattern = args[i+1]
+			i++
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+	ret := []interface{}{}
+	for _, lib := range functions.sorted() {
+		if pattern != "" && !globMatch(pattern, lib.name, false) {
+			continue
+		}
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		funcs := make([]interface{}, len(names))
+		for i, name := range names {
+			f := lib.functions[name]
+			var desc interface{}
+			if f.desc != "" {
+				desc = f.desc
+			}
+			flags := make([]interface{}, len(f.flags))
+			for j, flag := range f.flags {
+				flags[j] = flag
+			}
+			funcs[i] = []interface{}{"name", name, "description", desc, "flags", flags}
+		}
+		item := []interface{}{"library_name", lib.name, "engine", "LUA", "functions", funcs}
+		if withCode {
+			item = append(item, "library_code", lib.code)
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+// The payload of FUNCTION DUMP is the one of Redis, so that it can be
+// restored on a Redis server and the other way around: an
+// RDB_OPCODE_FUNCTION2 entry with the code of every library, then the RDB
+// version and the CRC64 of the payload, both little endian.
+const (
+	rdbOpcodeFunction2 = 245
+	rdbFunctionVersion = 10 // the first RDB version with RDB_OPCODE_FUNCTION2
+	rdbMaxVersion      = 12
+)
+
+func functionDump() []byte {
+	var p []byte
+	for _, lib := range functions.sorted() {
+		p = append(p, rdbOpcodeFunction2)
+		p = appendRDBString(p, lib.code)
+	}
+	p = binary.LittleEndian.AppendUint16(p, rdbFunctionVersion)
+	return binary.LittleEndian.AppendUint64(p, crc64.Digest(p))
+}
+
+func functionRestore(args []string) (interface{}, error) {
+	policy := "APPEND"
+	if len(args) == 2 {
+		policy = strings.ToUpper(args[1])
+		if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+			return nil, errFunctionPolicy
+		}
+	}
+	p := []byte(args[0])
+	if len(p) < 10 {
+		return nil, errFunctionPayload
+	}
+	body, footer := p[:len(p)-10], p[len(p)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbMaxVersion ||
+		binary.LittleEndian.Uint64(footer[2:]) != crc64.Digest(p[:len(p)-8]) {
+		return nil, errFunctionPayload
+	}
+	var libs []*functionLibrary
+	for len(body) > 0 {
+		if body[0] != rdbOpcodeFunction2 {
+			return nil, errFunctionPayload
+		}
+		code, n, err := readRDBString(body[1:])
+		if err != nil {
+			return nil, errFunctionPayload
+		}
+		body = body[1+n:]
+		lib, err := loadLibrary(code)
+		if err != nil {
+			return nil, err
+		}
+		libs = append(libs, lib)
+	}
+
+	// check every library before the table is changed
+	staged := &functionTable{
+		libs:  make(map[string]*functionLibrary),
+		funcs: make(map[string]*functionLibrary),
+	}
+	if policy != "FLUSH" {
+		for _, lib := range functions.libs {
+			staged.add(lib, false)
+		}
+	}
+	for _, lib := range libs {
+		if err := staged.add(lib, policy == "REPLACE"); err != nil {
+			return nil, err
+		}
+	}
+	*functions = *staged
+	return redcon.SimpleString("OK"), nil
+}
+
+// appendRDBString appends s as a raw RDB string.
+func appendRDBString(p []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 1<<6:
+		p = append(p, byte(n))
+	case n < 1<<14:
+		p = append(p, 0x40|byte(n>>8), byte(n))
+	case uint64(n) <= 0xffffffff:
+		p = append(p, 0x80)
+		p = binary.BigEndian.AppendUint32(p, uint32(n))
+	default:
+		p = append(p, 0x81)
+		p = binary.BigEndian.AppendUint64(p, uint64(n))
+	}
+	return append(p, s...)
+}
+
+// readRDBString reads an RDB string, raw, integer or LZF encoded, and returns
+// it with the number of bytes read.
+func readRDBString(p []byte) (string, int, error) {
+	errTrunc := errors.New("truncated string")
+	if len(p) == 0 {
+		return "", 0, errTrunc
+	}
+	readLen := func(p []byte) (uint64, int, bool) {
+		switch {
+		case p[0]>>6 == 0:
+			return uint64(p[0] & 0x3f), 1, true
+		case p[0]>>6 == 1 && len(p) >= 2:
+			return uint64(p[0]&0x3f)<<8 | uint64(p[1]), 2, true
+		case p[0] == 0x80 && len(p) >= 5:
+			return uint64(binary.BigEndian.Uint32(p[1:])), 5, true
+		case p[0] == 0x81 && len(p) >= 9:
+			return binary.BigEndian.Uint64(p[1:]), 9, true
+		}
+		return 0, 0, false
+	}
+	switch p[0] {
+	case 0xc0, 0xc1, 0xc2:
+		size := 1 << (p[0] - 0xc0)
+		if len(p) < 1+size {
+			return "", 0, errTrunc
+		}
+		var v int64
+		switch size {
+		case 1:
+			v = int64(int8(p[1]))
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p[1:])))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p[1:])))
+		}
+		return fmt.Sprint(v), 1 + size, nil
+	case 0xc3:
+		clen, n1, ok := readLen(p[1:])
+		if !ok {
+			return "", 0, errTrunc
+		}
+		ulen, n2, ok := readLen(p[1+n1:])
+		if !ok {
+			return "", 0, errTrunc
+		}
+		start := 1 + n1 + n2
+		if uint64(len(p)-start) < clen {
+			return "", 0, errTrunc
+		}
+		s, err := lzfDecompress(p[start:start+int(clen)], int(ulen))
+		return string(s), start + int(clen), err
+	}
+	n, sz, ok := readLen(p)
+	if !ok || uint64(len(p)-sz) < n {
+		return "", 0, errTrunc
+	}
+	return string(p[sz : sz+int(n)]), sz + int(n), nil
+}
+
+// lzfDecompress decompresses the LZF data of the compressed RDB strings.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	errLZF := errors.New("invalid LZF data")
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// literal run of ctrl+1 bytes
+			if i+ctrl+1 > len(in) {
+				return nil, errLZF
+			}
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errLZF
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errLZF
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errLZF
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != size {
+		return nil, errLZF
+	}
+	return out, nil
+}
+
+// cmdFCALL calls a function of a library. Like EVAL the call is a single
+// write entry.
+// Syntax: FCALL function numkeys [key [key ...]] [arg [arg ...]]
+func cmdFCALL(m uhaha.Machine, args []string) (interface{}, error) {
+	return fcall(m, args, false)
+}
+
+// cmdFCALLRO calls a function registered with the no-writes flag.
+// Syntax: FCALL_RO function numkeys [key [key ...]] [arg [arg ...]]
+func cmdFCALLRO(m uhaha.Machine, args []string) (interface{}, error) {
+	return fcall(m, args, true)
+}
+
+func fcall(m uhaha.Machine, args []string, readOnly bool) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	lib := functions.funcs[args[1]]
+	if lib == nil {
+		return nil, errNoFunction
+	}
+	f := lib.functions[args[1]]
+	if readOnly && !f.noWrites {
+		return nil, errFunctionWriteRO
+	}
+	keys, argv, err := scriptKeysArgs(args[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	// the functions can not write in a read command, and the ones with
+	// the no-writes flag never write
+	L := newScriptState(m, newScriptACL(m, keys, readOnly), readOnly || f.noWrites)
+	defer L.Close()
+	// the code of the library and the function share the budget of the call
+	limitSteps(L)
+	registered, err := runLibrary(L, lib.code)
+	if err != nil {
+		return nil, err
+	}
+	L.Push(registered[f.name].callback)
+	L.Push(scriptStrings(L, keys))
+	L.Push(scriptStrings(L, argv))
+	if err := L.PCall(2, 1, nil); err != nil {
+		return nil, scriptError(L, err, f.name)
+	}
+	return luaToReply(L.Get(-1))
+}
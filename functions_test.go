@@ -0,0 +1,240 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const testLibrary = `#!lua name=mylib
+local function set(keys, args)
+	return redis.call('set', keys[1], args[1])
+end
+redis.register_function('fn_set', set)
+redis.register_function{
+	function_name = 'fn_get',
+	callback = function(keys, args) return redis.call('get', keys[1]) end,
+	flags = {'no-writes'},
+	description = 'reads a key',
+}
+redis.register_function{
+	function_name = 'fn_sneaky',
+	callback = function(keys, args) return redis.call('set', keys[1], 'x') end,
+	flags = {'no-writes'},
+}`
+
+func TestFunction(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.FunctionFlush(ctx)
+	defer c.FunctionFlush(ctx)
+
+	if v, err := c.FunctionLoad(ctx, testLibrary).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "mylib" {
+		t.Fatal(v)
+	}
+	if err := c.FunctionLoad(ctx, testLibrary).Err(); err == nil || err.Error() != "ERR Library 'mylib' already exists" {
+		t.Fatal(err)
+	}
+	if err := c.FunctionLoadReplace(ctx, testLibrary).Err(); err != nil {
+		t.Fatal(err)
+	}
+	other := "#!lua name=other\nredis.register_function('fn_set', function() return 1 end)"
+	if err := c.FunctionLoad(ctx, other).Err(); err == nil || err.Error() != "ERR Function fn_set already exists" {
+		t.Fatal(err)
+	}
+
+	if v, err := c.FCall(ctx, "fn_set", []string{"fn_k"}, "v").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "OK" {
+		t.Fatal(v)
+	}
+	if v, err := c.FCallRO(ctx, "fn_get", []string{"fn_k"}).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+	if err := c.FCallRO(ctx, "fn_set", []string{"fn_k"}, "w").Err(); err == nil || err.Error() != errFunctionWriteRO.Error() {
+		t.Fatal(err)
+	}
+	// a no-writes function can not write, even with FCALL
+	if err := c.FCall(ctx, "fn_sneaky", []string{"fn_k"}).Err(); err == nil || err.Error() != errScriptReadOnly.Error() {
+		t.Fatal(err)
+	}
+	if err := c.FCall(ctx, "nosuch", nil).Err(); err == nil || err.Error() != errNoFunction.Error() {
+		t.Fatal(err)
+	}
+
+	libs, err := c.FunctionList(ctx, redis.FunctionListQuery{WithCode: true}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(libs) != 1 || libs[0].Name != "mylib" || libs[0].Engine != "LUA" || libs[0].Code != testLibrary {
+		t.Fatal(libs)
+	}
+	var names []string
+	for _, f := range libs[0].Functions {
+		names = append(names, f.Name)
+		if f.Name == "fn_get" && (f.Description != "reads a key" || !reflect.DeepEqual(f.Flags, []string{"no-writes"})) {
+			t.Fatal(f)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"fn_get", "fn_set", "fn_sneaky"}) {
+		t.Fatal(names)
+	}
+	if libs, err := c.FunctionList(ctx, redis.FunctionListQuery{LibraryNamePattern: "x*"}).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(libs) != 0 {
+		t.Fatal(libs)
+	}
+
+	if err := c.FunctionDelete(ctx, "mylib").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FunctionDelete(ctx, "mylib").Err(); err == nil || err.Error() != errNoLibrary.Error() {
+		t.Fatal(err)
+	}
+	if err := c.FCall(ctx, "fn_set", []string{"fn_k"}, "v").Err(); err == nil || err.Error() != errNoFunction.Error() {
+		t.Fatal(err)
+	}
+}
+
+func TestFunctionLoadErrors(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		code, err string
+	}{
+		{"return 1", errLibraryMetadata.Error()},
+		{"#!js name=lib\n", "ERR Engine 'js' not found"},
+		{"#!lua\n", "ERR Library name was not given"},
+		{"#!lua name=lib foo=bar\n", "ERR Invalid metadata value given: foo=bar"},
+		{"#!lua name=l-b\n", errLibraryName.Error()},
+		{"#!lua name=lib\nlocal x = 1", errNoFunctions.Error()},
+		{"#!lua name=lib\nredis.register_function('a-b', function() end)", errFunctionName.Error()},
+		{"#!lua name=lib\nredis.register_function{function_name='a', callback=function() end, flags={'bad'}}", errFunctionFlag.Error()},
+		{"#!lua name=lib\nredis.register_function('a', function() end) redis.register_function('a', function() end)", errFunctionExists.Error()},
+		{"#!lua name=lib\nredis.register_function('a', function() end) while true do end", errScriptSteps.Error()},
+	} {
+		if err := c.FunctionLoad(ctx, tc.code).Err(); err == nil || err.Error() != tc.err {
+			t.Fatalf("%q: %v", tc.code, err)
+		}
+	}
+	// redis.call can not run while the library loads
+	if err := c.FunctionLoad(ctx, "#!lua name=lib\nredis.call('set', 'a', 'b')").Err(); err == nil {
+		t.Fatal("loaded")
+	}
+	if err := c.FunctionLoad(ctx, "#!lua name=lib\nthis is not lua").Err(); err == nil || !strings.HasPrefix(err.Error(), "ERR Error compiling function") {
+		t.Fatal(err)
+	}
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.FunctionFlush(ctx)
+	defer c.FunctionFlush(ctx)
+
+	c.FunctionLoad(ctx, testLibrary)
+	payload, err := c.FunctionDump(ctx).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FunctionRestore(ctx, payload).Err(); err == nil || err.Error() != "ERR Library 'mylib' already exists" {
+		t.Fatal(err)
+	}
+	if err := c.Do(ctx, "function", "restore", payload, "replace").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Do(ctx, "function", "restore", payload, "nosuch").Err(); err == nil || err.Error() != errFunctionPolicy.Error() {
+		t.Fatal(err)
+	}
+	bad := []byte(payload)
+	bad[len(bad)-1] ^= 0xff
+	if err := c.FunctionRestore(ctx, string(bad)).Err(); err == nil || err.Error() != errFunctionPayload.Error() {
+		t.Fatal(err)
+	}
+
+	c.FunctionFlush(ctx)
+	c.FunctionLoad(ctx, "#!lua name=keep\nredis.register_function('fn_keep', function() return 1 end)")
+	if err := c.Do(ctx, "function", "restore", payload, "flush").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FCall(ctx, "fn_keep", nil).Err(); err == nil {
+		t.Fatal("FLUSH kept the library")
+	}
+	if v, err := c.FCall(ctx, "fn_set", []string{"fn_k2"}, "v").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "OK" {
+		t.Fatal(v)
+	}
+
+	// LZF compressed strings of Redis payloads
+	code := "#!lua name=lzf\nredis.register_function('fn_lzf', function() return 'aaaaaaaaaaaaaaaa' end)"
+	if s, err := lzfDecompress([]byte{2, 'a', 'b', 'c', 0xe0, 3, 2}, 15); err != nil || s == nil || string(s) != "abcabcabcabcabc" {
+		t.Fatal(string(s), err)
+	}
+	if s, n, err := readRDBString(appendRDBString(nil, code)); err != nil || s != code || n != len(code)+2 {
+		t.Fatal(s, n, err)
+	}
+}
+
+func TestFunctionSnapshot(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.FunctionFlush(ctx)
+	defer c.FunctionFlush(ctx)
+
+	c.FunctionLoad(ctx, testLibrary)
+	data := functions.save()
+	c.FunctionFlush(ctx)
+	if err := functions.load(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.FCallRO(ctx, "fn_get", []string{"fn_none"}).Result(); err != redis.Nil {
+		t.Fatal(v, err)
+	}
+	if err := functions.load(data[:len(data)-1]); err == nil {
+		t.Fatal("loaded a truncated section")
+	}
+	functions.load(nil)
+	if len(functions.libs) != 0 || len(functions.funcs) != 0 {
+		t.Fatal(functions.libs)
+	}
+}
+
+func TestFunctionStepLimit(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.FunctionFlush(ctx)
+	defer c.FunctionFlush(ctx)
+
+	code := "#!lua name=loop\nredis.register_function('fn_loop', function() while true do end end)"
+	if err := c.FunctionLoad(ctx, code).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FCall(ctx, "fn_loop", nil).Err(); err == nil || err.Error() != errScriptSteps.Error() {
+		t.Fatal(err)
+	}
+
+	// a payload with a library that loops while it loads is refused
+	code = "#!lua name=slow\nredis.register_function('fn_slow', function() end) while true do end"
+	functions.add(&functionLibrary{name: "slow", code: code,
+		functions: map[string]*luaFunction{"fn_slow": {name: "fn_slow"}}}, false)
+	payload := string(functionDump())
+	c.FunctionFlush(ctx)
+	if err := c.FunctionRestore(ctx, payload).Err(); err == nil || err.Error() != errScriptSteps.Error() {
+		t.Fatal(err)
+	}
+	if v, err := c.FunctionList(ctx, redis.FunctionListQuery{}).Result(); err != nil || len(v) != 0 {
+		t.Fatal(v, err)
+	}
+}
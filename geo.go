@@ -0,0 +1,739 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddWriteCommand("GEOADD", cmdGEOADD)
+	conf.AddWriteCommand("GEOSEARCHSTORE", cmdGEOSEARCHSTORE)
+
+	conf.AddReadCommand("GEODIST", cmdGEODIST)
+	conf.AddReadCommand("GEOHASH", cmdGEOHASH)
+	conf.AddReadCommand("GEOPOS", cmdGEOPOS)
+	conf.AddReadCommand("GEOSEARCH", cmdGEOSEARCH)
+}
+
+// The geo commands store the members in a zset, scored with the 52 bit
+// geohash of their position like Redis, so that the boxes of a search are
+// ranges of scores.
+const (
+	geoStepMax   = 26
+	geoLatMin    = -85.05112878
+	geoLatMax    = 85.05112878
+	geoLongMin   = -180.0
+	geoLongMax   = 180.0
+	mercatorMax  = 20037726.37
+	earthRadiusM = 6372797.560856
+)
+
+var (
+	errGeoUnit        = errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+	errGeoMember      = errors.New("ERR could not decode requested zset member")
+	errGeoAddSyntax   = errors.New("ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+	errGeoNotFloat    = errors.New("ERR value is not a valid float")
+	errGeoStoreWith   = errors.New("ERR STORE option in GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	errGeoStoreDist   = errors.New("ERR STOREDIST is not supported, the scores of the sorted sets are integers")
+	errGeoNXXX        = errors.New("ERR XX and NX options at the same time are not compatible")
+	errGeoFrom        = errors.New("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	errGeoBy          = errors.New("ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+	errGeoAnyCount    = errors.New("ERR the ANY argument requires COUNT argument")
+	errGeoCount       = errors.New("ERR COUNT must be > 0")
+	errGeoRadius      = errors.New("ERR radius cannot be negative")
+	errGeoBoxNegative = errors.New("ERR height or width cannot be negative")
+)
+
+// geoHash is a geohash of step bits per coordinate, the latitude bits in the
+// even positions and the longitude ones in the odd positions.
+type geoHash struct {
+	bits uint64
+	step uint
+}
+
+// geoArea is the box of a geohash.
+type geoArea struct {
+	minLon, maxLon, minLat, maxLat float64
+}
+
+func interleave64(x, y uint32) uint64 {
+	var r uint64
+	for i := 0; i < 32; i++ {
+		r |= uint64(x>>i&1)<<(2*i) | uint64(y>>i&1)<<(2*i+1)
+	}
+	return r
+}
+
+func deinterleave64(v uint64) (x, y uint32) {
+	for i := 0; i < 32; i++ {
+		x |= uint32(v>>(2*i)&1) << i
+		y |= uint32(v>>(2*i+1)&1) << i
+	}
+	return x, y
+}
+
+// geohashEncode encodes the position in the latitude range, false if it is
+// out of the supported coordinates.
+func geohashEncode(lon, lat, minLat, maxLat float64, step uint) (geoHash, bool) {
+	if lon > geoLongMax || lon < geoLongMin || lat > geoLatMax || lat < geoLatMin ||
+		lat < minLat || lat > maxLat {
+		return geoHash{}, false
+	}
+	latOffset := (lat - minLat) / (maxLat - minLat) * float64(uint64(1)<<step)
+	lonOffset := (lon - geoLongMin) / (geoLongMax - geoLongMin) * float64(uint64(1)<<step)
+	return geoHash{interleave64(uint32(latOffset), uint32(lonOffset)), step}, true
+}
+
+func geohashEncodeWGS84(lon, lat float64, step uint) (geoHash, bool) {
+	return geohashEncode(lon, lat, geoLatMin, geoLatMax, step)
+}
+
+func geohashDecode(h geoHash) geoArea {
+	lat, lon := deinterleave64(h.bits)
+	scale := float64(uint64(1) << h.step)
+	return geoArea{
+		minLon: geoLongMin + float64(lon)/scale*(geoLongMax-geoLongMin),
+		maxLon: geoLongMin + float64(lon+1)/scale*(geoLongMax-geoLongMin),
+		minLat: geoLatMin + float64(lat)/scale*(geoLatMax-geoLatMin),
+		maxLat: geoLatMin + float64(lat+1)/scale*(geoLatMax-geoLatMin),
+	}
+}
+
+// geoDecodeScore returns the longitude and latitude of a zset score, the
+// center of its geohash box.
+func geoDecodeScore(score int64) (lon, lat float64) {
+	a := geohashDecode(geoHash{uint64(score), geoStepMax})
+	lon = math.Max(geoLongMin, math.Min(geoLongMax, (a.minLon+a.maxLon)/2))
+	lat = math.Max(geoLatMin, math.Min(geoLatMax, (a.minLat+a.maxLat)/2))
+	return lon, lat
+}
+
+// geohashMove moves the hash by d boxes along the longitude when x is true,
+// along the latitude otherwise.
+func geohashMove(h geoHash, d int, x bool) geoHash {
+	const odd, even = 0xaaaaaaaaaaaaaaaa, 0x5555555555555555
+	moved, kept, zzMask := h.bits&even, h.bits&odd, uint64(odd)
+	if x {
+		moved, kept, zzMask = h.bits&odd, h.bits&even, even
+	}
+	zz := zzMask >> (64 - h.step*2)
+	if d > 0 {
+		moved += zz + 1
+	} else {
+		moved = (moved | zz) - (zz + 1)
+	}
+	moved &= (^zzMask) >> (64 - h.step*2)
+	return geoHash{moved | kept, h.step}
+}
+
+func degRad(ang float64) float64 { return ang * math.Pi / 180 }
+func radDeg(ang float64) float64 { return ang / (math.Pi / 180) }
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadiusM * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance returns the haversine distance in meters of two positions.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	v := math.Sin((degRad(lon2) - degRad(lon1)) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+// geoShape is the area of a search: a circle of radius, or a box of width
+// and height, in unit around lon, lat.
+type geoShape struct {
+	lon, lat      float64
+	box           bool
+	radius        float64
+	width, height float64
+	conversion    float64 // meters per unit
+}
+
+// contains returns the distance of the position from the center, false if
+// it is out of the shape.
+func (s *geoShape) contains(lon, lat float64) (float64, bool) {
+	if !s.box {
+		d := geoDistance(s.lon, s.lat, lon, lat)
+		return d, d <= s.radius*s.conversion
+	}
+	if geoLatDistance(lat, s.lat) > s.height*s.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(lon, lat, s.lon, lat) > s.width*s.conversion/2 {
+		return 0, false
+	}
+	return geoDistance(s.lon, s.lat, lon, lat), true
+}
+
+// boundingBox returns the min and max longitudes and latitudes of the shape.
+func (s *geoShape) boundingBox() (minLon, minLat, maxLon, maxLat float64) {
+	height, width := s.radius, s.radius
+	if s.box {
+		height, width = s.height/2, s.width/2
+	}
+	height *= s.conversion
+	width *= s.conversion
+	latDelta := radDeg(height / earthRadiusM)
+	lonDeltaTop := radDeg(width / earthRadiusM / math.Cos(degRad(s.lat+latDelta)))
+	lonDeltaBottom := radDeg(width / earthRadiusM / math.Cos(degRad(s.lat-latDelta)))
+	// the hemispheres are opposite, the widest side gives the bounds
+	lonDelta := lonDeltaTop
+	if s.lat < 0 {
+		lonDelta = lonDeltaBottom
+	}
+	return s.lon - lonDelta, s.lat - latDelta, s.lon + lonDelta, s.lat + latDelta
+}
+
+// geoEstimateSteps returns the geohash precision whose boxes are large
+// enough for a search of rangeMeters at lat.
+func geoEstimateSteps(rangeMeters, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2
+	// wider range towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > geoStepMax {
+		step = geoStepMax
+	}
+	return uint(step)
+}
+
+// searchBoxes returns the geohash boxes covering the shape, like the Redis
+// geohashCalculateAreasByShapeWGS84: the box of the center and its eight
+// neighbors, without the ones out of the bounding box.
+func (s *geoShape) searchBoxes() []geoHash {
+	minLon, minLat, maxLon, maxLat := s.boundingBox()
+	radius := s.radius
+	if s.box {
+		radius = math.Sqrt((s.width/2)*(s.width/2) + (s.height/2)*(s.height/2))
+	}
+	steps := geoEstimateSteps(radius*s.conversion, s.lat)
+
+	var hash geoHash
+	var boxes [9]geoHash
+	neighbors := func() {
+		hash, _ = geohashEncodeWGS84(s.lon, s.lat, steps)
+		boxes = [9]geoHash{
+			hash,
+			geohashMove(hash, 1, false),  // north
+			geohashMove(hash, -1, false), // south
+			geohashMove(hash, 1, true),   // east
+			geohashMove(hash, -1, true),  // west
+			geohashMove(geohashMove(hash, 1, true), 1, false),   // north east
+			geohashMove(geohashMove(hash, -1, true), 1, false),  // north west
+			geohashMove(geohashMove(hash, 1, true), -1, false),  // south east
+			geohashMove(geohashMove(hash, -1, true), -1, false), // south west
+		}
+	}
+	neighbors()
+	// the step may be too large when the shape is near an edge of the box
+	if steps > 1 && (geohashDecode(boxes[1]).maxLat < maxLat ||
+		geohashDecode(boxes[2]).minLat > minLat ||
+		geohashDecode(boxes[3]).maxLon < maxLon ||
+		geohashDecode(boxes[4]).minLon > minLon) {
+		steps--
+		neighbors()
+	}
+
+	skip := make([]bool, 9)
+	if steps >= 2 {
+		area := geohashDecode(hash)
+		if area.minLat < minLat {
+			skip[2], skip[7], skip[8] = true, true, true
+		}
+		if area.maxLat > maxLat {
+			skip[1], skip[5], skip[6] = true, true, true
+		}
+		if area.minLon < minLon {
+			skip[4], skip[6], skip[8] = true, true, true
+		}
+		if area.maxLon > maxLon {
+			skip[3], skip[5], skip[7] = true, true, true
+		}
+	}
+	var ret []geoHash
+	for i, box := range boxes {
+		// with a huge radius adjacent neighbors can be the same box
+		if skip[i] || (len(ret) > 0 && ret[len(ret)-1] == box) {
+			continue
+		}
+		ret = append(ret, box)
+	}
+	return ret
+}
+
+// geoPoint is a member found by a search.
+type geoPoint struct {
+	member   []byte
+	score    int64
+	lon, lat float64
+	dist     float64
+}
+
+// geoSearch returns the members of key in the shape, in the order of the
+// boxes. It stops once limit members are found if limit is not 0.
+func geoSearch(key []byte, s *geoShape, limit int) ([]geoPoint, error) {
+	var points []geoPoint
+	for _, box := range s.searchBoxes() {
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		shift := 52 - box.step*2
+		min, max := int64(box.bits<<shift), int64((box.bits+1)<<shift)
+		pairs, err := ldb.ZRangeByScore(key, min, max-1, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			lon, lat := geoDecodeScore(pair.Score)
+			if dist, ok := s.contains(lon, lat); ok {
+				points = append(points, geoPoint{pair.Member, pair.Score, lon, lat, dist})
+				if limit > 0 && len(points) >= limit {
+					break
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+// geoParseUnit returns the meters per unit.
+func geoParseUnit(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, errGeoUnit
+}
+
+func geoParseFloat(arg string) (float64, error) {
+	f, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errGeoNotFloat
+	}
+	return f, nil
+}
+
+// geoParseLonLat parses a longitude and a latitude and returns their score.
+func geoParseLonLat(lonArg, latArg string) (lon, lat float64, score int64, err error) {
+	if lon, err = geoParseFloat(lonArg); err != nil {
+		return
+	}
+	if lat, err = geoParseFloat(latArg); err != nil {
+		return
+	}
+	h, ok := geohashEncodeWGS84(lon, lat, geoStepMax)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("ERR invalid longitude,latitude pair %f,%f", lon, lat)
+	}
+	return lon, lat, int64(h.bits), nil
+}
+
+// geoFormatCoord formats a coordinate like the Redis human long doubles.
+func geoFormatCoord(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func geoFormatDist(d float64) string {
+	return strconv.FormatFloat(d, 'f', 4, 64)
+}
+
+// geoScore returns the score of member, false if it does not exist.
+func geoScore(key, member []byte) (int64, bool, error) {
+	score, err := ldb.ZScore(key, member)
+	if err == ledis.ErrScoreMiss {
+		return 0, false, nil
+	}
+	return score, err == nil, err
+}
+
+// cmdGEOADD adds the members at their positions in the zset at key.
+// Syntax: GEOADD key [NX | XX] [CH] longitude latitude member
+// [longitude latitude member ...]
+func cmdGEOADD(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	var nx, xx, ch bool
+	i := 2
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+			continue
+		case "XX":
+			xx = true
+			continue
+		case "CH":
+			ch = true
+			continue
+		}
+		break
+	}
+	if nx && xx {
+		return nil, errGeoNXXX
+	}
+	if len(args)-i == 0 || (len(args)-i)%3 != 0 {
+		return nil, errGeoAddSyntax
+	}
+	key := []byte(args[1])
+	pairs := make([]ledis.ScorePair, 0, (len(args)-i)/3)
+	for ; i < len(args); i += 3 {
+		_, _, score, err := geoParseLonLat(args[i], args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, ledis.ScorePair{Score: score, Member: []byte(args[i+2])})
+	}
+
+	var n int64
+	added := make([]ledis.ScorePair, 0, len(pairs))
+	for _, pair := range pairs {
+		old, ok, err := geoScore(key, pair.Member)
+		if err != nil {
+			return nil, err
+		}
+		if (nx && ok) || (xx && !ok) {
+			continue
+		}
+		if !ok || (ch && old != pair.Score) {
+			n++
+		}
+		added = append(added, pair)
+	}
+	if len(added) > 0 {
+		if _, err := ldb.ZAdd(key, added...); err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// cmdGEODIST returns the distance of two members.
+// Syntax: GEODIST key member1 member2 [M | KM | FT | MI]
+func cmdGEODIST(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 4 && len(args) != 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	conversion := 1.0
+	if len(args) == 5 {
+		var err error
+		if conversion, err = geoParseUnit(args[4]); err != nil {
+			return nil, err
+		}
+	}
+	key := []byte(args[1])
+	score1, ok1, err := geoScore(key, []byte(args[2]))
+	if err != nil {
+		return nil, err
+	}
+	score2, ok2, err := geoScore(key, []byte(args[3]))
+	if err != nil || !ok1 || !ok2 {
+		return nil, err
+	}
+	lon1, lat1 := geoDecodeScore(score1)
+	lon2, lat2 := geoDecodeScore(score2)
+	return geoFormatDist(geoDistance(lon1, lat1, lon2, lat2) / conversion), nil
+}
+
+// cmdGEOHASH returns the standard 11 characters geohash of the members.
+// Syntax: GEOHASH key [member [member ...]]
+func cmdGEOHASH(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	key := []byte(args[1])
+	ret := make([]interface{}, len(args)-2)
+	for i, member := range args[2:] {
+		score, ok, err := geoScore(key, []byte(member))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		// the standard geohash covers the latitudes from -90 to 90
+		lon, lat := geoDecodeScore(score)
+		h, _ := geohashEncode(lon, lat, -90, 90, geoStepMax)
+		buf := make([]byte, 11)
+		for j := range buf {
+			// 52 bits make 10 characters, the last one is always 0
+			var idx uint64
+			if j < 10 {
+				idx = h.bits >> (52 - (j+1)*5) & 0x1f
+			}
+			buf[j] = alphabet[idx]
+		}
+		ret[i] = string(buf)
+	}
+	return ret, nil
+}
+
+// cmdGEOPOS returns the longitude and latitude of the members.
+// Syntax: GEOPOS key [member [member ...]]
+func cmdGEOPOS(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	ret := make([]interface{}, len(args)-2)
+	for i, member := range args[2:] {
+		score, ok, err := geoScore(key, []byte(member))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lon, lat := geoDecodeScore(score)
+			ret[i] = []interface{}{geoFormatCoord(lon), geoFormatCoord(lat)}
+		}
+	}
+	return ret, nil
+}
+
+// geoSearchOptions holds the parsed options of GEOSEARCH and
+// GEOSEARCHSTORE.
+type geoSearchOptions struct {
+	shape     geoShape
+	member    []byte // FROMMEMBER
+	sort      int    // 0 unsorted, 1 ascending, -1 descending
+	count     int
+	any       bool
+	withCoord bool
+	withDist  bool
+	withHash  bool
+}
+
+// geoParseSearch parses the options of GEOSEARCH on key.
+// Syntax: FROMMEMBER member | FROMLONLAT longitude latitude
+// BYRADIUS radius M | KM | FT | MI | BYBOX width height M | KM | FT | MI
+// [ASC | DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func geoParseSearch(args []string, store bool) (opts geoSearchOptions, err error) {
+	var from, by int
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch arg := strings.ToUpper(args[i]); {
+		case arg == "FROMMEMBER" && left >= 1:
+			opts.member = []byte(args[i+1])
+			from++
+			i++
+		case arg == "FROMLONLAT" && left >= 2:
+			if opts.shape.lon, opts.shape.lat, _, err = geoParseLonLat(args[i+1], args[i+2]); err != nil {
+				return opts, err
+			}
+			from++
+			i += 2
+		case arg == "BYRADIUS" && left >= 2:
+			if opts.shape.radius, err = geoParseFloat(args[i+1]); err != nil {
+				return opts, err
+			}
+			if opts.shape.radius < 0 {
+				return opts, errGeoRadius
+			}
+			if opts.shape.conversion, err = geoParseUnit(args[i+2]); err != nil {
+				return opts, err
+			}
+			by++
+			i += 2
+		case arg == "BYBOX" && left >= 3:
+			opts.shape.box = true
+			if opts.shape.width, err = geoParseFloat(args[i+1]); err != nil {
+				return opts, err
+			}
+			if opts.shape.height, err = geoParseFloat(args[i+2]); err != nil {
+				return opts, err
+			}
+			if opts.shape.width < 0 || opts.shape.height < 0 {
+				return opts, errGeoBoxNegative
+			}
+			if opts.shape.conversion, err = geoParseUnit(args[i+3]); err != nil {
+				return opts, err
+			}
+			by++
+			i += 3
+		case arg == "ASC":
+			opts.sort = 1
+		case arg == "DESC":
+			opts.sort = -1
+		case arg == "COUNT" && left >= 1:
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return opts, errors.New("ERR value is not an integer or out of range")
+			}
+			if n <= 0 {
+				return opts, errGeoCount
+			}
+			opts.count = n
+			i++
+			if i+1 < len(args) && strings.EqualFold(args[i+1], "ANY") {
+				opts.any = true
+				i++
+			}
+		case arg == "ANY":
+			return opts, errGeoAnyCount
+		case arg == "WITHCOORD" && !store:
+			opts.withCoord = true
+		case arg == "WITHDIST" && !store:
+			opts.withDist = true
+		case arg == "WITHHASH" && !store:
+			opts.withHash = true
+		case store && (arg == "WITHCOORD" || arg == "WITHDIST" || arg == "WITHHASH"):
+			return opts, errGeoStoreWith
+		case store && arg == "STOREDIST":
+			return opts, errGeoStoreDist
+		default:
+			return opts, uhaha.ErrSyntax
+		}
+	}
+	if from != 1 {
+		return opts, errGeoFrom
+	}
+	if by != 1 {
+		return opts, errGeoBy
+	}
+	// like Redis a COUNT without ANY returns the nearest members
+	if opts.count > 0 && opts.sort == 0 && !opts.any {
+		opts.sort = 1
+	}
+	return opts, nil
+}
+
+// geoSearchCommand runs the search of GEOSEARCH and GEOSEARCHSTORE on key.
+func geoSearchCommand(key []byte, opts *geoSearchOptions) ([]geoPoint, error) {
+	if opts.member != nil {
+		score, ok, err := geoScore(key, opts.member)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errGeoMember
+		}
+		opts.shape.lon, opts.shape.lat = geoDecodeScore(score)
+	}
+	limit := 0
+	if opts.any {
+		limit = opts.count
+	}
+	points, err := geoSearch(key, &opts.shape, limit)
+	if err != nil {
+		return nil, err
+	}
+	if opts.sort != 0 {
+		sort.SliceStable(points, func(i, j int) bool {
+			if opts.sort > 0 {
+				return points[i].dist < points[j].dist
+			}
+			return points[i].dist > points[j].dist
+		})
+	}
+	if opts.count > 0 && len(points) > opts.count {
+		points = points[:opts.count]
+	}
+	return points, nil
+}
+
+// cmdGEOSEARCH returns the members of key in a circle or a box.
+// Syntax: GEOSEARCH key FROMMEMBER member | FROMLONLAT longitude latitude
+// BYRADIUS radius M | KM | FT | MI | BYBOX width height M | KM | FT | MI
+// [ASC | DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func cmdGEOSEARCH(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 7 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	opts, err := geoParseSearch(args[2:], false)
+	if err != nil {
+		return nil, err
+	}
+	points, err := geoSearchCommand([]byte(args[1]), &opts)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]interface{}, len(points))
+	for i, p := range points {
+		if !opts.withDist && !opts.withHash && !opts.withCoord {
+			ret[i] = p.member
+			continue
+		}
+		item := []interface{}{p.member}
+		if opts.withDist {
+			item = append(item, geoFormatDist(p.dist/opts.shape.conversion))
+		}
+		if opts.withHash {
+			item = append(item, redcon.SimpleInt(p.score))
+		}
+		if opts.withCoord {
+			item = append(item, []interface{}{geoFormatCoord(p.lon), geoFormatCoord(p.lat)})
+		}
+		ret[i] = item
+	}
+	return ret, nil
+}
+
+// cmdGEOSEARCHSTORE stores the members found by a GEOSEARCH on source in
+// destination, with their geohash scores.
+// Syntax: GEOSEARCHSTORE destination source FROMMEMBER member |
+// FROMLONLAT longitude latitude BYRADIUS radius M | KM | FT | MI |
+// BYBOX width height M | KM | FT | MI [ASC | DESC] [COUNT count [ANY]]
+func cmdGEOSEARCHSTORE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 8 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	opts, err := geoParseSearch(args[3:], true)
+	if err != nil {
+		return nil, err
+	}
+	points, err := geoSearchCommand([]byte(args[2]), &opts)
+	if err != nil {
+		return nil, err
+	}
+	dst := []byte(args[1])
+	if err := zdelete(dst); err != nil {
+		return nil, err
+	}
+	if len(points) > 0 {
+		pairs := make([]ledis.ScorePair, len(points))
+		for i, p := range points {
+			pairs[i] = ledis.ScorePair{Score: p.score, Member: p.member}
+		}
+		if _, err := ldb.ZAdd(dst, pairs...); err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleInt(len(points)), nil
+}
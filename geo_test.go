@@ -0,0 +1,157 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestGeo(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if n, err := c.GeoAdd(ctx, "sicily",
+		&redis.GeoLocation{Name: "Palermo", Longitude: 13.361389, Latitude: 38.115556},
+		&redis.GeoLocation{Name: "Catania", Longitude: 15.087269, Latitude: 37.502669},
+	).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	// the score is the 52 bit geohash
+	if v, err := c.Do(ctx, "zscore", "sicily", "Palermo").Int64(); err != nil {
+		t.Fatal(err)
+	} else if v != 3479099956230698 {
+		t.Fatal(v)
+	}
+
+	for _, tc := range []struct {
+		args []interface{}
+		want string
+	}{
+		{[]interface{}{"geodist", "sicily", "Palermo", "Catania"}, "166274.1516"},
+		{[]interface{}{"geodist", "sicily", "Palermo", "Catania", "km"}, "166.2742"},
+		{[]interface{}{"geodist", "sicily", "Palermo", "Catania", "mi"}, "103.3182"},
+		{[]interface{}{"geopos", "sicily", "Palermo", "none"}, "[[13.36138933897018433 38.11555639549629859] <nil>]"},
+		{[]interface{}{"geohash", "sicily", "Palermo", "Catania"}, "[sqc8b49rny0 sqdtr74hyu0]"},
+	} {
+		v, err := c.Do(ctx, tc.args...).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(v); got != tc.want {
+			t.Fatalf("%v: %s, want %s", tc.args, got, tc.want)
+		}
+	}
+	if err := c.Do(ctx, "geodist", "sicily", "Palermo", "none").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+
+	// NX, XX and CH
+	if n, err := c.Do(ctx, "geoadd", "sicily", "nx", "ch", 13, 38, "Palermo").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.Do(ctx, "geoadd", "sicily", "xx", 13, 38, "Palermo", 13, 38, "none").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.Do(ctx, "geoadd", "sicily", "xx", "ch", 13.361389, 38.115556, "Palermo").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.ZCard(ctx, "sicily").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	for _, args := range [][]interface{}{
+		{"geoadd", "sicily", 181, 0, "a"},
+		{"geoadd", "sicily", 0, 86, "a"},
+		{"geoadd", "sicily", 0, 0},
+		{"geoadd", "sicily", "nx", "xx", 0, 0, "a"},
+		{"geodist", "sicily", "Palermo", "Catania", "yd"},
+	} {
+		if err := c.Do(ctx, args...).Err(); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Do(ctx, "geoadd", "geo", 13.361389, 38.115556, "Palermo", 15.087269, 37.502669, "Catania",
+		12.758489, 38.788135, "edge1", 17.241510, 38.788135, "edge2")
+	for _, tc := range []struct {
+		args []interface{}
+		want string
+	}{
+		{[]interface{}{"geosearch", "geo", "fromlonlat", 15, 37, "byradius", 200, "km", "asc"}, "[Catania Palermo]"},
+		{[]interface{}{"geosearch", "geo", "fromlonlat", 15, 37, "byradius", 200, "km", "desc"}, "[Palermo Catania]"},
+		{[]interface{}{"geosearch", "geo", "fromlonlat", 15, 37, "bybox", 400, 400, "km", "asc", "withcoord", "withdist"},
+			"[[Catania 56.4413 [15.08726745843887329 37.50266842333162032]] " +
+				"[Palermo 190.4424 [13.36138933897018433 38.11555639549629859]] " +
+				"[edge2 279.7403 [17.24151045083999634 38.78813451624225195]] " +
+				"[edge1 279.7405 [12.7584877610206604 38.78813451624225195]]]"},
+		{[]interface{}{"geosearch", "geo", "frommember", "Palermo", "byradius", 100, "km", "withhash"}, "[[Palermo 3479099956230698] [edge1 3479273021651468]]"},
+		// COUNT returns the nearest members
+		{[]interface{}{"geosearch", "geo", "fromlonlat", 15, 37, "bybox", 400, 400, "km", "count", 2}, "[Catania Palermo]"},
+		// ANY returns the first members found, in the order of the geohashes
+		{[]interface{}{"geosearch", "geo", "fromlonlat", 15, 37, "bybox", 400, 400, "km", "count", 1, "any"}, "[Palermo]"},
+		{[]interface{}{"geosearch", "none", "fromlonlat", 15, 37, "byradius", 200, "km"}, "[]"},
+	} {
+		v, err := c.Do(ctx, tc.args...).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(v); got != tc.want {
+			t.Fatalf("%v: %s, want %s", tc.args, got, tc.want)
+		}
+	}
+
+	if n, err := c.Do(ctx, "geosearchstore", "geo_store", "geo", "fromlonlat", 15, 37, "bybox", 400, 400, "km", "asc", "count", 3).Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatal(n)
+	}
+	if v, err := c.Do(ctx, "geosearch", "geo_store", "fromlonlat", 15, 37, "bybox", 400, 400, "km", "asc", "withhash").Result(); err != nil {
+		t.Fatal(err)
+	} else if got := fmt.Sprint(v); got != "[[Catania 3479447370796909] [Palermo 3479099956230698] [edge2 3481342659049484]]" {
+		t.Fatal(got)
+	}
+	if n, err := c.Do(ctx, "geosearchstore", "geo_store", "geo", "fromlonlat", 0, 0, "byradius", 1, "m").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.Exists(ctx, "geo_store").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	for _, args := range [][]interface{}{
+		{"geosearch", "geo", "byradius", 200, "km", "asc"},
+		{"geosearch", "geo", "fromlonlat", 15, 37, "frommember", "Palermo", "byradius", 200, "km"},
+		{"geosearch", "geo", "fromlonlat", 15, 37, "byradius", 200, "km", "bybox", 1, 1, "km"},
+		{"geosearch", "geo", "fromlonlat", 15, 37, "byradius", -1, "km"},
+		{"geosearch", "geo", "fromlonlat", 15, 37, "byradius", 200, "km", "any"},
+		{"geosearch", "geo", "fromlonlat", 15, 37, "byradius", 200, "km", "count", 0},
+		{"geosearch", "geo", "frommember", "none", "byradius", 200, "km"},
+		{"geosearchstore", "geo_store", "geo", "fromlonlat", 15, 37, "byradius", 200, "km", "withdist"},
+	} {
+		if err := c.Do(ctx, args...).Err(); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
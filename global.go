@@ -6,8 +6,6 @@ import (
 	lediscfg "github.com/ledisdb/ledisdb/config"
 
 	"github.com/ledisdb/ledisdb/ledis"
-	"github.com/syndtr/goleveldb/leveldb"
-	rafthub "github.com/tidwall/uhaha"
 )
 
 // BuildDate: Binary file compilation time
@@ -18,7 +16,6 @@ var (
 )
 
 var (
-	db            *leveldb.DB
 	le            *ledis.Ledis
 	ldb           *ledis.DB
 	ldsCfg        *lediscfg.Config
@@ -26,7 +23,7 @@ var (
 	respClientNum int64
 )
 
-var conf rafthub.Config // raft config
+var conf config // raft config
 
 var banner string
 
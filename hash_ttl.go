@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/ledisdb/ledisdb/store"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddWriteCommand("HPEXPIRE", cmdHPEXPIRE)
+	conf.AddWriteCommand("HPEXPIREAT", cmdHPEXPIREAT)
+	conf.AddWriteCommand("HPERSIST", cmdHPERSIST)
+	conf.AddReadCommand("HPTTL", cmdHPTTL)
+	conf.AddReadCommand("HEXPIRETIME", cmdHEXPIRETIME)
+	conf.AddReadCommand("HPEXPIRETIME", cmdHPEXPIRETIME)
+	conf.AddWriteCommand("HEXPIRED", cmdHEXPIRED)
+}
+
+// Hash fields can expire on their own, like in Redis 7.4. The expire time of
+// a field is kept next to the ledis hash, with a time index for the reaper:
+//
+//	db|hashFieldExpireType|keylen|key|field -> unix time in ms
+//	db|hashFieldTimeType|ms|keylen|key|field -> nil
+//
+// The field commands take a FIELDS argument: HEXPIRE key seconds FIELDS 1 f.
+// Without it, HEXPIRE, HEXPIREAT, HTTL and HPERSIST keep their IceFireDB
+// meaning and apply to the whole key, like EXPIRE, EXPIREAT, TTL and PERSIST.
+//
+// HSET, HMSET, HSETNX, HDEL and HGETDEL drop the expire time of the fields
+// they write, HINCRBY and HINCRBYFLOAT keep it. Expired fields are removed by
+// the expire reaper with a HEXPIRED entry, see runExpireReaper. Until then
+// the commands find them missing, like the expired keys, see expireIfNeeded.
+const (
+	hashFieldExpireType byte = 35
+	hashFieldTimeType   byte = 36
+)
+
+// hFieldMaxExpire is the largest expire time of a field, in milliseconds.
+const hFieldMaxExpire = 1<<48 - 1
+
+func hFieldExpireKey(key, field []byte) []byte {
+	return streamKey(hashFieldExpireType, key, field)
+}
+
+func hFieldTimeKey(key, field []byte, ms int64) []byte {
+	b := append(streamDBPrefix(), hashFieldTimeType)
+	b = binary.BigEndian.AppendUint64(b, uint64(ms))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(key)))
+	return append(append(b, key...), field...)
+}
+
+// hFieldPExpireAt returns the expire time of the hash field as a unix time in
+// milliseconds, -1 if it has none.
+func hFieldPExpireAt(key, field []byte) (int64, error) {
+	v, err := ldb.GetSDB().Get(hFieldExpireKey(key, field))
+	if err != nil || len(v) != 8 {
+		return -1, err
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
+
+// setHFieldPExpireAt adds the expire time ms of the hash field to wb.
+func setHFieldPExpireAt(wb *store.WriteBatch, key, field []byte, ms int64) error {
+	if _, err := removeHFieldExpire(wb, key, field); err != nil {
+		return err
+	}
+	wb.Put(hFieldExpireKey(key, field), binary.BigEndian.AppendUint64(nil, uint64(ms)))
+	wb.Put(hFieldTimeKey(key, field, ms), nil)
+	return nil
+}
+
+// removeHFieldExpire adds the removal of the expire time of the hash field to
+// wb. It returns true if the field had one.
+func removeHFieldExpire(wb *store.WriteBatch, key, field []byte) (bool, error) {
+	ms, err := hFieldPExpireAt(key, field)
+	if err != nil || ms == -1 {
+		return false, err
+	}
+	wb.Delete(hFieldExpireKey(key, field))
+	wb.Delete(hFieldTimeKey(key, field, ms))
+	return true, nil
+}
+
+// removeHFieldExpires drops the expire times of the hash fields, of all of
+// them when fields is nil.
+func removeHFieldExpires(key []byte, fields [][]byte) error {
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if fields == nil {
+		deleteHFieldExpires(wb, key)
+	}
+	for _, field := range fields {
+		if _, err := removeHFieldExpire(wb, key, field); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// forEachHFieldExpire calls fn with every field of the hash that has an expire
+// time.
+func forEachHFieldExpire(key []byte, fn func(field []byte, ms int64)) {
+	prefix := streamKey(hashFieldExpireType, key)
+	it := ldb.GetSDB().RangeIterator(prefix, prefixEnd(prefix), store.RangeROpen)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if v := it.RawValue(); len(v) == 8 {
+			fn(append([]byte(nil), it.RawKey()[len(prefix):]...), int64(binary.BigEndian.Uint64(v)))
+		}
+	}
+}
+
+// deleteHFieldExpires adds the removal of the expire times of every field of
+// the hash to wb.
+func deleteHFieldExpires(wb *store.WriteBatch, key []byte) {
+	forEachHFieldExpire(key, func(field []byte, ms int64) {
+		wb.Delete(hFieldExpireKey(key, field))
+		wb.Delete(hFieldTimeKey(key, field, ms))
+	})
+}
+
+// copyHFieldExpires adds the copy of the expire times of the fields of src to
+// dst of the database index to wb.
+func copyHFieldExpires(wb *store.WriteBatch, src []byte, index int, dst []byte) {
+	var fields [][]byte
+	var times []int64
+	forEachHFieldExpire(src, func(field []byte, ms int64) {
+		fields = append(fields, field)
+		times = append(times, ms)
+	})
+	inDB(index, func() error {
+		for i, field := range fields {
+			wb.Put(hFieldExpireKey(dst, field), binary.BigEndian.AppendUint64(nil, uint64(times[i])))
+			wb.Put(hFieldTimeKey(dst, field, times[i]), nil)
+		}
+		return nil
+	})
+}
+
+// hFieldExpireFlush deletes the expire times of every hash field of the
+// current db.
+func hFieldExpireFlush() error {
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	for _, typ := range []byte{hashFieldExpireType, hashFieldTimeType} {
+		deletePrefix(wb, append(streamDBPrefix(), typ))
+	}
+	return wb.Commit()
+}
+
+// hParseFields parses "FIELDS numfields field [field ...]".
+func hParseFields(args []string) ([][]byte, error) {
+	if len(args) < 2 || strings.ToUpper(args[0]) != "FIELDS" {
+		return nil, errors.New("ERR Mandatory argument FIELDS is missing or not at the right position")
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n <= 0 {
+		return nil, errors.New("ERR Parameter `numFields` should be greater than 0")
+	}
+	if n != len(args)-2 {
+		return nil, errors.New("ERR The `numfields` parameter must match the number of arguments")
+	}
+	return stringSliceToBytes(args[2:]), nil
+}
+
+// hasFieldsArg reports whether args use the field form of a hash expire
+// command, rather than the IceFireDB key form.
+func hasFieldsArg(args []string) bool {
+	for i := 2; i < len(args); i++ {
+		if strings.EqualFold(args[i], "FIELDS") {
+			return true
+		}
+	}
+	return false
+}
+
+// hExpireFields sets the expire time of the hash fields to the time argument
+// in unit milliseconds, relative to m.Now() or a unix time. A time that is not
+// after m.Now() deletes the fields. The reply has an entry per field: -2 for
+// no such field, 0 when the options did not allow it, 1 when the time was set
+// and 2 when the field was deleted.
+// Syntax: HEXPIRE key time [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func hExpireFields(m uhaha.Machine, args []string, unit int64, relative bool) (interface{}, error) {
+	if len(args) < 6 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	v, err := ledis.StrInt64([]byte(args[2]), nil)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	now := unixMilli(m.Now())
+	ms := v * unit
+	if relative {
+		ms += now
+	}
+	if v < 0 || v > hFieldMaxExpire/unit || ms > hFieldMaxExpire {
+		return nil, errors.New("ERR invalid expire time, must be >= 0 and <= " + strconv.FormatInt(hFieldMaxExpire, 10))
+	}
+	i := 3
+	var opts expireOptions
+	if !strings.EqualFold(args[i], "FIELDS") {
+		if opts, err = parseExpireOptions(args[i : i+1]); err != nil {
+			return nil, err
+		}
+		i++
+	}
+	fields, err := hParseFields(args[i:])
+	if err != nil {
+		return nil, err
+	}
+
+	key, past := []byte(args[1]), ms <= now
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	ret := make([]interface{}, len(fields))
+	var deleted [][]byte
+	for i, field := range fields {
+		if v, err := ldb.HGet(key, field); err != nil {
+			return nil, err
+		} else if v == nil {
+			ret[i] = redcon.SimpleInt(-2)
+			continue
+		}
+		cur, err := hFieldPExpireAt(key, field)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.allow(cur, ms) {
+			ret[i] = redcon.SimpleInt(0)
+			continue
+		}
+		if past {
+			if _, err := removeHFieldExpire(wb, key, field); err != nil {
+				return nil, err
+			}
+			deleted = append(deleted, field)
+			ret[i] = redcon.SimpleInt(2)
+			continue
+		}
+		if err := setHFieldPExpireAt(wb, key, field, ms); err != nil {
+			return nil, err
+		}
+		ret[i] = redcon.SimpleInt(1)
+	}
+	if _, err := hDeleteFields(wb, key, deleted); err != nil {
+		return nil, err
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// cmdHPEXPIRE sets a time to live in milliseconds on hash fields.
+// Syntax: HPEXPIRE key milliseconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func cmdHPEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
+	return hExpireFields(m, args, 1, true)
+}
+
+// cmdHPEXPIREAT sets the expire time of hash fields as a unix time in
+// milliseconds.
+// Syntax: HPEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func cmdHPEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
+	return hExpireFields(m, args, 1, false)
+}
+
+// hFieldsTTL returns an entry per field computed by fn from its expire time,
+// -2 for no such field or an expired one and -1 for no expire time.
+func hFieldsTTL(m uhaha.Machine, args []string, fn func(ms, now int64) int64) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	fields, err := hParseFields(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	key, now := []byte(args[1]), unixMilli(m.Now())
+	ret := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if v, err := ldb.HGet(key, field); err != nil {
+			return nil, err
+		} else if v == nil {
+			ret[i] = redcon.SimpleInt(-2)
+			continue
+		}
+		ms, err := hFieldPExpireAt(key, field)
+		switch {
+		case err != nil:
+			return nil, err
+		case ms == -1:
+			ret[i] = redcon.SimpleInt(-1)
+		case ms <= now:
+			// expired, waiting to be removed
+			ret[i] = redcon.SimpleInt(-2)
+		default:
+			ret[i] = redcon.SimpleInt(fn(ms, now))
+		}
+	}
+	return ret, nil
+}
+
+// cmdHPTTL returns the remaining time to live of hash fields in milliseconds.
+// Syntax: HPTTL key FIELDS numfields field [field ...]
+func cmdHPTTL(m uhaha.Machine, args []string) (interface{}, error) {
+	return hFieldsTTL(m, args, func(ms, now int64) int64 { return ms - now })
+}
+
+// cmdHEXPIRETIME returns the expire time of hash fields as a unix time in
+// seconds.
+// Syntax: HEXPIRETIME key FIELDS numfields field [field ...]
+func cmdHEXPIRETIME(m uhaha.Machine, args []string) (interface{}, error) {
+	return hFieldsTTL(m, args, func(ms, now int64) int64 { return ms / 1000 })
+}
+
+// cmdHPEXPIRETIME returns the expire time of hash fields as a unix time in
+// milliseconds.
+// Syntax: HPEXPIRETIME key FIELDS numfields field [field ...]
+func cmdHPEXPIRETIME(m uhaha.Machine, args []string) (interface{}, error) {
+	return hFieldsTTL(m, args, func(ms, now int64) int64 { return ms })
+}
+
+// cmdHPERSIST removes the expire time of hash fields: -2 for no such field, -1
+// for no expire time and 1 when it was removed. Without FIELDS it removes the
+// expire time of the whole key.
+// Syntax: HPERSIST key FIELDS numfields field [field ...]
+func cmdHPERSIST(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) == 2 {
+		return hPersistKey(args)
+	}
+	if len(args) < 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	fields, err := hParseFields(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(args[1])
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	ret := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if v, err := ldb.HGet(key, field); err != nil {
+			return nil, err
+		} else if v == nil {
+			ret[i] = redcon.SimpleInt(-2)
+			continue
+		}
+		if ok, err := removeHFieldExpire(wb, key, field); err != nil {
+			return nil, err
+		} else if ok {
+			ret[i] = redcon.SimpleInt(1)
+		} else {
+			ret[i] = redcon.SimpleInt(-1)
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// hPersistKey removes the expire time of the hash key.
+func hPersistKey(args []string) (interface{}, error) {
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	ok, err := removeKeyExpire(wb, keyTypeByExp(ledis.HashType), []byte(args[1]))
+	if err != nil || !ok {
+		return redcon.SimpleInt(0), err
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(1), nil
+}
+
+// expiredHashFields returns up to limit "key field ms" triples of the hash
+// fields whose expire time is not after now, a unix time in milliseconds.
+func expiredHashFields(now int64, limit int) []string {
+	var args []string
+	scanExpiredHFields(now, func(key, field []byte, ms int64) bool {
+		args = append(args, string(key), string(field), strconv.FormatInt(ms, 10))
+		return len(args) < limit*3
+	})
+	return args
+}
+
+// expiredHFieldsOf returns the "key field ms" triples of the fields of the
+// hashes keys whose expire time is not after now.
+func expiredHFieldsOf(keys []string, now int64) []string {
+	if len(keys) == 0 {
+		return nil
+	}
+	hashes := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		hashes[key] = true
+	}
+	var args []string
+	scanExpiredHFields(now, func(key, field []byte, ms int64) bool {
+		if hashes[string(key)] {
+			args = append(args, string(key), string(field), strconv.FormatInt(ms, 10))
+		}
+		return true
+	})
+	return args
+}
+
+// scanExpiredHFields calls fn with the hash fields whose expire time is not
+// after now, in the order of the time index, until fn returns false.
+func scanExpiredHFields(now int64, fn func(key, field []byte, ms int64) bool) {
+	prefix := append(streamDBPrefix(), hashFieldTimeType)
+	end := binary.BigEndian.AppendUint64(append([]byte(nil), prefix...), uint64(now+1))
+	it := ldb.GetSDB().RangeIterator(prefix, end, store.RangeROpen)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		// ms|keylen|key|field
+		tk := it.RawKey()[len(prefix):]
+		if len(tk) < 10 {
+			continue
+		}
+		ms, n := int64(binary.BigEndian.Uint64(tk)), int(binary.BigEndian.Uint16(tk[8:]))
+		if len(tk) < 10+n {
+			continue
+		}
+		if !fn(tk[10:10+n], tk[10+n:], ms) {
+			return
+		}
+	}
+}
+
+// cmdHEXPIRED deletes the hash fields whose expire time is ms and not after
+// m.Now(). It is proposed by the expire reaper.
+// Syntax: HEXPIRED key field ms [key field ms ...]
+func cmdHEXPIRED(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 4 || (len(args)-1)%3 != 0 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	n, keys, err := deleteExpiredHFields(args[1:], unixMilli(m.Now()))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		notifyKeyspaceEvent(notifyHash, "hexpired", key)
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// deleteExpiredHFields deletes the hash fields of the "key field ms" triples
+// whose expire time is ms and not after now. It returns the number of fields
+// deleted and the keys that lost fields.
+func deleteExpiredHFields(triples []string, now int64) (int64, []string, error) {
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	var keys []string
+	expired := make(map[string][][]byte)
+	for i := 0; i+2 < len(triples); i += 3 {
+		key, field := []byte(triples[i]), []byte(triples[i+1])
+		ms, err := strconv.ParseInt(triples[i+2], 10, 64)
+		if err != nil {
+			return 0, nil, err
+		}
+		if ms > now {
+			continue
+		}
+		// the index entry is stale if the field got another expire time
+		wb.Delete(hFieldTimeKey(key, field, ms))
+		if cur, err := hFieldPExpireAt(key, field); err != nil {
+			return 0, nil, err
+		} else if cur != ms {
+			continue
+		}
+		wb.Delete(hFieldExpireKey(key, field))
+		if _, ok := expired[triples[i]]; !ok {
+			keys = append(keys, triples[i])
+		}
+		expired[triples[i]] = append(expired[triples[i]], field)
+	}
+	var n int64
+	var deleted []string
+	for _, key := range keys {
+		d, err := hDeleteFields(wb, []byte(key), expired[key])
+		if err != nil {
+			return 0, nil, err
+		}
+		n += d
+		if d > 0 {
+			deleted = append(deleted, key)
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return n, deleted, nil
+}
+
+// hDeleteFields adds the deletion of the fields of the hash to wb, and of the
+// whole hash once no field is left, so that the fields go in the same batch
+// as their expire times. It returns the number of fields deleted.
+func hDeleteFields(wb *store.WriteBatch, key []byte, fields [][]byte) (int64, error) {
+	var n int64
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if seen[string(field)] {
+			continue
+		}
+		seen[string(field)] = true
+		if v, err := ldb.HGet(key, field); err != nil {
+			return 0, err
+		} else if v != nil {
+			wb.Delete(hFieldKey(key, field))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	size, err := ldb.HLen(key)
+	if err != nil {
+		return 0, err
+	}
+	hash := keyTypeByExp(ledis.HashType)
+	if n >= size {
+		return n, hash.deleteKey(wb, key)
+	}
+	wb.Put(hash.metaKey(key), ledis.PutInt64(size-n))
+	return n, nil
+}
+
+// hFieldKey encodes db|HashType|keylen|key|':'|field, the layout of the
+// ledis hash fields.
+func hFieldKey(key, field []byte) []byte {
+	return streamKey(ledis.HashType, key, []byte{':'}, field)
+}
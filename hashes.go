@@ -1,7 +1,10 @@
 package main
 
 import (
-	"time"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/ledisdb/ledisdb/ledis"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -16,6 +19,7 @@ func init() {
 	conf.AddReadCommand("HEXISTS", cmdHEXISTS)
 	conf.AddReadCommand("HGETALL", cmdHGETALL)
 	conf.AddWriteCommand("HINCRBY", cmdHINCRBY)
+	conf.AddWriteCommand("HINCRBYFLOAT", cmdHINCRBYFLOAT)
 	conf.AddReadCommand("HKEYS", cmdHKEYS)
 	conf.AddReadCommand("HLEN", cmdHLEN)
 	conf.AddReadCommand("HMGET", cmdHMGET)
@@ -23,6 +27,8 @@ func init() {
 	conf.AddWriteCommand("HSETNX", cmdHSETNX)
 	conf.AddReadCommand("HSTRLEN", cmdHSTRLEN)
 	conf.AddReadCommand("HVALS", cmdHVALS)
+	conf.AddReadCommand("HRANDFIELD", cmdHRANDFIELD)
+	conf.AddWriteCommand("HGETDEL", cmdHGETDEL)
 
 	//IceFireDB special command
 	conf.AddWriteCommand("HCLEAR", cmdHCLEAR)
@@ -30,7 +36,6 @@ func init() {
 	conf.AddWriteCommand("HEXPIRE", cmdHEXPIRE)     //Timeout command HEXPIRE => HEXPIREAT
 	conf.AddWriteCommand("HEXPIREAT", cmdHEXPIREAT) //Timeout command
 	conf.AddReadCommand("HTTL", cmdHTTL)
-	// conf.AddWriteCommand("HPERSIST", cmdHPERSIST)
 	conf.AddReadCommand("HKEYEXISTS", cmdHKEYEXISTS)
 
 }
@@ -41,11 +46,16 @@ func cmdHSET(m uhaha.Machine, args []string) (interface{}, error) {
 	}
 
 	var n int64
+	fields := make([][]byte, 0, len(args)/2-1)
 	for i := 2; i < len(args); i += 2 {
 		if r, err := ldb.HSet([]byte(args[1]), []byte(args[i]), []byte(args[i+1])); err == nil {
 			n = n + r
+			fields = append(fields, []byte(args[i]))
 		}
 	}
+	if err := removeHFieldExpires([]byte(args[1]), fields); err != nil {
+		return nil, err
+	}
 
 	return redcon.SimpleInt(n), nil
 }
@@ -85,6 +95,9 @@ func cmdHDEL(m uhaha.Machine, args []string) (interface{}, error) {
 	if count, err := ldb.HDel([]byte(args[1]), argsData...); err == nil {
 		n = count
 	}
+	if err := removeHFieldExpires([]byte(args[1]), argsData); err != nil {
+		return nil, err
+	}
 
 	return redcon.SimpleInt(n), nil
 }
@@ -142,6 +155,53 @@ func cmdHINCRBY(m uhaha.Machine, args []string) (interface{}, error) {
 	return redcon.SimpleInt(n), nil
 }
 
+// cmdHINCRBYFLOAT increments the number stored at field by increment.
+// Syntax: HINCRBYFLOAT key field increment
+func cmdHINCRBYFLOAT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	incr, err := parseFloat(args[3])
+	if err != nil {
+		return nil, err
+	}
+	key, field := []byte(args[1]), []byte(args[2])
+	v, err := ldb.HGet(key, field)
+	if err != nil {
+		return nil, err
+	}
+	var n float64
+	if v != nil {
+		if n, err = parseFloat(string(v)); err != nil {
+			return nil, errors.New("ERR hash value is not a float")
+		}
+	}
+	n += incr
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return nil, errors.New("ERR increment would produce NaN or Infinity")
+	}
+	value := formatFloat(n)
+	if _, err := ldb.HSet(key, field, []byte(value)); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// parseFloat parses a float argument, rejecting NaN and infinities.
+func parseFloat(arg string) (float64, error) {
+	f, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errors.New("ERR value is not a valid float")
+	}
+	return f, nil
+}
+
+// formatFloat formats a float like the Redis increment commands, without an
+// exponent or trailing zeros.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
 func cmdHKEYS(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 2 {
 		return nil, uhaha.ErrWrongNumArgs
@@ -201,14 +261,19 @@ func cmdHMSET(m uhaha.Machine, args []string) (interface{}, error) {
 	args = args[2:]
 
 	kvs := make([]ledis.FVPair, len(args)/2)
+	fields := make([][]byte, len(kvs))
 	for i := 0; i < len(kvs); i++ {
 		kvs[i].Field = []byte(args[2*i])
 		kvs[i].Value = []byte(args[2*i+1])
+		fields[i] = kvs[i].Field
 	}
 
 	if err := ldb.HMset([]byte(key), kvs...); err != nil {
 		return nil, err
 	}
+	if err := removeHFieldExpires([]byte(key), fields); err != nil {
+		return nil, err
+	}
 
 	return redcon.SimpleString("OK"), nil
 }
@@ -232,6 +297,9 @@ func cmdHSETNX(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := removeHFieldExpires([]byte(args[1]), [][]byte{[]byte(args[2])}); err != nil {
+		return nil, err
+	}
 
 	return n, nil
 }
@@ -261,6 +329,93 @@ func cmdHVALS(m uhaha.Machine, args []string) (interface{}, error) {
 	return v, nil
 }
 
+// cmdHRANDFIELD returns random fields. A positive count returns distinct
+// fields, a negative one may return the same field several times.
+// Syntax: HRANDFIELD key [count [WITHVALUES]]
+func cmdHRANDFIELD(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	count, withValues, single := 1, false, len(args) == 2
+	if !single {
+		var err error
+		if count, err = strconv.Atoi(args[2]); err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		if len(args) == 4 {
+			if strings.ToUpper(args[3]) != "WITHVALUES" {
+				return nil, uhaha.ErrSyntax
+			}
+			withValues = true
+		}
+	}
+	pairs, err := ldb.HGetAll([]byte(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	rng := readRand()
+	if single {
+		if len(pairs) == 0 {
+			return nil, nil
+		}
+		return pairs[rng.Intn(len(pairs))].Field, nil
+	}
+	if len(pairs) == 0 || count == 0 {
+		return [][]byte{}, nil
+	}
+	var picked []ledis.FVPair
+	if count > 0 {
+		rng.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+		if count < len(pairs) {
+			pairs = pairs[:count]
+		}
+		picked = pairs
+	} else {
+		for i := 0; i < -count; i++ {
+			picked = append(picked, pairs[rng.Intn(len(pairs))])
+		}
+	}
+	ret := make([][]byte, 0, len(picked)*2)
+	for _, pair := range picked {
+		ret = append(ret, pair.Field)
+		if withValues {
+			ret = append(ret, pair.Value)
+		}
+	}
+	return ret, nil
+}
+
+// cmdHGETDEL returns the values of the fields and deletes them, nil for the
+// missing ones.
+// Syntax: HGETDEL key FIELDS numfields field [field ...]
+func cmdHGETDEL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	fields, err := hParseFields(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(args[1])
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		v, err := ldb.HGet(key, field)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			values[i] = v
+		}
+	}
+	if _, err := ldb.HDel(key, fields...); err != nil {
+		return nil, err
+	}
+	if err := removeHFieldExpires(key, fields); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
 func cmdHCLEAR(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 2 {
 		return nil, uhaha.ErrWrongNumArgs
@@ -270,6 +425,9 @@ func cmdHCLEAR(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := removeHFieldExpires([]byte(args[1]), nil); err != nil {
+		return nil, err
+	}
 	return redcon.SimpleInt(n), nil
 }
 
@@ -286,10 +444,21 @@ func cmdHMCLEAR(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, key := range keys {
+		if err := removeHFieldExpires(key, nil); err != nil {
+			return nil, err
+		}
+	}
 	return redcon.SimpleInt(n), nil
 }
 
+// cmdHEXPIRE sets a time to live in seconds on the hash key, or on the fields
+// with FIELDS, see hExpireFields.
+// Syntax: HEXPIRE key seconds [NX | XX | GT | LT] [FIELDS numfields field [field ...]]
 func cmdHEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
+	if hasFieldsArg(args) {
+		return hExpireFields(m, args, 1000, true)
+	}
 	if len(args) != 3 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
@@ -298,25 +467,16 @@ func cmdHEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	timestamp := m.Now().Unix() + duration
-	//If the timestamp is less than the current time, delete operation
-	if timestamp < time.Now().Unix() {
-		_, err := ldb.HClear([]byte(args[1]))
-		if err != nil {
-			return nil, err
-		}
-		return redcon.SimpleInt(0), nil
-	}
-
-	v, err := ldb.HExpireAt([]byte(args[1]), timestamp)
-	if err != nil {
-		return nil, err
-	}
-	return redcon.SimpleInt(v), nil
+	return expireKeyType(m, keyTypeByExp(ledis.HashType), []byte(args[1]), unixMilli(m.Now())+duration*1000)
 }
 
+// cmdHEXPIREAT sets the expire time of the hash key as a unix time in seconds,
+// or of the fields with FIELDS.
+// Syntax: HEXPIREAT key unix-time-seconds [NX | XX | GT | LT] [FIELDS numfields field [field ...]]
 func cmdHEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
+	if hasFieldsArg(args) {
+		return hExpireFields(m, args, 1000, false)
+	}
 	if len(args) != 3 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
@@ -325,45 +485,20 @@ func cmdHEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	//If the timestamp is less than the current time, delete operation
-	if timestamp < time.Now().Unix() {
-		_, err := ldb.HClear([]byte(args[1]))
-		if err != nil {
-			return nil, err
-		}
-		return redcon.SimpleInt(0), nil
-	}
-
-	v, err := ldb.HExpireAt([]byte(args[1]), timestamp)
-	if err != nil {
-		return nil, err
-	}
-	return redcon.SimpleInt(v), nil
+	return expireKeyType(m, keyTypeByExp(ledis.HashType), []byte(args[1]), timestamp*1000)
 }
 
+// cmdHTTL returns the remaining time to live of the hash key in seconds, or of
+// the fields with FIELDS.
+// Syntax: HTTL key [FIELDS numfields field [field ...]]
 func cmdHTTL(m uhaha.Machine, args []string) (interface{}, error) {
-	if len(args) != 2 {
-		return nil, uhaha.ErrWrongNumArgs
-	}
-
-	v, err := ldb.HTTL([]byte(args[1]))
-	if err != nil {
-		return nil, err
+	if hasFieldsArg(args) {
+		return hFieldsTTL(m, args, func(ms, now int64) int64 { return msToUnixCeil(ms - now) })
 	}
-	return redcon.SimpleInt(v), nil
-}
-
-func cmdHPERSIST(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 2 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-
-	n, err := ldb.HPersist([]byte(args[1]))
-	if err != nil {
-		return nil, err
-	}
-	return redcon.SimpleInt(n), nil
+	return keyTypeTTL(keyTypeByExp(ledis.HashType), []byte(args[1]), m.Now())
 }
 
 func cmdHKEYEXISTS(m uhaha.Machine, args []string) (interface{}, error) {
@@ -7,7 +7,9 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/spf13/cast"
 )
 
@@ -179,6 +181,246 @@ func TestHashIncr(t *testing.T) {
 	}
 }
 
+func TestHashIncrByFloat(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Del(ctx, "hincrbyfloat")
+	c.Do(ctx, "hclear", "hincrbyfloat")
+	if v, err := c.HIncrByFloat(ctx, "hincrbyfloat", "f", 10.5).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != 10.5 {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "hincrbyfloat", "hincrbyfloat", "f", "0.1").Text(); err != nil {
+		t.Fatal(err)
+	} else if v != "10.6" {
+		t.Fatal(v)
+	}
+	c.HSet(ctx, "hincrbyfloat", "g", "5.0e3")
+	if v, err := c.Do(ctx, "hincrbyfloat", "hincrbyfloat", "g", "2.0e2").Text(); err != nil {
+		t.Fatal(err)
+	} else if v != "5200" {
+		t.Fatal(v)
+	}
+	c.HSet(ctx, "hincrbyfloat", "s", "abc")
+	if err := c.HIncrByFloat(ctx, "hincrbyfloat", "s", 1).Err(); err == nil {
+		t.Fatal("expected a float error")
+	}
+	if err := c.Do(ctx, "hincrbyfloat", "hincrbyfloat", "f", "inf").Err(); err == nil {
+		t.Fatal("expected a float error")
+	}
+}
+
+func TestHashRandFieldGetDel(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	key := "hrandfield"
+	c.Do(ctx, "hclear", key)
+	if err := c.HRandField(ctx, key, 1).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Do(ctx, "hrandfield", key).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	c.HSet(ctx, key, "a", 1, "b", 2, "c", 3)
+	if v, err := c.HRandField(ctx, key, 2).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] == v[1] {
+		t.Fatal(v)
+	}
+	if v, err := c.HRandField(ctx, key, -5).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 5 {
+		t.Fatal(v)
+	}
+	if v, err := c.HRandFieldWithValues(ctx, key, 5).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 3 {
+		t.Fatal(v)
+	} else {
+		for _, kv := range v {
+			if want := map[string]string{"a": "1", "b": "2", "c": "3"}[kv.Key]; kv.Value != want {
+				t.Fatal(kv)
+			}
+		}
+	}
+
+	if v, err := c.Do(ctx, "hgetdel", key, "fields", 2, "a", "none").Slice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != "1" || v[1] != nil {
+		t.Fatal(v)
+	}
+	if n, err := c.HLen(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if err := c.Do(ctx, "hgetdel", key, "fields", 3, "b", "c").Err(); err == nil {
+		t.Fatal("expected a numfields error")
+	}
+	c.Do(ctx, "hgetdel", key, "fields", 2, "b", "c")
+	if n, err := c.Exists(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestHashFieldExpire(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	key := "hfield_ttl"
+	c.Do(ctx, "hclear", key)
+	c.HSet(ctx, key, "a", 1, "b", 2, "c", 3, "d", 4)
+	if v, err := c.Do(ctx, "hexpire", key, 100, "fields", 2, "a", "none").Slice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != int64(1) || v[1] != int64(-2) {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "httl", key, "fields", 2, "a", "b").Slice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != int64(100) || v[1] != int64(-1) {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "hpttl", key, "fields", 1, "a").Slice(); err != nil {
+		t.Fatal(err)
+	} else if ttl := v[0].(int64); ttl <= 99000 || ttl > 100000 {
+		t.Fatal(ttl)
+	}
+
+	// the options compare with the expire time of each field
+	if v, err := c.Do(ctx, "hexpire", key, 200, "nx", "fields", 2, "a", "b").Slice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != int64(0) || v[1] != int64(1) {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "hexpire", key, 150, "gt", "fields", 2, "a", "b").Slice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != int64(1) || v[1] != int64(0) {
+		t.Fatal(v)
+	}
+	at := time.Now().Add(time.Hour).UnixMilli()
+	if err := c.Do(ctx, "hpexpireat", key, at, "fields", 1, "c").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do(ctx, "hpexpiretime", key, "fields", 1, "c").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != at {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "hexpiretime", key, "fields", 1, "c").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != at/1000 {
+		t.Fatal(v)
+	}
+
+	// HSET drops the expire time, HINCRBY keeps it
+	c.HSet(ctx, key, "b", 5)
+	c.HIncrBy(ctx, key, "a", 1)
+	if v, err := c.Do(ctx, "httl", key, "fields", 2, "a", "b").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != int64(150) || v[1] != int64(-1) {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "hpersist", key, "fields", 2, "a", "b").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != int64(1) || v[1] != int64(-1) {
+		t.Fatal(v)
+	}
+
+	// a time in the past deletes the field
+	if v, err := c.Do(ctx, "hpexpireat", key, 1, "fields", 1, "b").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != int64(2) {
+		t.Fatal(v)
+	}
+	if err := c.HGet(ctx, key, "b").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if n, err := c.HLen(ctx, key).Result(); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+
+	// expired fields are reaped, the key goes with its last field
+	if err := c.Do(ctx, "hpexpire", key, 100, "fields", 1, "d").Err(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if v, err := c.HKeys(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != "a" || v[1] != "c" {
+		t.Fatal(v)
+	}
+	c.Do(ctx, "hpexpire", key, 100, "fields", 2, "a", "c")
+	time.Sleep(time.Second)
+	if n, err := c.Exists(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	if err := c.Do(ctx, "hexpire", key, 100, "fields", 0).Err(); err == nil {
+		t.Fatal("expected a numfields error")
+	}
+	if err := c.Do(ctx, "hexpire", key, -1, "fields", 1, "a").Err(); err == nil {
+		t.Fatal("expected an expire time error")
+	}
+	if err := c.Do(ctx, "hpttl", key, "a").Err(); err == nil {
+		t.Fatal("expected a FIELDS error")
+	}
+}
+
+func TestHashKeyExpire(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	// without FIELDS the expire commands apply to the whole key
+	key := "hkey_ttl"
+	c.Do(ctx, "hclear", key)
+	c.HSet(ctx, key, "a", 1)
+	if n, err := c.Do(ctx, "hexpire", key, 100).Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.Do(ctx, "httl", key).Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 100 {
+		t.Fatal(n)
+	}
+	if n, err := c.Do(ctx, "hpersist", key).Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.Do(ctx, "httl", key).Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != -1 {
+		t.Fatal(n)
+	}
+
+	// the field expire times move with the key
+	c.Do(ctx, "hexpire", key, 100, "fields", 1, "a")
+	if err := c.Rename(ctx, key, key+"_renamed").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do(ctx, "httl", key+"_renamed", "fields", 1, "a").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != int64(100) {
+		t.Fatal(v)
+	}
+	c.Do(ctx, "hclear", key+"_renamed")
+	c.HSet(ctx, key+"_renamed", "a", 1)
+	if v, err := c.Do(ctx, "httl", key+"_renamed", "fields", 1, "a").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != int64(-1) {
+		t.Fatal(v)
+	}
+}
+
 func TestHashGetAll(t *testing.T) {
 	c := getTestConn()
 
@@ -308,3 +550,84 @@ func TestHashErrorParams(t *testing.T) {
 		t.Fatalf("invalid err of %v", err)
 	}
 }
+
+func TestHashFieldLazyExpire(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	expireReaperPaused.Store(true)
+	defer expireReaperPaused.Store(false)
+
+	// the reads skip the fields the reaper did not remove yet
+	key := "hfield_lazy"
+	c.Do(ctx, "hclear", key)
+	c.HSet(ctx, key, "a", 1, "b", 2, "c", 3)
+	if err := c.Do(ctx, "hpexpire", key, 100, "fields", 2, "a", "b").Err(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := c.HGet(ctx, key, "a").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.HExists(ctx, key, "a").Result(); err != nil || ok {
+		t.Fatal(ok, err)
+	}
+	if n, err := c.HLen(ctx, key).Result(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if v, err := c.HGetAll(ctx, key).Result(); err != nil || len(v) != 1 || v["c"] != "3" {
+		t.Fatal(v, err)
+	}
+	if v, err := c.HKeys(ctx, key).Result(); err != nil || len(v) != 1 || v[0] != "c" {
+		t.Fatal(v, err)
+	}
+	if v, err := c.HVals(ctx, key).Result(); err != nil || len(v) != 1 || v[0] != "3" {
+		t.Fatal(v, err)
+	}
+	if v, err := c.HMGet(ctx, key, "a", "c").Result(); err != nil || v[0] == "1" || v[1] != "3" {
+		t.Fatal(v, err)
+	}
+	if n, err := c.Do(ctx, "hstrlen", key, "b").Int(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if v, err := c.HRandField(ctx, key, -5).Result(); err != nil || len(v) != 5 {
+		t.Fatal(v, err)
+	} else {
+		for _, field := range v {
+			if field != "c" {
+				t.Fatal(v)
+			}
+		}
+	}
+	dbMu.Lock()
+	v, err := ldb.HGet([]byte(key), []byte("a"))
+	dbMu.Unlock()
+	if err != nil || v == nil {
+		t.Fatal("a read deleted the field", err)
+	}
+
+	// the writes delete them first
+	if n, err := c.HIncrBy(ctx, key, "a", 5).Result(); err != nil || n != 5 {
+		t.Fatal(n, err)
+	}
+	if ok, err := c.HSetNX(ctx, key, "b", "x").Result(); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if n, err := c.HLen(ctx, key).Result(); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+
+	// a hash whose fields all expired is missing
+	key = "hfield_lazy_all"
+	c.Do(ctx, "hclear", key)
+	c.HSet(ctx, key, "a", 1)
+	if err := c.Do(ctx, "hpexpire", key, 100, "fields", 1, "a").Err(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n, err := c.Exists(ctx, key).Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if v, err := c.Type(ctx, key).Result(); err != nil || v != "none" {
+		t.Fatal(v, err)
+	}
+}
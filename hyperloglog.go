@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddWriteCommand("PFADD", cmdPFADD)
+	conf.AddReadCommand("PFCOUNT", cmdPFCOUNT)
+	conf.AddWriteCommand("PFMERGE", cmdPFMERGE)
+}
+
+// The HyperLogLogs are strings with the layout of Redis, so that they can be
+// moved with DUMP and RESTORE:
+//
+//	"HYLL" | encoding | 3 unused bytes | cardinality cache, 8 bytes LE
+//
+// followed by the registers. The dense encoding packs the 6 bit registers
+// from the least significant bit, the sparse one is a sequence of opcodes:
+//
+//	00xxxxxx          ZERO, xxxxxx+1 zero registers
+//	01xxxxxx yyyyyyyy XZERO, xxxxxxyyyyyyyy+1 zero registers
+//	1vvvvvxx          VAL, xx+1 registers set to vvvvv+1
+//
+// The most significant bit of the cache marks it as invalid.
+const (
+	hllP              = 14
+	hllQ              = 64 - hllP
+	hllRegisters      = 1 << hllP
+	hllBits           = 6
+	hllHdrSize        = 16
+	hllDenseSize      = hllHdrSize + (hllRegisters*hllBits+7)/8
+	hllDense          = 0
+	hllSparse         = 1
+	hllSparseMaxBytes = 3000 // the default hll-sparse-max-bytes of Redis
+	hllSparseValMax   = 32
+	hllAlphaInf       = 0.721347520444481703680 // 0.5/ln(2)
+)
+
+var (
+	errNotHLL     = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errInvalidHLL = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// murmurHash64A is the hash function of the Redis HyperLogLogs.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(key))*m
+	for ; len(key) >= 8; key = key[8:] {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register of ele and the length of the 000..1
+// pattern that follows, the value to max into the register.
+func hllPatLen(ele []byte) (int, uint8) {
+	hash := murmurHash64A(ele, 0xadc83b19)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= 1 << hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+// hllDecode returns the registers of the HyperLogLog value v.
+func hllDecode(v []byte) ([]uint8, error) {
+	if len(v) < hllHdrSize || string(v[:4]) != "HYLL" {
+		return nil, errNotHLL
+	}
+	regs := make([]uint8, hllRegisters)
+	switch v[4] {
+	case hllDense:
+		if len(v) != hllDenseSize {
+			return nil, errNotHLL
+		}
+		p := v[hllHdrSize:]
+		for i := range regs {
+			pos := i * hllBits
+			b := uint16(p[pos/8])
+			if pos/8+1 < len(p) {
+				b |= uint16(p[pos/8+1]) << 8
+			}
+			regs[i] = uint8(b>>(pos&7)) & 63
+		}
+	case hllSparse:
+		i := 0
+		for p := v[hllHdrSize:]; len(p) > 0; {
+			switch {
+			case p[0]&0xc0 == 0:
+				i += int(p[0]&0x3f) + 1
+				p = p[1:]
+			case p[0]&0xc0 == 0x40:
+				if len(p) < 2 {
+					return nil, errInvalidHLL
+				}
+				i += int(p[0]&0x3f)<<8 | int(p[1]) + 1
+				p = p[2:]
+			default:
+				n, val := int(p[0]&3)+1, (p[0]>>2)&0x1f+1
+				if i+n > hllRegisters {
+					return nil, errInvalidHLL
+				}
+				for ; n > 0; n-- {
+					regs[i] = val
+					i++
+				}
+				p = p[1:]
+			}
+			if i > hllRegisters {
+				return nil, errInvalidHLL
+			}
+		}
+		if i != hllRegisters {
+			return nil, errInvalidHLL
+		}
+	default:
+		return nil, errNotHLL
+	}
+	return regs, nil
+}
+
+// hllEncode returns the HyperLogLog value of the registers, with an invalid
+// cardinality cache. Like Redis the sparse encoding is used as long as the
+// values fit in it and it is at most hllSparseMaxBytes long, and a dense
+// value is never made sparse again.
+func hllEncode(regs []uint8, dense bool) []byte {
+	v := make([]byte, hllHdrSize, hllDenseSize)
+	copy(v, "HYLL")
+	v[hllHdrSize-1] = 1 << 7
+	if sparse, ok := hllEncodeSparse(regs); ok && !dense {
+		v[4] = hllSparse
+		return append(v, sparse...)
+	}
+	v[4] = hllDense
+	v = v[:hllDenseSize]
+	p := v[hllHdrSize:]
+	for i, val := range regs {
+		pos := i * hllBits
+		p[pos/8] |= val << (pos & 7)
+		if pos/8+1 < len(p) {
+			p[pos/8+1] |= val >> (8 - pos&7)
+		}
+	}
+	return v
+}
+
+func hllEncodeSparse(regs []uint8) ([]byte, bool) {
+	var p []byte
+	for i := 0; i < len(regs); {
+		j := i + 1
+		if regs[i] == 0 {
+			for j < len(regs) && regs[j] == 0 {
+				j++
+			}
+			if n := j - i; n > 64 {
+				p = append(p, 0x40|byte((n-1)>>8), byte(n-1))
+			} else {
+				p = append(p, byte(n-1))
+			}
+		} else {
+			if regs[i] > hllSparseValMax {
+				return nil, false
+			}
+			for j < len(regs) && j-i < 4 && regs[j] == regs[i] {
+				j++
+			}
+			p = append(p, 0x80|(regs[i]-1)<<2|byte(j-i-1))
+		}
+		if hllHdrSize+len(p) > hllSparseMaxBytes {
+			return nil, false
+		}
+		i = j
+	}
+	return p, true
+}
+
+// hllCount estimates the cardinality of the registers with the estimator of
+// Redis, from "New cardinality estimation algorithms for HyperLogLog
+// sketches" by Otmar Ertl.
+func hllCount(regs []uint8) int64 {
+	var histo [64]int
+	for _, val := range regs {
+		histo[val]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return int64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// hllGet returns the registers of the HyperLogLog at key, nil if the key
+// does not exist, and whether it is dense.
+func hllGet(key []byte) ([]uint8, bool, error) {
+	v, err := ldb.Get(key)
+	if err != nil || v == nil {
+		return nil, false, err
+	}
+	regs, err := hllDecode(v)
+	return regs, err == nil && v[4] == hllDense, err
+}
+
+// hllSet stores the registers at key. GetSet overwrites the value without
+// touching the TTL, like Redis updates the string in place.
+func hllSet(key []byte, regs []uint8, dense bool) error {
+	_, err := ldb.GetSet(key, hllEncode(regs, dense))
+	return err
+}
+
+// cmdPFADD adds the elements to the HyperLogLog at key. Returns 1 if the key
+// was created or a register changed, 0 otherwise.
+// Syntax: PFADD key [element [element ...]]
+func cmdPFADD(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	regs, dense, err := hllGet(key)
+	if err != nil {
+		return nil, err
+	}
+	updated := regs == nil
+	if updated {
+		regs = make([]uint8, hllRegisters)
+	}
+	for _, ele := range args[2:] {
+		index, count := hllPatLen([]byte(ele))
+		if count > regs[index] {
+			regs[index] = count
+			updated = true
+		}
+	}
+	if !updated {
+		return redcon.SimpleInt(0), nil
+	}
+	if err := hllSet(key, regs, dense); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(1), nil
+}
+
+// cmdPFCOUNT returns the approximated cardinality of the union of the
+// HyperLogLogs. Unlike Redis the cardinality cache is not written back,
+// since reads do not go through the Raft log.
+// Syntax: PFCOUNT key [key ...]
+func cmdPFCOUNT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	if len(args) == 2 {
+		v, err := ldb.Get([]byte(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return redcon.SimpleInt(0), nil
+		}
+		regs, err := hllDecode(v)
+		if err != nil {
+			return nil, err
+		}
+		if v[hllHdrSize-1]&(1<<7) == 0 {
+			// the cache of a value written by Redis
+			return redcon.SimpleInt(binary.LittleEndian.Uint64(v[8:hllHdrSize])), nil
+		}
+		return redcon.SimpleInt(hllCount(regs)), nil
+	}
+	max := make([]uint8, hllRegisters)
+	if _, err := hllMerge(max, args[1:]); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(hllCount(max)), nil
+}
+
+// hllMerge maxes the registers of the HyperLogLogs at keys into max. It
+// returns true if one of them is dense.
+func hllMerge(max []uint8, keys []string) (bool, error) {
+	var anyDense bool
+	for _, key := range keys {
+		regs, dense, err := hllGet([]byte(key))
+		if err != nil {
+			return false, err
+		}
+		anyDense = anyDense || dense
+		for i, val := range regs {
+			if val > max[i] {
+				max[i] = val
+			}
+		}
+	}
+	return anyDense, nil
+}
+
+// cmdPFMERGE merges the HyperLogLogs at the source keys and destkey into
+// destkey.
+// Syntax: PFMERGE destkey [sourcekey [sourcekey ...]]
+func cmdPFMERGE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	max := make([]uint8, hllRegisters)
+	dense, err := hllMerge(max, args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if err := hllSet([]byte(args[1]), max, dense); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
@@ -0,0 +1,131 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if n, err := c.PFAdd(ctx, "hll", 1, 2, 3, 4, 5).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.PFCount(ctx, "hll").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Fatal(n)
+	}
+	if n, err := c.PFAdd(ctx, "hll", 1, 2).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	c.PFAdd(ctx, "hll", 6, 7, 8, 8, 9, 10)
+	if n, err := c.PFCount(ctx, "hll").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 10 {
+		t.Fatal(n)
+	}
+	// a small HyperLogLog is sparse
+	if v, err := c.Get(ctx, "hll").Result(); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(v, "HYLL\x01") {
+		t.Fatalf("%q", v)
+	}
+	if n, err := c.PFAdd(ctx, "hll_empty").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.PFCount(ctx, "hll_empty", "hll_none").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	c.PFAdd(ctx, "hll2", 8, 9, 10, 11, 12)
+	if n, err := c.PFCount(ctx, "hll", "hll2").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 12 {
+		t.Fatal(n)
+	}
+	if err := c.PFMerge(ctx, "hll3", "hll", "hll2").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.PFCount(ctx, "hll3").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 12 {
+		t.Fatal(n)
+	}
+
+	// the cardinality cache of a value written by Redis is used
+	c.Set(ctx, "hll_redis", "HYLL\x01\x00\x00\x00\x2a\x00\x00\x00\x00\x00\x00\x00\x7f\xff", 0)
+	if n, err := c.PFCount(ctx, "hll_redis").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 42 {
+		t.Fatal(n)
+	}
+
+	c.Set(ctx, "hll_string", "v", 0)
+	if err := c.PFAdd(ctx, "hll_string", "a").Err(); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Fatal(err)
+	}
+	c.Append(ctx, "hll2", "hello")
+	if err := c.PFCount(ctx, "hll2").Err(); err == nil || !strings.HasPrefix(err.Error(), "INVALIDOBJ") {
+		t.Fatal(err)
+	}
+}
+
+func TestHyperLogLogDense(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	const n = 20000
+	for i := 0; i < n; i += 1000 {
+		elements := make([]interface{}, 1000)
+		for j := range elements {
+			elements[j] = "ele" + strconv.Itoa(i+j)
+		}
+		if err := c.PFAdd(ctx, "hll_dense", elements...).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := c.Get(ctx, "hll_dense").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != hllDenseSize || v[4] != hllDense {
+		t.Fatal(len(v), v[4])
+	}
+	count, err := c.PFCount(ctx, "hll_dense").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := math.Abs(float64(count-n)) / n; e > 0.05 {
+		t.Fatal(count)
+	}
+
+	// merging into a sparse HyperLogLog makes it dense
+	c.PFAdd(ctx, "hll_sparse", "a")
+	if err := c.PFMerge(ctx, "hll_sparse", "hll_dense").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "hll_sparse").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != hllDenseSize {
+		t.Fatal(len(v))
+	}
+	if m, err := c.PFCount(ctx, "hll_sparse").Result(); err != nil {
+		t.Fatal(err)
+	} else if m < count || math.Abs(float64(m-n-1))/n > 0.05 {
+		t.Fatal(m, count)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ledisdb/ledisdb/store"
+)
+
+// The stagedDB counts the keys of every db, and the keys of each type, so
+// that DBSIZE and RANDOMKEY do not walk the keyspace. The counts follow the
+// meta keys of keyTypes: every write of the store goes through the stagedDB,
+// whether it comes from a command, from ledis itself or a flush, and the
+// writes that create or delete a meta key move the counts. The moves of a
+// stage are kept apart until it is committed.
+//
+// The counts are not stored, so they are made when the store is opened and
+// again once a snapshot is restored, with a scan of the meta keys and a read
+// per key of several types. A write of a meta key also reads whether it
+// exists, and one that creates or deletes it reads the other types of the
+// key. --no-key-counts turns the counts off, DBSIZE and RANDOMKEY then walk
+// the keyspace like on a store opened without the stagedDB.
+
+// keyCounts is false when the counts are turned off with --no-key-counts.
+var keyCounts = true
+
+// countSlots is the number of counts of a db: its keys, then the keys of
+// each type of keyTypes.
+func countSlots() int {
+	return len(keyTypes) + 1
+}
+
+// countDelta are moves of the counts, by slot.
+type countDelta map[int]int64
+
+// metaTypeIndex returns the index in keyTypes of the type whose meta keys are
+// stored under typ, -1 if there is none.
+func metaTypeIndex(typ byte) int {
+	for i := range keyTypes {
+		if keyTypes[i].metaScan == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// rawMetaKey returns the meta key of the type t of key in the db index.
+func rawMetaKey(index, t int, key []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(index))
+	b = append(b, keyTypes[t].metaScan)
+	if keyTypes[t].metaScan == streamMetaType {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(key)))
+	}
+	return append(b, key...)
+}
+
+// parseMetaKey returns the db index, the type and the key name of a raw meta
+// key of the store. ok is false for the other keys.
+func (db *stagedDB) parseMetaKey(rk []byte) (index, t int, key []byte, ok bool) {
+	u, n := binary.Uvarint(rk)
+	if n <= 0 || u >= uint64(len(db.counts)/countSlots()) || len(rk) == n {
+		return 0, 0, nil, false
+	}
+	if t = metaTypeIndex(rk[n]); t < 0 {
+		return 0, 0, nil, false
+	}
+	key = rk[n+1:]
+	if keyTypes[t].metaScan == streamMetaType {
+		if len(key) < 2 || int(binary.BigEndian.Uint16(key)) != len(key)-2 {
+			return 0, 0, nil, false
+		}
+		key = key[2:]
+	}
+	return int(u), t, key, true
+}
+
+// isMetaKey reports whether rk is a meta key whose writes move the counts.
+func (db *stagedDB) isMetaKey(rk []byte) bool {
+	if db.countsPaused.Load() {
+		return false
+	}
+	_, _, _, ok := db.parseMetaKey(rk)
+	return ok
+}
+
+// countOps returns the moves of the counts made by the writes ops, in order,
+// against the current content of the store.
+func (db *stagedDB) countOps(ops []stagedOp) (countDelta, error) {
+	var counts countDelta
+	var written map[string]bool // the meta keys created or deleted by ops
+	exists := func(rk []byte) (bool, error) {
+		if ok, found := written[string(rk)]; found {
+			return ok, nil
+		}
+		v, err := db.Get(rk)
+		return v != nil, err
+	}
+	for _, op := range ops {
+		index, t, key, ok := db.parseMetaKey(op.key)
+		if !ok {
+			continue
+		}
+		had, err := exists(op.key)
+		if err != nil {
+			return nil, err
+		}
+		if had != op.del {
+			// an update, or the delete of a missing key
+			continue
+		}
+		if written == nil {
+			written, counts = make(map[string]bool), make(countDelta)
+		}
+		written[string(op.key)] = !op.del
+		n := int64(1)
+		if op.del {
+			n = -1
+		}
+		slot := index * countSlots()
+		counts[slot+1+t] += n
+		other := false
+		for i := range keyTypes {
+			if i == t {
+				continue
+			}
+			if other, err = exists(rawMetaKey(index, i, key)); err != nil {
+				return nil, err
+			} else if other {
+				break
+			}
+		}
+		if !other {
+			counts[slot] += n
+		}
+	}
+	return counts, nil
+}
+
+// addCounts applies counts, to the stage when one is begun.
+func (db *stagedDB) addCounts(counts countDelta) {
+	if db.overlay.Load() != nil {
+		for slot, n := range counts {
+			db.stageCounts[slot] += n
+		}
+		return
+	}
+	for slot, n := range counts {
+		db.counts[slot].Add(n)
+	}
+}
+
+// keyCount returns the number of keys of the ledis db index, of the type t of
+// keyTypes, or of all the types when t is -1. The index is ldb.Index(), not
+// the logical index SWAPDB changes.
+func (db *stagedDB) keyCount(index, t int) int64 {
+	slot := index*countSlots() + 1 + t
+	n := db.counts[slot].Load()
+	if db.overlay.Load() != nil {
+		n += db.stageCounts[slot]
+	}
+	return n
+}
+
+// withoutCounts runs fn, whose writes do not move the counts, then counts the
+// keys again. The restore of a snapshot writes every key, a single scan costs
+// less than the reads of each write.
+func (db *stagedDB) withoutCounts(fn func() error) error {
+	if db.counts == nil {
+		return fn()
+	}
+	db.countsPaused.Store(true)
+	defer db.countsPaused.Store(false)
+	err := fn()
+	if cerr := db.countKeys(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// countKeys counts the keys of the store.
+func (db *stagedDB) countKeys() error {
+	for i := range db.counts {
+		db.counts[i].Store(0)
+	}
+	it := db.IDB.NewIterator()
+	defer it.Close()
+	for index := 0; index < len(db.counts)/countSlots(); index++ {
+		slot := index * countSlots()
+		for t := range keyTypes {
+			prefix := rawMetaKey(index, t, nil)
+			if keyTypes[t].metaScan == streamMetaType {
+				prefix = prefix[:len(prefix)-2]
+			}
+			for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+				_, _, key, ok := db.parseMetaKey(it.Key())
+				if !ok {
+					continue
+				}
+				db.counts[slot+1+t].Add(1)
+				other := false
+				for i := 0; i < t && !other; i++ {
+					v, err := db.IDB.Get(rawMetaKey(index, i, key))
+					if err != nil {
+						return err
+					}
+					other = v != nil
+				}
+				if !other {
+					db.counts[slot].Add(1)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dbKeyCount returns the number of keys of the current db, of the type t of
+// keyTypes or of all the types when t is -1. It walks the keyspace when there
+// are no counts.
+func dbKeyCount(t int) int64 {
+	if counter, _ := ldb.GetSDB().GetDriver().(*stagedDB); counter != nil && counter.counts != nil {
+		return counter.keyCount(ldb.Index(), t)
+	}
+	var n int64
+	if t == -1 {
+		forEachKey(func([]byte) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	prefix := append(streamDBPrefix(), keyTypes[t].metaScan)
+	it := ldb.GetSDB().RangeIterator(prefix, prefixEnd(prefix), store.RangeROpen)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/ledisdb/ledisdb/store"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddReadCommand("KEYS", cmdKEYS)
+	conf.AddReadCommand("TYPE", cmdTYPE)
+	conf.AddReadCommand("RANDOMKEY", cmdRANDOMKEY)
+	conf.AddReadCommand("DBSIZE", cmdDBSIZE)
+	conf.AddWriteCommand("RENAME", cmdRENAME)
+	conf.AddWriteCommand("RENAMENX", cmdRENAMENX)
+	conf.AddWriteCommand("COPY", cmdCOPY)
+}
+
+var (
+	errNoSuchKey    = errors.New("ERR no such key")
+	errDBOutOfRange = errors.New("ERR DB index is out of range")
+	errSameObject   = errors.New("ERR source and destination objects are the same")
+	errWrongType    = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+// keyType describes how the values of a Redis type are laid out in the ledis
+// store. Every type has a meta key, which exists as long as the key does, and
+// data keys prefixed with db|type|keylen|key. The expire time is kept in the
+// ledis TTL keys under expType.
+type keyType struct {
+	name      string
+	metaKey   func(key []byte) []byte
+	metaScan  byte // store type of the meta keys, to enumerate the keys
+	dataTypes []byte
+	expType   byte
+}
+
+// ledisMetaKey encodes db|typ|key, the layout of the ledis meta keys.
+func ledisMetaKey(typ byte, key []byte) []byte {
+	return append(append(streamDBPrefix(), typ), key...)
+}
+
+func ledisMetaKeyFunc(typ byte) func(key []byte) []byte {
+	return func(key []byte) []byte {
+		return ledisMetaKey(typ, key)
+	}
+}
+
+// keyTypes lists the types in the order TYPE checks them, since ledis keeps
+// every type in its own namespace a name can exist with several types.
+var keyTypes = []keyType{
+	{"string", ledisMetaKeyFunc(ledis.KVType), ledis.KVType, nil, ledis.KVType},
+	{"list", ledisMetaKeyFunc(ledis.LMetaType), ledis.LMetaType, []byte{ledis.ListType}, ledis.ListType},
+	{"set", ledisMetaKeyFunc(ledis.SSizeType), ledis.SSizeType, []byte{ledis.SetType}, ledis.SetType},
+	{"zset", ledisMetaKeyFunc(ledis.ZSizeType), ledis.ZSizeType, []byte{ledis.ZSetType, ledis.ZScoreType}, ledis.ZSetType},
+	{"hash", ledisMetaKeyFunc(ledis.HSizeType), ledis.HSizeType, []byte{ledis.HashType}, ledis.HashType},
+	{"stream", func(key []byte) []byte { return streamKey(streamMetaType, key) }, streamMetaType,
+		[]byte{streamEntryType, streamGroupType, streamPELType}, streamMetaType},
+}
+
+// decodeMetaKey returns the key name of a raw meta key of the type.
+func (kt *keyType) decodeMetaKey(rk []byte) []byte {
+	rk = rk[len(streamDBPrefix())+1:]
+	if kt.metaScan == streamMetaType {
+		rk = rk[2:]
+	}
+	return rk
+}
+
+// keyTypeByExp returns the type whose expire time is kept under the ledis
+// data type typ, nil if there is none.
+func keyTypeByExp(typ byte) *keyType {
+	for i := range keyTypes {
+		if keyTypes[i].expType == typ {
+			return &keyTypes[i]
+		}
+	}
+	return nil
+}
+
+func (kt *keyType) exists(key []byte) (bool, error) {
+	v, err := ldb.GetSDB().Get(kt.metaKey(key))
+	return v != nil, err
+}
+
+// keyTypesOf returns the types the key exists with.
+func keyTypesOf(key []byte) ([]*keyType, error) {
+	var types []*keyType
+	for i := range keyTypes {
+		if ok, err := keyTypes[i].exists(key); err != nil {
+			return nil, err
+		} else if ok {
+			types = append(types, &keyTypes[i])
+		}
+	}
+	return types, nil
+}
+
+// expMetaKey and expTimeKey are the ledis TTL keys:
+//
+//	db|ExpMetaType|type|key      -> when
+//	db|ExpTimeType|when|type|key -> meta key
+func expMetaKey(typ byte, key []byte) []byte {
+	return append(append(streamDBPrefix(), ledis.ExpMetaType, typ), key...)
+}
+
+func expTimeKey(typ byte, key []byte, when int64) []byte {
+	b := append(streamDBPrefix(), ledis.ExpTimeType)
+	b = binary.BigEndian.AppendUint64(b, uint64(when))
+	return append(append(b, typ), key...)
+}
+
+// copyKey adds the copy of every value of the type from src to dst of the
+// database index to wb. The expire time is copied too. The values are read
+// before the copies are added, since their keys depend on the database.
+func (kt *keyType) copyKey(wb *store.WriteBatch, src []byte, index int, dst []byte) error {
+	sdb := ldb.GetSDB()
+	meta, err := sdb.Get(kt.metaKey(src))
+	if err != nil {
+		return err
+	}
+	data := make([][][2][]byte, len(kt.dataTypes))
+	for i, typ := range kt.dataTypes {
+		srcPrefix := streamKey(typ, src)
+		it := sdb.RangeIterator(srcPrefix, prefixEnd(srcPrefix), store.RangeROpen)
+		for ; it.Valid(); it.Next() {
+			data[i] = append(data[i], [2][]byte{
+				append([]byte(nil), it.RawKey()[len(srcPrefix):]...), it.Value()})
+		}
+		it.Close()
+	}
+	if kt.expType == ledis.HashType {
+		copyHFieldExpires(wb, src, index, dst)
+	}
+	ms, err := keyPExpireAt(kt, src)
+	if err != nil {
+		return err
+	}
+	return inDB(index, func() error {
+		wb.Put(kt.metaKey(dst), meta)
+		for i, typ := range kt.dataTypes {
+			dstPrefix := streamKey(typ, dst)
+			for _, kv := range data[i] {
+				wb.Put(append(dstPrefix[:len(dstPrefix):len(dstPrefix)], kv[0]...), kv[1])
+			}
+		}
+		if ms == -1 {
+			return nil
+		}
+		return setKeyPExpireAt(wb, kt, dst, ms)
+	})
+}
+
+// deleteKey adds the deletion of every value of the type of key to wb.
+func (kt *keyType) deleteKey(wb *store.WriteBatch, key []byte) error {
+	wb.Delete(kt.metaKey(key))
+	for _, typ := range kt.dataTypes {
+		deletePrefix(wb, streamKey(typ, key))
+	}
+	if kt.expType == ledis.HashType {
+		deleteHFieldExpires(wb, key)
+	}
+	_, err := removeKeyExpire(wb, kt, key)
+	return err
+}
+
+// deleteKeyAllTypes adds the deletion of key, whatever its types, to wb. It
+// returns true if the key existed.
+func deleteKeyAllTypes(wb *store.WriteBatch, key []byte) (bool, error) {
+	types, err := keyTypesOf(key)
+	if err != nil {
+		return false, err
+	}
+	for _, kt := range types {
+		if err := kt.deleteKey(wb, key); err != nil {
+			return false, err
+		}
+	}
+	return len(types) > 0, nil
+}
+
+// forEachKey calls fn with every distinct key name of the current db, until fn
+// returns false.
+func forEachKey(fn func(key []byte) bool) {
+	seen := make(map[string]bool)
+	for i := range keyTypes {
+		kt := &keyTypes[i]
+		prefix := append(streamDBPrefix(), kt.metaScan)
+		it := ldb.GetSDB().RangeIterator(prefix, prefixEnd(prefix), store.RangeROpen)
+		for ; it.Valid(); it.Next() {
+			key := kt.decodeMetaKey(it.RawKey())
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			if !fn(append([]byte(nil), key...)) {
+				it.Close()
+				return
+			}
+		}
+		it.Close()
+	}
+}
+
+// cmdKEYS returns all the keys matching the glob-style pattern
+// Syntax: KEYS pattern
+func cmdKEYS(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	missing, err := unreapedKeys(unixMilli(m.Now()))
+	if err != nil {
+		return nil, err
+	}
+	pattern := args[1]
+	keys := []interface{}{}
+	forEachKey(func(key []byte) bool {
+		if missing[string(key)] {
+			return true
+		}
+		if pattern == "*" || globMatch(pattern, string(key), false) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, nil
+}
+
+// cmdTYPE returns the type of the value stored at key
+// Syntax: TYPE key
+func cmdTYPE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	types, err := keyTypesOf([]byte(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		return redcon.SimpleString("none"), nil
+	}
+	return redcon.SimpleString(types[0].name), nil
+}
+
+// randomKeyTries is the number of keys RANDOMKEY picks before it walks the
+// keyspace, when the keys it picks expired.
+const randomKeyTries = 16
+
+// cmdRANDOMKEY returns a random key of the current db
+// Syntax: RANDOMKEY
+func cmdRANDOMKEY(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	missing, err := unreapedKeys(unixMilli(m.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if dbKeyCount(-1) <= int64(len(missing)) {
+		return nil, nil
+	}
+	counts := make([]int64, len(keyTypes))
+	for t := range keyTypes {
+		counts[t] = dbKeyCount(t)
+	}
+	for i := 0; i < randomKeyTries; i++ {
+		if key := randomKey(counts); key != nil && !missing[string(key)] {
+			return key, nil
+		}
+	}
+	var key []byte
+	forEachKey(func(k []byte) bool {
+		if missing[string(k)] {
+			return true
+		}
+		key = k
+		return false
+	})
+	return key, nil
+}
+
+// randomKey picks a type by its number of keys in counts, then the first key
+// of the type from a random point between its first and its last key. The
+// keys are not picked evenly, like in Redis. It returns nil for an empty db.
+func randomKey(counts []int64) []byte {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	if total <= 0 {
+		return nil
+	}
+	rng := readRand()
+	r := rng.Int63n(total)
+	t := 0
+	for ; t < len(keyTypes)-1; t++ {
+		if r -= counts[t]; r < 0 {
+			break
+		}
+	}
+	kt := &keyTypes[t]
+	sdb := ldb.GetSDB()
+	prefix := append(streamDBPrefix(), kt.metaScan)
+	end := prefixEnd(prefix)
+
+	it := sdb.RangeIterator(prefix, end, store.RangeROpen)
+	if !it.Valid() {
+		it.Close()
+		return nil
+	}
+	first := append([]byte(nil), it.RawKey()[len(prefix):]...)
+	it.Close()
+	it = sdb.RevRangeIterator(prefix, end, store.RangeROpen)
+	last := append([]byte(nil), it.RawKey()[len(prefix):]...)
+	it.Close()
+
+	prefix = prefix[:len(prefix):len(prefix)]
+	if lo, hi := keyPoint(first), keyPoint(last); hi > lo {
+		off := rng.Uint64()
+		if hi-lo < math.MaxUint64 {
+			off %= hi - lo + 1
+		}
+		point := binary.BigEndian.AppendUint64(prefix, lo+off)
+		it = sdb.RangeIterator(point, end, store.RangeROpen)
+		defer it.Close()
+		if it.Valid() {
+			return append([]byte(nil), kt.decodeMetaKey(it.RawKey())...)
+		}
+	}
+	return append([]byte(nil), kt.decodeMetaKey(append(prefix, first...))...)
+}
+
+// keyPoint returns the first 8 bytes of a raw key as a number, to pick a
+// point between two keys.
+func keyPoint(b []byte) uint64 {
+	var p [8]byte
+	copy(p[:], b)
+	return binary.BigEndian.Uint64(p[:])
+}
+
+// cmdDBSIZE returns the number of keys of the current db
+// Syntax: DBSIZE
+func cmdDBSIZE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	missing, err := unreapedKeys(unixMilli(m.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(dbKeyCount(-1) - int64(len(missing))), nil
+}
+
+// cmdRENAME renames key to newkey, overwriting newkey whatever its type
+// Syntax: RENAME key newkey
+func cmdRENAME(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	if _, err := renameKey([]byte(args[1]), []byte(args[2]), false); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+// cmdRENAMENX renames key to newkey if newkey does not exist
+// Syntax: RENAMENX key newkey
+func cmdRENAMENX(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	ok, err := renameKey([]byte(args[1]), []byte(args[2]), true)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return redcon.SimpleInt(0), nil
+	}
+	return redcon.SimpleInt(1), nil
+}
+
+// renameKey moves every type of src to dst in one write batch.
+func renameKey(src, dst []byte, nx bool) (bool, error) {
+	types, err := keyTypesOf(src)
+	if err != nil {
+		return false, err
+	}
+	if len(types) == 0 {
+		return false, errNoSuchKey
+	}
+	if nx {
+		if dstTypes, err := keyTypesOf(dst); err != nil || len(dstTypes) > 0 {
+			return false, err
+		}
+	}
+	if string(src) == string(dst) {
+		return !nx, nil
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if _, err := deleteKeyAllTypes(wb, dst); err != nil {
+		return false, err
+	}
+	for _, kt := range types {
+		if err := kt.copyKey(wb, src, curDB, dst); err != nil {
+			return false, err
+		}
+		if err := kt.deleteKey(wb, src); err != nil {
+			return false, err
+		}
+	}
+	return true, wb.Commit()
+}
+
+// parseCopyArgs returns the destination database and the REPLACE option of
+// COPY source destination [DB destination-db] [REPLACE].
+func parseCopyArgs(args []string) (index int, replace bool, err error) {
+	index = curDB
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return 0, false, uhaha.ErrSyntax
+			}
+			if index, err = parseDBIndex(args[i+1]); err != nil {
+				return 0, false, err
+			}
+			i++
+		default:
+			return 0, false, uhaha.ErrSyntax
+		}
+	}
+	return index, replace, nil
+}
+
+// cmdCOPY copies the value of source to destination
+// Syntax: COPY source destination [DB destination-db] [REPLACE]
+func cmdCOPY(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	src, dst := []byte(args[1]), []byte(args[2])
+	index, replace, err := parseCopyArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if index == curDB && string(src) == string(dst) {
+		return nil, errSameObject
+	}
+	types, err := keyTypesOf(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		return redcon.SimpleInt(0), nil
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	var exists bool
+	if err := inDB(index, func() error {
+		if replace {
+			_, err := deleteKeyAllTypes(wb, dst)
+			return err
+		}
+		dstTypes, err := keyTypesOf(dst)
+		exists = len(dstTypes) > 0
+		return err
+	}); err != nil {
+		return nil, err
+	} else if exists {
+		return redcon.SimpleInt(0), nil
+	}
+	for _, kt := range types {
+		if err := kt.copyKey(wb, src, index, dst); err != nil {
+			return nil, err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	if index != curDB {
+		// the keyspace events of the current database are notified by
+		// AddWriteCommand, the ones of the destination here
+		inDB(index, func() error {
+			notifyKeyspaceEvent(notifyNew, "new", args[2])
+			notifyKeyspaceEvent(notifyGeneric, "copy_to", args[2])
+			return nil
+		})
+	}
+	return redcon.SimpleInt(1), nil
+}
+
+// globMatch reports whether str matches the Redis glob-style pattern, with
+// the same rules as the Redis stringmatchlen: *, ?, [...] classes with ranges
+// and negation, and \ escapes.
+func globMatch(pattern, str string, nocase bool) bool {
+	lower := func(c byte) byte {
+		if nocase && c >= 'A' && c <= 'Z' {
+			return c + 'a' - 'A'
+		}
+		return c
+	}
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if globMatch(pattern[1:], str[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			var match bool
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := lower(pattern[0]), lower(pattern[2])
+					if start > end {
+						start, end = end, start
+					}
+					if c := lower(str[0]); c >= start && c <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				default:
+					if lower(pattern[0]) == lower(str[0]) {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// unterminated class, like Redis the last char closes it
+				pattern = "]"
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || lower(pattern[0]) != lower(str[0]) {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
+}
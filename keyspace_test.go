@@ -0,0 +1,250 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestKeyspace(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if err := c.FlushAll(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	c.Set(ctx, "ks_string", "v", 0)
+	c.RPush(ctx, "ks_list", "a", "b")
+	c.SAdd(ctx, "ks_set", "a")
+	c.ZAdd(ctx, "ks_zset", redis.Z{Score: 1, Member: "a"})
+	c.HSet(ctx, "ks_hash", "f", "v")
+	c.XAdd(ctx, &redis.XAddArgs{Stream: "ks_stream", ID: "1-1", Values: []string{"f", "v"}})
+
+	for key, typ := range map[string]string{
+		"ks_string": "string", "ks_list": "list", "ks_set": "set",
+		"ks_zset": "zset", "ks_hash": "hash", "ks_stream": "stream", "ks_none": "none",
+	} {
+		if v, err := c.Type(ctx, key).Result(); err != nil {
+			t.Fatal(err)
+		} else if v != typ {
+			t.Fatalf("%s: expected %s, got %s", key, typ, v)
+		}
+	}
+
+	if n, err := c.DBSize(ctx).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 6 {
+		t.Fatal(n)
+	}
+	keys, err := c.Keys(ctx, "ks_[hl]*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "ks_hash" || keys[1] != "ks_list" {
+		t.Fatal(keys)
+	}
+	if keys, err := c.Keys(ctx, "*").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 6 {
+		t.Fatal(keys)
+	}
+	if key, err := c.RandomKey(ctx).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(key) < 3 || key[:3] != "ks_" {
+		t.Fatal(key)
+	}
+
+	// RENAME moves the value and overwrites the destination whatever its type
+	if err := c.Rename(ctx, "ks_hash", "ks_list").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Type(ctx, "ks_list").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "hash" {
+		t.Fatal(v)
+	}
+	if v, err := c.HGet(ctx, "ks_list", "f").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+	if v, err := c.Type(ctx, "ks_hash").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "none" {
+		t.Fatal(v)
+	}
+	if err := c.Rename(ctx, "ks_none", "ks_other").Err(); err == nil {
+		t.Fatal("expected no such key")
+	}
+
+	c.Expire(ctx, "ks_string", time.Hour)
+	if ok, err := c.RenameNX(ctx, "ks_string", "ks_set").Result(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("RENAMENX overwrote an existing key")
+	}
+	if ok, err := c.RenameNX(ctx, "ks_string", "ks_string2").Result(); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("RENAMENX failed")
+	}
+	if v, err := c.Get(ctx, "ks_string2").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+	if d, err := c.TTL(ctx, "ks_string2").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 0 {
+		t.Fatal("RENAMENX lost the TTL", d)
+	}
+
+	if n, err := c.Copy(ctx, "ks_zset", "ks_set", 0, false).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.Copy(ctx, "ks_zset", "ks_set", 0, true).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if v, err := c.ZRange(ctx, "ks_set", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 1 || v[0] != "a" {
+		t.Fatal(v)
+	}
+	if v, err := c.Type(ctx, "ks_set").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "zset" {
+		t.Fatal(v)
+	}
+	if n, err := c.Copy(ctx, "ks_stream", "ks_stream2", 0, false).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.XLen(ctx, "ks_stream2").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+}
+
+// walkDBSize counts the keys of the database index by walking the keyspace.
+func walkDBSize(t *testing.T, index int) int64 {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	var n int64
+	inDB(index, func() error {
+		forEachKey(func(key []byte) bool {
+			n++
+			return true
+		})
+		return nil
+	})
+	return n
+}
+
+func TestKeyCounts(t *testing.T) {
+	ctx := context.Background()
+	conn, other := dbConn(t, 7), dbConn(t, 8)
+	conn.FlushDB(ctx)
+	other.FlushDB(ctx)
+
+	expect := func(n int64) {
+		t.Helper()
+		for i, cn := range []*redis.Client{conn, other} {
+			v, err := cn.DBSize(ctx).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w := walkDBSize(t, 7+i); v != w || (i == 0 && v != n) {
+				t.Fatalf("db %d: DBSIZE %d, %d keys, expected %d", 7+i, v, w, n)
+			}
+		}
+	}
+
+	conn.Set(ctx, "count_a", "v", 0)
+	conn.Set(ctx, "count_empty", "", 0)
+	conn.HSet(ctx, "count_a", "f", "v") // the same name as a hash
+	conn.RPush(ctx, "count_list", "a", "b")
+	conn.SAdd(ctx, "count_set", "a")
+	conn.ZAdd(ctx, "count_zset", redis.Z{Score: 1, Member: "a"})
+	conn.XAdd(ctx, &redis.XAddArgs{Stream: "count_stream", ID: "1-1", Values: []string{"f", "v"}})
+	expect(6)
+	conn.Set(ctx, "count_a", "w", 0)
+	conn.HDel(ctx, "count_a", "f")
+	expect(6)
+	conn.Del(ctx, "count_a")
+	conn.LPop(ctx, "count_list")
+	conn.LPop(ctx, "count_list")
+	expect(4)
+	conn.Rename(ctx, "count_set", "count_set2")
+	conn.Copy(ctx, "count_zset", "count_zset", 8, false)
+	conn.Move(ctx, "count_stream", 8)
+	expect(3)
+	if err := conn.PExpireAt(ctx, "count_set2", time.UnixMilli(1)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect(2)
+
+	// EXEC counts its staged writes once committed
+	cmds, err := conn.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, "count_tx", "v", 0)
+		p.DBSize(ctx)
+		p.Del(ctx, "count_empty")
+		p.DBSize(ctx)
+		return nil
+	})
+	if err != nil || cmds[1].(*redis.IntCmd).Val() != 3 || cmds[3].(*redis.IntCmd).Val() != 2 {
+		t.Fatal(cmds, err)
+	}
+	expect(2)
+	if err := conn.Do(ctx, "swapdb", 7, 8).Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect(2)
+	conn.Do(ctx, "swapdb", 7, 8)
+	conn.FlushDB(ctx)
+	expect(0)
+	if err := conn.RandomKey(ctx).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyspaceUnreaped(t *testing.T) {
+	ctx := context.Background()
+	expireReaperPaused.Store(true)
+	defer expireReaperPaused.Store(false)
+	conn := dbConn(t, 7)
+	conn.FlushDB(ctx)
+
+	conn.Set(ctx, "unreaped_live", "v", 0)
+	conn.Set(ctx, "unreaped_key", "v", 100*time.Millisecond)
+	conn.HSet(ctx, "unreaped_hash", "f", "v")
+	conn.Do(ctx, "hpexpire", "unreaped_hash", 100, "fields", 1, "f")
+	time.Sleep(500 * time.Millisecond)
+	if n, err := conn.DBSize(ctx).Result(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if keys, err := conn.Keys(ctx, "*").Result(); err != nil || len(keys) != 1 || keys[0] != "unreaped_live" {
+		t.Fatal(keys, err)
+	}
+	for i := 0; i < 20; i++ {
+		if key, err := conn.RandomKey(ctx).Result(); err != nil || key != "unreaped_live" {
+			t.Fatal(key, err)
+		}
+	}
+	conn.Del(ctx, "unreaped_live")
+	if err := conn.RandomKey(ctx).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+}
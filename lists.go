@@ -2,18 +2,30 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ledisdb/ledisdb/ledis"
-	"github.com/siddontang/go/hack"
 	"github.com/tidwall/redcon"
 	"github.com/tidwall/uhaha"
 )
 
 func init() {
-	//All block type instructions of the queue need to be avoided, dangerous operation
-	//conf.AddReadCommand("BLPOP", cmdBLPOP) //Danger here: If it is a Raft write command, Raft will perform command rollback => stuck Raft. If it is a Raft read command, then Raft will not be able to roll back the queue consumption log, and dirty data in the queue will appear.
+	// Blocking pops never block inside the Raft log: the leader waits for
+	// data on the client connection, then issues the pop as a write that
+	// does not block.
+	addConnCommand("BLPOP", connBPOP)
+	addConnCommand("BRPOP", connBPOP)
+	addConnCommand("BRPOPLPUSH", connBPOP)
+	addConnCommand("BLMOVE", connBPOP)
+	conf.AddWriteCommand("BLPOP", cmdBLPOP)
+	conf.AddWriteCommand("BRPOP", cmdBRPOP)
+	conf.AddWriteCommand("BRPOPLPUSH", cmdBRPOPLPUSH)
+	conf.AddWriteCommand("BLMOVE", cmdBLMOVE)
 	conf.AddWriteCommand("RPUSH", cmdRPUSH)
 	conf.AddWriteCommand("LPOP", cmdLPOP)
 	conf.AddReadCommand("LINDEX", cmdLINDEX)
@@ -23,6 +35,13 @@ func init() {
 	conf.AddWriteCommand("LSET", cmdLSET)
 	conf.AddReadCommand("LLEN", cmdLLEN)
 	conf.AddWriteCommand("RPOPLPUSH", cmdRPOPLPUSH)
+	conf.AddWriteCommand("LMOVE", cmdLMOVE)
+	conf.AddWriteCommand("LINSERT", cmdLINSERT)
+	conf.AddWriteCommand("LREM", cmdLREM)
+	conf.AddReadCommand("LPOS", cmdLPOS)
+	conf.AddWriteCommand("LPUSHX", cmdLPUSHX)
+	conf.AddWriteCommand("RPUSHX", cmdRPUSHX)
+	conf.AddWriteCommand("LMPOP", cmdLMPOP)
 
 	//IceFireDB special command
 	conf.AddWriteCommand("LCLEAR", cmdLCLEAR)
@@ -89,12 +108,7 @@ func cmdLTTL(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 2 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-
-	v, err := ldb.LTTL([]byte(args[1]))
-	if err != nil {
-		return nil, err
-	}
-	return redcon.SimpleInt(v), nil
+	return keyTypeTTL(keyTypeByExp(ledis.ListType), []byte(args[1]), m.Now())
 }
 
 func cmdLEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
@@ -106,21 +120,7 @@ func cmdLEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	//If the timestamp is less than the current time, delete operation: There are boundary conditions here: because it is a queue, the rollback of the raft log is sequential
-	if timestamp < time.Now().Unix() {
-		_, err := ldb.LClear([]byte(args[1]))
-		if err != nil {
-			return nil, err
-		}
-		return redcon.SimpleInt(0), nil
-	}
-
-	v, err := ldb.LExpireAt([]byte(args[1]), timestamp)
-	if err != nil {
-		return nil, err
-	}
-	return redcon.SimpleInt(v), nil
+	return expireKeyType(m, keyTypeByExp(ledis.ListType), []byte(args[1]), timestamp*1000)
 }
 
 func cmdLEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
@@ -132,22 +132,7 @@ func cmdLEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	timestamp := m.Now().Unix() + duration
-	//If the timestamp is less than the current time, delete operation
-	if timestamp < time.Now().Unix() {
-		_, err := ldb.LClear([]byte(args[1]))
-		if err != nil {
-			return nil, err
-		}
-		return redcon.SimpleInt(0), nil
-	}
-
-	v, err := ldb.LExpireAt([]byte(args[1]), timestamp)
-	if err != nil {
-		return nil, err
-	}
-	return redcon.SimpleInt(v), nil
+	return expireKeyType(m, keyTypeByExp(ledis.ListType), []byte(args[1]), unixMilli(m.Now())+duration*1000)
 }
 
 func cmdLMCLEAR(m uhaha.Machine, args []string) (interface{}, error) {
@@ -183,18 +168,57 @@ func cmdRPOPLPUSH(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 3 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-	source, dest := []byte(args[1]), []byte(args[2])
+	return lMove([]byte(args[1]), []byte(args[2]), false, true)
+}
 
-	var ttl int64 = -1
-	if bytes.Compare(source, dest) == 0 {
+func cmdLMOVE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	fromLeft, err := lParseDirection(args[3])
+	if err != nil {
+		return nil, err
+	}
+	toLeft, err := lParseDirection(args[4])
+	if err != nil {
+		return nil, err
+	}
+	return lMove([]byte(args[1]), []byte(args[2]), fromLeft, toLeft)
+}
+
+func lParseDirection(arg string) (left bool, err error) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, uhaha.ErrSyntax
+}
+
+// lMove pops an element from one end of source and pushes it to one end of
+// dest. It returns nil if source is empty.
+func lMove(source, dest []byte, fromLeft, toLeft bool) (interface{}, error) {
+	list := keyTypeByExp(ledis.ListType)
+	var expireAt int64 = -1
+	if bytes.Equal(source, dest) {
 		var err error
-		ttl, err = ldb.LTTL(source)
+		expireAt, err = keyPExpireAt(list, source)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	data, err := ldb.RPop(source)
+	pop, revert := ldb.RPop, ldb.RPush
+	if fromLeft {
+		pop, revert = ldb.LPop, ldb.LPush
+	}
+	push := ldb.RPush
+	if toLeft {
+		push = ldb.LPush
+	}
+
+	data, err := pop(source)
 	if err != nil {
 		return nil, err
 	}
@@ -203,14 +227,21 @@ func cmdRPOPLPUSH(m uhaha.Machine, args []string) (interface{}, error) {
 		return nil, nil
 	}
 
-	if _, err := ldb.LPush(dest, data); err != nil {
-		ldb.RPush(source, data) //revert pop
+	if _, err := push(dest, data); err != nil {
+		revert(source, data) //revert pop
 		return nil, err
 	}
 
-	//reset ttl
-	if ttl != -1 {
-		ldb.LExpire(source, ttl)
+	// popping the last element dropped the expire time
+	if expireAt != -1 {
+		wb := ldb.GetSDB().NewWriteBatch()
+		defer wb.Close()
+		if err := setKeyPExpireAt(wb, list, source, expireAt); err != nil {
+			return nil, err
+		}
+		if err := wb.Commit(); err != nil {
+			return nil, err
+		}
 	}
 
 	return data, nil
@@ -350,42 +381,432 @@ func cmdRPUSH(m uhaha.Machine, args []string) (interface{}, error) {
 	return redcon.SimpleInt(n), nil
 }
 
-//Danger here: If it is a Raft write command, Raft will perform command rollback => stuck Raft. If it is a Raft read command, then Raft will not be able to roll back the queue consumption log, and dirty data in the queue will appear.
-// func cmdBLPOP(m uhaha.Machine, args []string) (interface{}, error) {
-// 	if len(args) < 3 {
-// 		return nil, uhaha.ErrWrongNumArgs
-// 	}
+// cmdLINSERT inserts element before or after the first occurrence of pivot.
+// Syntax: LINSERT key BEFORE | AFTER pivot element
+func cmdLINSERT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	var before bool
+	switch strings.ToUpper(args[2]) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+	default:
+		return nil, uhaha.ErrSyntax
+	}
 
-// 	keys, timeout, err := lParseBPopArgs(args)
+	key := []byte(args[1])
+	values, err := ldb.LRange(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return redcon.SimpleInt(0), nil
+	}
+	for i, v := range values {
+		if string(v) != args[3] {
+			continue
+		}
+		if !before {
+			i++
+		}
+		list := make([][]byte, 0, len(values)+1)
+		list = append(list, values[:i]...)
+		list = append(list, []byte(args[4]))
+		list = append(list, values[i:]...)
+		if err := lReplace(key, values, list); err != nil {
+			return nil, err
+		}
+		return redcon.SimpleInt(len(list)), nil
+	}
+	return redcon.SimpleInt(-1), nil
+}
 
-// 	if err != nil {
-// 		return nil, err
-// 	}
+// cmdLREM removes the first count occurrences of element, the last ones for
+// a negative count and all of them for 0.
+// Syntax: LREM key count element
+func cmdLREM(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	count, err := ledis.StrInt64([]byte(args[2]), nil)
+	if err != nil {
+		return nil, err
+	}
 
-// 	ay, err := ldb.BLPop(keys, timeout)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	return ay, nil
-// }
+	key := []byte(args[1])
+	values, err := ldb.LRange(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]bool, len(values))
+	var n int64
+	for i := range values {
+		j := i
+		if count < 0 {
+			j = len(values) - 1 - i
+		}
+		if string(values[j]) != args[3] {
+			continue
+		}
+		removed[j] = true
+		n++
+		if n == count || n == -count {
+			break
+		}
+	}
+	if n == 0 {
+		return redcon.SimpleInt(0), nil
+	}
+	list := make([][]byte, 0, len(values)-int(n))
+	for i, v := range values {
+		if !removed[i] {
+			list = append(list, v)
+		}
+	}
+	if err := lReplace(key, values, list); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
 
-func lParseBPopArgs(argsOrigin []string) (keys [][]byte, timeout time.Duration, err error) {
-	if len(argsOrigin) < 3 {
-		err = uhaha.ErrWrongNumArgs
-		return
+// cmdLPOS returns the index of the matching elements.
+// Syntax: LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func cmdLPOS(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	if len(args)%2 == 0 {
+		return nil, uhaha.ErrSyntax
+	}
+	var rank, count, maxLen int64 = 1, 1, 0
+	withCount := false
+	for i := 3; i < len(args); i += 2 {
+		n, err := ledis.StrInt64([]byte(args[i+1]), nil)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(args[i]) {
+		case "RANK":
+			if n == 0 || n == math.MinInt64 {
+				return nil, errors.New("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return nil, errors.New("ERR COUNT can't be negative")
+			}
+			count, withCount = n, true
+		case "MAXLEN":
+			if n < 0 {
+				return nil, errors.New("ERR MAXLEN can't be negative")
+			}
+			maxLen = n
+		default:
+			return nil, uhaha.ErrSyntax
+		}
 	}
 
-	args := make([][]byte, len(argsOrigin)-1)
-	for i := 1; i < len(argsOrigin); i++ {
-		args[i-1] = []byte(argsOrigin[i])
+	values, err := ldb.LRange([]byte(args[1]), 0, -1)
+	if err != nil {
+		return nil, err
 	}
-	var t float64
-	if t, err = strconv.ParseFloat(hack.String(args[len(args)-1]), 64); err != nil {
-		return
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	matches := []interface{}{}
+	for i := range values {
+		if maxLen > 0 && int64(i) == maxLen {
+			break
+		}
+		j := i
+		if rank < 0 {
+			j = len(values) - 1 - i
+		}
+		if string(values[j]) != args[2] {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		matches = append(matches, redcon.SimpleInt(j))
+		if int64(len(matches)) == count {
+			break
+		}
+	}
+	if withCount {
+		return matches, nil
 	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return matches[0], nil
+}
 
-	timeout = time.Duration(t * float64(time.Second))
+func cmdLPUSHX(m uhaha.Machine, args []string) (interface{}, error) {
+	return lPushExisting(args, ldb.LPush)
+}
+
+func cmdRPUSHX(m uhaha.Machine, args []string) (interface{}, error) {
+	return lPushExisting(args, ldb.RPush)
+}
+
+// lPushExisting pushes the elements with push only if the list exists.
+func lPushExisting(args []string, push func(key []byte, args ...[]byte) (int64, error)) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	if n, err := ldb.LKeyExists(key); err != nil || n == 0 {
+		return redcon.SimpleInt(0), err
+	}
+	n, err := push(key, stringSliceToBytes(args[2:])...)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// cmdLMPOP pops up to count elements from the first non-empty list.
+// Syntax: LMPOP numkeys key [key ...] LEFT | RIGHT [COUNT count]
+func cmdLMPOP(m uhaha.Machine, args []string) (interface{}, error) {
+	keys, left, count, err := lParseMPopArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		bkey := []byte(key)
+		var values [][]byte
+		if left {
+			values, err = ldb.LRange(bkey, 0, int32(count-1))
+		} else {
+			values, err = ldb.LRange(bkey, int32(-count), -1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if left {
+			_, err = ldb.LTrimFront(bkey, int32(len(values)))
+		} else {
+			_, err = ldb.LTrimBack(bkey, int32(len(values)))
+			for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+				values[i], values[j] = values[j], values[i]
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{key, values}, nil
+	}
+	return nil, nil
+}
+
+func lParseMPopArgs(args []string) (keys []string, left bool, count int, err error) {
+	if len(args) < 4 {
+		return nil, false, 0, uhaha.ErrWrongNumArgs
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, errors.New("ERR numkeys should be greater than 0")
+	}
+	if len(args) < numKeys+3 {
+		return nil, false, 0, uhaha.ErrSyntax
+	}
+	keys = args[2 : numKeys+2]
+	if left, err = lParseDirection(args[numKeys+2]); err != nil {
+		return nil, false, 0, err
+	}
+	count = 1
+	switch rest := args[numKeys+3:]; {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0]) == "COUNT":
+		if count, err = strconv.Atoi(rest[1]); err != nil || count <= 0 || count > math.MaxInt32 {
+			return nil, false, 0, errors.New("ERR count should be greater than 0")
+		}
+	default:
+		return nil, false, 0, uhaha.ErrSyntax
+	}
+	return keys, left, count, nil
+}
+
+// lmpopKeys returns the keys of a LMPOP command.
+func lmpopKeys(args []string) []string {
+	keys, _, _, err := lParseMPopArgs(args)
+	if err != nil {
+		return nil
+	}
+	return keys
+}
+
+// lMaxSeq is the upper bound of the ledis list sequences.
+const lMaxSeq = 1<<31 - 1000
+
+// lSeqKey encodes db|ListType|keylen|key|seq, the ledis key of a list element.
+func lSeqKey(key []byte, seq int32) []byte {
+	return binary.BigEndian.AppendUint32(streamKey(ledis.ListType, key), uint32(seq))
+}
+
+// lReplace replaces the elements old of the list key with values in a single
+// batch. The list keeps its head sequence, so only the elements that moved are
+// written, and its expire time unless it becomes empty.
+func lReplace(key []byte, old, values [][]byte) error {
+	list := keyTypeByExp(ledis.ListType)
+	sdb := ldb.GetSDB()
+	wb := sdb.NewWriteBatch()
+	defer wb.Close()
+	if len(values) == 0 {
+		if err := list.deleteKey(wb, key); err != nil {
+			return err
+		}
+		return wb.Commit()
+	}
 
-	keys = args[0 : len(args)-1]
+	metaKey := list.metaKey(key)
+	meta, err := sdb.Get(metaKey)
+	if err != nil {
+		return err
+	}
+	if len(meta) != 8 {
+		return errors.New("ERR invalid list meta")
+	}
+	head := int32(binary.LittleEndian.Uint32(meta))
+	if int64(head)+int64(len(values)) >= lMaxSeq {
+		return errors.New("ERR invalid list sequence, overflow")
+	}
+	for i, v := range values {
+		if i >= len(old) || !bytes.Equal(v, old[i]) {
+			wb.Put(lSeqKey(key, head+int32(i)), v)
+		}
+	}
+	for i := len(values); i < len(old); i++ {
+		wb.Delete(lSeqKey(key, head+int32(i)))
+	}
+	meta = make([]byte, 8)
+	binary.LittleEndian.PutUint32(meta[0:4], uint32(head))
+	binary.LittleEndian.PutUint32(meta[4:8], uint32(head+int32(len(values))-1))
+	wb.Put(metaKey, meta)
+	return wb.Commit()
+}
+
+// connBPOP waits until one of the lists of a blocking pop has data, then
+// sends the pop, which does not block in the Raft log. A nil result means
+// another client won the race and the wait goes on.
+func connBPOP(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	keys, timeout, err := lParseBPop(args)
+	if err != nil {
+		return nil, err
+	}
+	return block(keys, timeout, func() (interface{}, error) {
+		for _, key := range keys {
+			n, err := c.sendRecv(s, "llen", key)
+			if err != nil {
+				return nil, err
+			}
+			if n, _ := n.(redcon.SimpleInt); n > 0 {
+				return c.sendRecv(s, args...)
+			}
+		}
+		return nil, nil
+	})
+}
+
+// cmdBLPOP pops the first element of the first list that is not empty. It
+// only runs once connBPOP saw data, or in a transaction, where it does not
+// block like in Redis.
+// Syntax: BLPOP key [key ...] timeout
+func cmdBLPOP(m uhaha.Machine, args []string) (interface{}, error) {
+	return lPopFirst(m, args, "lpop")
+}
+
+// cmdBRPOP pops the last element of the first list that is not empty.
+// Syntax: BRPOP key [key ...] timeout
+func cmdBRPOP(m uhaha.Machine, args []string) (interface{}, error) {
+	return lPopFirst(m, args, "rpop")
+}
+
+// lPopFirst runs pop on the keys of a BLPOP or BRPOP until one returns an
+// element. The pop tracks and notifies its key itself.
+func lPopFirst(m uhaha.Machine, args []string, pop string) (interface{}, error) {
+	keys, _, err := lParseBPop(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		v, err := commands[pop].fn(m, []string{pop, key})
+		if err != nil {
+			return nil, err
+		}
+		if v, _ := v.([]byte); v != nil {
+			return []interface{}{key, v}, nil
+		}
+	}
+	return nil, nil
+}
+
+// cmdBRPOPLPUSH is RPOPLPUSH once connBPOP saw data, or in a transaction.
+// Syntax: BRPOPLPUSH source destination timeout
+func cmdBRPOPLPUSH(m uhaha.Machine, args []string) (interface{}, error) {
+	if _, _, err := lParseBPop(args); err != nil {
+		return nil, err
+	}
+	return commands["rpoplpush"].fn(m, []string{"rpoplpush", args[1], args[2]})
+}
+
+// cmdBLMOVE is LMOVE once connBPOP saw data, or in a transaction.
+// Syntax: BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func cmdBLMOVE(m uhaha.Machine, args []string) (interface{}, error) {
+	if _, _, err := lParseBPop(args); err != nil {
+		return nil, err
+	}
+	return commands["lmove"].fn(m, append([]string{"lmove"}, args[1:5]...))
+}
+
+// lParseBPop returns the keys waited on by a blocking pop and its timeout.
+func lParseBPop(args []string) (keys []string, timeout time.Duration, err error) {
+	switch args[0] {
+	case "brpoplpush":
+		if len(args) != 4 {
+			return nil, 0, uhaha.ErrWrongNumArgs
+		}
+	case "blmove":
+		if len(args) != 6 {
+			return nil, 0, uhaha.ErrWrongNumArgs
+		}
+		for _, arg := range args[3:5] {
+			if _, err := lParseDirection(arg); err != nil {
+				return nil, 0, err
+			}
+		}
+	default:
+		return lParseBPopArgs(args)
+	}
+	timeout, err = lParseTimeout(args[len(args)-1])
+	return args[1:2], timeout, err
+}
+
+func lParseBPopArgs(args []string) (keys []string, timeout time.Duration, err error) {
+	if len(args) < 3 {
+		err = uhaha.ErrWrongNumArgs
+		return
+	}
+	timeout, err = lParseTimeout(args[len(args)-1])
+	keys = args[1 : len(args)-1]
 	return
 }
+
+func lParseTimeout(arg string) (time.Duration, error) {
+	t, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(t) || math.IsInf(t, 0) {
+		return 0, errors.New("ERR timeout is not a float or out of range")
+	}
+	if t < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	return time.Duration(t * float64(time.Second)), nil
+}
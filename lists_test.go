@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"reflect"
 	"testing"
 	"time"
 
@@ -400,6 +401,135 @@ func TestRPopLPushSingleElement(t *testing.T) {
 	}
 }
 
+func TestLMove(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Do(ctx, "lclear", "lmove_src")
+	c.Do(ctx, "lclear", "lmove_dst")
+	c.RPush(ctx, "lmove_src", 1, 2, 3)
+
+	if v, err := c.LMove(ctx, "lmove_src", "lmove_dst", "LEFT", "RIGHT").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "1" {
+		t.Fatal(v)
+	}
+	if v, err := c.LMove(ctx, "lmove_src", "lmove_dst", "RIGHT", "LEFT").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "3" {
+		t.Fatal(v)
+	}
+	if err := testListRange([]byte("lmove_dst"), 0, -1, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(ctx, "lmove", "lmove_src", "lmove_dst", "UP", "LEFT").Result(); err == nil {
+		t.Fatal("expected syntax error")
+	}
+	if _, err := c.LMove(ctx, "lmove_empty", "lmove_dst", "LEFT", "LEFT").Result(); err != redis.Nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Do(ctx, "lclear", "bpop1")
+	c.Do(ctx, "lclear", "bpop2")
+
+	// data available: no wait
+	c.RPush(ctx, "bpop2", "a", "b")
+	if v, err := c.BLPop(ctx, time.Second, "bpop1", "bpop2").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != "bpop2" || v[1] != "a" {
+		t.Fatal(v)
+	}
+	if v, err := c.BRPop(ctx, time.Second, "bpop1", "bpop2").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != "bpop2" || v[1] != "b" {
+		t.Fatal(v)
+	}
+
+	// timeout
+	start := time.Now()
+	if _, err := c.BLPop(ctx, 200*time.Millisecond, "bpop1").Result(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatal("BLPOP returned before the timeout")
+	}
+
+	// woken up by a push from another client
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.RPush(ctx, "bpop1", "c")
+	}()
+	if v, err := c.BLPop(ctx, 0, "bpop1").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != "bpop1" || v[1] != "c" {
+		t.Fatal(v)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.RPush(ctx, "bpop1", "d", "e")
+	}()
+	if v, err := c.BRPopLPush(ctx, "bpop1", "bpop2", 5*time.Second).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "e" {
+		t.Fatal(v)
+	}
+	if v, err := c.BLMove(ctx, "bpop1", "bpop2", "LEFT", "LEFT", 5*time.Second).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "d" {
+		t.Fatal(v)
+	}
+	if v, err := c.LRange(ctx, "bpop2", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 || v[0] != "d" || v[1] != "e" {
+		t.Fatal(v)
+	}
+
+	if _, err := c.Do(ctx, "blpop", "bpop1", "-1").Result(); err == nil {
+		t.Fatal("expected negative timeout error")
+	}
+	if _, err := c.Do(ctx, "blpop", "bpop1", "inf").Result(); err == nil {
+		t.Fatal("expected invalid timeout error")
+	}
+	if _, err := c.Do(ctx, "blpop", "bpop1").Result(); err == nil {
+		t.Fatal("expected wrong number of arguments error")
+	}
+
+	// in a transaction, the blocking pops do not block
+	c.Do(ctx, "lclear", "bpop2")
+	c.RPush(ctx, "bpop2", "f", "g", "h")
+	var empty, pop *redis.StringSliceCmd
+	var move *redis.StringCmd
+	start = time.Now()
+	if _, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		empty = p.BLPop(ctx, 0, "bpop1")
+		pop = p.BRPop(ctx, 0, "bpop1", "bpop2")
+		move = p.BLMove(ctx, "bpop2", "bpop1", "LEFT", "LEFT", 0)
+		return nil
+	}); err != nil && err != redis.Nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("BLPOP blocked in a transaction")
+	}
+	if empty.Err() != redis.Nil {
+		t.Fatal(empty.Val(), empty.Err())
+	}
+	if v := pop.Val(); len(v) != 2 || v[0] != "bpop2" || v[1] != "h" {
+		t.Fatal(v, pop.Err())
+	}
+	if v := move.Val(); v != "f" {
+		t.Fatal(v, move.Err())
+	}
+	c.Do(ctx, "lclear", "bpop1")
+	c.Do(ctx, "lclear", "bpop2")
+}
+
 func TestTrim(t *testing.T) {
 	c := getTestConn()
 	ctx := context.Background()
@@ -436,6 +566,224 @@ func TestTrim(t *testing.T) {
 	}
 }
 
+func TestLInsertLRem(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Do(ctx, "lclear", "linsert")
+	c.RPush(ctx, "linsert", "aap", "noot", "mies")
+	if n, err := c.LInsertBefore(ctx, "linsert", "noot", "vuur").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatal(n)
+	}
+	if n, err := c.LInsertAfter(ctx, "linsert", "mies", "noot").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Fatal(n)
+	}
+	if n, err := c.LInsertAfter(ctx, "linsert", "none", "x").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != -1 {
+		t.Fatal(n)
+	}
+	if n, err := c.LInsertAfter(ctx, "linsert_none", "aap", "x").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if err := c.Do(ctx, "linsert", "linsert", "middle", "aap", "x").Err(); err == nil {
+		t.Fatal("expected syntax error")
+	}
+	if v, err := c.LRange(ctx, "linsert", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []string{"aap", "vuur", "noot", "mies", "noot"}) {
+		t.Fatal(v)
+	}
+
+	// the list keeps working with the ledis commands after the rewrite
+	c.RPush(ctx, "linsert", "noot")
+	c.LPush(ctx, "linsert", "noot")
+	if n, err := c.LRem(ctx, "linsert", -1, "noot").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.LRem(ctx, "linsert", 2, "noot").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if v, err := c.LRange(ctx, "linsert", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []string{"aap", "vuur", "mies", "noot"}) {
+		t.Fatal(v)
+	}
+	if v, err := c.RPop(ctx, "linsert").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "noot" {
+		t.Fatal(v)
+	}
+
+	// removing every element deletes the list and its expire time
+	c.Expire(ctx, "linsert", time.Hour)
+	if n, err := c.LRem(ctx, "linsert", 2, "vuur").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if d, err := c.TTL(ctx, "linsert").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 0 {
+		t.Fatal(d)
+	}
+	c.LRem(ctx, "linsert", 0, "aap")
+	c.LRem(ctx, "linsert", 0, "mies")
+	if n, err := c.Exists(ctx, "linsert").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.LRem(ctx, "linsert", 0, "aap").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if err := c.Do(ctx, "lrem", "linsert", "noint", "aap").Err(); err == nil {
+		t.Fatal("expected an integer error")
+	}
+}
+
+func TestLPos(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Do(ctx, "lclear", "lpos")
+	c.RPush(ctx, "lpos", "a", "b", "c", "1", "2", "3", "c", "c")
+	if n, err := c.LPos(ctx, "lpos", "c", redis.LPosArgs{}).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if n, err := c.LPos(ctx, "lpos", "c", redis.LPosArgs{Rank: -1}).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 7 {
+		t.Fatal(n)
+	}
+	if v, err := c.LPosCount(ctx, "lpos", "c", 0, redis.LPosArgs{Rank: 2}).Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []int64{6, 7}) {
+		t.Fatal(v)
+	}
+	if v, err := c.LPosCount(ctx, "lpos", "c", 2, redis.LPosArgs{Rank: -1}).Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []int64{7, 6}) {
+		t.Fatal(v)
+	}
+	if v, err := c.LPosCount(ctx, "lpos", "c", 0, redis.LPosArgs{MaxLen: 7}).Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []int64{2, 6}) {
+		t.Fatal(v)
+	}
+	if err := c.LPos(ctx, "lpos", "x", redis.LPosArgs{}).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if v, err := c.LPosCount(ctx, "lpos", "x", 1, redis.LPosArgs{}).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 0 {
+		t.Fatal(v)
+	}
+	if err := c.Do(ctx, "lpos", "lpos", "c", "rank", 0).Err(); err == nil {
+		t.Fatal("expected a RANK error")
+	}
+	if err := c.Do(ctx, "lpos", "lpos", "c", "count", -1).Err(); err == nil {
+		t.Fatal("expected a COUNT error")
+	}
+	if err := c.Do(ctx, "lpos", "lpos", "c", "rank").Err(); err == nil {
+		t.Fatal("expected syntax error")
+	}
+}
+
+func TestPushX(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Do(ctx, "lclear", "pushx")
+	if n, err := c.LPushX(ctx, "pushx", "a").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.RPushX(ctx, "pushx", "a").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.Exists(ctx, "pushx").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	c.RPush(ctx, "pushx", "b")
+	if n, err := c.LPushX(ctx, "pushx", "a").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if n, err := c.RPushX(ctx, "pushx", "c", "d").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatal(n)
+	}
+	if v, err := c.LRange(ctx, "pushx", 0, -1).Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []string{"a", "b", "c", "d"}) {
+		t.Fatal(v)
+	}
+}
+
+func TestLMPop(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Do(ctx, "lmclear", "lmpop1", "lmpop2")
+	if err := c.LMPop(ctx, "left", 1, "lmpop1", "lmpop2").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	c.RPush(ctx, "lmpop2", "a", "b", "c", "d")
+	if key, v, err := c.LMPop(ctx, "left", 2, "lmpop1", "lmpop2").Result(); err != nil {
+		t.Fatal(err)
+	} else if key != "lmpop2" || !reflect.DeepEqual(v, []string{"a", "b"}) {
+		t.Fatal(key, v)
+	}
+	if key, v, err := c.LMPop(ctx, "right", 1, "lmpop1", "lmpop2").Result(); err != nil {
+		t.Fatal(err)
+	} else if key != "lmpop2" || !reflect.DeepEqual(v, []string{"d"}) {
+		t.Fatal(key, v)
+	}
+	if key, v, err := c.LMPop(ctx, "right", 10, "lmpop2").Result(); err != nil {
+		t.Fatal(err)
+	} else if key != "lmpop2" || !reflect.DeepEqual(v, []string{"c"}) {
+		t.Fatal(key, v)
+	}
+	if n, err := c.Exists(ctx, "lmpop2").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	if err := c.Do(ctx, "lmpop", 0, "lmpop1", "left").Err(); err == nil {
+		t.Fatal("expected a numkeys error")
+	}
+	if err := c.Do(ctx, "lmpop", 1, "lmpop1", "left", "count", 0).Err(); err == nil {
+		t.Fatal("expected a count error")
+	}
+	if err := c.Do(ctx, "lmpop", 2, "lmpop1", "left").Err(); err == nil {
+		t.Fatal("expected syntax error")
+	}
+}
+
 func TestListErrorParams(t *testing.T) {
 	c := getTestConn()
 	ctx := context.Background()
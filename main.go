@@ -2,33 +2,23 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"path/filepath"
-	"sync/atomic"
 
-	ipfs_log "github.com/IceFireDB/IceFireDB/driver/ipfs-log"
-	"github.com/IceFireDB/icefiredb-ipfs-log/stores/levelkv"
 	"github.com/joho/godotenv"
 
-	badger "github.com/dgraph-io/badger/v4"
 	lediscfg "github.com/ledisdb/ledisdb/config"
-	"github.com/ledisdb/ledisdb/ledis"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/tidwall/sds"
 	rafthub "github.com/tidwall/uhaha"
 
 	_ "github.com/IceFireDB/IceFireDB/driver/badger"
-	"github.com/IceFireDB/IceFireDB/driver/crdt"
 	"github.com/IceFireDB/IceFireDB/driver/hybriddb"
 	"github.com/IceFireDB/IceFireDB/driver/ipfs"
 	"github.com/IceFireDB/IceFireDB/driver/ipfs-synckv"
 
 	// "github.com/IceFireDB/IceFireDB/driver/orbitdb"
 	"github.com/IceFireDB/IceFireDB/driver/oss"
-	"github.com/IceFireDB/icefiredb-crdt-kv/kv"
 )
 
 var (
@@ -52,49 +42,31 @@ func main() {
 	conf.Version = "1.0.1"
 	conf.GitSHA = BuildVersion
 	conf.Flag.Custom = true
-	confInit(&conf)
+	confInit(&conf.Config)
 	conf.DataDirReady = func(dir string) {
 		//os.RemoveAll(filepath.Join(dir, "main.db"))
 
 		ldsCfg = lediscfg.NewConfigDefault()
 		ldsCfg.DataDir = filepath.Join(dir, "main.db")
-		ldsCfg.Databases = 1
+		ldsCfg.Databases = numDatabases
+		ldsCfg.TTLCheckInterval = ledisTTLCheckInterval
 		ldsCfg.DBName = storageBackend
 
 		var err error
-		le, err = ledis.Open(ldsCfg)
+		le, err = openLedis(ldsCfg)
 		if err != nil {
 			panic(err)
 		}
 
-		ldb, err = le.Select(0)
-		if err != nil {
+		if err := openDatabases(le, numDatabases); err != nil {
 			panic(err)
 		}
 
-		// Obtain the leveldb object and handle it carefully
-		driver := ldb.GetSDB().GetDriver().GetStorageEngine()
-		switch v := driver.(type) {
-		case *leveldb.DB:
-			db = v
-		case *badger.DB:
-		case *kv.CRDTKeyValueDB:
-			db = ldb.GetSDB().GetDriver().(*crdt.DB).GetLevelDB()
-		case *levelkv.LevelKV:
-			switch driver := ldb.GetSDB().GetDriver().(type) {
-			case *ipfs_log.DB:
-				db = driver.GetLevelDB()
-			case *ipfs_synckv.DB:
-				db = driver.GetStorageEngine().(*leveldb.DB)
-			}
-		default:
-			panic(fmt.Errorf("unsupported storage is caused: %T", v))
-		}
 		if storageBackend == hybriddb.StorageName {
-			serverInfo.RegisterExtInfo(ldb.GetSDB().GetDriver().(*hybriddb.DB).Metrics)
+			serverInfo.RegisterExtInfo(baseDriver(ldb.GetSDB().GetDriver()).(*hybriddb.DB).Metrics)
 		}
 		if storageBackend == ipfs.StorageName {
-			serverInfo.RegisterExtInfo(ldb.GetSDB().GetDriver().(*ipfs.DB).Metrics)
+			serverInfo.RegisterExtInfo(baseDriver(ldb.GetSDB().GetDriver()).(*ipfs.DB).Metrics)
 		}
 		// if storageBackend == orbitdb.StorageName {
 		// 	serverInfo.RegisterExtInfo(ldb.GetSDB().GetDriver().(*orbitdb.DB).Metrics)
@@ -104,7 +76,7 @@ func main() {
 			//serverInfo.RegisterExtInfo(ldb.GetSDB().GetDriver().(*orbitdb.DB).Metrics)
 		}
 		if storageBackend == ipfs_synckv.StorageName {
-			serverInfo.RegisterExtInfo(ldb.GetSDB().GetDriver().(*ipfs_synckv.DB).Metrics)
+			serverInfo.RegisterExtInfo(baseDriver(ldb.GetSDB().GetDriver()).(*ipfs_synckv.DB).Metrics)
 		}
 
 	}
@@ -121,76 +93,5 @@ func main() {
 	//conf.CmdRewriteFunc = utils.RedisCmdRewrite
 
 	fmt.Printf("start with Storage Engine: %s\n", storageBackend)
-	rafthub.Main(conf)
-}
-
-type snap struct {
-	s *leveldb.Snapshot
-}
-
-func (s *snap) Done(path string) {}
-
-func (s *snap) Persist(wr io.Writer) error {
-	sw := sds.NewWriter(wr)
-	iter := s.s.NewIterator(nil, nil)
-	for ok := iter.First(); ok; ok = iter.Next() {
-		if err := sw.WriteBytes(iter.Key()); err != nil {
-			return err
-		}
-		if err := sw.WriteBytes(iter.Value()); err != nil {
-			return err
-		}
-	}
-	iter.Release()
-	if err := iter.Error(); err != nil {
-		return err
-	}
-	return sw.Flush()
-}
-
-func snapshot(data interface{}) (rafthub.Snapshot, error) {
-	s, err := db.GetSnapshot()
-	if err != nil {
-		return nil, err
-	}
-	return &snap{s: s}, nil
-}
-
-func restore(rd io.Reader) (interface{}, error) {
-	sr := sds.NewReader(rd)
-	var batch leveldb.Batch
-	for {
-		key, err := sr.ReadBytes()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		value, err := sr.ReadBytes()
-		if err != nil {
-			return nil, err
-		}
-		batch.Put(key, value)
-		if batch.Len() == 1000 {
-			if err := db.Write(&batch, nil); err != nil {
-				return nil, err
-			}
-			batch.Reset()
-		}
-	}
-	if err := db.Write(&batch, nil); err != nil {
-		return nil, err
-	}
-	return nil, nil
-}
-
-func connOpened(addr string) (context interface{}, accept bool) {
-	atomic.AddInt64(&respClientNum, 1)
-	return nil, true
-}
-
-func connClosed(context interface{}, addr string) {
-	atomic.AddInt64(&respClientNum, -1)
-	return
+	rafthub.Main(conf.Config)
 }
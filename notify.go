@@ -0,0 +1,571 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	// notify-keyspace-events is a setting of the node, like in Redis, since
+	// each node only notifies its own subscribers.
+	addConnCommand("CONFIG", connCONFIG)
+}
+
+// the classes of the keyspace events, the characters of the
+// notify-keyspace-events setting of Redis
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZSet                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyModule               // d
+	notifyNew                  // n
+
+	// notifyAll is A, every class but m and n
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet |
+		notifyHash | notifyZSet | notifyExpired | notifyEvicted |
+		notifyStream | notifyModule
+)
+
+var errNotifyClass = errors.New("ERR Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+
+// notifyClasses maps the characters of notify-keyspace-events to the
+// classes, in the order Redis prints them.
+var notifyClasses = []struct {
+	c     byte
+	class int
+}{
+	{'g', notifyGeneric}, {'$', notifyString}, {'l', notifyList},
+	{'s', notifySet}, {'h', notifyHash}, {'z', notifyZSet},
+	{'x', notifyExpired}, {'e', notifyEvicted}, {'t', notifyStream},
+	{'m', notifyKeyMiss}, {'d', notifyModule}, {'n', notifyNew},
+	{'K', notifyKeyspace}, {'E', notifyKeyevent},
+}
+
+// keyspaceEvents holds the classes of notify-keyspace-events, none by
+// default.
+var keyspaceEvents atomic.Int64
+
+func parseNotifyClasses(s string) (int, error) {
+	var flags int
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		found := false
+		for _, nc := range notifyClasses {
+			if nc.c == s[i] {
+				flags |= nc.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errNotifyClass
+		}
+	}
+	return flags, nil
+}
+
+func formatNotifyClasses(flags int) string {
+	var b []byte
+	if flags&notifyAll == notifyAll {
+		b = append(b, 'A')
+	}
+	for _, nc := range notifyClasses {
+		if flags&nc.class == 0 ||
+			(flags&notifyAll == notifyAll && nc.class&notifyAll != 0) {
+			continue
+		}
+		b = append(b, nc.c)
+	}
+	return string(b)
+}
+
+// notifying returns true if the events of class reach someone. The events
+// are only delivered to the subscribers of the node, so there is nothing to
+// do without them.
+func notifying(class int) bool {
+	flags := int(keyspaceEvents.Load())
+	return flags&(notifyKeyspace|notifyKeyevent) != 0 && flags&class != 0 &&
+		pubsub.subscribed()
+}
+
+// notifyKeyspaceEvent publishes event on key to the local subscribers of
+// the __keyspace@<db>__:<key> and __keyevent@<db>__:<event> channels, db
+// being the database of the write. It is called
+// while the write that caused the event is applied, so each node notifies
+// its subscribers once.
+func notifyKeyspaceEvent(class int, event, key string) {
+	if !notifying(class) {
+		return
+	}
+	flags := int(keyspaceEvents.Load())
+	db := strconv.Itoa(curDB)
+	if flags&notifyKeyspace != 0 {
+		pubsub.publish("__keyspace@"+db+"__:"+key, event, false)
+	}
+	if flags&notifyKeyevent != 0 {
+		pubsub.publish("__keyevent@"+db+"__:"+event, key, false)
+	}
+}
+
+// keyEvent is a keyspace event of a write command.
+type keyEvent struct {
+	class int
+	name  string
+	key   string
+}
+
+// writeEvent is a successful write command, with the keys of its key spec
+// and whether they existed before and after it.
+type writeEvent struct {
+	args    []string
+	reply   interface{}
+	keys    []string
+	existed map[string]bool
+	exists  map[string]bool
+}
+
+// keyEventsFunc returns the events of a write.
+type keyEventsFunc func(w *writeEvent) []keyEvent
+
+// keysExist returns which keys exist.
+func keysExist(keys []string) map[string]bool {
+	exist := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		types, err := keyTypesOf([]byte(key))
+		exist[key] = err == nil && len(types) > 0
+	}
+	return exist
+}
+
+// notifyWrite publishes the events of a write: "new" for the keys it
+// created, the events of the command, and "del" for the keys it removed
+// unless the command events already tell so, after the last event of the key
+// like in Redis.
+func notifyWrite(name string, w *writeEvent) {
+	fn := keyEvents[name]
+	if fn == nil {
+		return
+	}
+	events := fn(w)
+	removed := make(map[string]bool)
+	for _, key := range w.keys {
+		if !w.existed[key] && w.exists[key] {
+			notifyKeyspaceEvent(notifyNew, "new", key)
+		}
+		if w.existed[key] && !w.exists[key] {
+			removed[key] = true
+		}
+	}
+	last := make(map[string]int)
+	for i, e := range events {
+		last[e.key] = i
+		if e.name == "del" || e.name == "expired" || e.name == "rename_from" {
+			delete(removed, e.key)
+		}
+	}
+	for i, e := range events {
+		notifyKeyspaceEvent(e.class, e.name, e.key)
+		if removed[e.key] && last[e.key] == i {
+			notifyKeyspaceEvent(notifyGeneric, "del", e.key)
+			delete(removed, e.key)
+		}
+	}
+	for _, key := range w.keys {
+		if removed[key] {
+			notifyKeyspaceEvent(notifyGeneric, "del", key)
+			delete(removed, key)
+		}
+	}
+}
+
+// noChange returns true for the replies of writes that did nothing: 0, nil
+// or an empty array.
+func noChange(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case redcon.SimpleInt:
+		return v == 0
+	case int64:
+		return v == 0
+	case int:
+		return v == 0
+	case []interface{}:
+		return len(v) == 0
+	case [][]byte:
+		return len(v) == 0
+	}
+	return false
+}
+
+// keysEvent is the event of every key of the key spec.
+func keysEvent(class int, name string) keyEventsFunc {
+	return func(w *writeEvent) []keyEvent {
+		events := make([]keyEvent, len(w.keys))
+		for i, key := range w.keys {
+			events[i] = keyEvent{class, name, key}
+		}
+		return events
+	}
+}
+
+// changedEvent is keysEvent for the writes that changed something.
+func changedEvent(class int, name string) keyEventsFunc {
+	return func(w *writeEvent) []keyEvent {
+		if noChange(w.reply) {
+			return nil
+		}
+		return keysEvent(class, name)(w)
+	}
+}
+
+// existingEvent is the event of the keys that existed before a write that
+// changed something.
+func existingEvent(class int, name string) keyEventsFunc {
+	return func(w *writeEvent) []keyEvent {
+		if noChange(w.reply) {
+			return nil
+		}
+		var events []keyEvent
+		for _, key := range w.keys {
+			if w.existed[key] {
+				events = append(events, keyEvent{class, name, key})
+			}
+		}
+		return events
+	}
+}
+
+// storeEvent is the event of the keys that exist after a write, the
+// destinations of the *STORE commands, which are removed by an empty result.
+func storeEvent(class int, name string) keyEventsFunc {
+	return func(w *writeEvent) []keyEvent {
+		var events []keyEvent
+		for _, key := range w.keys {
+			if w.exists[key] {
+				events = append(events, keyEvent{class, name, key})
+			}
+		}
+		return events
+	}
+}
+
+// removedEvent is the event of the keys a write removed.
+func removedEvent(class int, name string) keyEventsFunc {
+	return func(w *writeEvent) []keyEvent {
+		var events []keyEvent
+		for _, key := range w.keys {
+			if w.existed[key] && !w.exists[key] {
+				events = append(events, keyEvent{class, name, key})
+			}
+		}
+		return events
+	}
+}
+
+// moveEvents are the events of the commands that move a value from
+// args[1] to args[2], when they changed something.
+func moveEvents(class int, from, to string) keyEventsFunc {
+	return func(w *writeEvent) []keyEvent {
+		if noChange(w.reply) {
+			return nil
+		}
+		return []keyEvent{{class, from, w.args[1]}, {class, to, w.args[2]}}
+	}
+}
+
+// setEvents are "set" plus "expire" when the command sets a TTL.
+func setEvents(w *writeEvent) []keyEvent {
+	if w.reply == nil || w.reply == redcon.SimpleInt(0) {
+		return nil
+	}
+	events := keysEvent(notifyString, "set")(w)
+	name := strings.ToLower(w.args[0])
+	expire := name != "set" && name != "setnx"
+	for _, arg := range w.args[3:] {
+		switch strings.ToUpper(arg) {
+		case "EX", "PX", "EXAT", "PXAT":
+			expire = name == "set"
+		}
+	}
+	if expire {
+		events = append(events, keyEvent{notifyGeneric, "expire", w.args[1]})
+	}
+	return events
+}
+
+// keyEvents has the events of the write commands, with the names Redis uses.
+// The commands that run other commands have none, the commands they run
+// notify their own events.
+var keyEvents = map[string]keyEventsFunc{
+	"append":      keysEvent(notifyString, "append"),
+	"bitfield":    bitfieldEvents,
+	"bitop":       storeEvent(notifyString, "set"),
+	"decr":        keysEvent(notifyString, "incrby"),
+	"decrby":      keysEvent(notifyString, "incrby"),
+	"getdel":      changedEvent(notifyGeneric, "del"),
+	"getex":       getexEvents,
+	"getset":      keysEvent(notifyString, "set"),
+	"incr":        keysEvent(notifyString, "incrby"),
+	"incrby":      keysEvent(notifyString, "incrby"),
+	"incrbyfloat": keysEvent(notifyString, "incrbyfloat"),
+	"mset":        keysEvent(notifyString, "set"),
+	"msetnx":      changedEvent(notifyString, "set"),
+	"pfadd":       changedEvent(notifyString, "pfadd"),
+	"pfmerge":     keysEvent(notifyString, "pfadd"),
+	"psetex":      setEvents,
+	"set":         setEvents,
+	"setbit":      keysEvent(notifyString, "setbit"),
+	"setex":       setEvents,
+	"setexat":     setEvents,
+	"setnx":       setEvents,
+	"setrange":    keysEvent(notifyString, "setrange"),
+
+	"copy":      copyEvents,
+	"del":       existingEvent(notifyGeneric, "del"),
+	"expire":    changedEvent(notifyGeneric, "expire"),
+	"expireat":  changedEvent(notifyGeneric, "expire"),
+	"expired":   removedEvent(notifyExpired, "expired"),
+	"pexpire":   changedEvent(notifyGeneric, "expire"),
+	"pexpireat": changedEvent(notifyGeneric, "expire"),
+	"rename":    moveEvents(notifyGeneric, "rename_from", "rename_to"),
+	"renamenx":  moveEvents(notifyGeneric, "rename_from", "rename_to"),
+	"restore":   keysEvent(notifyGeneric, "restore"),
+
+	"lclear":    existingEvent(notifyGeneric, "del"),
+	"lexpire":   changedEvent(notifyGeneric, "expire"),
+	"lexpireat": changedEvent(notifyGeneric, "expire"),
+	"linsert":   linsertEvents,
+	"lmclear":   existingEvent(notifyGeneric, "del"),
+	"lmove":     lmoveEvents,
+	"lmpop":     lmpopEvents,
+	"lpop":      changedEvent(notifyList, "lpop"),
+	"lpush":     keysEvent(notifyList, "lpush"),
+	"lpushx":    changedEvent(notifyList, "lpush"),
+	"lrem":      changedEvent(notifyList, "lrem"),
+	"lset":      keysEvent(notifyList, "lset"),
+	"ltrim":     keysEvent(notifyList, "ltrim"),
+	"rpop":      changedEvent(notifyList, "rpop"),
+	"rpoplpush": moveEvents(notifyList, "rpop", "lpush"),
+	"rpush":     keysEvent(notifyList, "rpush"),
+	"rpushx":    changedEvent(notifyList, "rpush"),
+
+	"hclear":       existingEvent(notifyGeneric, "del"),
+	"hdel":         changedEvent(notifyHash, "hdel"),
+	"hexpire":      hexpireEvents("hexpire"),
+	"hexpireat":    hexpireEvents("hexpire"),
+	"hgetdel":      hgetdelEvents,
+	"hincrby":      keysEvent(notifyHash, "hincrby"),
+	"hincrbyfloat": keysEvent(notifyHash, "hincrbyfloat"),
+	"hmclear":      existingEvent(notifyGeneric, "del"),
+	"hmset":        keysEvent(notifyHash, "hset"),
+	"hpersist":     hexpireEvents("hpersist"),
+	"hpexpire":     hexpireEvents("hexpire"),
+	"hpexpireat":   hexpireEvents("hexpire"),
+	"hset":         keysEvent(notifyHash, "hset"),
+	"hsetnx":       changedEvent(notifyHash, "hset"),
+	// hexpired notifies the keys whose fields expired itself
+	"hexpired": func(w *writeEvent) []keyEvent { return nil },
+
+	"sadd":        changedEvent(notifySet, "sadd"),
+	"sclear":      existingEvent(notifyGeneric, "del"),
+	"sdiffstore":  storeEvent(notifySet, "sdiffstore"),
+	"sexpire":     changedEvent(notifyGeneric, "expire"),
+	"sexpireat":   changedEvent(notifyGeneric, "expire"),
+	"sinterstore": storeEvent(notifySet, "sinterstore"),
+	"smclear":     existingEvent(notifyGeneric, "del"),
+	"smove":       moveEvents(notifySet, "srem", "sadd"),
+	"spersist":    changedEvent(notifyGeneric, "persist"),
+	"spop":        changedEvent(notifySet, "spop"),
+	"srem":        changedEvent(notifySet, "srem"),
+	"sunionstore": storeEvent(notifySet, "sunionstore"),
+
+	"geoadd":           changedEvent(notifyZSet, "zadd"),
+	"geosearchstore":   storeEvent(notifyZSet, "geosearchstore"),
+	"zadd":             keysEvent(notifyZSet, "zadd"),
+	"zclear":           existingEvent(notifyGeneric, "del"),
+	"zincrby":          keysEvent(notifyZSet, "zincr"),
+	"zinterstore":      storeEvent(notifyZSet, "zinterstore"),
+	"zpopmax":          changedEvent(notifyZSet, "zpopmax"),
+	"zpopmin":          changedEvent(notifyZSet, "zpopmin"),
+	"zrangestore":      storeEvent(notifyZSet, "zrangestore"),
+	"zrem":             changedEvent(notifyZSet, "zrem"),
+	"zremrangebylex":   changedEvent(notifyZSet, "zremrangebylex"),
+	"zremrangebyrank":  changedEvent(notifyZSet, "zremrangebyrank"),
+	"zremrangebyscore": changedEvent(notifyZSet, "zremrangebyscore"),
+	"zunionstore":      storeEvent(notifyZSet, "zunionstore"),
+
+	"xadd":   keysEvent(notifyStream, "xadd"),
+	"xdel":   changedEvent(notifyStream, "xdel"),
+	"xgroup": xgroupEvents,
+	"xtrim":  changedEvent(notifyStream, "xtrim"),
+}
+
+func bitfieldEvents(w *writeEvent) []keyEvent {
+	for _, arg := range w.args[2:] {
+		if op := strings.ToUpper(arg); op == "SET" || op == "INCRBY" {
+			return []keyEvent{{notifyString, "setbit", w.args[1]}}
+		}
+	}
+	return nil
+}
+
+func getexEvents(w *writeEvent) []keyEvent {
+	if w.reply == nil || len(w.args) < 3 {
+		return nil
+	}
+	if strings.EqualFold(w.args[2], "PERSIST") {
+		return []keyEvent{{notifyGeneric, "persist", w.args[1]}}
+	}
+	return []keyEvent{{notifyGeneric, "expire", w.args[1]}}
+}
+
+// copyEvents is copy_to, unless the destination is another database, which
+// COPY notifies itself.
+func copyEvents(w *writeEvent) []keyEvent {
+	if index, _, _ := parseCopyArgs(w.args); noChange(w.reply) || index != curDB {
+		return nil
+	}
+	return []keyEvent{{notifyGeneric, "copy_to", w.args[2]}}
+}
+
+func linsertEvents(w *writeEvent) []keyEvent {
+	if n, ok := w.reply.(redcon.SimpleInt); ok && n <= 0 {
+		return nil
+	}
+	return keysEvent(notifyList, "linsert")(w)
+}
+
+func lmoveEvents(w *writeEvent) []keyEvent {
+	if w.reply == nil || len(w.args) < 5 {
+		return nil
+	}
+	pop, push := "rpop", "rpush"
+	if strings.EqualFold(w.args[3], "LEFT") {
+		pop = "lpop"
+	}
+	if strings.EqualFold(w.args[4], "LEFT") {
+		push = "lpush"
+	}
+	return []keyEvent{{notifyList, pop, w.args[1]}, {notifyList, push, w.args[2]}}
+}
+
+// lmpopEvents notifies the list the elements were popped from, the first
+// item of the reply.
+func lmpopEvents(w *writeEvent) []keyEvent {
+	reply, ok := w.reply.([]interface{})
+	if !ok || len(reply) == 0 {
+		return nil
+	}
+	key, _ := reply[0].(string)
+	pop := "rpop"
+	if _, left, _, _ := lParseMPopArgs(w.args); left {
+		pop = "lpop"
+	}
+	return []keyEvent{{notifyList, pop, key}}
+}
+
+// hexpireEvents are the events of the TTL commands of hashes: the TTL of
+// the fields when the FIELDS argument is given, of the whole key otherwise.
+// The fields given a time in the past are deleted.
+func hexpireEvents(name string) keyEventsFunc {
+	return func(w *writeEvent) []keyEvent {
+		reply, ok := w.reply.([]interface{})
+		if !ok {
+			if noChange(w.reply) {
+				return nil
+			}
+			if name == "hpersist" {
+				return []keyEvent{{notifyGeneric, "persist", w.args[1]}}
+			}
+			return []keyEvent{{notifyGeneric, "expire", w.args[1]}}
+		}
+		var events []keyEvent
+		var set, deleted bool
+		for _, v := range reply {
+			set = set || v == redcon.SimpleInt(1)
+			deleted = deleted || v == redcon.SimpleInt(2)
+		}
+		if set {
+			events = append(events, keyEvent{notifyHash, name, w.args[1]})
+		}
+		if deleted {
+			events = append(events, keyEvent{notifyHash, "hdel", w.args[1]})
+		}
+		return events
+	}
+}
+
+func hgetdelEvents(w *writeEvent) []keyEvent {
+	reply, _ := w.reply.([]interface{})
+	for _, v := range reply {
+		if v != nil {
+			return []keyEvent{{notifyHash, "hdel", w.args[1]}}
+		}
+	}
+	return nil
+}
+
+func xgroupEvents(w *writeEvent) []keyEvent {
+	if len(w.args) < 3 {
+		return nil
+	}
+	switch sub := strings.ToLower(w.args[1]); sub {
+	case "create", "destroy", "createconsumer", "delconsumer", "setid":
+		if sub == "destroy" && noChange(w.reply) {
+			return nil
+		}
+		return []keyEvent{{notifyStream, "xgroup-" + sub, w.args[2]}}
+	}
+	return nil
+}
+
+// connCONFIG reads and changes the settings of the node, only
+// notify-keyspace-events for now.
+// Syntax: CONFIG GET parameter [parameter ...] | SET parameter value
+func connCONFIG(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	switch strings.ToUpper(args[1]) {
+	case "GET":
+		ret := []interface{}{}
+		for _, pattern := range args[2:] {
+			if globMatch(strings.ToLower(pattern), "notify-keyspace-events", false) {
+				ret = append(ret, "notify-keyspace-events",
+					formatNotifyClasses(int(keyspaceEvents.Load())))
+				break
+			}
+		}
+		return ret, nil
+	case "SET":
+		if len(args) != 4 || !strings.EqualFold(args[2], "notify-keyspace-events") {
+			return nil, errors.New("ERR Unknown option or number of arguments for CONFIG SET - '" + args[2] + "'")
+		}
+		flags, err := parseNotifyClasses(args[3])
+		if err != nil {
+			return nil, errors.New("ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - " +
+				strings.TrimPrefix(err.Error(), "ERR "))
+		}
+		keyspaceEvents.Store(int64(flags))
+		return redcon.SimpleString("OK"), nil
+	}
+	return nil, errors.New("ERR unknown subcommand '" + args[1] + "'. Try CONFIG HELP.")
+}
@@ -0,0 +1,187 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// receiveEvents reads the next n keyspace events as "channel payload".
+func receiveEvents(t *testing.T, sub *redis.PubSub, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var events []string
+	for len(events) < n {
+		msg, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			t.Fatal(events, err)
+		}
+		events = append(events, msg.Channel+" "+msg.Payload)
+	}
+	return events
+}
+
+func expectEvents(t *testing.T, sub *redis.PubSub, want ...string) {
+	t.Helper()
+	got := receiveEvents(t, sub, len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	defer c.ConfigSet(ctx, "notify-keyspace-events", "")
+
+	for _, tc := range []struct{ set, get string }{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Elg", "glE"},
+		{"Kg$lshzxetdmn", "AmnK"},
+	} {
+		if err := c.ConfigSet(ctx, "notify-keyspace-events", tc.set).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := c.ConfigGet(ctx, "notify-keyspace-events").Result(); err != nil {
+			t.Fatal(err)
+		} else if v["notify-keyspace-events"] != tc.get {
+			t.Fatalf("%q: %q", tc.set, v)
+		}
+	}
+	if err := c.ConfigSet(ctx, "notify-keyspace-events", "KQ").Err(); err == nil {
+		t.Fatal("set an invalid class")
+	}
+	if err := c.ConfigSet(ctx, "maxmemory", "1").Err(); err == nil {
+		t.Fatal("set an unknown parameter")
+	}
+}
+
+func TestNotifyKeyspace(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.Del(ctx, "nk_str", "nk_list", "nk_hash", "nk_dst")
+	if err := c.ConfigSet(ctx, "notify-keyspace-events", "KA").Err(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConfigSet(ctx, "notify-keyspace-events", "")
+
+	sub := c.PSubscribe(ctx, "__keyspace@0__:nk_*")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set(ctx, "nk_str", "1", 0)
+	c.Incr(ctx, "nk_str")
+	c.Set(ctx, "nk_str", "1", time.Hour)
+	expectEvents(t, sub,
+		"__keyspace@0__:nk_str set",
+		"__keyspace@0__:nk_str incrby",
+		"__keyspace@0__:nk_str set",
+		"__keyspace@0__:nk_str expire")
+
+	// the writes that change nothing are silent
+	c.SetNX(ctx, "nk_str", "2", 0)
+	c.LPushX(ctx, "nk_list", "a")
+	c.Del(ctx, "nk_none")
+	c.RPush(ctx, "nk_list", "a", "b")
+	c.LPop(ctx, "nk_list")
+	c.LMove(ctx, "nk_list", "nk_dst", "RIGHT", "LEFT")
+	expectEvents(t, sub,
+		"__keyspace@0__:nk_list rpush",
+		"__keyspace@0__:nk_list lpop",
+		"__keyspace@0__:nk_list rpop",
+		"__keyspace@0__:nk_list del",
+		"__keyspace@0__:nk_dst lpush")
+
+	c.HSet(ctx, "nk_hash", "f", "v")
+	c.HDel(ctx, "nk_hash", "f")
+	c.Rename(ctx, "nk_str", "nk_str2")
+	c.Del(ctx, "nk_str2", "nk_dst")
+	expectEvents(t, sub,
+		"__keyspace@0__:nk_hash hset",
+		"__keyspace@0__:nk_hash hdel",
+		"__keyspace@0__:nk_hash del",
+		"__keyspace@0__:nk_str rename_from",
+		"__keyspace@0__:nk_str2 rename_to",
+		"__keyspace@0__:nk_str2 del",
+		"__keyspace@0__:nk_dst del")
+
+	// the commands of transactions and scripts notify their own events
+	c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, "nk_str", "tx", 0)
+		return nil
+	})
+	c.Eval(ctx, "return redis.call('append', KEYS[1], 'lua')", []string{"nk_str"})
+	expectEvents(t, sub,
+		"__keyspace@0__:nk_str set",
+		"__keyspace@0__:nk_str append")
+	c.Del(ctx, "nk_str")
+	expectEvents(t, sub, "__keyspace@0__:nk_str del")
+}
+
+func TestNotifyKeyevent(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.Del(ctx, "ne_key", "ne_exp")
+	if err := c.ConfigSet(ctx, "notify-keyspace-events", "Egxn").Err(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConfigSet(ctx, "notify-keyspace-events", "")
+
+	sub := c.PSubscribe(ctx, "__keyevent@0__:*")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the string events are not enabled, new and del are
+	c.Set(ctx, "ne_key", "v", 0)
+	c.Expire(ctx, "ne_key", time.Hour)
+	c.Del(ctx, "ne_key")
+	expectEvents(t, sub,
+		"__keyevent@0__:new ne_key",
+		"__keyevent@0__:expire ne_key",
+		"__keyevent@0__:del ne_key")
+
+	// expired keys are notified by the node that applies the EXPIRED entry
+	c.Set(ctx, "ne_exp", "v", 100*time.Millisecond)
+	expectEvents(t, sub,
+		"__keyevent@0__:new ne_exp",
+		"__keyevent@0__:expire ne_exp")
+	expectEvents(t, sub, "__keyevent@0__:expired ne_exp")
+}
+
+func TestNotifyHashFields(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.Del(ctx, "nh_hash")
+	if err := c.ConfigSet(ctx, "notify-keyspace-events", "Khg").Err(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConfigSet(ctx, "notify-keyspace-events", "")
+
+	sub := c.Subscribe(ctx, "__keyspace@0__:nh_hash")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.HSet(ctx, "nh_hash", "f", "v")
+	c.HPExpire(ctx, "nh_hash", 100*time.Millisecond, "f")
+	expectEvents(t, sub,
+		"__keyspace@0__:nh_hash hset",
+		"__keyspace@0__:nh_hash hexpire")
+	expectEvents(t, sub,
+		"__keyspace@0__:nh_hash hexpired",
+		"__keyspace@0__:nh_hash del")
+}
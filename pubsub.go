@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// PUBLISH and SPUBLISH go through the Raft log like the writes: every node
+// applies them and delivers the message to its own subscribers, so that a
+// subscriber on any node gets the messages published on any other. The
+// delivery follows the log, not the clock of the publisher:
+//
+//   - the reply counts the subscribers of the leader, the node that answers
+//     the publisher, not those of the followers;
+//   - a follower delivers a message when it applies the entry, late when it
+//     lags behind the leader;
+//   - the messages stay in the log until a snapshot compacts it, so a node
+//     that restarts applies them again and delivers them to the subscribers
+//     it has by then;
+//   - a message is delivered once per application, with no retry, and a
+//     subscriber that is disconnected misses it, like in Redis.
+//
+// The subscriptions are local to the node, like in a Redis cluster.
+func init() {
+	conf.AddWriteCommand("PUBLISH", cmdPUBLISH)
+	conf.AddWriteCommand("SPUBLISH", cmdSPUBLISH)
+	addConnCommand("PUBSUB", connPUBSUB)
+}
+
+// subscriberOutputLimit is the hard limit of the pending messages of a
+// subscriber, the default client-output-buffer-limit of Redis for pubsub
+// clients. A slower subscriber is disconnected, since PUBLISH never waits.
+const subscriberOutputLimit = 32 << 20
+
+// the kinds of subscriptions
+const (
+	subChannel = iota
+	subPattern
+	subShard
+	subKinds
+)
+
+var (
+	subscribeCommands   = [subKinds]string{"subscribe", "psubscribe", "ssubscribe"}
+	unsubscribeCommands = [subKinds]string{"unsubscribe", "punsubscribe", "sunsubscribe"}
+)
+
+// pubSubCommandKind returns the kind of a (P|S)SUBSCRIBE or
+// (P|S)UNSUBSCRIBE command and whether it subscribes, or -1.
+func pubSubCommandKind(name string) (int, bool) {
+	for kind := 0; kind < subKinds; kind++ {
+		switch name {
+		case subscribeCommands[kind]:
+			return kind, true
+		case unsubscribeCommands[kind]:
+			return kind, false
+		}
+	}
+	return -1, false
+}
+
+// pubSubRegistry holds the subscriptions of the connections of the node.
+type pubSubRegistry struct {
+	mu   sync.RWMutex
+	subs [subKinds]map[string]map[*subscriber]struct{}
+}
+
+var pubsub = newPubSubRegistry()
+
+func newPubSubRegistry() *pubSubRegistry {
+	r := &pubSubRegistry{}
+	for kind := range r.subs {
+		r.subs[kind] = make(map[string]map[*subscriber]struct{})
+	}
+	return r
+}
+
+// publish delivers message to the local subscribers of channel and returns
+// their number. It never blocks, the messages are queued on the subscribers.
+func (r *pubSubRegistry) publish(channel, message string, shard bool) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var n int
+	if shard {
+		for sub := range r.subs[subShard][channel] {
+			sub.write(redcon.AppendBulkString(redcon.AppendBulkString(
+				redcon.AppendBulkString(redcon.AppendArray(nil, 3), "smessage"),
+				channel), message))
+			n++
+		}
+		return n
+	}
+	for sub := range r.subs[subChannel][channel] {
+		sub.write(redcon.AppendBulkString(redcon.AppendBulkString(
+			redcon.AppendBulkString(redcon.AppendArray(nil, 3), "message"),
+			channel), message))
+		n++
+	}
+	for pattern, subs := range r.subs[subPattern] {
+		if !globMatch(pattern, channel, false) {
+			continue
+		}
+		for sub := range subs {
+			sub.write(redcon.AppendBulkString(redcon.AppendBulkString(
+				redcon.AppendBulkString(redcon.AppendBulkString(
+					redcon.AppendArray(nil, 4), "pmessage"), pattern),
+				channel), message))
+			n++
+		}
+	}
+	return n
+}
+
+// subscribed returns true if the node has channel or pattern subscriptions.
+func (r *pubSubRegistry) subscribed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.subs[subChannel]) > 0 || len(r.subs[subPattern]) > 0
+}
+
+// subscribe subscribes sub to the channels and replies with a confirmation
+// for each of them.
+func (r *pubSubRegistry) subscribe(sub *subscriber, kind int, channels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, channel := range channels {
+		if _, ok := sub.names[kind][channel]; !ok {
+			sub.names[kind][channel] = struct{}{}
+			if r.subs[kind][channel] == nil {
+				r.subs[kind][channel] = make(map[*subscriber]struct{})
+			}
+			r.subs[kind][channel][sub] = struct{}{}
+		}
+		sub.write(sub.appendConfirm(nil, subscribeCommands[kind], kind, channel))
+	}
+}
+
+// unsubscribe unsubscribes sub from the channels, or from all the channels
+// of the kind when there is none, and replies with a confirmation for each
+// of them.
+func (r *pubSubRegistry) unsubscribe(sub *subscriber, kind int, channels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := len(channels) == 0
+	if all {
+		for channel := range sub.names[kind] {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+	}
+	var b []byte
+	for _, channel := range channels {
+		r.remove(sub, kind, channel)
+		b = sub.appendConfirm(b, unsubscribeCommands[kind], kind, channel)
+	}
+	if all && len(channels) == 0 {
+		b = redcon.AppendArray(b, 3)
+		b = redcon.AppendBulkString(b, unsubscribeCommands[kind])
+		b = redcon.AppendNull(b)
+		b = redcon.AppendInt(b, int64(sub.count(kind)))
+	}
+	sub.write(b)
+}
+
+func (r *pubSubRegistry) remove(sub *subscriber, kind int, channel string) {
+	delete(sub.names[kind], channel)
+	if subs := r.subs[kind][channel]; subs != nil {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(r.subs[kind], channel)
+		}
+	}
+}
+
+// removeAll drops the subscriptions of a closed connection.
+func (r *pubSubRegistry) removeAll(sub *subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for kind := range sub.names {
+		for channel := range sub.names[kind] {
+			r.remove(sub, kind, channel)
+		}
+	}
+}
+
+// subscriber is a connection detached from the RESP service by its first
+// SUBSCRIBE, PSUBSCRIBE or SSUBSCRIBE. It serves the connection itself: only
+// the pubsub commands while it has subscriptions, every command otherwise.
+type subscriber struct {
+	c     *respConn
+	conn  redcon.DetachedConn
+	names [subKinds]map[string]struct{} // guarded by the registry
+
+	mu     sync.Mutex // guards out and closed
+	out    []byte
+	closed bool
+	wake   chan struct{}
+	wmu    sync.Mutex // serializes the writes to conn
+}
+
+func newSubscriber(c *respConn, conn redcon.DetachedConn) *subscriber {
+	sub := &subscriber{c: c, conn: conn, wake: make(chan struct{}, 1)}
+	for kind := range sub.names {
+		sub.names[kind] = make(map[string]struct{})
+	}
+	return sub
+}
+
+// count returns the number of subscriptions reported to the client for kind:
+// the channels and patterns are counted together, the shard channels apart.
+func (sub *subscriber) count(kind int) int {
+	if kind == subShard {
+		return len(sub.names[subShard])
+	}
+	return len(sub.names[subChannel]) + len(sub.names[subPattern])
+}
+
+func (sub *subscriber) appendConfirm(b []byte, command string, kind int, channel string) []byte {
+	b = redcon.AppendArray(b, 3)
+	b = redcon.AppendBulkString(b, command)
+	b = redcon.AppendBulkString(b, channel)
+	return redcon.AppendInt(b, int64(sub.count(kind)))
+}
+
+// write queues b for the writer goroutine.
+func (sub *subscriber) write(b []byte) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	if len(sub.out)+len(b) > subscriberOutputLimit {
+		// the writer may be blocked, close the socket under it, serve
+		// cleans up once the read fails
+		sub.closed = true
+		sub.conn.NetConn().Close()
+		return
+	}
+	sub.out = append(sub.out, b...)
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes the queued replies and messages, wmu must be held.
+func (sub *subscriber) flush() error {
+	sub.mu.Lock()
+	out := sub.out
+	sub.out = nil
+	sub.mu.Unlock()
+	if len(out) > 0 {
+		sub.conn.WriteRaw(out)
+	}
+	return sub.conn.Flush()
+}
+
+func (sub *subscriber) writer(done chan struct{}) {
+	for {
+		select {
+		case <-sub.wake:
+		case <-done:
+			return
+		}
+		sub.wmu.Lock()
+		err := sub.flush()
+		sub.wmu.Unlock()
+		if err != nil {
+			sub.conn.NetConn().Close()
+			return
+		}
+	}
+}
+
+func (sub *subscriber) subscribed() bool {
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+	for kind := range sub.names {
+		if len(sub.names[kind]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serve runs the commands of the connection, starting with the pending ones
+// read along the first subscription, until it is closed.
+func (sub *subscriber) serve(s uhaha.Service, pending [][]string) {
+	done := make(chan struct{})
+	go sub.writer(done)
+	defer func() {
+		close(done)
+		pubsub.removeAll(sub)
+		sub.mu.Lock()
+		sub.closed = true
+		sub.mu.Unlock()
+		// Close flushes the connection writer
+		sub.wmu.Lock()
+		sub.conn.Close()
+		sub.wmu.Unlock()
+		s.Closed(sub.c.opts.Context, sub.conn.RemoteAddr())
+	}()
+	for {
+		var args []string
+		if len(pending) > 0 {
+			args, pending = pending[0], pending[1:]
+		} else {
+			cmd, err := sub.conn.ReadCommand()
+			if err != nil {
+				return
+			}
+			if len(cmd.Args) == 0 {
+				continue
+			}
+			args = respCommandToArgs(cmd)
+		}
+		if !sub.handle(s, args) {
+			return
+		}
+	}
+}
+
+// handle runs a command, it returns false when the connection must close.
+func (sub *subscriber) handle(s uhaha.Service, args []string) bool {
+	if kind, subscribe := pubSubCommandKind(args[0]); kind >= 0 {
+		sub.c.touch(args)
+		if subscribe && len(args) < 2 {
+			sub.write(redcon.AppendError(nil, "ERR wrong number of arguments for '"+args[0]+"' command"))
+		} else if err := sub.c.checkACL(args); err != nil {
+			sub.write(redcon.AppendError(nil, err.Error()))
+		} else if subscribe {
+			pubsub.subscribe(sub, kind, args[1:])
+		} else {
+			pubsub.unsubscribe(sub, kind, args[1:])
+		}
+		return true
+	}
+	if !sub.subscribed() {
+		// back to a regular connection
+		sub.wmu.Lock()
+		defer sub.wmu.Unlock()
+		if err := sub.flush(); err != nil {
+			return false
+		}
+		sub.c.execArgs(s, sub.conn, [][]string{args})
+		return sub.conn.Flush() == nil
+	}
+	switch args[0] {
+	case "ping":
+		if len(args) > 2 {
+			sub.write(redcon.AppendError(nil, "ERR wrong number of arguments for 'ping' command"))
+			return true
+		}
+		var msg string
+		if len(args) == 2 {
+			msg = args[1]
+		}
+		sub.write(redcon.AppendBulkString(redcon.AppendBulkString(
+			redcon.AppendArray(nil, 2), "pong"), msg))
+		return true
+	case "quit":
+		sub.wmu.Lock()
+		defer sub.wmu.Unlock()
+		sub.write(redcon.AppendOK(nil))
+		sub.flush()
+		return false
+	}
+	sub.write(redcon.AppendError(nil, "ERR Can't execute '"+args[0]+
+		"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+	return true
+}
+
+// cmdPUBLISH posts a message to a channel. It replies with the number of
+// subscribers of the node that answers the client, the leader: the subscribers
+// of the followers get the message too but are not counted.
+// Syntax: PUBLISH channel message
+func cmdPUBLISH(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	return redcon.SimpleInt(pubsub.publish(args[1], args[2], false)), nil
+}
+
+// cmdSPUBLISH posts a message to a shard channel. There is a single shard,
+// the Raft group, so it only differs from PUBLISH by the subscribers it
+// reaches.
+// Syntax: SPUBLISH shardchannel message
+func cmdSPUBLISH(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	return redcon.SimpleInt(pubsub.publish(args[1], args[2], true)), nil
+}
+
+// connPUBSUB inspects the subscriptions of the node.
+// Syntax: PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+// | SHARDCHANNELS [pattern] | SHARDNUMSUB [shardchannel ...]
+func connPUBSUB(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+	channels := func(kind int) (interface{}, error) {
+		if len(args) > 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		ret := []string{}
+		for channel := range pubsub.subs[kind] {
+			if len(args) == 2 || globMatch(args[2], channel, false) {
+				ret = append(ret, channel)
+			}
+		}
+		sort.Strings(ret)
+		return ret, nil
+	}
+	numSub := func(kind int) (interface{}, error) {
+		ret := make([]interface{}, 0, 2*(len(args)-2))
+		for _, channel := range args[2:] {
+			ret = append(ret, channel, redcon.SimpleInt(len(pubsub.subs[kind][channel])))
+		}
+		return ret, nil
+	}
+	switch strings.ToUpper(args[1]) {
+	case "CHANNELS":
+		return channels(subChannel)
+	case "SHARDCHANNELS":
+		return channels(subShard)
+	case "NUMSUB":
+		return numSub(subChannel)
+	case "SHARDNUMSUB":
+		return numSub(subShard)
+	case "NUMPAT":
+		if len(args) != 2 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		return redcon.SimpleInt(len(pubsub.subs[subPattern])), nil
+	}
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[1])
+}
@@ -0,0 +1,198 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestPubSub(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	sub := c.Subscribe(ctx, "ps_news", "ps_sport")
+	defer sub.Close()
+	for _, channel := range []string{"ps_news", "ps_sport"} {
+		v, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, ok := v.(*redis.Subscription); !ok || s.Kind != "subscribe" || s.Channel != channel {
+			t.Fatal(v)
+		}
+	}
+	psub := c.PSubscribe(ctx, "ps_n*")
+	defer psub.Close()
+	if _, err := psub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.Publish(ctx, "ps_news", "hello").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if msg, err := sub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Channel != "ps_news" || msg.Payload != "hello" {
+		t.Fatal(msg)
+	}
+	if msg, err := psub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Pattern != "ps_n*" || msg.Channel != "ps_news" || msg.Payload != "hello" {
+		t.Fatal(msg)
+	}
+	if n, err := c.Publish(ctx, "ps_other", "x").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	// a subscribed connection still answers pings
+	if err := sub.Ping(ctx, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	} else if p, ok := v.(*redis.Pong); !ok || p.Payload != "hi" {
+		t.Fatal(v)
+	}
+
+	if v, err := c.PubSubChannels(ctx, "ps_*").Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []string{"ps_news", "ps_sport"}) {
+		t.Fatal(v)
+	}
+	if v, err := c.PubSubNumSub(ctx, "ps_news", "ps_none").Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, map[string]int64{"ps_news": 1, "ps_none": 0}) {
+		t.Fatal(v)
+	}
+	if v, err := c.PubSubNumPat(ctx).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != 1 {
+		t.Fatal(v)
+	}
+
+	if err := sub.Unsubscribe(ctx, "ps_news"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	} else if s, ok := v.(*redis.Subscription); !ok || s.Kind != "unsubscribe" || s.Count != 1 {
+		t.Fatal(v)
+	}
+	if n, err := c.Publish(ctx, "ps_news", "again").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+
+	// PUBLISH is replayed from transactions and scripts
+	if _, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Publish(ctx, "ps_sport", "tx")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := sub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Payload != "tx" {
+		t.Fatal(msg)
+	}
+	if err := c.Eval(ctx, "return redis.call('publish', 'ps_sport', 'lua')", nil).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := sub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Payload != "lua" {
+		t.Fatal(msg)
+	}
+}
+
+func TestPubSubShard(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	sub := c.SSubscribe(ctx, "ps_shard")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.PubSubShardChannels(ctx, "*").Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []string{"ps_shard"}) {
+		t.Fatal(v)
+	}
+	if v, err := c.PubSubShardNumSub(ctx, "ps_shard").Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, map[string]int64{"ps_shard": 1}) {
+		t.Fatal(v)
+	}
+
+	// the shard channels are apart from the channels
+	if n, err := c.Publish(ctx, "ps_shard", "x").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.SPublish(ctx, "ps_shard", "hello").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if msg, err := sub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Channel != "ps_shard" || msg.Payload != "hello" {
+		t.Fatal(msg)
+	}
+}
+
+func TestPubSubConnection(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	conn := c.Conn()
+	defer conn.Close()
+	if err := conn.Do(ctx, "subscribe", "ps_conn").Err(); err != nil {
+		t.Fatal(err)
+	}
+	// only the pubsub commands are allowed while subscribed
+	if err := conn.Get(ctx, "ps_key").Err(); err == nil || err == redis.Nil {
+		t.Fatal(err)
+	}
+	// the connection is a regular one again once unsubscribed
+	if err := conn.Do(ctx, "unsubscribe").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Set(ctx, "ps_key", "v", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := conn.Get(ctx, "ps_key").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+
+	// a closed subscriber is forgotten
+	sub := c.Subscribe(ctx, "ps_closed")
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+	for i := 0; ; i++ {
+		if v, _ := c.PubSubNumSub(ctx, "ps_closed").Result(); v["ps_closed"] == 0 {
+			break
+		}
+		if i == 50 {
+			t.Fatal("the subscription was kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
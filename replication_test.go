@@ -0,0 +1,377 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const followerEnv = "ICEFIREDB_TEST_FOLLOWER"
+
+// TestReplicationFollower is the follower node started by
+// TestWriteCommandsReplicate in another process.
+func TestReplicationFollower(t *testing.T) {
+	if os.Getenv(followerEnv) == "" {
+		t.Skip("started by TestWriteCommandsReplicate")
+	}
+	conf.Addr = "127.0.0.1:11002"
+	conf.NodeID = "2"
+	conf.JoinAddr = "127.0.0.1:11001"
+	conf.OpenReads = true
+	startTestNode("/tmp/icefiredb-follower")
+	select {}
+}
+
+// replicatedState returns the ACL users and the keys of the first databases of
+// the node with their type, expire time and value, and the expire times of
+// the hash fields.
+func replicatedState(ctx context.Context, client *redis.Client) (map[string]string, error) {
+	state := make(map[string]string)
+	users, err := client.Do(ctx, "acl", "list").StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	state["acl"] = fmt.Sprint(users)
+	for db := 0; db < 3; db++ {
+		opts := *client.Options()
+		opts.DB = db
+		c := redis.NewClient(&opts)
+		err := dbState(ctx, c, db, state)
+		c.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// dbState adds the keys of the database db to state.
+func dbState(ctx context.Context, c *redis.Client, db int, state map[string]string) error {
+	keys, err := c.Keys(ctx, "*").Result()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		typ, err := c.Type(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		at, err := c.Do(ctx, "pexpiretime", key).Int64()
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		if typ == "stream" {
+			v, err = c.XRange(ctx, key, "-", "+").Result()
+		} else {
+			v, err = c.Dump(ctx, key).Result()
+		}
+		if err != nil {
+			return err
+		}
+		if typ == "hash" {
+			// the expire times of the fields are not in DUMP
+			fields, err := c.HKeys(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			args := []interface{}{"hpexpiretime", key, "fields", len(fields)}
+			for _, field := range fields {
+				args = append(args, field)
+			}
+			ats, err := c.Do(ctx, args...).Slice()
+			if err != nil {
+				return err
+			}
+			v = fmt.Sprintf("%v %v", v, ats)
+		}
+		state[fmt.Sprintf("%d:%s", db, key)] = fmt.Sprintf("%s %d %v", typ, at, v)
+	}
+	return nil
+}
+
+func TestWriteCommandsReplicate(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReplicationFollower$")
+	cmd.Env = append(os.Environ(), followerEnv+"=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// the leader alone must keep a quorum for the next tests
+		c.Do(ctx, "raft", "server", "remove", "2")
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	follower := redis.NewClient(&redis.Options{Addr: "127.0.0.1:11002"})
+	defer follower.Close()
+	c.Set(ctx, "repl_joined", "1", 0)
+	for i := 0; ; i++ {
+		if v, _ := follower.Get(ctx, "repl_joined").Result(); v == "1" {
+			break
+		}
+		if i == 300 {
+			t.Fatal("the follower did not join")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the messages published on the leader reach the follower subscribers
+	sub := follower.Subscribe(ctx, "repl_chan")
+	defer sub.Close()
+	ssub := follower.SSubscribe(ctx, "repl_schan")
+	defer ssub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ssub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set(ctx, "repl_dump", "v", 0)
+	payload, err := c.Dump(ctx, "repl_dump").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	atMs := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	const replScript = "return redis.call('rpush', KEYS[1], ARGV[1])"
+
+	// an invocation of every write command, run in order on the leader
+	samples := [][]interface{}{
+		{"flushall"},
+		{"flushdb"},
+
+		{"set", "repl_s", "v"},
+		{"setnx", "repl_s2", "v"},
+		{"setex", "repl_s3", 100, "v"},
+		{"psetex", "repl_s4", 100000, "v"},
+		{"setexat", "repl_s5", at, "v"},
+		{"getset", "repl_s", "v2"},
+		{"append", "repl_s", "x"},
+		{"setrange", "repl_s", 1, "y"},
+		{"incr", "repl_n"},
+		{"incrby", "repl_n", 5},
+		{"decr", "repl_n"},
+		{"decrby", "repl_n", 2},
+		{"setbit", "repl_b", 3, 1},
+		{"bitop", "or", "repl_b2", "repl_b", "repl_b"},
+		{"mset", "repl_m1", "a", "repl_m2", "b"},
+		{"del", "repl_m2"},
+		{"expire", "repl_m1", 100},
+		{"expireat", "repl_s2", at},
+		{"pexpire", "repl_s", 100000},
+		{"pexpireat", "repl_s3", atMs},
+		{"rename", "repl_m1", "repl_m3"},
+		{"renamenx", "repl_m3", "repl_m4"},
+		{"copy", "repl_m4", "repl_m5"},
+		{"copy", "repl_m4", "repl_m5", "db", 1},
+		{"set", "repl_moved", "v", "ex", 100},
+		{"move", "repl_moved", 2},
+		{"swapdb", 1, 2},
+		{"restore", "repl_r", 0, payload},
+		{"incrbyfloat", "repl_f", "1.25"},
+		{"set", "repl_s6", "v"},
+		{"getdel", "repl_s6"},
+		{"getex", "repl_s4", "ex", 100},
+		{"getex", "repl_s3", "persist"},
+		{"msetnx", "repl_m6", "a", "repl_m7", "b"},
+		{"pfadd", "repl_hll", "a", "b", "c"},
+		{"pfadd", "repl_hll2", "c", "d"},
+		{"pfmerge", "repl_hll3", "repl_hll", "repl_hll2"},
+		{"bitfield", "repl_bf", "set", "u8", 0, 200, "overflow", "sat", "incrby", "u8", 0, 100},
+		{"expired", "repl_none"},
+
+		{"hset", "repl_h", "f", "v"},
+		{"hmset", "repl_h", "g", 1, "h", 2},
+		{"hsetnx", "repl_h", "i", 1},
+		{"hincrby", "repl_h", "g", 3},
+		{"hdel", "repl_h", "h"},
+		{"hexpire", "repl_h", 100},
+		{"hexpireat", "repl_h", at},
+		{"hset", "repl_h2", "f", "v"},
+		{"hclear", "repl_h2"},
+		{"hset", "repl_h3", "f", "v"},
+		{"hmclear", "repl_h3"},
+		{"hincrbyfloat", "repl_h", "g", "1.5"},
+		{"hset", "repl_h4", "a", 1, "b", 2, "c", 3, "d", 4},
+		{"hgetdel", "repl_h4", "fields", 1, "a"},
+		{"hexpire", "repl_h4", 100, "fields", 1, "b"},
+		{"hexpireat", "repl_h4", at, "fields", 1, "c"},
+		{"hpexpire", "repl_h4", 100000, "fields", 1, "d"},
+		{"hpexpireat", "repl_h4", atMs, "fields", 1, "b"},
+		{"hpersist", "repl_h4", "fields", 1, "c"},
+		{"hexpired", "repl_h4", "d", 1},
+
+		{"rpush", "repl_l", "a", "b", "c", "d"},
+		{"lpush", "repl_l", "z"},
+		{"lpop", "repl_l"},
+		{"rpop", "repl_l"},
+		{"lset", "repl_l", 0, "x"},
+		{"ltrim", "repl_l", 0, 2},
+		{"lmove", "repl_l", "repl_l2", "left", "right"},
+		{"rpoplpush", "repl_l", "repl_l2"},
+		{"linsert", "repl_l", "before", "x", "y"},
+		{"lrem", "repl_l", 1, "x"},
+		{"lpushx", "repl_l", "p"},
+		{"rpushx", "repl_l", "q"},
+		{"lmpop", 2, "repl_none", "repl_l", "right", "count", 2},
+		{"rpush", "repl_bl", "a", "b", "c", "d"},
+		{"blpop", "repl_none", "repl_bl", 0},
+		{"brpop", "repl_bl", 0},
+		{"brpoplpush", "repl_bl", "repl_l2", 0},
+		{"blmove", "repl_bl", "repl_l2", "left", "left", 0},
+		{"lexpire", "repl_l", 100},
+		{"lexpireat", "repl_l2", at},
+		{"rpush", "repl_l3", "a"},
+		{"lclear", "repl_l3"},
+		{"rpush", "repl_l4", "a"},
+		{"lmclear", "repl_l4"},
+
+		{"sadd", "repl_set", "a", "b", "c"},
+		{"srem", "repl_set", "c"},
+		{"sadd", "repl_set2", "b", "d"},
+		{"sdiffstore", "repl_set3", "repl_set", "repl_set2"},
+		{"sinterstore", "repl_set4", "repl_set", "repl_set2"},
+		{"sunionstore", "repl_set5", "repl_set", "repl_set2"},
+		{"sexpire", "repl_set", 100},
+		{"sexpireat", "repl_set2", at},
+		{"spersist", "repl_set2"},
+		{"sadd", "repl_set6", "a", "b", "c", "d", "e", "f", "g", "h"},
+		{"spop", "repl_set6"},
+		{"spop", "repl_set6", 3},
+		{"smove", "repl_set6", "repl_set", "a"},
+		{"smove", "repl_set6", "repl_set", "b"},
+		{"smove", "repl_set6", "repl_set", "c"},
+		{"sclear", "repl_set3"},
+		{"smclear", "repl_set4"},
+
+		{"zadd", "repl_z", 1, "a", 2, "b", 3, "c", 4, "d"},
+		{"zrem", "repl_z", "d"},
+		{"zincrby", "repl_z", 5, "a"},
+		{"zremrangebyscore", "repl_z", 3, 3},
+		{"zremrangebyrank", "repl_z", 0, 0},
+		{"zadd", "repl_z2", 1, "a"},
+		{"zclear", "repl_z2"},
+		{"zadd", "repl_z3", 0, "a", 0, "b", 0, "c", 0, "d", 0, "e"},
+		{"zremrangebylex", "repl_z3", "[e", "+"},
+		{"zpopmin", "repl_z3"},
+		{"zpopmax", "repl_z3"},
+		{"zunionstore", "repl_z4", 2, "repl_z", "repl_z3"},
+		{"zinterstore", "repl_z5", 2, "repl_z", "repl_z4", "weights", 2, 3},
+		{"zrangestore", "repl_z6", "repl_z4", 0, -1, "rev"},
+		{"geoadd", "repl_geo", 13.361389, 38.115556, "a", 15.087269, 37.502669, "b"},
+		{"geoadd", "repl_geo", "xx", "ch", 13.361389, 38.2, "a"},
+		{"geosearchstore", "repl_geo2", "repl_geo", "fromlonlat", 15, 37, "byradius", 100, "km"},
+
+		{"xadd", "repl_x", "1-1", "f", "v"},
+		{"xadd", "repl_x", "2-1", "f", "v"},
+		{"xgroup", "create", "repl_x", "g", "0"},
+		{"xreadgroup", "group", "g", "c", "streams", "repl_x", ">"},
+		{"xack", "repl_x", "g", "1-1"},
+		{"xclaim", "repl_x", "g", "c2", 0, "2-1"},
+		{"xdel", "repl_x", "1-1"},
+		{"xtrim", "repl_x", "maxlen", 1},
+
+		{"eval", "redis.call('set', KEYS[1], math.random(1000000)) return redis.call('incr', KEYS[2])", 2, "repl_lua", "repl_lua_n"},
+		{"script", "load", replScript},
+		{"evalsha", scriptSHA(replScript), 1, "repl_lua_l", "a"},
+		{"script", "flush"},
+		{"function", "load", "#!lua name=repl\nredis.register_function('repl_incr', function(keys, args) return redis.call('incrby', keys[1], args[1]) end)"},
+		{"fcall", "repl_incr", 1, "repl_fn", 3},
+		{"publish", "repl_chan", "m"},
+		{"spublish", "repl_schan", "sm"},
+		{"acl", "setuser", "repl_user", "on", ">secret", "~repl_*", "&repl_*", "+@read", "-get"},
+		{"acl", "setuser", "repl_user2"},
+		{"acl", "deluser", "repl_user2"},
+	}
+	// the scripts of the connections are sent in ASUSER entries
+	sampled := map[string]bool{"exec": true, "asuser": true}
+	for _, args := range samples {
+		if err := c.Do(ctx, args...).Err(); err != nil && err != redis.Nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		sampled[args[0].(string)] = true
+	}
+	// the writes of the other databases are sent in SELECT entries
+	db1 := redis.NewClient(&redis.Options{Addr: "127.0.0.1:11001", DB: 1})
+	defer db1.Close()
+	if err := db1.HSet(ctx, "repl_db", "f", "v").Err(); err != nil {
+		t.Fatal(err)
+	}
+	sampled["select"] = true
+	if _, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, "repl_tx", "v", 0)
+		p.RPush(ctx, "repl_tx_list", "a")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name, cmd := range commands {
+		if cmd.write && !sampled[name] {
+			t.Errorf("write command %s has no replication sample", name)
+		}
+	}
+
+	if msg, err := sub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Channel != "repl_chan" || msg.Payload != "m" {
+		t.Fatal(msg)
+	}
+	if msg, err := ssub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Channel != "repl_schan" || msg.Payload != "sm" {
+		t.Fatal(msg)
+	}
+
+	// the reply of PUBLISH only counts the subscribers of the leader
+	if n, err := c.Publish(ctx, "repl_chan", "m2").Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if msg, err := sub.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.Channel != "repl_chan" || msg.Payload != "m2" {
+		t.Fatal(msg)
+	}
+
+	want, err := replicatedState(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		got, err := replicatedState(ctx, follower)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if i == 50 {
+			for key, v := range want {
+				if got[key] != v {
+					t.Errorf("%s: leader %q, follower %q", key, v, got[key])
+				}
+			}
+			for key, v := range got {
+				if _, ok := want[key]; !ok {
+					t.Errorf("%s: only on the follower %q", key, v)
+				}
+			}
+			t.FailNow()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
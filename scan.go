@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/ledisdb/ledisdb/store"
 	"github.com/siddontang/go/num"
 	"github.com/tidwall/uhaha"
 )
@@ -22,6 +26,7 @@ var (
 )
 
 func init() {
+	conf.AddReadCommand("SCAN", cmdSCAN)
 	conf.AddReadCommand("HSCAN", scanGroup.cmdXHSCAN)
 	conf.AddReadCommand("SSCAN", scanGroup.cmdXSSCAN)
 	conf.AddReadCommand("ZSCAN", scanGroup.cmdXZSCAN)
@@ -237,3 +242,147 @@ func (scg scanCommandGroup) cmdXZSCAN(_ uhaha.Machine, args []string) (interface
 	data[1] = vv
 	return data, nil
 }
+
+var errInvalidCursor = errors.New("ERR invalid cursor")
+
+// ledisScanTypes maps the meta store type of the ledis data types to the type
+// argument of ledis.DB.Scan.
+var ledisScanTypes = map[byte]ledis.DataType{
+	ledis.KVType:    ledis.KV,
+	ledis.LMetaType: ledis.LIST,
+	ledis.SSizeType: ledis.SET,
+	ledis.ZSizeType: ledis.ZSET,
+	ledis.HSizeType: ledis.HASH,
+}
+
+const scanCursorSlots = 1 << 14
+
+// scanCursorTable maps the numeric cursors of SCAN, which clients expect to
+// be integers, to the position of the scan: a type of keyTypes and the last
+// key returned for it. The table is local to the node serving the reads, a
+// cursor that is unknown (evicted, or issued by a former leader) restarts
+// the scan of its type, which may return keys twice but never misses one.
+type scanCursorTable struct {
+	mu    sync.Mutex
+	next  uint64
+	slots [scanCursorSlots]scanCursor
+}
+
+type scanCursor struct {
+	id  uint64
+	typ int
+	key []byte
+}
+
+var scanCursors = &scanCursorTable{next: uint64(rand.Int63())}
+
+// save returns a new cursor for the position, the cursor type is kept in its
+// low byte to survive an eviction from the table.
+func (t *scanCursorTable) save(typ int, key []byte) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	id := (t.next&(1<<55-1))<<8 | uint64(typ+1)
+	t.slots[id%scanCursorSlots] = scanCursor{id: id, typ: typ, key: key}
+	return id
+}
+
+func (t *scanCursorTable) load(id uint64) (typ int, key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.slots[id%scanCursorSlots]; c.id == id {
+		return c.typ, c.key
+	}
+	return int(id&0xff) - 1, nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func cmdSCAN(_ uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var match, typeName string
+	count := 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, uhaha.ErrSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return nil, uhaha.ErrSyntax
+			}
+		case "TYPE":
+			typeName = strings.ToLower(args[i+1])
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+
+	var typ int
+	var last []byte
+	if cursor != 0 {
+		typ, last = scanCursors.load(cursor)
+		if typ < 0 || typ >= len(keyTypes) {
+			return nil, errInvalidCursor
+		}
+	}
+	keys := [][]byte{}
+	for scanned := 0; typ < len(keyTypes) && scanned < count; {
+		kt := &keyTypes[typ]
+		if typeName != "" && kt.name != typeName {
+			typ, last = typ+1, nil
+			continue
+		}
+		want := count - scanned
+		ay, err := scanKeyType(kt, last, want)
+		if err != nil {
+			return nil, err
+		}
+		scanned += len(ay)
+		for _, key := range ay {
+			if match == "" || globMatch(match, string(key), false) {
+				keys = append(keys, key)
+			}
+		}
+		if len(ay) < want {
+			typ, last = typ+1, nil
+		} else {
+			last = ay[len(ay)-1]
+		}
+	}
+
+	next := []byte("0")
+	if typ < len(keyTypes) {
+		next = strconv.AppendUint(nil, scanCursors.save(typ, last), 10)
+	}
+	return []interface{}{next, keys}, nil
+}
+
+// scanKeyType returns up to count keys of the type after cursor.
+func scanKeyType(kt *keyType, cursor []byte, count int) ([][]byte, error) {
+	if dataType, ok := ledisScanTypes[kt.metaScan]; ok {
+		return ldb.Scan(dataType, cursor, count, false, "")
+	}
+	prefix := append(streamDBPrefix(), kt.metaScan)
+	min, rangeType := prefix, store.RangeROpen
+	if cursor != nil {
+		min, rangeType = kt.metaKey(cursor), store.RangeOpen
+	}
+	it := ldb.GetSDB().RangeLimitIterator(min, prefixEnd(prefix), rangeType, 0, count)
+	defer it.Close()
+	var keys [][]byte
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, append([]byte(nil), kt.decodeMetaKey(it.RawKey())...))
+	}
+	return keys, nil
+}
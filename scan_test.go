@@ -215,3 +215,64 @@ func TestZSetScan(t *testing.T) {
 		checkScanValues(t, ay[1], "a", "1", "b", "2")
 	}
 }
+
+func TestScanAllTypes(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.FlushAll(ctx)
+	expected := make(map[string]bool)
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("scan_all_%d", i)
+		switch i % 5 {
+		case 0:
+			c.Set(ctx, key, "v", 0)
+		case 1:
+			c.RPush(ctx, key, "v")
+		case 2:
+			c.SAdd(ctx, key, "v")
+		case 3:
+			c.ZAdd(ctx, key, redis.Z{Score: 1, Member: "v"})
+		case 4:
+			c.HSet(ctx, key, "f", "v")
+		}
+		expected[key] = true
+	}
+	c.XAdd(ctx, &redis.XAddArgs{Stream: "scan_all_stream", ID: "1-1", Values: []string{"f", "v"}})
+	expected["scan_all_stream"] = true
+	c.Set(ctx, "other", "v", 0)
+
+	seen := make(map[string]bool)
+	iter := c.Scan(ctx, 0, "scan_all_*", 4).Iterator()
+	for iter.Next(ctx) {
+		seen[iter.Val()] = true
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(expected) {
+		t.Fatalf("expected %d keys, got %d", len(expected), len(seen))
+	}
+	for key := range expected {
+		if !seen[key] {
+			t.Fatalf("missing %s", key)
+		}
+	}
+
+	var hashes []string
+	iter = c.ScanType(ctx, 0, "", 3, "hash").Iterator()
+	for iter.Next(ctx) {
+		hashes = append(hashes, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 5 {
+		t.Fatal(hashes)
+	}
+
+	if err := c.Do(ctx, "SCAN", "abc").Err(); err == nil {
+		t.Fatal("expected invalid cursor")
+	}
+	c.FlushAll(ctx)
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func init() {
+	conf.AddWriteCommand("EVAL", cmdEVAL)
+	conf.AddWriteCommand("EVALSHA", cmdEVALSHA)
+	conf.AddReadCommand("EVAL_RO", cmdEVALRO)
+	conf.AddReadCommand("EVALSHA_RO", cmdEVALSHARO)
+	// SCRIPT LOAD and FLUSH change the script cache, so the whole command
+	// goes through the log.
+	conf.AddWriteCommand("SCRIPT", cmdSCRIPT)
+
+	registerSnapshotSection("scripts", scripts.save, scripts.load)
+}
+
+var (
+	errNoScript         = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	errScriptNumKeys    = errors.New("ERR Number of keys can't be greater than number of args")
+	errScriptNegKeys    = errors.New("ERR Number of keys can't be negative")
+	errScriptCommand    = errors.New("ERR This Redis command is not allowed from script")
+	errScriptUnknown    = errors.New("ERR Unknown Redis command called from script")
+	errScriptReadOnly   = errors.New("ERR Write commands are not allowed from read-only scripts.")
+	errScriptArgs       = errors.New("ERR Lua redis lib command arguments must be strings or integers")
+	errScriptNoCommand  = errors.New("ERR Please specify at least one argument for this redis lib call")
+	errScriptSteps      = errors.New("ERR Script killed after running too many instructions")
+	errScriptSubcommand = "ERR unknown subcommand '%s'. Try SCRIPT HELP."
+)
+
+// scriptCommandDenied lists the commands a script can not call, the ones
+// that run other commands or only make sense on a client connection.
+var scriptCommandDenied = map[string]bool{
+	"eval": true, "evalsha": true, "eval_ro": true, "evalsha_ro": true,
+	"script": true, "exec": true, "watch": true,
+	"function": true, "fcall": true, "fcall_ro": true, "acl": true,
+	"asuser": true,
+}
+
+// scriptTable is the script cache of EVALSHA, keyed by the SHA1 digest of
+// the scripts. It is only changed by write commands inside Apply, so it is
+// the same on every node, and it is carried by snapshots.
+type scriptTable struct {
+	bodies map[string]string
+}
+
+var scripts = &scriptTable{bodies: make(map[string]string)}
+
+func scriptSHA(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// add caches body and returns its digest.
+func (t *scriptTable) add(body string) string {
+	sha := scriptSHA(body)
+	t.bodies[sha] = body
+	return sha
+}
+
+// save encodes the scripts, sorted by digest: uvarint len | body ...
+func (t *scriptTable) save() []byte {
+	shas := make([]string, 0, len(t.bodies))
+	for sha := range t.bodies {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+	var data []byte
+	for _, sha := range shas {
+		data = binary.AppendUvarint(data, uint64(len(t.bodies[sha])))
+		data = append(data, t.bodies[sha]...)
+	}
+	return data
+}
+
+func (t *scriptTable) load(data []byte) error {
+	t.bodies = make(map[string]string)
+	for len(data) > 0 {
+		n, sz := binary.Uvarint(data)
+		if sz <= 0 || uint64(len(data)-sz) < n {
+			return uhaha.ErrCorrupt
+		}
+		t.add(string(data[sz : sz+int(n)]))
+		data = data[sz+int(n):]
+	}
+	return nil
+}
+
+// cmdEVAL runs a Lua script. The whole script is a single write entry, so it
+// runs atomically and its redis.call writes replay the same on every node.
+// Syntax: EVAL script numkeys [key [key ...]] [arg [arg ...]]
+func cmdEVAL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	sha := scripts.add(args[1])
+	return runScript(m, sha, args[1], args[2:], false)
+}
+
+// cmdEVALSHA runs a script of the cache.
+// Syntax: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+func cmdEVALSHA(m uhaha.Machine, args []string) (interface{}, error) {
+	return evalSHA(m, args, false)
+}
+
+// cmdEVALRO runs a script that only calls read commands, without going
+// through the log. It is not added to the script cache.
+// Syntax: EVAL_RO script numkeys [key [key ...]] [arg [arg ...]]
+func cmdEVALRO(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	return runScript(m, scriptSHA(args[1]), args[1], args[2:], true)
+}
+
+// cmdEVALSHARO runs a read only script of the cache.
+// Syntax: EVALSHA_RO sha1 numkeys [key [key ...]] [arg [arg ...]]
+func cmdEVALSHARO(m uhaha.Machine, args []string) (interface{}, error) {
+	return evalSHA(m, args, true)
+}
+
+func evalSHA(m uhaha.Machine, args []string, readOnly bool) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	sha := strings.ToLower(args[1])
+	body, ok := scripts.bodies[sha]
+	if !ok {
+		return nil, errNoScript
+	}
+	return runScript(m, sha, body, args[2:], readOnly)
+}
+
+// cmdSCRIPT manages the script cache.
+// Syntax: SCRIPT LOAD script | EXISTS sha1 [sha1 ...] | FLUSH [ASYNC | SYNC]
+func cmdSCRIPT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "LOAD" && len(args) == 3:
+		return scripts.add(args[2]), nil
+	case sub == "EXISTS" && len(args) >= 3:
+		ret := make([]interface{}, len(args)-2)
+		for i, sha := range args[2:] {
+			_, ok := scripts.bodies[strings.ToLower(sha)]
+			ret[i] = redcon.SimpleInt(boolInt(ok))
+		}
+		return ret, nil
+	case sub == "FLUSH" && len(args) <= 3:
+		if len(args) == 3 && !strings.EqualFold(args[2], "ASYNC") && !strings.EqualFold(args[2], "SYNC") {
+			return nil, uhaha.ErrSyntax
+		}
+		scripts.bodies = make(map[string]string)
+		return redcon.SimpleString("OK"), nil
+	case sub == "LOAD" || sub == "EXISTS" || sub == "FLUSH":
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	return nil, fmt.Errorf(errScriptSubcommand, args[1])
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// scriptKeysArgs splits "numkeys [key ...] [arg ...]".
+func scriptKeysArgs(args []string) (keys, argv []string, err error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, errScriptNegKeys
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, errScriptNumKeys
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+// runScript runs the script body in a new Lua state with the KEYS and ARGV
+// tables of args.
+func runScript(m uhaha.Machine, sha, body string, args []string, readOnly bool) (interface{}, error) {
+	keys, argv, err := scriptKeysArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	L := newScriptState(m, newScriptACL(m, keys, readOnly), readOnly)
+	defer L.Close()
+	limitSteps(L)
+	L.SetGlobal("KEYS", scriptStrings(L, keys))
+	L.SetGlobal("ARGV", scriptStrings(L, argv))
+
+	fn, err := L.LoadString(body)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling script (new function): %s", err)
+	}
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, scriptError(L, err, "f_"+sha)
+	}
+	return luaToReply(L.Get(-1))
+}
+
+// newScriptState returns a Lua state for a script. Only the deterministic
+// libraries are opened and math.random draws from the machine generator, so
+// that a write script has the same effects on every node. Without a machine,
+// while a function library is loaded, redis.call is not available. The calls
+// are checked by caller when it is not nil.
+func newScriptState(m uhaha.Machine, caller *scriptACL, readOnly bool) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	var rng *rand.Rand
+	switch {
+	case m == nil:
+		rng = rand.New(rand.NewSource(0))
+	case readOnly:
+		rng = readRand()
+	default:
+		rng = machineRand(m)
+	}
+	scriptOpenRandom(L, rng)
+	scriptOpenRedis(L, m, caller, readOnly)
+	return L
+}
+
+// scriptMaxSteps is the number of VM instructions a script can run before
+// it is aborted. A write script runs inside Apply, so it is bounded by a
+// count of instructions instead of a timeout, which every node reaches at
+// the same point of the script.
+const scriptMaxSteps = 100000000
+
+// stepBudget is the context of a Lua state limited by limitSteps. The VM
+// calls Done before every instruction, so Done counts the instructions.
+type stepBudget struct {
+	left int
+	done chan struct{}
+}
+
+func (b *stepBudget) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (b *stepBudget) Value(key interface{}) interface{} { return nil }
+
+func (b *stepBudget) Done() <-chan struct{} {
+	if b.left--; b.left == 0 {
+		close(b.done)
+	}
+	return b.done
+}
+
+func (b *stepBudget) Err() error {
+	if b.left <= 0 {
+		return errScriptSteps
+	}
+	return nil
+}
+
+// limitSteps makes L abort once it ran scriptMaxSteps instructions.
+func limitSteps(L *lua.LState) {
+	L.SetContext(&stepBudget{left: scriptMaxSteps, done: make(chan struct{})})
+}
+
+// scriptError returns the error of a script that failed in the function
+// name. An error table raised by redis.call keeps the command error.
+func scriptError(L *lua.LState, err error, name string) error {
+	if b, ok := L.Context().(*stepBudget); ok && b.Err() != nil {
+		return errScriptSteps
+	}
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok {
+		return err
+	}
+	if t, ok := apiErr.Object.(*lua.LTable); ok {
+		if msg, ok := t.RawGetString("err").(lua.LString); ok {
+			return errors.New(string(msg))
+		}
+	}
+	return fmt.Errorf("ERR Error running script (call to %s): %s", name, apiErr.Object)
+}
+
+func scriptStrings(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// scriptOpenRandom replaces math.random and math.randomseed, which use the
+// global generator of Go, with rng.
+func scriptOpenRandom(L *lua.LState, rng *rand.Rand) {
+	math := L.GetGlobal(lua.MathLibName).(*lua.LTable)
+	L.SetField(math, "random", L.NewFunction(func(L *lua.LState) int {
+		switch L.GetTop() {
+		case 0:
+			L.Push(lua.LNumber(rng.Float64()))
+		case 1:
+			n := L.CheckInt(1)
+			if n < 1 {
+				L.ArgError(1, "interval is empty")
+			}
+			L.Push(lua.LNumber(rng.Intn(n) + 1))
+		default:
+			min, max := L.CheckInt(1), L.CheckInt(2)
+			if min > max {
+				L.ArgError(2, "interval is empty")
+			}
+			L.Push(lua.LNumber(rng.Intn(max-min+1) + min))
+		}
+		return 1
+	}))
+	L.SetField(math, "randomseed", L.NewFunction(func(L *lua.LState) int {
+		rng.Seed(L.CheckInt64(1))
+		return 0
+	}))
+}
+
+// scriptOpenRedis sets the redis table of the scripts.
+func scriptOpenRedis(L *lua.LState, m uhaha.Machine, caller *scriptACL, readOnly bool) {
+	redis := L.NewTable()
+	call := func(raise bool) lua.LGFunction {
+		return func(L *lua.LState) int {
+			v, err := scriptCall(L, m, caller, readOnly)
+			if err != nil {
+				t := L.NewTable()
+				t.RawSetString("err", lua.LString(err.Error()))
+				if raise {
+					L.Error(t, 1)
+				}
+				L.Push(t)
+				return 1
+			}
+			L.Push(replyToLua(L, v))
+			return 1
+		}
+	}
+	if m != nil {
+		L.SetField(redis, "call", L.NewFunction(call(true)))
+		L.SetField(redis, "pcall", L.NewFunction(call(false)))
+	}
+	L.SetField(redis, "sha1hex", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(scriptSHA(L.CheckString(1))))
+		return 1
+	}))
+	reply := func(field string) lua.LGFunction {
+		return func(L *lua.LState) int {
+			t := L.NewTable()
+			t.RawSetString(field, lua.LString(L.CheckString(1)))
+			L.Push(t)
+			return 1
+		}
+	}
+	L.SetField(redis, "error_reply", L.NewFunction(reply("err")))
+	L.SetField(redis, "status_reply", L.NewFunction(reply("ok")))
+	L.SetGlobal("redis", redis)
+}
+
+// scriptCall runs the command of the arguments of redis.call with the
+// handler registered by conf.AddWriteCommand or conf.AddReadCommand, once
+// allowed by caller when it is not nil.
+func scriptCall(L *lua.LState, m uhaha.Machine, caller *scriptACL, readOnly bool) (interface{}, error) {
+	if L.GetTop() == 0 {
+		return nil, errScriptNoCommand
+	}
+	args := make([]string, L.GetTop())
+	for i := range args {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString:
+			args[i] = string(v)
+		case lua.LNumber:
+			args[i] = v.String()
+		default:
+			return nil, errScriptArgs
+		}
+	}
+	name := strings.ToLower(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		return nil, errScriptUnknown
+	}
+	if scriptCommandDenied[name] {
+		return nil, errScriptCommand
+	}
+	if cmd.write && readOnly {
+		return nil, errScriptReadOnly
+	}
+	args[0] = name
+	if caller != nil {
+		if err := caller.check(args); err != nil {
+			return nil, err
+		}
+	}
+	if !cmd.write && !readOnly {
+		// the keys read by a write script are expired in its log entry, the
+		// read-only scripts only see their declared keys expired
+		if err := expireIfNeeded(m, commandKeys(args)); err != nil {
+			return nil, err
+		}
+	}
+	return cmd.fn(m, args)
+}
+
+// replyToLua converts a command reply to a Lua value like Redis: integers to
+// numbers, bulk strings to strings, nil to false, arrays to tables, status
+// and error replies to tables with an ok or err field.
+func replyToLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LFalse
+	case redcon.SimpleInt:
+		return lua.LNumber(v)
+	case redcon.SimpleString:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v))
+		return t
+	case error:
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(v.Error()))
+		return t
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case bool:
+		if v {
+			return lua.LNumber(1)
+		}
+		return lua.LFalse
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return lua.LNumber(rv.Uint())
+	case reflect.Slice:
+		t := L.CreateTable(rv.Len(), 0)
+		for i := 0; i < rv.Len(); i++ {
+			t.Append(replyToLua(L, rv.Index(i).Interface()))
+		}
+		return t
+	}
+	return lua.LString(fmt.Sprint(v))
+}
+
+// luaToReply converts the value returned by a script to a reply like Redis:
+// numbers are truncated to integers, true is 1 and false nil, and a table is
+// an array up to its first nil unless it has an ok or err field.
+func luaToReply(v lua.LValue) (interface{}, error) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return redcon.SimpleInt(int64(v)), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LBool:
+		if v {
+			return redcon.SimpleInt(1), nil
+		}
+		return nil, nil
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return nil, errors.New(string(msg))
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return redcon.SimpleString(msg), nil
+		}
+		var ret []interface{}
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			r, err := luaToReply(item)
+			if err != nil {
+				// like Redis an error inside an array is an error reply
+				r = err
+			}
+			ret = append(ret, r)
+		}
+		if ret == nil {
+			ret = []interface{}{}
+		}
+		return ret, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,243 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestEval(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	script := "redis.call('set', KEYS[1], ARGV[1]) return redis.call('get', KEYS[1])"
+	if v, err := c.Eval(ctx, script, []string{"lua_k"}, "v").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+	if v, err := c.Get(ctx, "lua_k").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+
+	// EVAL caches the script
+	sha := scriptSHA(script)
+	if v, err := c.EvalSha(ctx, sha, []string{"lua_k2"}, "w").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "w" {
+		t.Fatal(v)
+	}
+	if err := c.EvalSha(ctx, strings.Repeat("0", 40), nil).Err(); err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		t.Fatal(err)
+	}
+
+	if err := c.Eval(ctx, "return 1", []string{"a", "b"}, 1).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Do(ctx, "eval", "return 1", 3, "a").Err(); err == nil || err.Error() != errScriptNumKeys.Error() {
+		t.Fatal(err)
+	}
+	if err := c.Do(ctx, "eval", "return 1", -1).Err(); err == nil || err.Error() != errScriptNegKeys.Error() {
+		t.Fatal(err)
+	}
+	if err := c.Eval(ctx, "return (", nil).Err(); err == nil || !strings.HasPrefix(err.Error(), "ERR Error compiling script") {
+		t.Fatal(err)
+	}
+	if err := c.Eval(ctx, "error('boom')", nil).Err(); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatal(err)
+	}
+}
+
+func TestEvalReplies(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		script string
+		want   interface{}
+	}{
+		{"return 3.99", int64(3)},
+		{"return 'x'", "x"},
+		{"return true", int64(1)},
+		{"return {1, 'a', {2}, nil, 3}", []interface{}{int64(1), "a", []interface{}{int64(2)}}},
+		{"return redis.status_reply('FINE')", "FINE"},
+		{"return redis.call('set', 'lua_s', 'v')", "OK"},
+		{"return redis.call('incr', 'lua_n')", int64(1)},
+		{"return redis.sha1hex('')", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{"return redis.call('get', 'lua_none') == false", int64(1)},
+		{"return #KEYS + #ARGV", int64(0)},
+	} {
+		v, err := c.Eval(ctx, tc.script, nil).Result()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.script, err)
+		}
+		if !reflect.DeepEqual(v, tc.want) {
+			t.Fatalf("%s: %#v", tc.script, v)
+		}
+	}
+	if err := c.Eval(ctx, "return false", nil).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if err := c.Eval(ctx, "return redis.error_reply('MY error')", nil).Err(); err == nil || err.Error() != "MY error" {
+		t.Fatal(err)
+	}
+
+	// redis.call raises the error of the command, redis.pcall returns it
+	c.Set(ctx, "lua_str", "a", 0)
+	if err := c.Eval(ctx, "return redis.call('incr', KEYS[1])", []string{"lua_str"}).Err(); err == nil || err == redis.Nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Eval(ctx, "local r = redis.pcall('incr', KEYS[1]) return type(r.err)", []string{"lua_str"}).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "string" {
+		t.Fatal(v)
+	}
+	if err := c.Eval(ctx, "return redis.call('nosuchcommand')", nil).Err(); err == nil || err.Error() != errScriptUnknown.Error() {
+		t.Fatal(err)
+	}
+	if err := c.Eval(ctx, "return redis.call('eval', 'return 1', 0)", nil).Err(); err == nil || err.Error() != errScriptCommand.Error() {
+		t.Fatal(err)
+	}
+	if err := c.Eval(ctx, "return redis.call('get', {})", nil).Err(); err == nil || err.Error() != errScriptArgs.Error() {
+		t.Fatal(err)
+	}
+
+	// the libraries that reach the file system are not loaded
+	if v, err := c.Eval(ctx, "return type(dofile) .. type(loadfile) .. type(require) .. type(os) .. type(io)", nil).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "nilnilnilnilnil" {
+		t.Fatal(v)
+	}
+}
+
+func TestEvalRO(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "lua_ro", "v", 0)
+	if v, err := c.EvalRO(ctx, "return redis.call('get', KEYS[1])", []string{"lua_ro"}).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+	if err := c.EvalRO(ctx, "return redis.call('set', KEYS[1], 'w')", []string{"lua_ro"}).Err(); err == nil || err.Error() != errScriptReadOnly.Error() {
+		t.Fatal(err)
+	}
+
+	// EVAL_RO does not cache the script
+	script := "return 'ro'"
+	if err := c.EvalRO(ctx, script, nil).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EvalShaRO(ctx, scriptSHA(script), nil).Err(); err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		t.Fatal(err)
+	}
+	c.ScriptLoad(ctx, script)
+	if v, err := c.EvalShaRO(ctx, scriptSHA(script), nil).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "ro" {
+		t.Fatal(v)
+	}
+}
+
+func TestScript(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	sha, err := c.ScriptLoad(ctx, "return ARGV[1]").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != scriptSHA("return ARGV[1]") {
+		t.Fatal(sha)
+	}
+	if v, err := c.EvalSha(ctx, strings.ToUpper(sha), nil, "a").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "a" {
+		t.Fatal(v)
+	}
+	if v, err := c.ScriptExists(ctx, sha, "nosuchsha").Result(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []bool{true, false}) {
+		t.Fatal(v)
+	}
+
+	// the cache is carried by snapshots
+	data := scripts.save()
+	if err := c.ScriptFlush(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.ScriptExists(ctx, sha).Result(); !reflect.DeepEqual(v, []bool{false}) {
+		t.Fatal(v)
+	}
+	if err := scripts.load(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.ScriptExists(ctx, sha).Result(); !reflect.DeepEqual(v, []bool{true}) {
+		t.Fatal(v)
+	}
+	if err := scripts.load(data[:len(data)-1]); err == nil {
+		t.Fatal("loaded a truncated section")
+	}
+	scripts.load(nil)
+
+	if err := c.Do(ctx, "script", "nosuch").Err(); err == nil || !strings.HasPrefix(err.Error(), "ERR unknown subcommand") {
+		t.Fatal(err)
+	}
+}
+
+func TestEvalRandom(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	// math.random draws from the generator of the log, so two runs of a
+	// script do not repeat themselves
+	script := "return {math.random(1000000000), math.random(1000000000)}"
+	a, err := c.Eval(ctx, script, nil).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.Eval(ctx, script, nil).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(a, b) {
+		t.Fatal(a, b)
+	}
+}
+
+func TestEvalStepLimit(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	for _, script := range []string{
+		"while true do end",
+		"redis.call('incr', KEYS[1]) while true do end",
+		// pcall catches the first error, the next instruction fails again
+		"pcall(function() while true do end end) return 1",
+	} {
+		if err := c.Eval(ctx, script, []string{"lua_steps"}).Err(); err == nil || err.Error() != errScriptSteps.Error() {
+			t.Fatal(script, err)
+		}
+	}
+	if err := c.EvalRO(ctx, "while true do end", nil).Err(); err == nil || err.Error() != errScriptSteps.Error() {
+		t.Fatal(err)
+	}
+
+	// the writes made before the limit stay, like the ones of a script
+	// that fails
+	if v, err := c.Get(ctx, "lua_steps").Result(); err != nil || v != "1" {
+		t.Fatal(v, err)
+	}
+	if v, err := c.Eval(ctx, "local n = 0 for i = 1, 100000 do n = n + i end return n", nil).Int(); err != nil || v != 5000050000 {
+		t.Fatal(v, err)
+	}
+}
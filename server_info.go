@@ -67,6 +67,8 @@ func (i *info) Dump(section string) []byte {
 		i.dumpAll(buf)
 	case "server":
 		i.dumpServer(buf)
+	case "clients":
+		i.dumpClients(buf)
 	case "mem":
 		i.dumpMem(buf)
 	case "gc":
@@ -104,6 +106,8 @@ type infoPair struct {
 func (i *info) dumpAll(buf *bytes.Buffer) {
 	i.dumpServer(buf)
 	buf.Write(Delims)
+	i.dumpClients(buf)
+	buf.Write(Delims)
 	i.dumpStore(buf)
 	buf.Write(Delims)
 	i.dumpMem(buf)
@@ -132,6 +136,23 @@ func (i *info) dumpServer(buf *bytes.Buffer) {
 	)
 }
 
+func (i *info) dumpClients(buf *bytes.Buffer) {
+	buf.WriteString("# Clients\r\n")
+
+	conns := clients.sorted()
+	pubsubs := 0
+	for _, c := range conns {
+		if c.pubsub() {
+			pubsubs++
+		}
+	}
+	i.dumpPairs(buf,
+		infoPair{"connected_clients", len(conns)},
+		infoPair{"blocked_clients", blockedClientNum.Load()},
+		infoPair{"pubsub_clients", pubsubs},
+	)
+}
+
 func (i *info) dumpMem(buf *bytes.Buffer) {
 	buf.WriteString("# Mem\r\n")
 
@@ -11,24 +11,63 @@ func init() {
 	conf.AddWriteCommand("FLUSHDB", cmdFLUSHDB)
 }
 
+// cmdINFO returns the information of a section, or of all of them
+// Syntax: INFO [section]
 func cmdINFO(_ uhaha.Machine, args []string) (interface{}, error) {
+	switch len(args) {
+	case 1:
+		return serverInfo.Dump(""), nil
+	case 2:
+		return serverInfo.Dump(args[1]), nil
+	}
+	return nil, uhaha.ErrWrongNumArgs
+}
+
+// cmdFLUSHALL deletes the keys of every database
+// Syntax: FLUSHALL
+func cmdFLUSHALL(_ uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 1 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-	return serverInfo.Dump(""), nil
+	var n int64
+	for index := range ldbs {
+		if err := inDB(index, func() error {
+			d, err := flushDB()
+			n += d
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleInt(n), nil
 }
 
-func cmdFLUSHALL(_ uhaha.Machine, args []string) (interface{}, error) {
+// cmdFLUSHDB deletes the keys of the current database
+// Syntax: FLUSHDB
+func cmdFLUSHDB(_ uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 1 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-	n, err := ldb.FlushAll()
+	n, err := flushDB()
 	if err != nil {
 		return nil, err
 	}
 	return redcon.SimpleInt(n), nil
 }
 
-func cmdFLUSHDB(_ uhaha.Machine, args []string) (interface{}, error) {
-	return cmdFLUSHALL(nil, args)
+// flushDB deletes the keys of the current database and returns their number.
+func flushDB() (int64, error) {
+	n, err := ldb.FlushAll()
+	if err != nil {
+		return 0, err
+	}
+	// streams are stored outside of the ledis data types
+	ns, err := streamFlush()
+	if err != nil {
+		return 0, err
+	}
+	if err := hFieldExpireFlush(); err != nil {
+		return 0, err
+	}
+	return n + ns, nil
 }
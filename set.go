@@ -1,7 +1,10 @@
 package main
 
 import (
-	"time"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
 
 	"github.com/ledisdb/ledisdb/ledis"
 	"github.com/tidwall/redcon"
@@ -27,6 +30,11 @@ func init() {
 	conf.AddReadCommand("STTL", cmdSTTL)
 	conf.AddWriteCommand("SPERSIST", cmdSPERSIST)
 	conf.AddReadCommand("SKEYEXISTS", cmdSKEYEXISTS)
+	conf.AddWriteCommand("SPOP", cmdSPOP)
+	conf.AddReadCommand("SRANDMEMBER", cmdSRANDMEMBER)
+	conf.AddWriteCommand("SMOVE", cmdSMOVE)
+	conf.AddReadCommand("SMISMEMBER", cmdSMISMEMBER)
+	conf.AddReadCommand("SINTERCARD", cmdSINTERCARD)
 }
 
 func cmdSADD(m uhaha.Machine, args []string) (interface{}, error) {
@@ -164,18 +172,7 @@ func cmdSEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, uhaha.ErrInvalid
 	}
-
-	timestamp := m.Now().Unix() + duration
-	if timestamp < time.Now().Unix() {
-		_, err := ldb.SClear([]byte(args[1]))
-		if err != nil {
-			return nil, err
-		}
-		return redcon.SimpleInt(0), nil
-	}
-
-	v, err := ldb.SExpireAt([]byte(args[1]), timestamp)
-	return redcon.SimpleInt(v), err
+	return expireKeyType(m, keyTypeByExp(ledis.SetType), []byte(args[1]), unixMilli(m.Now())+duration*1000)
 }
 
 func cmdSEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
@@ -187,25 +184,14 @@ func cmdSEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
 	if err != nil {
 		return nil, uhaha.ErrInvalid
 	}
-	if timestamp < time.Now().Unix() {
-		_, err := ldb.SClear([]byte(args[1]))
-		if err != nil {
-			return nil, err
-		}
-		return redcon.SimpleInt(0), nil
-	}
-
-	v, err := ldb.SExpireAt([]byte(args[1]), timestamp)
-	return redcon.SimpleInt(v), err
+	return expireKeyType(m, keyTypeByExp(ledis.SetType), []byte(args[1]), timestamp*1000)
 }
 
 func cmdSTTL(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 2 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-
-	v, err := ldb.STTL([]byte(args[1]))
-	return redcon.SimpleInt(v), err
+	return keyTypeTTL(keyTypeByExp(ledis.SetType), []byte(args[1]), m.Now())
 }
 
 func cmdSPERSIST(m uhaha.Machine, args []string) (interface{}, error) {
@@ -226,6 +212,210 @@ func cmdSKEYEXISTS(m uhaha.Machine, args []string) (interface{}, error) {
 	return redcon.SimpleInt(n), err
 }
 
+// machineRand returns a generator seeded by m.Rand(), so that a write command
+// draws the same numbers on every node and when the log is replayed.
+func machineRand(m uhaha.Machine) *rand.Rand {
+	return rand.New(rand.NewSource(int64(m.Rand().Uint64())))
+}
+
+// readRand returns a generator for a read command. Reads are not in the log,
+// and m.Rand() of a read always returns the value of the last applied entry,
+// so it would draw the same numbers until the next write.
+func readRand() *rand.Rand {
+	return rand.New(rand.NewSource(rand.Int63()))
+}
+
+// sParseCount parses the count of SPOP and SRANDMEMBER.
+func sParseCount(arg string, allowNegative bool) (int, error) {
+	count, err := strconv.Atoi(arg)
+	if err != nil || (!allowNegative && count < 0) {
+		return 0, errors.New("ERR value is out of range, must be positive")
+	}
+	return count, nil
+}
+
+// cmdSPOP removes and returns random members.
+// Syntax: SPOP key [count]
+func cmdSPOP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	count, single := 1, len(args) == 2
+	if !single {
+		var err error
+		if count, err = sParseCount(args[2], false); err != nil {
+			return nil, err
+		}
+	}
+	key := []byte(args[1])
+	members, err := ldb.SMembers(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 || count == 0 {
+		if single {
+			return nil, nil
+		}
+		return [][]byte{}, nil
+	}
+	r := machineRand(m)
+	r.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	if count < len(members) {
+		members = members[:count]
+	}
+	if _, err := ldb.SRem(key, members...); err != nil {
+		return nil, err
+	}
+	if single {
+		return members[0], nil
+	}
+	return members, nil
+}
+
+// cmdSRANDMEMBER returns random members. A positive count returns distinct
+// members, a negative one may return the same member several times.
+// Syntax: SRANDMEMBER key [count]
+func cmdSRANDMEMBER(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	count, single := 1, len(args) == 2
+	if !single {
+		var err error
+		if count, err = sParseCount(args[2], true); err != nil {
+			return nil, err
+		}
+	}
+	members, err := ldb.SMembers([]byte(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	rng := readRand()
+	if single {
+		if len(members) == 0 {
+			return nil, nil
+		}
+		return members[rng.Intn(len(members))], nil
+	}
+	if len(members) == 0 || count == 0 {
+		return [][]byte{}, nil
+	}
+	if count > 0 {
+		rng.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+		if count < len(members) {
+			members = members[:count]
+		}
+		return members, nil
+	}
+	picked := make([][]byte, -count)
+	for i := range picked {
+		picked[i] = members[rng.Intn(len(members))]
+	}
+	return picked, nil
+}
+
+// cmdSMOVE moves member from the source set to the destination set.
+// Syntax: SMOVE source destination member
+func cmdSMOVE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	source, dest, member := []byte(args[1]), []byte(args[2]), []byte(args[3])
+	n, err := ldb.SIsMember(source, member)
+	if err != nil || n == 0 || args[1] == args[2] {
+		return redcon.SimpleInt(n), err
+	}
+
+	// the member leaves source and joins dest in one write batch
+	set := keyTypeByExp(ledis.SetType)
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	size, err := ldb.SCard(source)
+	if err != nil {
+		return nil, err
+	}
+	if size == 1 {
+		if err := set.deleteKey(wb, source); err != nil {
+			return nil, err
+		}
+	} else {
+		wb.Delete(setMemberKey(source, member))
+		wb.Put(set.metaKey(source), ledis.PutInt64(size-1))
+	}
+	if n, err := ldb.SIsMember(dest, member); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if size, err = ldb.SCard(dest); err != nil {
+			return nil, err
+		}
+		wb.Put(setMemberKey(dest, member), nil)
+		wb.Put(set.metaKey(dest), ledis.PutInt64(size+1))
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(1), nil
+}
+
+// setMemberKey encodes db|SetType|keylen|key|':'|member, the layout of the
+// ledis set members.
+func setMemberKey(key, member []byte) []byte {
+	return streamKey(ledis.SetType, key, []byte{':'}, member)
+}
+
+// cmdSMISMEMBER returns whether each member belongs to the set.
+// Syntax: SMISMEMBER key member [member ...]
+func cmdSMISMEMBER(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	ret := make([]interface{}, len(args)-2)
+	for i, member := range args[2:] {
+		n, err := ldb.SIsMember(key, []byte(member))
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = redcon.SimpleInt(n)
+	}
+	return ret, nil
+}
+
+// cmdSINTERCARD returns the size of the intersection of the sets, stopping at
+// limit when it is not 0.
+// Syntax: SINTERCARD numkeys key [key ...] [LIMIT limit]
+func cmdSINTERCARD(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys <= 0 {
+		return nil, errors.New("ERR numkeys should be greater than 0")
+	}
+	if len(args) < numKeys+2 {
+		return nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	limit := 0
+	switch rest := args[numKeys+2:]; {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0]) == "LIMIT":
+		if limit, err = strconv.Atoi(rest[1]); err != nil || limit < 0 {
+			return nil, errors.New("ERR LIMIT can't be negative")
+		}
+	default:
+		return nil, uhaha.ErrSyntax
+	}
+	members, err := ldb.SInter(stringSliceToBytes(args[2 : numKeys+2])...)
+	if err != nil {
+		return nil, err
+	}
+	n := len(members)
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	return redcon.SimpleInt(n), nil
+}
+
 func stringSliceToBytes(args []string) [][]byte {
 	bs := make([][]byte, len(args))
 	for k, v := range args {
@@ -315,3 +315,162 @@ func TestSKeyExists(t *testing.T) {
 		t.Fatal("invalid value ", n)
 	}
 }
+
+func TestSPopRandMember(t *testing.T) {
+	db := getTestConn()
+	ctx := context.Background()
+	key := "spop_test"
+
+	db.Del(ctx, key)
+	if err := db.SPop(ctx, key).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if err := db.SRandMember(ctx, key).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	db.SAdd(ctx, key, "a", "b", "c", "d", "e")
+
+	if v, err := db.SRandMemberN(ctx, key, 3).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 3 || v[0] == v[1] || v[0] == v[2] || v[1] == v[2] {
+		t.Fatal(v)
+	}
+	if v, err := db.SRandMemberN(ctx, key, 10).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 5 {
+		t.Fatal(v)
+	}
+	if v, err := db.SRandMemberN(ctx, key, -10).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 10 {
+		t.Fatal(v)
+	}
+
+	v, err := db.SPop(ctx, key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.SIsMember(ctx, key, v).Result(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("%s was not removed", v)
+	}
+	if vs, err := db.SPopN(ctx, key, 3).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(vs) != 3 {
+		t.Fatal(vs)
+	}
+	if n, err := db.SCard(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if vs, err := db.SPopN(ctx, key, 3).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(vs) != 1 {
+		t.Fatal(vs)
+	}
+	if n, err := db.Exists(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if err := db.Do(ctx, "spop", key, -1).Err(); err == nil {
+		t.Fatal("expected a range error")
+	}
+}
+
+func TestSMove(t *testing.T) {
+	db := getTestConn()
+	ctx := context.Background()
+	src, dst := "smove_src", "smove_dst"
+
+	db.Del(ctx, src, dst)
+	db.SAdd(ctx, src, "a", "b")
+	if ok, err := db.SMove(ctx, src, dst, "a").Result(); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("SMOVE failed")
+	}
+	if ok, err := db.SMove(ctx, src, dst, "a").Result(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("moved a missing member")
+	}
+	if ok, err := db.SMove(ctx, src, src, "b").Result(); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("SMOVE to the same set failed")
+	}
+	if ok, err := db.SMove(ctx, src, dst, "b").Result(); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("SMOVE failed")
+	}
+	if n, err := db.Exists(ctx, src).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if v, err := db.SMembers(ctx, dst).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 {
+		t.Fatal(v)
+	}
+
+	// a member already in dst still leaves src, which keeps its expire time
+	db.SAdd(ctx, src, "c", "d")
+	db.Expire(ctx, src, time.Hour)
+	if ok, err := db.SMove(ctx, src, dst, "a").Result(); err != nil || ok {
+		t.Fatal(ok, err)
+	}
+	db.SAdd(ctx, dst, "c")
+	if ok, err := db.SMove(ctx, src, dst, "c").Result(); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if n, err := db.SCard(ctx, src).Result(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n, err := db.SCard(ctx, dst).Result(); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+	if d, err := db.TTL(ctx, src).Result(); err != nil || d <= 0 {
+		t.Fatal(d, err)
+	}
+}
+
+func TestSMIsMemberInterCard(t *testing.T) {
+	db := getTestConn()
+	ctx := context.Background()
+
+	db.Del(ctx, "sintercard_a", "sintercard_b")
+	db.SAdd(ctx, "sintercard_a", "a", "b", "c", "d")
+	db.SAdd(ctx, "sintercard_b", "b", "c", "d", "e")
+	if v, err := db.SMIsMember(ctx, "sintercard_a", "a", "e", "d").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 3 || !v[0] || v[1] || !v[2] {
+		t.Fatal(v)
+	}
+
+	if n, err := db.SInterCard(ctx, 0, "sintercard_a", "sintercard_b").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatal(n)
+	}
+	if n, err := db.SInterCard(ctx, 2, "sintercard_a", "sintercard_b").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if n, err := db.SInterCard(ctx, 0, "sintercard_a", "sintercard_none").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if err := db.Do(ctx, "sintercard", 3, "sintercard_a", "sintercard_b").Err(); err == nil {
+		t.Fatal("expected a numkeys error")
+	}
+	if err := db.Do(ctx, "sintercard", 1, "sintercard_a", "limit", -1).Err(); err == nil {
+		t.Fatal("expected a LIMIT error")
+	}
+}
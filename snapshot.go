@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io"
+
+	"github.com/ledisdb/ledisdb/store"
+	"github.com/tidwall/sds"
+	rafthub "github.com/tidwall/uhaha"
+)
+
+// restoreBatchSize is the number of key/value pairs committed per write batch
+// while restoring a snapshot.
+const restoreBatchSize = 1000
+
+// snap is a point-in-time view of the ledis store. It only relies on the
+// ledis driver.ISnapshot/IIterator interfaces, so it works the same for every
+// storage backend (goleveldb, badger, hybriddb, oss, crdt, ipfs...).
+type snap struct {
+	s        *store.Snapshot
+	sections [][2][]byte
+}
+
+// snapshotSection is machine state kept outside of ledis that must still be
+// carried by Raft snapshots. save runs while Apply is not running, load gets
+// nil when the snapshot has no data for the section.
+type snapshotSection struct {
+	name string
+	save func() []byte
+	load func(data []byte) error
+}
+
+var snapshotSections []snapshotSection
+
+func registerSnapshotSection(name string, save func() []byte,
+	load func(data []byte) error,
+) {
+	snapshotSections = append(snapshotSections, snapshotSection{name, save, load})
+}
+
+func (s *snap) Done(path string) {
+	s.s.Close()
+}
+
+// Persist writes every raw key/value pair of the snapshot as a sds stream:
+// (key, value), (key, value), ... followed by an empty key and the
+// (name, data) pairs of the snapshot sections. Raw ledis keys are never empty.
+func (s *snap) Persist(wr io.Writer) error {
+	sw := sds.NewWriter(wr)
+	iter := s.s.NewIterator()
+	defer iter.Close()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if err := sw.WriteBytes(iter.RawKey()); err != nil {
+			return err
+		}
+		if err := sw.WriteBytes(iter.RawValue()); err != nil {
+			return err
+		}
+	}
+	if len(s.sections) > 0 {
+		if err := sw.WriteBytes(nil); err != nil {
+			return err
+		}
+		for _, section := range s.sections {
+			if err := sw.WriteBytes(section[0]); err != nil {
+				return err
+			}
+			if err := sw.WriteBytes(section[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return sw.Flush()
+}
+
+func snapshot(data interface{}) (rafthub.Snapshot, error) {
+	s, err := newSnapshot(storeDB())
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range snapshotSections {
+		s.sections = append(s.sections,
+			[2][]byte{[]byte(section.name), section.save()})
+	}
+	return s, nil
+}
+
+func restore(rd io.Reader) (interface{}, error) {
+	sections, err := restoreSnapshot(storeDB(), rd)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range snapshotSections {
+		if err := section.load(sections[section.name]); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func newSnapshot(sdb *store.DB) (*snap, error) {
+	s, err := sdb.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &snap{s: s}, nil
+}
+
+// restoreSnapshot replaces the content of the store with the pairs read from
+// a stream written by snap.Persist and returns the snapshot sections. The key
+// counts of the stagedDB are made again once the pairs are written.
+func restoreSnapshot(sdb *store.DB, rd io.Reader) (sections map[string][]byte, err error) {
+	counter, _ := sdb.GetDriver().(*stagedDB)
+	if counter == nil {
+		return loadSnapshot(sdb, rd)
+	}
+	err = counter.withoutCounts(func() error {
+		sections, err = loadSnapshot(sdb, rd)
+		return err
+	})
+	return sections, err
+}
+
+func loadSnapshot(sdb *store.DB, rd io.Reader) (map[string][]byte, error) {
+	// A follower installing a snapshot may still hold stale keys that are
+	// not part of the snapshot, drop them first.
+	if err := clearStore(sdb); err != nil {
+		return nil, err
+	}
+
+	sr := sds.NewReader(rd)
+	wb := newChunkedBatch(sdb)
+	defer wb.Close()
+	sections := make(map[string][]byte)
+	for {
+		key, err := sr.ReadBytes()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if len(key) == 0 {
+			if sections, err = readSnapshotSections(sr); err != nil {
+				return nil, err
+			}
+			break
+		}
+		value, err := sr.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := wb.Put(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return sections, wb.Commit()
+}
+
+func readSnapshotSections(sr *sds.Reader) (map[string][]byte, error) {
+	sections := make(map[string][]byte)
+	for {
+		name, err := sr.ReadBytes()
+		if err != nil {
+			if err == io.EOF {
+				return sections, nil
+			}
+			return nil, err
+		}
+		data, err := sr.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		sections[string(name)] = data
+	}
+}
+
+func clearStore(sdb *store.DB) error {
+	iter := sdb.NewIterator()
+	defer iter.Close()
+
+	wb := newChunkedBatch(sdb)
+	defer wb.Close()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if err := wb.Delete(iter.Key()); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// chunkedBatch commits every restoreBatchSize operations and starts a fresh
+// write batch, since not every driver resets its batch on Commit.
+type chunkedBatch struct {
+	sdb *store.DB
+	wb  *store.WriteBatch
+	n   int
+}
+
+func newChunkedBatch(sdb *store.DB) *chunkedBatch {
+	return &chunkedBatch{sdb: sdb, wb: sdb.NewWriteBatch()}
+}
+
+func (b *chunkedBatch) Put(key, value []byte) error {
+	b.wb.Put(key, value)
+	return b.next()
+}
+
+func (b *chunkedBatch) Delete(key []byte) error {
+	b.wb.Delete(key)
+	return b.next()
+}
+
+func (b *chunkedBatch) next() error {
+	b.n++
+	if b.n < restoreBatchSize {
+		return nil
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	b.wb.Close()
+	b.wb = b.sdb.NewWriteBatch()
+	b.n = 0
+	return nil
+}
+
+func (b *chunkedBatch) Commit() error {
+	return b.wb.Commit()
+}
+
+func (b *chunkedBatch) Close() {
+	b.wb.Close()
+}
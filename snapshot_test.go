@@ -0,0 +1,117 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	lediscfg "github.com/ledisdb/ledisdb/config"
+	"github.com/ledisdb/ledisdb/ledis"
+
+	"github.com/IceFireDB/IceFireDB/driver/badger"
+	"github.com/IceFireDB/IceFireDB/driver/hybriddb"
+)
+
+func openSnapshotTestDB(t *testing.T, driver string) *ledis.DB {
+	cfg := lediscfg.NewConfigDefault()
+	cfg.DataDir = t.TempDir()
+	cfg.Databases = 1
+	cfg.DBName = driver
+	l, err := ledis.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Close)
+
+	db, err := l.Select(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, driver := range []string{"goleveldb", badger.StorageName, hybriddb.StorageName} {
+		t.Run(driver, func(t *testing.T) {
+			src := openSnapshotTestDB(t, driver)
+
+			if err := src.Set([]byte("kv"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := src.HSet([]byte("hash"), []byte("field"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := src.RPush([]byte("list"), []byte("a"), []byte("b")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := src.SAdd([]byte("set"), []byte("m1"), []byte("m2")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := src.ZAdd([]byte("zset"), ledis.ScorePair{Score: 3, Member: []byte("m")}); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := newSnapshot(src.GetSDB())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// writes after the snapshot was taken must not leak into it
+			if err := src.Set([]byte("late"), []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+			s.sections = append(s.sections, [2][]byte{[]byte("section"), []byte("data")})
+			var buf bytes.Buffer
+			if err := s.Persist(&buf); err != nil {
+				t.Fatal(err)
+			}
+			s.Done("")
+
+			dst := openSnapshotTestDB(t, driver)
+			if err := dst.Set([]byte("stale"), []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+			sections, err := restoreSnapshot(dst.GetSDB(), &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(sections["section"]) != "data" {
+				t.Fatalf("section: %q", sections["section"])
+			}
+
+			if v, err := dst.Get([]byte("kv")); err != nil {
+				t.Fatal(err)
+			} else if string(v) != "value" {
+				t.Fatalf("kv: %q", v)
+			}
+			if v, err := dst.HGet([]byte("hash"), []byte("field")); err != nil {
+				t.Fatal(err)
+			} else if string(v) != "value" {
+				t.Fatalf("hash: %q", v)
+			}
+			if v, err := dst.LRange([]byte("list"), 0, -1); err != nil {
+				t.Fatal(err)
+			} else if len(v) != 2 || string(v[0]) != "a" || string(v[1]) != "b" {
+				t.Fatalf("list: %q", v)
+			}
+			if n, err := dst.SCard([]byte("set")); err != nil {
+				t.Fatal(err)
+			} else if n != 2 {
+				t.Fatalf("set: %d", n)
+			}
+			if n, err := dst.ZScore([]byte("zset"), []byte("m")); err != nil {
+				t.Fatal(err)
+			} else if n != 3 {
+				t.Fatalf("zset: %d", n)
+			}
+			for _, key := range []string{"late", "stale"} {
+				if n, err := dst.Exists([]byte(key)); err != nil {
+					t.Fatal(err)
+				} else if n != 0 {
+					t.Fatalf("%s should not exist after restore", key)
+				}
+			}
+		})
+	}
+}
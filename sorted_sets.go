@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"math"
 	"strconv"
 	"strings"
 
 	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/ledisdb/ledisdb/store"
 	"github.com/siddontang/go/hack"
 	"github.com/tidwall/redcon"
 	"github.com/tidwall/uhaha"
@@ -15,6 +17,15 @@ func init() {
 	conf.AddWriteCommand("ZADD", cmdZADD)
 	conf.AddWriteCommand("ZREM", cmdZREM)
 	conf.AddWriteCommand("ZCLEAR", cmdZCLEAR)
+	conf.AddWriteCommand("ZINCRBY", cmdZINCRBY)
+	conf.AddWriteCommand("ZREMRANGEBYSCORE", cmdZREMRANGEBYSCORE)
+	conf.AddWriteCommand("ZREMRANGEBYRANK", cmdZREMRANGEBYRANK)
+	conf.AddWriteCommand("ZREMRANGEBYLEX", cmdZREMRANGEBYLEX)
+	conf.AddWriteCommand("ZUNIONSTORE", cmdZUNIONSTORE)
+	conf.AddWriteCommand("ZINTERSTORE", cmdZINTERSTORE)
+	conf.AddWriteCommand("ZRANGESTORE", cmdZRANGESTORE)
+	conf.AddWriteCommand("ZPOPMIN", cmdZPOPMIN)
+	conf.AddWriteCommand("ZPOPMAX", cmdZPOPMAX)
 
 	// Read command
 	conf.AddReadCommand("ZCARD", cmdZCARD)
@@ -23,12 +34,14 @@ func init() {
 	conf.AddReadCommand("ZRANGE", cmdZRANGE)
 	conf.AddReadCommand("ZREVRANGE", cmdZREVRANGE)
 	conf.AddReadCommand("ZSCORE", cmdZSCORE)
-	conf.AddReadCommand("ZINCRBY", cmdZINCRBY)
 	conf.AddReadCommand("ZREVRANK", cmdZREVRANK)
 	conf.AddReadCommand("ZRANGEBYSCORE", cmdZRANGEBYSCORE)
 	conf.AddReadCommand("ZREVRANGEBYSCORE", cmdZREVRANGEBYSCORE)
-	conf.AddReadCommand("ZREMRANGEBYSCORE", cmdZREMRANGEBYSCORE)
-	conf.AddReadCommand("ZREMRANGEBYRANK", cmdZREMRANGEBYRANK)
+	conf.AddReadCommand("ZRANGEBYLEX", cmdZRANGEBYLEX)
+	conf.AddReadCommand("ZREVRANGEBYLEX", cmdZREVRANGEBYLEX)
+	conf.AddReadCommand("ZLEXCOUNT", cmdZLEXCOUNT)
+	conf.AddReadCommand("ZMSCORE", cmdZMSCORE)
+	conf.AddReadCommand("ZRANDMEMBER", cmdZRANDMEMBER)
 }
 
 func zparseRange(a1 string, a2 string) (start int, stop int, err error) {
@@ -144,53 +157,6 @@ func cmdZCARD(m uhaha.Machine, args []string) (interface{}, error) {
 	return redcon.SimpleInt(n), nil
 }
 
-func cmdZRANGE(m uhaha.Machine, args []string) (interface{}, error) {
-	if len(args) < 4 {
-		return nil, uhaha.ErrWrongNumArgs
-	}
-
-	min, max, err := zparseRange(args[2], args[3])
-	if err != nil {
-		return nil, err
-	}
-
-	ScorePair, err := ldb.ZRange([]byte(args[1]), int(min), int(max))
-	if err != nil {
-		return nil, err
-	}
-
-	var withScores bool
-	args = args[4:]
-	if len(args) > 0 {
-		if len(args) != 1 {
-			return nil, uhaha.ErrWrongNumArgs
-		}
-		if strings.ToLower(args[0]) == "withscores" {
-			withScores = true
-		} else {
-			return nil, uhaha.ErrSyntax
-		}
-	}
-
-	if withScores {
-		ret := make([][]byte, len(ScorePair)*2)
-
-		for index, item := range ScorePair {
-			ret[index*2] = item.Member
-			ret[index*2+1] = []byte(strconv.Itoa(int(item.Score)))
-		}
-		return ret, nil
-	}
-
-	ret := make([][]byte, len(ScorePair))
-
-	for index, item := range ScorePair {
-		ret[index] = item.Member
-	}
-
-	return ret, nil
-}
-
 func cmdZREVRANGE(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) < 4 {
 		return nil, uhaha.ErrWrongNumArgs
@@ -544,3 +510,505 @@ func cmdZREMRANGEBYRANK(m uhaha.Machine, args []string) (interface{}, error) {
 
 	return redcon.SimpleInt(n), nil
 }
+
+// zscorePairs returns the members of pairs, each followed by its score when
+// withScores is set.
+func zscorePairs(pairs []ledis.ScorePair, withScores bool) [][]byte {
+	ret := make([][]byte, 0, len(pairs)*2)
+	for _, item := range pairs {
+		ret = append(ret, item.Member)
+		if withScores {
+			ret = append(ret, []byte(strconv.FormatInt(item.Score, 10)))
+		}
+	}
+	return ret
+}
+
+// zdelete deletes the zset key with its expire time.
+func zdelete(key []byte) error {
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if err := keyTypeByExp(ledis.ZSetType).deleteKey(wb, key); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// zparseLimit parses "LIMIT offset count".
+func zparseLimit(args []string) (offset, count int, err error) {
+	if len(args) != 3 || strings.ToUpper(args[0]) != "LIMIT" {
+		return 0, 0, uhaha.ErrSyntax
+	}
+	if offset, err = strconv.Atoi(args[1]); err != nil {
+		return 0, 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if count, err = strconv.Atoi(args[2]); err != nil {
+		return 0, 0, errors.New("ERR value is not an integer or out of range")
+	}
+	return offset, count, nil
+}
+
+// zparseLexRange parses the min and max of the lex range commands, a nil min
+// or max stands for - or +. empty is set for the ranges that cannot match
+// anything, like + -.
+func zparseLexRange(minArg, maxArg string) (min, max []byte, rangeType uint8, empty bool, err error) {
+	errRange := errors.New("ERR min or max not valid string range item")
+	switch {
+	case minArg == "-":
+	case minArg == "+":
+		empty = true
+	case strings.HasPrefix(minArg, "["):
+		min = []byte(minArg[1:])
+	case strings.HasPrefix(minArg, "("):
+		min = []byte(minArg[1:])
+		rangeType |= store.RangeLOpen
+	default:
+		return nil, nil, 0, false, errRange
+	}
+	switch {
+	case maxArg == "+":
+	case maxArg == "-":
+		empty = true
+	case strings.HasPrefix(maxArg, "["):
+		max = []byte(maxArg[1:])
+	case strings.HasPrefix(maxArg, "("):
+		max = []byte(maxArg[1:])
+		rangeType |= store.RangeROpen
+	default:
+		return nil, nil, 0, false, errRange
+	}
+	return min, max, rangeType, empty, nil
+}
+
+// zrangeByLex returns the members of key between the lex range items min and
+// max, from max to min when rev is set.
+func zrangeByLex(key []byte, minArg, maxArg string, offset, count int, rev bool) ([][]byte, error) {
+	min, max, rangeType, empty, err := zparseLexRange(minArg, maxArg)
+	if err != nil || empty || offset < 0 {
+		return nil, err
+	}
+	if !rev {
+		return ldb.ZRangeByLex(key, min, max, rangeType, offset, count)
+	}
+	// ledis only iterates forward
+	members, err := ldb.ZRangeByLex(key, min, max, rangeType, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+		members[i], members[j] = members[j], members[i]
+	}
+	if offset >= len(members) {
+		return nil, nil
+	}
+	members = members[offset:]
+	if count >= 0 && count < len(members) {
+		members = members[:count]
+	}
+	return members, nil
+}
+
+// zrangeOptions are the options of ZRANGE and ZRANGESTORE:
+// [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+type zrangeOptions struct {
+	byScore, byLex bool
+	rev            bool
+	offset, count  int
+	withScores     bool
+}
+
+func zparseRangeOptions(args []string, withScores bool) (opts zrangeOptions, err error) {
+	opts.count = -1
+	var limit bool
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BYSCORE":
+			opts.byScore = true
+		case "BYLEX":
+			opts.byLex = true
+		case "REV":
+			opts.rev = true
+		case "WITHSCORES":
+			if !withScores {
+				return opts, uhaha.ErrSyntax
+			}
+			opts.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return opts, uhaha.ErrSyntax
+			}
+			if opts.offset, opts.count, err = zparseLimit(args[i : i+3]); err != nil {
+				return opts, err
+			}
+			limit = true
+			i += 2
+		default:
+			return opts, uhaha.ErrSyntax
+		}
+	}
+	if opts.byScore && opts.byLex {
+		return opts, uhaha.ErrSyntax
+	}
+	if limit && !opts.byScore && !opts.byLex {
+		return opts, errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if opts.withScores && opts.byLex {
+		return opts, errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	return opts, nil
+}
+
+// zrange returns the members of key from start to stop, which are ranks,
+// scores or lex range items depending on opts. With REV, the score and lex
+// ranges go from max to min.
+func zrange(key []byte, start, stop string, opts zrangeOptions) ([]ledis.ScorePair, error) {
+	switch {
+	case opts.byScore:
+		if opts.rev {
+			start, stop = stop, start
+		}
+		min, max, err := zparseScoreRange([]byte(start), []byte(stop))
+		if err != nil || opts.offset < 0 {
+			return nil, err
+		}
+		return ldb.ZRangeByScoreGeneric(key, min, max, opts.offset, opts.count, opts.rev)
+	case opts.byLex:
+		if opts.rev {
+			start, stop = stop, start
+		}
+		members, err := zrangeByLex(key, start, stop, opts.offset, opts.count, opts.rev)
+		if err != nil {
+			return nil, err
+		}
+		pairs := make([]ledis.ScorePair, len(members))
+		for i, member := range members {
+			score, err := ldb.ZScore(key, member)
+			if err != nil {
+				return nil, err
+			}
+			pairs[i] = ledis.ScorePair{Score: score, Member: member}
+		}
+		return pairs, nil
+	default:
+		min, max, err := zparseRange(start, stop)
+		if err != nil {
+			return nil, err
+		}
+		return ldb.ZRangeGeneric(key, min, max, opts.rev)
+	}
+}
+
+// cmdZRANGE returns a range of members.
+// Syntax: ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func cmdZRANGE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	opts, err := zparseRangeOptions(args[4:], true)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := zrange([]byte(args[1]), args[2], args[3], opts)
+	if err != nil {
+		return nil, err
+	}
+	return zscorePairs(pairs, opts.withScores), nil
+}
+
+// cmdZRANGESTORE stores a range of members of src in dst.
+// Syntax: ZRANGESTORE dst src min max [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+func cmdZRANGESTORE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	opts, err := zparseRangeOptions(args[5:], false)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := zrange([]byte(args[2]), args[3], args[4], opts)
+	if err != nil {
+		return nil, err
+	}
+	dst := []byte(args[1])
+	if err := zdelete(dst); err != nil {
+		return nil, err
+	}
+	if len(pairs) > 0 {
+		if _, err := ldb.ZAdd(dst, pairs...); err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleInt(len(pairs)), nil
+}
+
+// zparseStoreArgs parses "numkeys key [key ...] [WEIGHTS weight [weight ...]]
+// [AGGREGATE SUM | MIN | MAX]" of ZUNIONSTORE and ZINTERSTORE.
+func zparseStoreArgs(args []string) (keys [][]byte, weights []int64, aggregate byte, err error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if numKeys < 1 {
+		return nil, nil, 0, errors.New("ERR at least 1 input key is needed for this command")
+	}
+	if len(args) < numKeys+1 {
+		return nil, nil, 0, uhaha.ErrSyntax
+	}
+	keys = stringSliceToBytes(args[1 : numKeys+1])
+	aggregate = ledis.AggregateSum
+	for i := numKeys + 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WEIGHTS":
+			if i+numKeys >= len(args) {
+				return nil, nil, 0, uhaha.ErrSyntax
+			}
+			weights = make([]int64, numKeys)
+			for j := range weights {
+				if weights[j], err = strconv.ParseInt(args[i+1+j], 10, 64); err != nil {
+					return nil, nil, 0, errors.New("ERR weight value is not an integer")
+				}
+			}
+			i += numKeys
+		case "AGGREGATE":
+			if i+1 >= len(args) {
+				return nil, nil, 0, uhaha.ErrSyntax
+			}
+			switch strings.ToUpper(args[i+1]) {
+			case "SUM":
+				aggregate = ledis.AggregateSum
+			case "MIN":
+				aggregate = ledis.AggregateMin
+			case "MAX":
+				aggregate = ledis.AggregateMax
+			default:
+				return nil, nil, 0, uhaha.ErrSyntax
+			}
+			i++
+		default:
+			return nil, nil, 0, uhaha.ErrSyntax
+		}
+	}
+	return keys, weights, aggregate, nil
+}
+
+// zstore runs ZUNIONSTORE and ZINTERSTORE with the ledis store function.
+func zstore(args []string, store func([]byte, [][]byte, []int64, byte) (int64, error)) (interface{}, error) {
+	if len(args) < 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	keys, weights, aggregate, err := zparseStoreArgs(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	dst := []byte(args[1])
+	n, err := store(dst, keys, weights, aggregate)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		// ledis leaves an empty zset behind
+		if err := zdelete(dst); err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// cmdZUNIONSTORE stores the union of the zsets in destination.
+// Syntax: ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM | MIN | MAX]
+func cmdZUNIONSTORE(m uhaha.Machine, args []string) (interface{}, error) {
+	return zstore(args, ldb.ZUnionStore)
+}
+
+// cmdZINTERSTORE stores the intersection of the zsets in destination.
+// Syntax: ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM | MIN | MAX]
+func cmdZINTERSTORE(m uhaha.Machine, args []string) (interface{}, error) {
+	return zstore(args, ldb.ZInterStore)
+}
+
+// cmdZRANGEBYLEX returns the members between min and max, all the members of
+// the zset having the same score.
+// Syntax: ZRANGEBYLEX key min max [LIMIT offset count]
+func cmdZRANGEBYLEX(m uhaha.Machine, args []string) (interface{}, error) {
+	return zrangeByLexCommand(args, false)
+}
+
+// cmdZREVRANGEBYLEX returns the members between max and min, in reverse order.
+// Syntax: ZREVRANGEBYLEX key max min [LIMIT offset count]
+func cmdZREVRANGEBYLEX(m uhaha.Machine, args []string) (interface{}, error) {
+	return zrangeByLexCommand(args, true)
+}
+
+func zrangeByLexCommand(args []string, rev bool) (interface{}, error) {
+	if len(args) != 4 && len(args) != 7 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	offset, count := 0, -1
+	if len(args) == 7 {
+		var err error
+		if offset, count, err = zparseLimit(args[4:]); err != nil {
+			return nil, err
+		}
+	}
+	min, max := args[2], args[3]
+	if rev {
+		min, max = max, min
+	}
+	members, err := zrangeByLex([]byte(args[1]), min, max, offset, count, rev)
+	if err != nil {
+		return nil, err
+	}
+	if members == nil {
+		members = [][]byte{}
+	}
+	return members, nil
+}
+
+// cmdZLEXCOUNT returns the number of members between min and max.
+// Syntax: ZLEXCOUNT key min max
+func cmdZLEXCOUNT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	min, max, rangeType, empty, err := zparseLexRange(args[2], args[3])
+	if err != nil || empty {
+		return redcon.SimpleInt(0), err
+	}
+	n, err := ldb.ZLexCount([]byte(args[1]), min, max, rangeType)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// cmdZREMRANGEBYLEX removes the members between min and max.
+// Syntax: ZREMRANGEBYLEX key min max
+func cmdZREMRANGEBYLEX(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	// ledis ZRemRangeByLex leaves the scores and the size behind
+	members, err := zrangeByLex(key, args[2], args[3], 0, -1, false)
+	if err != nil || len(members) == 0 {
+		return redcon.SimpleInt(0), err
+	}
+	n, err := ldb.ZRem(key, members...)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// cmdZPOPMIN removes and returns the members with the lowest scores.
+// Syntax: ZPOPMIN key [count]
+func cmdZPOPMIN(m uhaha.Machine, args []string) (interface{}, error) {
+	return zpop(args, false)
+}
+
+// cmdZPOPMAX removes and returns the members with the highest scores.
+// Syntax: ZPOPMAX key [count]
+func cmdZPOPMAX(m uhaha.Machine, args []string) (interface{}, error) {
+	return zpop(args, true)
+}
+
+func zpop(args []string, max bool) (interface{}, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	count := 1
+	if len(args) == 3 {
+		var err error
+		if count, err = strconv.Atoi(args[2]); err != nil || count < 0 {
+			return nil, errors.New("ERR value is out of range, must be positive")
+		}
+	}
+	if count == 0 {
+		return [][]byte{}, nil
+	}
+	key := []byte(args[1])
+	pairs, err := ldb.ZRangeGeneric(key, 0, count-1, max)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return [][]byte{}, nil
+	}
+	members := make([][]byte, len(pairs))
+	for i, item := range pairs {
+		members[i] = item.Member
+	}
+	if _, err := ldb.ZRem(key, members...); err != nil {
+		return nil, err
+	}
+	return zscorePairs(pairs, true), nil
+}
+
+// cmdZMSCORE returns the scores of the members, nil for the missing ones.
+// Syntax: ZMSCORE key member [member ...]
+func cmdZMSCORE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	ret := make([]interface{}, len(args)-2)
+	for i, member := range args[2:] {
+		score, err := ldb.ZScore(key, []byte(member))
+		if err == ledis.ErrScoreMiss {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ret[i] = strconv.FormatInt(score, 10)
+	}
+	return ret, nil
+}
+
+// cmdZRANDMEMBER returns random members. A positive count returns distinct
+// members, a negative one may return the same member several times.
+// Syntax: ZRANDMEMBER key [count [WITHSCORES]]
+func cmdZRANDMEMBER(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	count, withScores, single := 1, false, len(args) == 2
+	if !single {
+		var err error
+		if count, err = strconv.Atoi(args[2]); err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		if len(args) == 4 {
+			if strings.ToUpper(args[3]) != "WITHSCORES" {
+				return nil, uhaha.ErrSyntax
+			}
+			withScores = true
+		}
+	}
+	pairs, err := ldb.ZRange([]byte(args[1]), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	rng := readRand()
+	if single {
+		if len(pairs) == 0 {
+			return nil, nil
+		}
+		return pairs[rng.Intn(len(pairs))].Member, nil
+	}
+	if len(pairs) == 0 || count == 0 {
+		return [][]byte{}, nil
+	}
+	var picked []ledis.ScorePair
+	if count > 0 {
+		rng.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+		if count < len(pairs) {
+			pairs = pairs[:count]
+		}
+		picked = pairs
+	} else {
+		for i := 0; i < -count; i++ {
+			picked = append(picked, pairs[rng.Intn(len(pairs))])
+		}
+	}
+	return zscorePairs(picked, withScores), nil
+}
@@ -601,3 +601,148 @@ func TestZsetErrorParams(t *testing.T) {
 	}
 
 }
+
+func TestZSetStore(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.ZAdd(ctx, "zstore_a", redis.Z{Score: 1, Member: "a"}, redis.Z{Score: 2, Member: "b"})
+	c.ZAdd(ctx, "zstore_b", redis.Z{Score: 10, Member: "b"}, redis.Z{Score: 20, Member: "c"})
+
+	if n, err := c.Do(ctx, "zunionstore", "zstore_u", 2, "zstore_a", "zstore_b", "weights", 1, 2).Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatal(n)
+	}
+	if v, err := c.Do(ctx, "zrange", "zstore_u", 0, -1, "withscores").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(v) != "[a 1 b 22 c 40]" {
+		t.Fatal(v)
+	}
+	if n, err := c.Do(ctx, "zinterstore", "zstore_i", 2, "zstore_a", "zstore_b", "aggregate", "max").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if v, err := c.Do(ctx, "zmscore", "zstore_i", "b", "a").Slice(); err != nil {
+		t.Fatal(err)
+	} else if v[0] != "10" || v[1] != nil {
+		t.Fatal(v)
+	}
+
+	// an empty result deletes the destination
+	if n, err := c.Do(ctx, "zinterstore", "zstore_i", 2, "zstore_a", "zstore_none").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if v, err := c.Type(ctx, "zstore_i").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "none" {
+		t.Fatal(v)
+	}
+
+	if n, err := c.Do(ctx, "zrangestore", "zstore_r", "zstore_u", "(1", "+inf", "byscore", "limit", 0, 1).Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if v, err := c.Do(ctx, "zrange", "zstore_r", 0, -1, "withscores").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(v) != "[b 22]" {
+		t.Fatal(v)
+	}
+
+	if v, err := c.Do(ctx, "zpopmax", "zstore_u", 2).StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(v) != "[c 40 b 22]" {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "zpopmin", "zstore_u").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(v) != "[a 1]" {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "zpopmin", "zstore_u").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 0 {
+		t.Fatal(v)
+	}
+}
+
+func TestZSetLexAndRange(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	key := "zlex"
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		c.ZAdd(ctx, key, redis.Z{Score: 0, Member: m})
+	}
+	for _, tc := range []struct {
+		args []interface{}
+		want string
+	}{
+		{[]interface{}{"zrangebylex", key, "-", "+"}, "[a b c d e]"},
+		{[]interface{}{"zrangebylex", key, "[b", "(d"}, "[b c]"},
+		{[]interface{}{"zrangebylex", key, "-", "+", "limit", 1, 2}, "[b c]"},
+		{[]interface{}{"zrevrangebylex", key, "+", "[c"}, "[e d c]"},
+		{[]interface{}{"zrevrangebylex", key, "+", "-", "limit", 1, 2}, "[d c]"},
+		{[]interface{}{"zrange", key, "[b", "[c", "bylex"}, "[b c]"},
+		{[]interface{}{"zrange", key, "+", "-", "bylex", "rev", "limit", 0, 2}, "[e d]"},
+		{[]interface{}{"zrange", key, 0, 1, "rev"}, "[e d]"},
+		{[]interface{}{"zrangebylex", key, "+", "-"}, "[]"},
+	} {
+		if v, err := c.Do(ctx, tc.args...).StringSlice(); err != nil {
+			t.Fatal(tc.args, err)
+		} else if fmt.Sprint(v) != tc.want {
+			t.Fatal(tc.args, v)
+		}
+	}
+	if n, err := c.Do(ctx, "zlexcount", key, "(a", "[d").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatal(n)
+	}
+	if n, err := c.Do(ctx, "zremrangebylex", key, "[d", "+").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if n, err := c.ZCard(ctx, key).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatal(n)
+	}
+
+	c.ZAdd(ctx, "zrange_score", redis.Z{Score: 1, Member: "a"}, redis.Z{Score: 2, Member: "b"}, redis.Z{Score: 3, Member: "c"})
+	if v, err := c.Do(ctx, "zrange", "zrange_score", "+inf", 2, "byscore", "rev", "withscores").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(v) != "[c 3 b 2]" {
+		t.Fatal(v)
+	}
+	if err := c.Do(ctx, "zrange", "zrange_score", 0, -1, "limit", 0, 1).Err(); err == nil {
+		t.Fatal("LIMIT without BYSCORE or BYLEX must fail")
+	}
+	if err := c.Do(ctx, "zrange", key, "-", "+", "bylex", "withscores").Err(); err == nil {
+		t.Fatal("WITHSCORES with BYLEX must fail")
+	}
+
+	if v, err := c.Do(ctx, "zrandmember", "zrange_score", 5, "withscores").StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 6 {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "zrandmember", "zrange_score", -5).StringSlice(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 5 {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "zrandmember", "zrange_score").Text(); err != nil {
+		t.Fatal(err)
+	} else if v != "a" && v != "b" && v != "c" {
+		t.Fatal(v)
+	}
+	if err := c.Do(ctx, "zrandmember", "zrange_none").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1519 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledisdb/ledisdb/store"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddWriteCommand("XADD", cmdXADD)
+	conf.AddWriteCommand("XDEL", cmdXDEL)
+	conf.AddWriteCommand("XTRIM", cmdXTRIM)
+	conf.AddReadCommand("XLEN", cmdXLEN)
+	conf.AddReadCommand("XRANGE", cmdXRANGE)
+	conf.AddReadCommand("XREVRANGE", cmdXREVRANGE)
+	conf.AddReadCommand("XREAD", cmdXREAD)
+	conf.AddWriteCommand("XGROUP", cmdXGROUP)
+	conf.AddWriteCommand("XREADGROUP", cmdXREADGROUP)
+	conf.AddWriteCommand("XACK", cmdXACK)
+	conf.AddReadCommand("XPENDING", cmdXPENDING)
+	conf.AddWriteCommand("XCLAIM", cmdXCLAIM)
+
+	// XREAD/XREADGROUP BLOCK wait on the client connection, the commands
+	// themselves never block.
+	addConnCommand("XREAD", connXREAD)
+	addConnCommand("XREADGROUP", connXREAD)
+}
+
+// Streams are stored on the ledis store next to the ledis data types, using
+// the same db index prefix:
+//
+//	meta:    db|streamMetaType|keylen|key                  -> length, last id, entries added, max deleted id
+//	entry:   db|streamEntryType|keylen|key|id              -> field, value, ...
+//	group:   db|streamGroupType|keylen|key|group           -> last delivered id, entries read, consumers
+//	pending: db|streamPELType|keylen|key|grouplen|group|id -> consumer, delivery time, delivery count
+//
+// ids are encoded big-endian so that entries are iterated in id order.
+const (
+	streamMetaType  byte = 30
+	streamEntryType byte = 31
+	streamGroupType byte = 32
+	streamPELType   byte = 33
+)
+
+var (
+	errStreamID         = errors.New("ERR Invalid stream ID specified as stream command argument")
+	errStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	errStreamIDZero     = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	errStreamUnbalanced = errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	errStreamBusyGroup  = errors.New("BUSYGROUP Consumer Group name already exists")
+	errStreamNoKey      = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	errStreamCount      = errors.New("ERR value is not an integer or out of range")
+)
+
+func errStreamNoGroup(key, group, cmd string) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in %s", key, group, cmd)
+}
+
+type streamID struct {
+	ms, seq uint64
+}
+
+var (
+	streamMinID = streamID{0, 0}
+	streamMaxID = streamID{math.MaxUint64, math.MaxUint64}
+)
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+func (id streamID) isZero() bool {
+	return id == streamMinID
+}
+
+func (id streamID) appendTo(b []byte) []byte {
+	b = binary.BigEndian.AppendUint64(b, id.ms)
+	return binary.BigEndian.AppendUint64(b, id.seq)
+}
+
+// next returns the smallest id greater than id.
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the greatest id smaller than id.
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses "ms-seq" or "ms", a missing seq is set to missingSeq.
+func parseStreamID(s string, missingSeq uint64) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errStreamID
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, errStreamID
+	}
+	return streamID{ms, seq}, nil
+}
+
+// parseStreamRangeID parses a XRANGE/XPENDING bound: -, +, an id or an
+// exclusive (id.
+func parseStreamRangeID(s string, start bool) (id streamID, ok bool, err error) {
+	switch s {
+	case "-":
+		return streamMinID, true, nil
+	case "+":
+		return streamMaxID, true, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	missingSeq := uint64(0)
+	if !start {
+		missingSeq = math.MaxUint64
+	}
+	if id, err = parseStreamID(s, missingSeq); err != nil {
+		return id, false, err
+	}
+	if !exclusive {
+		return id, true, nil
+	}
+	if start {
+		id, ok = id.next()
+	} else {
+		id, ok = id.prev()
+	}
+	return id, ok, nil
+}
+
+func decodeStreamID(b []byte) streamID {
+	return streamID{binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])}
+}
+
+// streamEncoder and streamDecoder encode the stream values as a sequence of
+// uvarints and length prefixed byte strings.
+type streamEncoder struct {
+	b []byte
+}
+
+func (e *streamEncoder) uvarint(v uint64) {
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+func (e *streamEncoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v)
+}
+
+func (e *streamEncoder) id(id streamID) {
+	e.uvarint(id.ms)
+	e.uvarint(id.seq)
+}
+
+func (e *streamEncoder) bytes(v []byte) {
+	e.uvarint(uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+type streamDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *streamDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = uhaha.ErrCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *streamDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = uhaha.ErrCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *streamDecoder) id() streamID {
+	return streamID{d.uvarint(), d.uvarint()}
+}
+
+func (d *streamDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.b)) < n {
+		d.err = uhaha.ErrCorrupt
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func streamDBPrefix() []byte {
+	return binary.AppendUvarint(nil, uint64(ldb.Index()))
+}
+
+func streamKey(typ byte, key []byte, parts ...[]byte) []byte {
+	b := append(streamDBPrefix(), typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(key)))
+	b = append(b, key...)
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func streamEntryKey(key []byte, id streamID) []byte {
+	return streamKey(streamEntryType, key, id.appendTo(nil))
+}
+
+func streamPELPrefix(key []byte, group string) []byte {
+	return streamKey(streamPELType, key,
+		binary.BigEndian.AppendUint16(nil, uint16(len(group))), []byte(group))
+}
+
+func streamPELKey(key []byte, group string, id streamID) []byte {
+	return append(streamPELPrefix(key, group), id.appendTo(nil)...)
+}
+
+// prefixEnd returns the smallest key greater than every key with the prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+type streamMeta struct {
+	length       uint64
+	lastID       streamID
+	entriesAdded uint64
+	maxDeletedID streamID
+}
+
+func (s *streamMeta) encode() []byte {
+	var e streamEncoder
+	e.uvarint(s.length)
+	e.id(s.lastID)
+	e.uvarint(s.entriesAdded)
+	e.id(s.maxDeletedID)
+	return e.b
+}
+
+// getStreamMeta returns nil if the stream does not exist.
+func getStreamMeta(key []byte) (*streamMeta, error) {
+	v, err := ldb.GetSDB().Get(streamKey(streamMetaType, key))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	d := streamDecoder{b: v}
+	s := &streamMeta{
+		length:       d.uvarint(),
+		lastID:       d.id(),
+		entriesAdded: d.uvarint(),
+		maxDeletedID: d.id(),
+	}
+	return s, d.err
+}
+
+type streamEntry struct {
+	id     streamID
+	fields [][]byte
+}
+
+func encodeStreamFields(fields []string) []byte {
+	var e streamEncoder
+	e.uvarint(uint64(len(fields)))
+	for _, f := range fields {
+		e.bytes([]byte(f))
+	}
+	return e.b
+}
+
+func decodeStreamFields(v []byte) ([][]byte, error) {
+	d := streamDecoder{b: v}
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(v)) {
+		return nil, uhaha.ErrCorrupt
+	}
+	fields := make([][]byte, n)
+	for i := range fields {
+		fields[i] = append([]byte(nil), d.bytes()...)
+	}
+	return fields, d.err
+}
+
+func (e streamEntry) resp() interface{} {
+	if e.fields == nil {
+		return []interface{}{e.id.String(), nil}
+	}
+	return []interface{}{e.id.String(), e.fields}
+}
+
+func streamEntriesResp(entries []streamEntry) []interface{} {
+	resp := make([]interface{}, len(entries))
+	for i, e := range entries {
+		resp[i] = e.resp()
+	}
+	return resp
+}
+
+// streamRange returns up to count (count < 0 for all) entries with start <= id
+// <= end, in reverse order if rev is set.
+func streamRange(key []byte, start, end streamID, count int, rev bool) ([]streamEntry, error) {
+	if end.less(start) || count == 0 {
+		return nil, nil
+	}
+	min, max := streamEntryKey(key, start), streamEntryKey(key, end)
+	var it *store.RangeLimitIterator
+	if rev {
+		it = ldb.GetSDB().RevRangeLimitIterator(min, max, store.RangeClose, 0, count)
+	} else {
+		it = ldb.GetSDB().RangeLimitIterator(min, max, store.RangeClose, 0, count)
+	}
+	defer it.Close()
+
+	prefixLen := len(streamKey(streamEntryType, key))
+	var entries []streamEntry
+	for ; it.Valid(); it.Next() {
+		rk := it.RawKey()
+		fields, err := decodeStreamFields(it.RawValue())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, streamEntry{decodeStreamID(rk[prefixLen:]), fields})
+	}
+	return entries, nil
+}
+
+func streamGetEntry(key []byte, id streamID) (*streamEntry, error) {
+	v, err := ldb.GetSDB().Get(streamEntryKey(key, id))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	fields, err := decodeStreamFields(v)
+	if err != nil {
+		return nil, err
+	}
+	return &streamEntry{id, fields}, nil
+}
+
+type streamConsumer struct {
+	name string
+	seen int64 // ms
+}
+
+type streamGroup struct {
+	lastID      streamID
+	entriesRead uint64
+	consumers   []streamConsumer
+}
+
+func (g *streamGroup) encode() []byte {
+	var e streamEncoder
+	e.id(g.lastID)
+	e.uvarint(g.entriesRead)
+	e.uvarint(uint64(len(g.consumers)))
+	for _, c := range g.consumers {
+		e.bytes([]byte(c.name))
+		e.varint(c.seen)
+	}
+	return e.b
+}
+
+// consumer returns the index of the named consumer, creating it if create is
+// set. It returns -1 if the consumer does not exist.
+func (g *streamGroup) consumer(name string, create bool) int {
+	for i, c := range g.consumers {
+		if c.name == name {
+			return i
+		}
+	}
+	if !create {
+		return -1
+	}
+	g.consumers = append(g.consumers, streamConsumer{name: name})
+	return len(g.consumers) - 1
+}
+
+func streamGroupKey(key []byte, group string) []byte {
+	return streamKey(streamGroupType, key, []byte(group))
+}
+
+// getStreamGroup returns nil if the group does not exist.
+func getStreamGroup(key []byte, group string) (*streamGroup, error) {
+	v, err := ldb.GetSDB().Get(streamGroupKey(key, group))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	d := streamDecoder{b: v}
+	g := &streamGroup{lastID: d.id(), entriesRead: d.uvarint()}
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(v)) {
+		return nil, uhaha.ErrCorrupt
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		g.consumers = append(g.consumers, streamConsumer{
+			name: string(d.bytes()),
+			seen: d.varint(),
+		})
+	}
+	return g, d.err
+}
+
+type streamPending struct {
+	id        streamID
+	consumer  string
+	delivered int64 // ms
+	count     uint64
+}
+
+func (p *streamPending) encode() []byte {
+	var e streamEncoder
+	e.bytes([]byte(p.consumer))
+	e.varint(p.delivered)
+	e.uvarint(p.count)
+	return e.b
+}
+
+func decodeStreamPending(id streamID, v []byte) (streamPending, error) {
+	d := streamDecoder{b: v}
+	p := streamPending{
+		id:        id,
+		consumer:  string(d.bytes()),
+		delivered: d.varint(),
+		count:     d.uvarint(),
+	}
+	return p, d.err
+}
+
+func getStreamPending(key []byte, group string, id streamID) (*streamPending, error) {
+	v, err := ldb.GetSDB().Get(streamPELKey(key, group, id))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	p, err := decodeStreamPending(id, v)
+	return &p, err
+}
+
+// streamPendingRange returns the pending entries of the group with start <=
+// id <= end, filtered by filter when set, up to count (count < 0 for all).
+func streamPendingRange(key []byte, group string, start, end streamID, count int,
+	filter func(p *streamPending) bool,
+) ([]streamPending, error) {
+	if end.less(start) || count == 0 {
+		return nil, nil
+	}
+	it := ldb.GetSDB().RangeIterator(streamPELKey(key, group, start),
+		streamPELKey(key, group, end), store.RangeClose)
+	defer it.Close()
+
+	prefixLen := len(streamPELPrefix(key, group))
+	var pending []streamPending
+	for ; it.Valid(); it.Next() {
+		p, err := decodeStreamPending(decodeStreamID(it.RawKey()[prefixLen:]), it.RawValue())
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil && !filter(&p) {
+			continue
+		}
+		pending = append(pending, p)
+		if count > 0 && len(pending) == count {
+			break
+		}
+	}
+	return pending, nil
+}
+
+// deletePrefix adds the deletion of every key with the prefix to wb.
+func deletePrefix(wb *store.WriteBatch, prefix []byte) int64 {
+	it := ldb.GetSDB().RangeIterator(prefix, prefixEnd(prefix), store.RangeROpen)
+	defer it.Close()
+	var n int64
+	for ; it.Valid(); it.Next() {
+		wb.Delete(it.Key())
+		n++
+	}
+	return n
+}
+
+// streamTrim describes the MAXLEN/MINID trimming of XADD and XTRIM.
+type streamTrim struct {
+	maxLen   bool
+	minID    bool
+	len      uint64
+	id       streamID
+	nextArgs int
+}
+
+// parseStreamTrim parses MAXLEN|MINID [=|~] threshold [LIMIT count] at
+// args[0]. The LIMIT count is accepted but ignored since trimming is exact.
+func parseStreamTrim(args []string) (t streamTrim, err error) {
+	switch strings.ToUpper(args[0]) {
+	case "MAXLEN":
+		t.maxLen = true
+	case "MINID":
+		t.minID = true
+	default:
+		return t, uhaha.ErrSyntax
+	}
+	i := 1
+	if i < len(args) && (args[i] == "=" || args[i] == "~") {
+		i++
+	}
+	if i >= len(args) {
+		return t, uhaha.ErrSyntax
+	}
+	if t.maxLen {
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil || n < 0 {
+			return t, errors.New("ERR The MAXLEN argument must be >= 0.")
+		}
+		t.len = uint64(n)
+	} else if t.id, err = parseStreamID(args[i], 0); err != nil {
+		return t, err
+	}
+	i++
+	if i+1 < len(args) && strings.ToUpper(args[i]) == "LIMIT" {
+		if _, err := strconv.ParseUint(args[i+1], 10, 64); err != nil {
+			return t, errStreamCount
+		}
+		i += 2
+	}
+	t.nextArgs = i
+	return t, nil
+}
+
+// apply adds the deletion of the trimmed entries to wb and returns the
+// number of deleted entries. pending are entries added to wb by the current
+// command that are not in the store yet and are trimmed last.
+func (t streamTrim) apply(wb *store.WriteBatch, key []byte, meta *streamMeta,
+	pending []streamID,
+) (int64, []streamID, error) {
+	if !t.maxLen && !t.minID {
+		return 0, pending, nil
+	}
+	it := ldb.GetSDB().RangeIterator(streamEntryKey(key, streamMinID),
+		streamEntryKey(key, streamMaxID), store.RangeClose)
+	defer it.Close()
+
+	prefixLen := len(streamKey(streamEntryType, key))
+	var deleted int64
+	trim := func(id streamID) bool {
+		if t.maxLen {
+			return meta.length > t.len
+		}
+		return id.less(t.id)
+	}
+	for ; it.Valid(); it.Next() {
+		id := decodeStreamID(it.RawKey()[prefixLen:])
+		if !trim(id) {
+			return deleted, pending, nil
+		}
+		wb.Delete(it.Key())
+		meta.length--
+		if meta.maxDeletedID.less(id) {
+			meta.maxDeletedID = id
+		}
+		deleted++
+	}
+	for len(pending) > 0 && trim(pending[0]) {
+		wb.Delete(streamEntryKey(key, pending[0]))
+		meta.length--
+		if meta.maxDeletedID.less(pending[0]) {
+			meta.maxDeletedID = pending[0]
+		}
+		pending = pending[1:]
+		deleted++
+	}
+	return deleted, pending, nil
+}
+
+func cmdXADD(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	var noMkStream bool
+	var trim streamTrim
+	i := 2
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NOMKSTREAM":
+			noMkStream = true
+			continue
+		case "MAXLEN", "MINID":
+			t, err := parseStreamTrim(args[i:])
+			if err != nil {
+				return nil, err
+			}
+			trim = t
+			i += t.nextArgs - 1
+			continue
+		}
+		break
+	}
+	if i >= len(args) || (len(args)-i-1)%2 != 0 || len(args)-i-1 == 0 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+
+	meta, err := getStreamMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		if noMkStream {
+			return nil, nil
+		}
+		meta = &streamMeta{}
+	}
+
+	id, err := streamNextID(m, meta.lastID, args[i])
+	if err != nil {
+		return nil, err
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	wb.Put(streamEntryKey(key, id), encodeStreamFields(args[i+1:]))
+	meta.length++
+	meta.lastID = id
+	meta.entriesAdded++
+	if _, _, err := trim.apply(wb, key, meta, []streamID{id}); err != nil {
+		return nil, err
+	}
+	wb.Put(streamKey(streamMetaType, key), meta.encode())
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return id.String(), nil
+}
+
+// streamNextID returns the id of a new entry from the XADD id argument: *,
+// ms-* or ms-seq. Automatic ids use the machine time, which is the same on
+// every node.
+func streamNextID(m uhaha.Machine, last streamID, arg string) (streamID, error) {
+	var id streamID
+	switch {
+	case arg == "*":
+		ms := uint64(m.Now().UnixNano() / int64(time.Millisecond))
+		if ms > last.ms {
+			id = streamID{ms, 0}
+		} else {
+			next, ok := last.next()
+			if !ok {
+				return id, errStreamIDTooSmall
+			}
+			id = next
+		}
+		return id, nil
+	case strings.HasSuffix(arg, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(arg, "-*"), 10, 64)
+		if err != nil {
+			return id, errStreamID
+		}
+		id = streamID{ms, 0}
+		if ms == last.ms {
+			if last.seq == math.MaxUint64 {
+				return id, errStreamIDTooSmall
+			}
+			id.seq = last.seq + 1
+		} else if ms == 0 {
+			id.seq = 1
+		}
+	default:
+		var err error
+		if id, err = parseStreamID(arg, 0); err != nil {
+			return id, err
+		}
+		if id.isZero() {
+			return id, errStreamIDZero
+		}
+	}
+	if !last.less(id) {
+		return id, errStreamIDTooSmall
+	}
+	return id, nil
+}
+
+func cmdXDEL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	ids := make([]streamID, len(args)-2)
+	for i, arg := range args[2:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	meta, err := getStreamMeta(key)
+	if err != nil || meta == nil {
+		return redcon.SimpleInt(0), err
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	deleted := make(map[streamID]bool)
+	for _, id := range ids {
+		if deleted[id] {
+			continue
+		}
+		if e, err := streamGetEntry(key, id); err != nil {
+			return nil, err
+		} else if e == nil {
+			continue
+		}
+		wb.Delete(streamEntryKey(key, id))
+		deleted[id] = true
+		meta.length--
+		if meta.maxDeletedID.less(id) {
+			meta.maxDeletedID = id
+		}
+	}
+	wb.Put(streamKey(streamMetaType, key), meta.encode())
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(len(deleted)), nil
+}
+
+func cmdXTRIM(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	trim, err := parseStreamTrim(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	if 2+trim.nextArgs != len(args) {
+		return nil, uhaha.ErrSyntax
+	}
+	meta, err := getStreamMeta(key)
+	if err != nil || meta == nil {
+		return redcon.SimpleInt(0), err
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	n, _, err := trim.apply(wb, key, meta, nil)
+	if err != nil {
+		return nil, err
+	}
+	wb.Put(streamKey(streamMetaType, key), meta.encode())
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+func cmdXLEN(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	meta, err := getStreamMeta([]byte(args[1]))
+	if err != nil || meta == nil {
+		return redcon.SimpleInt(0), err
+	}
+	return redcon.SimpleInt(meta.length), nil
+}
+
+func cmdXRANGE(m uhaha.Machine, args []string) (interface{}, error) {
+	return xRange(args, false)
+}
+
+func cmdXREVRANGE(m uhaha.Machine, args []string) (interface{}, error) {
+	return xRange(args, true)
+}
+
+func xRange(args []string, rev bool) (interface{}, error) {
+	if len(args) != 4 && len(args) != 6 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	startArg, endArg := args[2], args[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, okStart, err := parseStreamRangeID(startArg, true)
+	if err != nil {
+		return nil, err
+	}
+	end, okEnd, err := parseStreamRangeID(endArg, false)
+	if err != nil {
+		return nil, err
+	}
+	count := -1
+	if len(args) == 6 {
+		if strings.ToUpper(args[4]) != "COUNT" {
+			return nil, uhaha.ErrSyntax
+		}
+		n, err := strconv.Atoi(args[5])
+		if err != nil {
+			return nil, errStreamCount
+		}
+		if n >= 0 {
+			count = n
+		}
+	}
+	if !okStart || !okEnd {
+		return []interface{}{}, nil
+	}
+	entries, err := streamRange([]byte(args[1]), start, end, count, rev)
+	if err != nil {
+		return nil, err
+	}
+	return streamEntriesResp(entries), nil
+}
+
+// xReadArgs are the parsed arguments of XREAD and XREADGROUP.
+type xReadArgs struct {
+	group, consumer string
+	count           int
+	block           time.Duration
+	blocking        bool
+	noAck           bool
+	keys, ids       []string
+	blockArg        int // index of the BLOCK option in args
+}
+
+func parseXReadArgs(args []string, group bool) (*xReadArgs, error) {
+	r := &xReadArgs{count: -1}
+	i := 1
+	if group {
+		if len(args) < 4 || strings.ToUpper(args[1]) != "GROUP" {
+			return nil, uhaha.ErrSyntax
+		}
+		r.group, r.consumer = args[2], args[3]
+		i = 4
+	}
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, errStreamCount
+			}
+			if n > 0 {
+				r.count = n
+			}
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return nil, errors.New("ERR timeout is negative")
+			}
+			r.block = time.Duration(ms) * time.Millisecond
+			r.blocking = true
+			r.blockArg = i
+			i++
+		case "NOACK":
+			if !group {
+				return nil, uhaha.ErrSyntax
+			}
+			r.noAck = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return nil, errStreamUnbalanced
+			}
+			r.keys, r.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+			return r, nil
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+	return nil, uhaha.ErrSyntax
+}
+
+// xStreamsKeys returns the keys of a XREAD/XREADGROUP command.
+func xStreamsKeys(args []string) []string {
+	r, err := parseXReadArgs(args, strings.ToLower(args[0]) == "xreadgroup")
+	if err != nil {
+		return nil
+	}
+	return r.keys
+}
+
+// cmdXREAD never blocks, BLOCK is handled by connXREAD on the connection.
+func cmdXREAD(m uhaha.Machine, args []string) (interface{}, error) {
+	r, err := parseXReadArgs(args, false)
+	if err != nil {
+		return nil, err
+	}
+	var resp []interface{}
+	for i, key := range r.keys {
+		if r.ids[i] == "$" {
+			// only new entries, which a non-blocking read never sees
+			continue
+		}
+		after, err := parseStreamID(r.ids[i], 0)
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := after.next(); ok {
+			entries, err := streamRange([]byte(key), start, streamMaxID, r.count, false)
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) > 0 {
+				resp = append(resp, []interface{}{key, streamEntriesResp(entries)})
+			}
+		}
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func cmdXREADGROUP(m uhaha.Machine, args []string) (interface{}, error) {
+	r, err := parseXReadArgs(args, true)
+	if err != nil {
+		return nil, err
+	}
+	now := m.Now().UnixNano() / int64(time.Millisecond)
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	var resp []interface{}
+	var news bool
+	for i, key := range r.keys {
+		g, err := getStreamGroup([]byte(key), r.group)
+		if err != nil {
+			return nil, err
+		}
+		if g == nil {
+			return nil, errStreamNoGroup(key, r.group, "XREADGROUP with GROUP option")
+		}
+		ci := g.consumer(r.consumer, true)
+		g.consumers[ci].seen = now
+
+		var entries []streamEntry
+		if r.ids[i] == ">" {
+			news = true
+			start, ok := g.lastID.next()
+			if ok {
+				if entries, err = streamRange([]byte(key), start, streamMaxID, r.count, false); err != nil {
+					return nil, err
+				}
+			}
+			for _, e := range entries {
+				g.lastID = e.id
+				g.entriesRead++
+				if !r.noAck {
+					p := streamPending{id: e.id, consumer: r.consumer, delivered: now, count: 1}
+					wb.Put(streamPELKey([]byte(key), r.group, e.id), p.encode())
+				}
+			}
+			if len(entries) > 0 {
+				resp = append(resp, []interface{}{key, streamEntriesResp(entries)})
+			}
+		} else {
+			// history of the consumer pending entries
+			after, err := parseStreamID(r.ids[i], 0)
+			if err != nil {
+				return nil, err
+			}
+			if start, ok := after.next(); ok {
+				pending, err := streamPendingRange([]byte(key), r.group, start, streamMaxID, r.count,
+					func(p *streamPending) bool { return p.consumer == r.consumer })
+				if err != nil {
+					return nil, err
+				}
+				for _, p := range pending {
+					e, err := streamGetEntry([]byte(key), p.id)
+					if err != nil {
+						return nil, err
+					}
+					if e == nil {
+						e = &streamEntry{id: p.id}
+					}
+					entries = append(entries, *e)
+				}
+			}
+			resp = append(resp, []interface{}{key, streamEntriesResp(entries)})
+		}
+		wb.Put(streamGroupKey([]byte(key), r.group), g.encode())
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	if news && resp == nil {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// connXREAD implements the BLOCK option of XREAD and XREADGROUP: the
+// command is sent without BLOCK until it returns entries or the timeout
+// expires.
+func connXREAD(s uhaha.Service, c *respConn, args []string) (interface{}, error) {
+	group := args[0] == "xreadgroup"
+	r, err := parseXReadArgs(args, group)
+	if err != nil {
+		return nil, err
+	}
+	if !r.blocking {
+		return c.sendRecv(s, args...)
+	}
+	cmd := append(append([]string{}, args[:r.blockArg]...), args[r.blockArg+2:]...)
+	if !group {
+		// $ means the entries added after the call, resolve it once
+		idsAt := len(cmd) - len(r.ids)
+		for i, id := range r.ids {
+			if id != "$" {
+				continue
+			}
+			last, err := c.sendRecv(s, "xrevrange", r.keys[i], "+", "-", "COUNT", "1")
+			if err != nil {
+				return nil, err
+			}
+			cmd[idsAt+i] = "0-0"
+			if last, ok := last.([]interface{}); ok && len(last) > 0 {
+				cmd[idsAt+i] = last[0].([]interface{})[0].(string)
+			}
+		}
+	}
+	return block(r.keys, r.block, func() (interface{}, error) {
+		return c.sendRecv(s, cmd...)
+	})
+}
+
+func cmdXGROUP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	sub := strings.ToUpper(args[1])
+	if len(args) < 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key, group := []byte(args[2]), args[3]
+	meta, err := getStreamMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	if sub == "CREATE" {
+		return xGroupCreate(key, group, meta, args[4:])
+	}
+	if meta == nil {
+		return nil, errStreamNoKey
+	}
+	g, err := getStreamGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return nil, errStreamNoGroup(string(key), group, "XGROUP "+sub)
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	var resp interface{}
+	switch sub {
+	case "DESTROY":
+		if len(args) != 4 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		wb.Delete(streamGroupKey(key, group))
+		deletePrefix(wb, streamPELPrefix(key, group))
+		resp = redcon.SimpleInt(1)
+	case "CREATECONSUMER":
+		if len(args) != 5 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		if g.consumer(args[4], false) >= 0 {
+			return redcon.SimpleInt(0), nil
+		}
+		g.consumer(args[4], true)
+		wb.Put(streamGroupKey(key, group), g.encode())
+		resp = redcon.SimpleInt(1)
+	case "DELCONSUMER":
+		if len(args) != 5 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		ci := g.consumer(args[4], false)
+		if ci < 0 {
+			return redcon.SimpleInt(0), nil
+		}
+		pending, err := streamPendingRange(key, group, streamMinID, streamMaxID, -1,
+			func(p *streamPending) bool { return p.consumer == args[4] })
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pending {
+			wb.Delete(streamPELKey(key, group, p.id))
+		}
+		g.consumers = append(g.consumers[:ci], g.consumers[ci+1:]...)
+		wb.Put(streamGroupKey(key, group), g.encode())
+		resp = redcon.SimpleInt(len(pending))
+	case "SETID":
+		if len(args) != 5 && len(args) != 7 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		id := meta.lastID
+		if args[4] != "$" {
+			if id, err = parseStreamID(args[4], 0); err != nil {
+				return nil, err
+			}
+		}
+		g.lastID = id
+		if len(args) == 7 {
+			if strings.ToUpper(args[5]) != "ENTRIESREAD" {
+				return nil, uhaha.ErrSyntax
+			}
+			n, err := strconv.ParseUint(args[6], 10, 64)
+			if err != nil {
+				return nil, errStreamCount
+			}
+			g.entriesRead = n
+		}
+		wb.Put(streamGroupKey(key, group), g.encode())
+		resp = redcon.SimpleString("OK")
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'", args[1])
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// xGroupCreate handles XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD n].
+func xGroupCreate(key []byte, group string, meta *streamMeta, args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	var mkStream bool
+	g := &streamGroup{}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "MKSTREAM":
+			mkStream = true
+		case "ENTRIESREAD":
+			if i+1 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			n, err := strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil {
+				return nil, errStreamCount
+			}
+			g.entriesRead = n
+			i++
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if meta == nil {
+		if !mkStream {
+			return nil, errStreamNoKey
+		}
+		meta = &streamMeta{}
+		wb.Put(streamKey(streamMetaType, key), meta.encode())
+	}
+	if old, err := getStreamGroup(key, group); err != nil {
+		return nil, err
+	} else if old != nil {
+		return nil, errStreamBusyGroup
+	}
+	if args[0] == "$" {
+		g.lastID = meta.lastID
+	} else {
+		id, err := parseStreamID(args[0], 0)
+		if err != nil {
+			return nil, err
+		}
+		g.lastID = id
+	}
+	wb.Put(streamGroupKey(key, group), g.encode())
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdXACK(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 4 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key, group := []byte(args[1]), args[2]
+	ids := make([]streamID, len(args)-3)
+	for i, arg := range args[3:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	acked := make(map[streamID]bool)
+	for _, id := range ids {
+		if acked[id] {
+			continue
+		}
+		p, err := getStreamPending(key, group, id)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			continue
+		}
+		wb.Delete(streamPELKey(key, group, id))
+		acked[id] = true
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(len(acked)), nil
+}
+
+// cmdXPENDING handles the summary form XPENDING key group and the extended
+// form XPENDING key group [IDLE min-idle-time] start end count [consumer].
+func cmdXPENDING(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key, group := []byte(args[1]), args[2]
+	g, err := getStreamGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return nil, errStreamNoGroup(args[1], group, "XPENDING")
+	}
+	now := m.Now().UnixNano() / int64(time.Millisecond)
+
+	if len(args) == 3 {
+		pending, err := streamPendingRange(key, group, streamMinID, streamMaxID, -1, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) == 0 {
+			return []interface{}{redcon.SimpleInt(0), nil, nil, nil}, nil
+		}
+		var consumers []interface{}
+		counts := make(map[string]int)
+		for _, p := range pending {
+			if counts[p.consumer] == 0 {
+				consumers = append(consumers, p.consumer)
+			}
+			counts[p.consumer]++
+		}
+		for i, name := range consumers {
+			consumers[i] = []interface{}{name, strconv.Itoa(counts[name.(string)])}
+		}
+		return []interface{}{
+			redcon.SimpleInt(len(pending)),
+			pending[0].id.String(),
+			pending[len(pending)-1].id.String(),
+			consumers,
+		}, nil
+	}
+
+	rest := args[3:]
+	var minIdle int64
+	if strings.ToUpper(rest[0]) == "IDLE" {
+		if len(rest) < 2 {
+			return nil, uhaha.ErrSyntax
+		}
+		if minIdle, err = strconv.ParseInt(rest[1], 10, 64); err != nil {
+			return nil, errStreamCount
+		}
+		rest = rest[2:]
+	}
+	if len(rest) != 3 && len(rest) != 4 {
+		return nil, uhaha.ErrSyntax
+	}
+	start, okStart, err := parseStreamRangeID(rest[0], true)
+	if err != nil {
+		return nil, err
+	}
+	end, okEnd, err := parseStreamRangeID(rest[1], false)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(rest[2])
+	if err != nil {
+		return nil, errStreamCount
+	}
+	if count <= 0 || !okStart || !okEnd {
+		return []interface{}{}, nil
+	}
+	pending, err := streamPendingRange(key, group, start, end, count,
+		func(p *streamPending) bool {
+			if len(rest) == 4 && p.consumer != rest[3] {
+				return false
+			}
+			return now-p.delivered >= minIdle
+		})
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]interface{}, len(pending))
+	for i, p := range pending {
+		resp[i] = []interface{}{
+			p.id.String(),
+			p.consumer,
+			redcon.SimpleInt(now - p.delivered),
+			redcon.SimpleInt(p.count),
+		}
+	}
+	return resp, nil
+}
+
+// cmdXCLAIM handles XCLAIM key group consumer min-idle-time id [id ...]
+// [IDLE ms] [TIME unix-time-ms] [RETRYCOUNT count] [FORCE] [JUSTID]
+// [LASTID id].
+func cmdXCLAIM(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 6 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key, group, consumer := []byte(args[1]), args[2], args[3]
+	minIdle, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	now := m.Now().UnixNano() / int64(time.Millisecond)
+
+	var ids []streamID
+	i := 5
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errStreamID
+	}
+	delivered := now
+	var retryCount *uint64
+	var force, justID bool
+	var lastID *streamID
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "FORCE":
+			force = true
+			continue
+		case "JUSTID":
+			justID = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, uhaha.ErrSyntax
+		}
+		switch opt {
+		case "IDLE", "TIME":
+			v, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, errStreamCount
+			}
+			if opt == "IDLE" {
+				delivered = now - v
+			} else {
+				delivered = v
+			}
+		case "RETRYCOUNT":
+			v, err := strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil {
+				return nil, errStreamCount
+			}
+			retryCount = &v
+		case "LASTID":
+			id, err := parseStreamID(args[i+1], 0)
+			if err != nil {
+				return nil, err
+			}
+			lastID = &id
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+		i++
+	}
+
+	g, err := getStreamGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return nil, errStreamNoGroup(args[1], group, "XCLAIM")
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if lastID != nil && g.lastID.less(*lastID) {
+		g.lastID = *lastID
+	}
+	g.consumers[g.consumer(consumer, true)].seen = now
+
+	var resp []interface{}
+	for _, id := range ids {
+		e, err := streamGetEntry(key, id)
+		if err != nil {
+			return nil, err
+		}
+		p, err := getStreamPending(key, group, id)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			if !force || e == nil {
+				continue
+			}
+			p = &streamPending{id: id, delivered: now}
+		} else if e == nil {
+			// the entry was deleted from the stream, drop it from the PEL
+			wb.Delete(streamPELKey(key, group, id))
+			continue
+		}
+		if minIdle > 0 && now-p.delivered < minIdle {
+			continue
+		}
+		p.consumer = consumer
+		p.delivered = delivered
+		if retryCount != nil {
+			p.count = *retryCount
+		} else if !justID {
+			p.count++
+		}
+		wb.Put(streamPELKey(key, group, id), p.encode())
+		if justID {
+			resp = append(resp, id.String())
+		} else {
+			resp = append(resp, e.resp())
+		}
+	}
+	wb.Put(streamGroupKey(key, group), g.encode())
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return []interface{}{}, nil
+	}
+	return resp, nil
+}
+
+// streamFlush deletes every stream of the current db.
+func streamFlush() (int64, error) {
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	var n int64
+	for _, typ := range []byte{streamMetaType, streamEntryType, streamGroupType, streamPELType} {
+		d := deletePrefix(wb, append(streamDBPrefix(), typ))
+		if typ == streamMetaType {
+			n = d
+		}
+	}
+	return n, wb.Commit()
+}
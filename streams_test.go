@@ -0,0 +1,192 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestStreams(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if err := c.XAdd(ctx, &redis.XAddArgs{Stream: "stream1", ID: "1-1", Values: []string{"a", "1"}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.XAdd(ctx, &redis.XAddArgs{Stream: "stream1", ID: "1-1", Values: []string{"a", "2"}}).Err(); err == nil {
+		t.Fatal("expected an error for a smaller id")
+	}
+	if id, err := c.XAdd(ctx, &redis.XAddArgs{Stream: "stream1", ID: "1-*", Values: []string{"b", "2"}}).Result(); err != nil {
+		t.Fatal(err)
+	} else if id != "1-2" {
+		t.Fatal(id)
+	}
+	id3, err := c.XAdd(ctx, &redis.XAddArgs{Stream: "stream1", Values: []string{"c", "3"}}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.XLen(ctx, "stream1").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatal(n)
+	}
+
+	if msgs, err := c.XRange(ctx, "stream1", "-", "+").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 3 || msgs[0].ID != "1-1" || msgs[0].Values["a"] != "1" || msgs[2].ID != id3 {
+		t.Fatal(msgs)
+	}
+	if msgs, err := c.XRangeN(ctx, "stream1", "(1-1", "+", 1).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 1 || msgs[0].ID != "1-2" {
+		t.Fatal(msgs)
+	}
+	if msgs, err := c.XRevRange(ctx, "stream1", "+", "-").Result(); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 3 || msgs[0].ID != id3 {
+		t.Fatal(msgs)
+	}
+
+	if streams, err := c.XRead(ctx, &redis.XReadArgs{Streams: []string{"stream1", "1-1"}, Block: -1}).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(streams) != 1 || len(streams[0].Messages) != 2 {
+		t.Fatal(streams)
+	}
+
+	// woken up by XADD from another client
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.XAdd(ctx, &redis.XAddArgs{Stream: "stream1", Values: []string{"d", "4"}})
+	}()
+	if streams, err := c.XRead(ctx, &redis.XReadArgs{Streams: []string{"stream1", "$"}, Block: 5 * time.Second}).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(streams) != 1 || len(streams[0].Messages) != 1 || streams[0].Messages[0].Values["d"] != "4" {
+		t.Fatal(streams)
+	}
+	if _, err := c.XRead(ctx, &redis.XReadArgs{Streams: []string{"stream1", "$"}, Block: 200 * time.Millisecond}).Result(); err != redis.Nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.XDel(ctx, "stream1", "1-2", "9-9").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.XTrimMaxLen(ctx, "stream1", 2).Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if n, err := c.XLen(ctx, "stream1").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+
+	if err := c.XAdd(ctx, &redis.XAddArgs{Stream: "stream_nomk", NoMkStream: true, Values: []string{"a", "1"}}).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamGroups(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if err := c.XGroupCreate(ctx, "stream2", "g1", "0").Err(); err == nil {
+		t.Fatal("expected an error for a missing stream")
+	}
+	if err := c.XGroupCreateMkStream(ctx, "stream2", "g1", "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.XGroupCreate(ctx, "stream2", "g1", "0").Err(); err == nil {
+		t.Fatal("expected BUSYGROUP")
+	}
+	for _, id := range []string{"1-1", "1-2", "1-3"} {
+		if err := c.XAdd(ctx, &redis.XAddArgs{Stream: "stream2", ID: id, Values: []string{"f", id}}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	streams, err := c.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "g1", Consumer: "alice", Streams: []string{"stream2", ">"}, Count: 2, Block: -1,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(streams) != 1 || len(streams[0].Messages) != 2 || streams[0].Messages[1].ID != "1-2" {
+		t.Fatal(streams)
+	}
+	streams, err = c.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "g1", Consumer: "bob", Streams: []string{"stream2", ">"}, Block: -1,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(streams) != 1 || len(streams[0].Messages) != 1 || streams[0].Messages[0].ID != "1-3" {
+		t.Fatal(streams)
+	}
+	if _, err := c.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "g1", Consumer: "bob", Streams: []string{"stream2", ">"}, Block: 200 * time.Millisecond,
+	}).Result(); err != redis.Nil {
+		t.Fatal(err)
+	}
+
+	// history of the pending entries of a consumer
+	streams, err = c.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "g1", Consumer: "alice", Streams: []string{"stream2", "0"}, Block: -1,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(streams) != 1 || len(streams[0].Messages) != 2 {
+		t.Fatal(streams)
+	}
+
+	if p, err := c.XPending(ctx, "stream2", "g1").Result(); err != nil {
+		t.Fatal(err)
+	} else if p.Count != 3 || p.Lower != "1-1" || p.Higher != "1-3" || p.Consumers["alice"] != 2 || p.Consumers["bob"] != 1 {
+		t.Fatal(p)
+	}
+
+	if n, err := c.XAck(ctx, "stream2", "g1", "1-1", "1-1", "9-9").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+
+	if ids, err := c.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream: "stream2", Group: "g1", Consumer: "bob", Messages: []string{"1-2"},
+	}).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 1 || ids[0] != "1-2" {
+		t.Fatal(ids)
+	}
+	if ext, err := c.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: "stream2", Group: "g1", Start: "-", End: "+", Count: 10, Consumer: "bob",
+	}).Result(); err != nil {
+		t.Fatal(err)
+	} else if len(ext) != 2 || ext[0].ID != "1-2" || ext[1].ID != "1-3" {
+		t.Fatal(ext)
+	}
+
+	if n, err := c.XGroupDelConsumer(ctx, "stream2", "g1", "bob").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal(n)
+	}
+	if n, err := c.XGroupDestroy(ctx, "stream2", "g1").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal(n)
+	}
+	if err := c.XAck(ctx, "stream2", "nogroup", "1-1").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "g1", Consumer: "alice", Streams: []string{"stream2", ">"}, Block: -1,
+	}).Err(); err == nil {
+		t.Fatal("expected NOGROUP")
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/ledisdb/ledisdb/ledis"
 
@@ -23,6 +23,7 @@ func init() {
 	conf.AddReadCommand("GET", cmdGET)
 	conf.AddReadCommand("GETBIT", cmdGETBIT)
 	conf.AddReadCommand("GETRANGE", cmdGETRANGE)
+	conf.AddReadCommand("LCS", cmdLCS)
 	conf.AddReadCommand("MGET", cmdMGET)
 	conf.AddReadCommand("STRLEN", cmdSTRLEN)
 	conf.AddReadCommand("TTL", cmdTTL)
@@ -35,62 +36,60 @@ func init() {
 	conf.AddWriteCommand("DEL", cmdDEL)
 	conf.AddWriteCommand("INCR", cmdINCR)
 	conf.AddWriteCommand("INCRBY", cmdINCRBY)
+	conf.AddWriteCommand("INCRBYFLOAT", cmdINCRBYFLOAT)
 	conf.AddWriteCommand("MSET", cmdMSET)
+	conf.AddWriteCommand("MSETNX", cmdMSETNX)
 	conf.AddWriteCommand("SET", cmdSET)
 	conf.AddWriteCommand("SETBIT", cmdSETBIT)
 	conf.AddWriteCommand("GETSET", cmdGETSET)
+	conf.AddWriteCommand("GETDEL", cmdGETDEL)
+	conf.AddWriteCommand("GETEX", cmdGETEX)
 	conf.AddWriteCommand("SETNX", cmdSETNX)
 	conf.AddWriteCommand("SETEX", cmdSETEX)
 	conf.AddWriteCommand("SETEXAT", cmdSETEXAT)
+	conf.AddWriteCommand("PSETEX", cmdPSETEX)
 	conf.AddWriteCommand("SETRANGE", cmdSETRANGE)
 	conf.AddWriteCommand("EXPIRE", cmdEXPIRE)
 	conf.AddWriteCommand("EXPIREAT", cmdEXPIREAT)
 	// conf.AddWriteCommand("PERSIST", cmdPERSIST) // Prohibition: time persistence
 }
 
-// handleExpiration handles common expiration logic for EXPIRE/EXPIREAT/SETEX/SETEXAT
-func handleExpiration(key []byte, timestamp int64) (interface{}, error) {
-	// If the timestamp is in the past, delete the key
-	if timestamp < time.Now().Unix() {
-		if _, err := ldb.Del(key); err != nil {
-			return nil, err
-		}
-		return redcon.SimpleInt(1), nil
+// setStringPExpireAt sets key to hold value until ms, a unix time in
+// milliseconds. A time that is not after m.Now() deletes the key instead.
+func setStringPExpireAt(m uhaha.Machine, key, value []byte, ms int64) error {
+	if ms <= unixMilli(m.Now()) {
+		_, err := ldb.Del(key)
+		return err
 	}
-	
-	v, err := ldb.ExpireAt(key, timestamp)
-	if err != nil {
-		return nil, err
+	if err := ldb.Set(key, value); err != nil {
+		return err
+	}
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if err := setKeyPExpireAt(wb, &keyTypes[0], key, ms); err != nil {
+		return err
 	}
-	return redcon.SimpleInt(v), nil
+	return wb.Commit()
 }
 
-// cmdEXPIREAT sets an expiration timestamp for a key.
+// cmdEXPIREAT sets the expire time of key as a unix time in seconds.
+// Syntax: EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
 func cmdEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
-	if len(args) != 3 {
-		return nil, uhaha.ErrWrongNumArgs
-	}
-
-	timestamp, err := ledis.StrInt64([]byte(args[2]), nil)
+	key, ms, opts, err := parseExpireArgs(args, 1000, 0)
 	if err != nil {
-		return nil, fmt.Errorf("ERR invalid timestamp: %v", err)
+		return nil, err
 	}
-
-	return handleExpiration([]byte(args[1]), timestamp)
+	return expireKey(m, key, ms, opts)
 }
 
-// cmdEXPIRE sets an expiration time for a key.
+// cmdEXPIRE sets a time to live in seconds on key.
+// Syntax: EXPIRE key seconds [NX | XX | GT | LT]
 func cmdEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
-	if len(args) != 3 {
-		return nil, uhaha.ErrWrongNumArgs
-	}
-
-	duration, err := ledis.StrInt64([]byte(args[2]), nil)
+	key, ms, opts, err := parseExpireArgs(args, 1000, unixMilli(m.Now()))
 	if err != nil {
-		return nil, fmt.Errorf("ERR invalid duration: %v", err)
+		return nil, err
 	}
-
-	return handleExpiration([]byte(args[1]), m.Now().Unix() + duration)
+	return expireKey(m, key, ms, opts)
 }
 
 // cmdSTRLEN returns the length of the string value stored at key.
@@ -658,73 +657,178 @@ func cmdBITCOUNT(m uhaha.Machine, args []string) (interface{}, error) {
 	return redcon.SimpleInt(n), nil
 }
 
-// This is different from the RESP standard. It needs to enrich the algorithm to support more atomic instructions.
-func cmdSET(m uhaha.Machine, args []string) (interface{}, error) {
-	if len(args) != 3 {
-		return nil, uhaha.ErrWrongNumArgs
-	}
+// setOptions holds the parsed options of a SET command.
+type setOptions struct {
+	nx, xx  bool
+	get     bool
+	keepTTL bool
+	// expireAt is the absolute expiration in unix milliseconds, 0 means no
+	// expiration.
+	expireAt int64
+}
 
-	if err := ldb.Set([]byte(args[1]), []byte(args[2])); err != nil {
-		return nil, err
+// parseSetOptions parses SET options:
+// [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+// Relative expirations are converted to absolute times with m.Now(), so the
+// Raft log replays to the same result on every node.
+func parseSetOptions(m uhaha.Machine, args []string) (opts setOptions, err error) {
+	var hasExpire bool
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GET":
+			opts.get = true
+		case "KEEPTTL":
+			opts.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || i+1 >= len(args) {
+				return opts, uhaha.ErrSyntax
+			}
+			hasExpire = true
+			i++
+			v, err := ledis.StrInt64([]byte(args[i]), nil)
+			if err != nil {
+				return opts, fmt.Errorf("ERR value is not an integer or out of range")
+			}
+			unit, base := expireUnit(m, opt)
+			var ok bool
+			if opts.expireAt, ok = expireAtMs(v, unit, base); !ok || v <= 0 {
+				return opts, errExpireTime("set")
+			}
+		default:
+			return opts, uhaha.ErrSyntax
+		}
+	}
+	if (opts.nx && opts.xx) || (opts.keepTTL && hasExpire) {
+		return opts, uhaha.ErrSyntax
 	}
+	return opts, nil
+}
 
-	return redcon.SimpleString("OK"), nil
+// expireUnit returns the unit in milliseconds and the base of the time of
+// the SET option opt, EX, PX, EXAT or PXAT, for expireAtMs.
+func expireUnit(m uhaha.Machine, opt string) (unit, base int64) {
+	switch opt {
+	case "EX":
+		return 1000, unixMilli(m.Now())
+	case "PX":
+		return 1, unixMilli(m.Now())
+	case "EXAT":
+		return 1000, 0
+	}
+	return 1, 0
 }
 
-// Setex is rewritten as setexat to avoid the exception of raft log playback
-func cmdSETEX(m uhaha.Machine, args []string) (interface{}, error) {
-	if len(args) != 4 {
+// cmdSET sets key to hold the string value.
+// Syntax: SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+// Returns OK, nil when the NX/XX condition is not met, or the old value when
+// GET is given.
+func cmdSET(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
 
-	duration, err := ledis.StrInt64([]byte(args[2]), nil)
+	key, value := []byte(args[1]), []byte(args[2])
+	opts, err := parseSetOptions(m, args[3:])
 	if err != nil {
 		return nil, err
 	}
-	timestamp := m.Now().Unix() + duration
 
-	//If the timestamp is less than the current time, delete operation
-	if timestamp < time.Now().Unix() {
-		keys := make([][]byte, 1)
-		keys[0] = []byte(args[1])
-		_, err := ldb.Del(keys...)
-		if err != nil {
-			return nil, err
+	old, err := ldb.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	// NX and XX test the key with any type, like MSETNX
+	types, err := keyTypesOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if opts.get && old == nil && len(types) > 0 {
+		// GET fails, and nothing is set, when the key holds another type
+		return nil, errWrongType
+	}
+
+	// reply is the response once the key was (or was not) written
+	reply := func(written bool) interface{} {
+		if opts.get {
+			if old == nil {
+				return nil
+			}
+			return old
+		}
+		if !written {
+			return nil
 		}
-		return redcon.SimpleString("OK"), nil
+		return redcon.SimpleString("OK")
 	}
 
-	if err := ldb.SetEXAT([]byte(args[1]), timestamp, []byte(args[3])); err != nil {
-		return nil, err
+	if (opts.nx && len(types) > 0) || (opts.xx && len(types) == 0) {
+		return reply(false), nil
 	}
 
-	return redcon.SimpleString("OK"), nil
+	switch {
+	case opts.expireAt > 0:
+		// An expiration already in the past sets the key and expires it
+		// immediately, which is the same as deleting it.
+		if err := setStringPExpireAt(m, key, value, opts.expireAt); err != nil {
+			return nil, err
+		}
+	case opts.keepTTL:
+		// GetSet overwrites the value without touching the TTL.
+		if _, err := ldb.GetSet(key, value); err != nil {
+			return nil, err
+		}
+	default:
+		if err := ldb.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return reply(true), nil
 }
 
+// cmdSETEX sets key to hold value with a time to live in seconds. The expire
+// time is computed from m.Now() so that the Raft log replays to the same
+// result on every node.
+// Syntax: SETEX key seconds value
+func cmdSETEX(m uhaha.Machine, args []string) (interface{}, error) {
+	return setEx(m, args, "EX")
+}
+
+// cmdPSETEX sets key to hold value with a time to live in milliseconds.
+// Syntax: PSETEX key milliseconds value
+func cmdPSETEX(m uhaha.Machine, args []string) (interface{}, error) {
+	return setEx(m, args, "PX")
+}
+
+// cmdSETEXAT sets key to hold value until a unix time in seconds.
+// Syntax: SETEXAT key unix-time-seconds value
 func cmdSETEXAT(m uhaha.Machine, args []string) (interface{}, error) {
-	if len(args) < 4 {
+	return setEx(m, args, "EXAT")
+}
+
+// setEx runs the SETEX commands, opt is the SET option of their time
+// argument.
+func setEx(m uhaha.Machine, args []string, opt string) (interface{}, error) {
+	if len(args) != 4 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-	timestamp, err := ledis.StrInt64([]byte(args[2]), nil)
+	v, err := ledis.StrInt64([]byte(args[2]), nil)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("ERR value is not an integer or out of range")
 	}
-
-	//If the timestamp is less than the current time, delete operation
-	if timestamp < time.Now().Unix() {
-		keys := make([][]byte, 1)
-		keys[0] = []byte(args[1])
-		_, err := ldb.Del(keys...)
-		if err != nil {
-			return nil, err
-		}
-		return redcon.SimpleString("OK"), nil
+	unit, base := expireUnit(m, opt)
+	ms, ok := expireAtMs(v, unit, base)
+	if !ok || v <= 0 {
+		return nil, errExpireTime(args[0])
 	}
-
-	if err := ldb.SetEXAT([]byte(args[1]), timestamp, []byte(args[3])); err != nil {
+	if err := setStringPExpireAt(m, []byte(args[1]), []byte(args[3]), ms); err != nil {
 		return nil, err
 	}
-
 	return redcon.SimpleString("OK"), nil
 }
 
@@ -841,37 +945,20 @@ func cmdMGET(m uhaha.Machine, args []string) (interface{}, error) {
 	return result, nil
 }
 
+// cmdTTL returns the remaining time to live of key in seconds.
+// Syntax: TTL key
 func cmdTTL(m uhaha.Machine, args []string) (interface{}, error) {
-	// Validate the number of arguments
 	if len(args) != 2 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
-
-	key := []byte(args[1])
-
-	// Check if the key exists
-	exists, err := ldb.Exists(key)
-	if err != nil {
-		return nil, err
-	}
-
-	// If the key does not exist, return -2
-	if exists == 0 {
-		return redcon.SimpleInt(-2), nil
-	}
-
-	// Get the TTL value for the key
-	ttl, err := ldb.TTL(key)
+	ttl, err := keyPTTL([]byte(args[1]), m.Now())
 	if err != nil {
 		return nil, err
 	}
-
-	// If TTL is -1, the key exists but has no associated expiration
-	if ttl == -1 {
-		return redcon.SimpleInt(-1), nil
+	if ttl > 0 {
+		// rounded like redis
+		ttl = (ttl + 500) / 1000
 	}
-
-	// Return the remaining TTL in seconds
 	return redcon.SimpleInt(ttl), nil
 }
 
@@ -912,3 +999,262 @@ func parseBitRange(args []string) (start int, end int, bitMode string, err error
 
 	return start, end, bitMode, nil
 }
+
+// cmdINCRBYFLOAT increments the float stored at key by increment, keeping its
+// time to live.
+// Syntax: INCRBYFLOAT key increment
+func cmdINCRBYFLOAT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	incr, err := parseFloat(args[2])
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(args[1])
+	v, err := ldb.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var n float64
+	if v != nil {
+		if n, err = parseFloat(string(v)); err != nil {
+			return nil, err
+		}
+	}
+	n += incr
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return nil, errors.New("ERR increment would produce NaN or Infinity")
+	}
+	value := formatFloat(n)
+	// GetSet overwrites the value without touching the TTL.
+	if _, err := ldb.GetSet(key, []byte(value)); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// cmdGETDEL returns the value of key and deletes it.
+// Syntax: GETDEL key
+func cmdGETDEL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	v, err := ldb.Get(key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if _, err := ldb.Del(key); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// cmdGETEX returns the value of key and optionally sets or removes its
+// expire time. Relative times are converted with m.Now(), so the Raft log
+// replays to the same result on every node.
+// Syntax: GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST]
+func cmdGETEX(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	var ms int64
+	var persist bool
+	switch {
+	case len(args) == 2:
+	case len(args) == 3 && strings.EqualFold(args[2], "PERSIST"):
+		persist = true
+	case len(args) == 4:
+		v, err := ledis.StrInt64([]byte(args[3]), nil)
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		opt := strings.ToUpper(args[2])
+		switch opt {
+		case "EX", "PX", "EXAT", "PXAT":
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+		unit, base := expireUnit(m, opt)
+		var ok bool
+		if ms, ok = expireAtMs(v, unit, base); !ok || v <= 0 {
+			return nil, errExpireTime("getex")
+		}
+	default:
+		return nil, uhaha.ErrSyntax
+	}
+
+	key := []byte(args[1])
+	v, err := ldb.Get(key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	switch {
+	case ms > 0:
+		if err := setStringPExpireAt(m, key, v, ms); err != nil {
+			return nil, err
+		}
+	case persist:
+		wb := ldb.GetSDB().NewWriteBatch()
+		defer wb.Close()
+		if _, err := removeKeyExpire(wb, &keyTypes[0], key); err != nil {
+			return nil, err
+		}
+		if err := wb.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// cmdMSETNX sets the given keys to their values, only if none of them exists,
+// whatever its type. The keys are written in a single batch.
+// Syntax: MSETNX key value [key value ...]
+func cmdMSETNX(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 || (len(args)-1)%2 != 0 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	kvPairs := make([]ledis.KVPair, 0, (len(args)-1)/2)
+	for i := 1; i < len(args); i += 2 {
+		key := []byte(args[i])
+		if types, err := keyTypesOf(key); err != nil {
+			return nil, err
+		} else if len(types) > 0 {
+			return redcon.SimpleInt(0), nil
+		}
+		kvPairs = append(kvPairs, ledis.KVPair{Key: key, Value: []byte(args[i+1])})
+	}
+	if err := ldb.MSet(kvPairs...); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(1), nil
+}
+
+// lcsMaxCells bounds the table of LCS, like the Redis proto-max-bulk-len
+// check on its transient memory.
+const lcsMaxCells = 1 << 29
+
+// cmdLCS returns the longest common subsequence of the strings stored at
+// key1 and key2, its length with LEN, or the matching ranges with IDX.
+// Syntax: LCS key1 key2 [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+func cmdLCS(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	var getLen, getIdx, withMatchLen bool
+	var minMatchLen int64
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(args) {
+				return nil, uhaha.ErrSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if n > 0 {
+				minMatchLen = n
+			}
+			i++
+		default:
+			return nil, uhaha.ErrSyntax
+		}
+	}
+	if getLen && getIdx {
+		return nil, errors.New("ERR If you want both the length and indexes, please just use IDX.")
+	}
+	a, err := ldb.Get([]byte(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ldb.Get([]byte(args[2]))
+	if err != nil {
+		return nil, err
+	}
+	if (len(a)+1)*(len(b)+1) > lcsMaxCells {
+		return nil, errors.New("ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+
+	// dp[i*(len(b)+1)+j] is the LCS length of a[:i] and b[:j]
+	w := len(b) + 1
+	dp := make([]uint32, (len(a)+1)*w)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			switch {
+			case a[i-1] == b[j-1]:
+				dp[i*w+j] = dp[(i-1)*w+j-1] + 1
+			case dp[(i-1)*w+j] > dp[i*w+j-1]:
+				dp[i*w+j] = dp[(i-1)*w+j]
+			default:
+				dp[i*w+j] = dp[i*w+j-1]
+			}
+		}
+	}
+	n := int(dp[len(a)*w+len(b)])
+	if getLen {
+		return redcon.SimpleInt(n), nil
+	}
+
+	// walk the table back from the end, collecting the subsequence and the
+	// ranges of contiguous matches, from the last one like Redis
+	result := make([]byte, n)
+	matches := []interface{}{}
+	idx := n
+	aStart, aEnd, bStart, bEnd := -1, -1, -1, -1
+	for i, j := len(a), len(b); i > 0 && j > 0; {
+		emit := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aStart == -1 {
+				aStart, aEnd, bStart, bEnd = i-1, i-1, j-1, j-1
+			} else if aStart == i && bStart == j {
+				aStart--
+				bStart--
+			} else {
+				emit = true
+			}
+			if aStart == 0 || bStart == 0 {
+				emit = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if dp[(i-1)*w+j] > dp[i*w+j-1] {
+				i--
+			} else {
+				j--
+			}
+			if aStart != -1 {
+				emit = true
+			}
+		}
+		if emit {
+			matchLen := aEnd - aStart + 1
+			if int64(matchLen) >= minMatchLen {
+				match := []interface{}{
+					[]interface{}{redcon.SimpleInt(aStart), redcon.SimpleInt(aEnd)},
+					[]interface{}{redcon.SimpleInt(bStart), redcon.SimpleInt(bEnd)},
+				}
+				if withMatchLen {
+					match = append(match, redcon.SimpleInt(matchLen))
+				}
+				matches = append(matches, match)
+			}
+			aStart = -1
+		}
+	}
+	if getIdx {
+		return []interface{}{"matches", matches, "len", redcon.SimpleInt(n)}, nil
+	}
+	return result, nil
+}
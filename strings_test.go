@@ -5,6 +5,9 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"strings"
 	"testing"
 	"time"
 
@@ -386,6 +389,110 @@ func TestKVIncrDecr(t *testing.T) {
 	}
 }
 
+func TestKVSetOptions(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if ok, err := c.Do(ctx, "set", "set_opt", "1", "NX", "EX", 30).Result(); err != nil {
+		t.Fatal(err)
+	} else if ok != "OK" {
+		t.Fatal(ok)
+	}
+
+	if ttl, err := c.TTL(ctx, "set_opt").Result(); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 || ttl > 30*time.Second {
+		t.Fatal(ttl)
+	}
+
+	// NX fails when the key exists
+	if _, err := c.Do(ctx, "set", "set_opt", "2", "NX").Result(); err != redis.Nil {
+		t.Fatalf("set nx: %v", err)
+	}
+
+	// NX sees a key of another type
+	c.HSet(ctx, "set_opt_hash", "f", "v")
+	if _, err := c.Do(ctx, "set", "set_opt_hash", "1", "NX").Result(); err != redis.Nil {
+		t.Fatalf("set nx: %v", err)
+	}
+	if v, err := c.Type(ctx, "set_opt_hash").Result(); err != nil || v != "hash" {
+		t.Fatal(v, err)
+	}
+
+	// KEEPTTL keeps the previous expiration
+	if ok, err := c.Do(ctx, "set", "set_opt", "3", "XX", "KEEPTTL").Result(); err != nil {
+		t.Fatal(err)
+	} else if ok != "OK" {
+		t.Fatal(ok)
+	}
+	if ttl, err := c.TTL(ctx, "set_opt").Result(); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 {
+		t.Fatal(ttl)
+	}
+
+	// a plain SET clears the expiration
+	if v, err := c.Do(ctx, "set", "set_opt", "4", "GET").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "3" {
+		t.Fatal(v)
+	}
+	if ttl, err := c.TTL(ctx, "set_opt").Result(); err != nil {
+		t.Fatal(err)
+	} else if ttl != -1 {
+		t.Fatal(ttl)
+	}
+
+	// XX fails when the key does not exist
+	if _, err := c.Do(ctx, "set", "set_opt_missing", "1", "XX").Result(); err != redis.Nil {
+		t.Fatalf("set xx: %v", err)
+	}
+
+	// GET on a missing key returns nil but still sets the value
+	if _, err := c.Do(ctx, "set", "set_opt_get", "1", "GET", "PX", 1500).Result(); err != redis.Nil {
+		t.Fatalf("set get: %v", err)
+	}
+	if v, err := c.Get(ctx, "set_opt_get").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "1" {
+		t.Fatal(v)
+	}
+
+	// an absolute time in the past deletes the key
+	if _, err := c.Do(ctx, "set", "set_opt_get", "1", "EXAT", 1).Result(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Exists(ctx, "set_opt_get").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	// GET fails on a key of another type, which is kept
+	c.RPush(ctx, "set_opt_list", "a")
+	if err := c.Do(ctx, "set", "set_opt_list", "v", "GET").Err(); err == nil ||
+		!strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "set_opt_list").Result(); err != redis.Nil {
+		t.Fatal(v, err)
+	}
+	c.Del(ctx, "set_opt_list")
+
+	for _, args := range [][]interface{}{
+		{"set", "a", "b", "NX", "XX"},
+		{"set", "a", "b", "EX", 10, "PX", 100},
+		{"set", "a", "b", "EX", 10, "KEEPTTL"},
+		{"set", "a", "b", "EX"},
+		{"set", "a", "b", "EX", 0},
+		{"set", "a", "b", "EX", "ten"},
+	} {
+		if _, err := c.Do(ctx, args...).Result(); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
 func TestKVErrorParams(t *testing.T) {
 	c := getTestConn()
 	ctx := context.Background()
@@ -462,3 +569,212 @@ func TestKVErrorParams(t *testing.T) {
 		t.Errorf("invalid err %v", err)
 	}
 }
+
+func TestKVIncrByFloat(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "float", "10.50", time.Hour)
+	if v, err := c.IncrByFloat(ctx, "float", 0.1).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != 10.6 {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "incrbyfloat", "float", "-5").Text(); err != nil {
+		t.Fatal(err)
+	} else if v != "5.6" {
+		t.Fatal(v)
+	}
+	if v, err := c.Do(ctx, "incrbyfloat", "float", "5.0e3").Text(); err != nil {
+		t.Fatal(err)
+	} else if v != "5005.6" {
+		t.Fatal(v)
+	}
+	// the time to live is kept
+	if d, err := c.TTL(ctx, "float").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 0 {
+		t.Fatal(d)
+	}
+	c.Set(ctx, "float_text", "abc", 0)
+	if err := c.IncrByFloat(ctx, "float_text", 1).Err(); err == nil {
+		t.Fatal("expected a float error")
+	}
+	if err := c.Do(ctx, "incrbyfloat", "float", "inf").Err(); err == nil {
+		t.Fatal("expected a float error")
+	}
+}
+
+func TestKVGetDelGetEx(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "getdel", "v", 0)
+	if v, err := c.GetDel(ctx, "getdel").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+	if err := c.GetDel(ctx, "getdel").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+
+	c.Set(ctx, "getex", "v", 0)
+	if v, err := c.GetEx(ctx, "getex", 100*time.Second).Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+	if d, err := c.PTTL(ctx, "getex").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 99*time.Second || d > 100*time.Second {
+		t.Fatal(d)
+	}
+	at := time.Now().Add(time.Hour).UnixMilli()
+	if err := c.Do(ctx, "getex", "getex", "pxat", at).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do(ctx, "pexpiretime", "getex").Int64(); err != nil {
+		t.Fatal(err)
+	} else if v != at {
+		t.Fatal(v, at)
+	}
+	if err := c.Do(ctx, "getex", "getex", "persist").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.TTL(ctx, "getex").Result(); err != nil {
+		t.Fatal(err)
+	} else if d != -1 {
+		t.Fatal(d)
+	}
+	if err := c.Do(ctx, "getex", "getex", "ex", 0).Err(); err == nil {
+		t.Fatal("expected an invalid expire time")
+	}
+	if err := c.Do(ctx, "getex", "getex", "ex", 10, "persist").Err(); err == nil {
+		t.Fatal("expected a syntax error")
+	}
+	// a time that overflows is rejected and keeps the key
+	for _, opt := range []string{"ex", "px", "exat"} {
+		if err := c.Do(ctx, "getex", "getex", opt, int64(math.MaxInt64)).Err(); err == nil ||
+			err.Error() != "ERR invalid expire time in 'getex' command" {
+			t.Fatal(opt, err)
+		}
+	}
+	if d, err := c.TTL(ctx, "getex").Result(); err != nil || d != -1 {
+		t.Fatal(d, err)
+	}
+	// a time in the past deletes the key
+	if err := c.Do(ctx, "getex", "getex", "exat", 1).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, "getex").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if err := c.Do(ctx, "getex", "getex_none", "ex", 10).Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVMSetNX(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if ok, err := c.MSetNX(ctx, "msetnx1", "a", "msetnx2", "b").Result(); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("MSETNX failed")
+	}
+	// any existing key, whatever its type, fails the whole command
+	c.RPush(ctx, "msetnx_list", "a")
+	if ok, err := c.MSetNX(ctx, "msetnx3", "c", "msetnx_list", "d").Result(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("MSETNX overwrote a key")
+	}
+	if n, err := c.Exists(ctx, "msetnx3").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if v, err := c.MGet(ctx, "msetnx1", "msetnx2").Result(); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(v) != "[a b]" {
+		t.Fatal(v)
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	check := func(want string, args ...interface{}) {
+		t.Helper()
+		v, err := c.Do(ctx, args...).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(v); got != want {
+			t.Fatalf("%v: %s, want %s", args, got, want)
+		}
+	}
+	check("[1 0]", "bitfield", "bitfield", "incrby", "i5", 100, 1, "get", "u4", 0)
+	for _, want := range []string{"[1 1]", "[2 2]", "[3 3]", "[0 3]"} {
+		check(want, "bitfield", "bitfield_sat", "incrby", "u2", 100, 1, "overflow", "sat", "incrby", "u2", 102, 1)
+	}
+	for _, want := range []string{"[1]", "[2]", "[3]", "[<nil>]"} {
+		check(want, "bitfield", "bitfield_fail", "overflow", "fail", "incrby", "u2", 102, 1)
+	}
+
+	// SET returns the old value, signed fields wrap by default
+	check("[0 -128 128]", "bitfield", "bitfield_set", "set", "i8", "#1", 128, "get", "i8", 8, "get", "u8", 8)
+	check("[-128 127]", "bitfield", "bitfield_set", "set", "i8", 8, -32767, "overflow", "sat", "incrby", "i8", 8, 1000)
+	check("[127]", "bitfield_ro", "bitfield_set", "get", "i8", 8)
+	check("[0]", "bitfield", "bitfield_set", "set", "i64", 64, -1)
+	check("[-1 -9223372036854775808]", "bitfield", "bitfield_set", "get", "i64", 64, "overflow", "sat", "incrby", "i64", 64, "-9223372036854775808")
+	if v, err := c.Get(ctx, "bitfield_set").Bytes(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 16 || v[1] != 127 {
+		t.Fatal(v)
+	}
+
+	for _, args := range [][]interface{}{
+		{"bitfield", "bitfield", "get", "u64", 0},
+		{"bitfield", "bitfield", "get", "i65", 0},
+		{"bitfield", "bitfield", "get", "u8", -1},
+		{"bitfield", "bitfield", "overflow", "none", "get", "u8", 0},
+		{"bitfield", "bitfield", "set", "u8", 0},
+		{"bitfield_ro", "bitfield", "set", "u8", 0, 1},
+	} {
+		if err := c.Do(ctx, args...).Err(); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestLCS(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.MSet(ctx, "lcs1", "ohmytext", "lcs2", "mynewtext")
+	for _, tc := range []struct {
+		args []interface{}
+		want string
+	}{
+		{[]interface{}{"lcs", "lcs1", "lcs2"}, "mytext"},
+		{[]interface{}{"lcs", "lcs1", "lcs2", "len"}, "6"},
+		{[]interface{}{"lcs", "lcs1", "lcs2", "idx"}, "[matches [[[4 7] [5 8]] [[2 3] [0 1]]] len 6]"},
+		{[]interface{}{"lcs", "lcs1", "lcs2", "idx", "minmatchlen", 4, "withmatchlen"}, "[matches [[[4 7] [5 8] 4]] len 6]"},
+		{[]interface{}{"lcs", "lcs1", "lcs_none"}, ""},
+	} {
+		v, err := c.Do(ctx, tc.args...).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(v); got != tc.want {
+			t.Fatalf("%v: %s, want %s", tc.args, got, tc.want)
+		}
+	}
+	if err := c.Do(ctx, "lcs", "lcs1", "lcs2", "len", "idx").Err(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddReadCommand("WATCH", cmdWATCH)
+	// EXEC is never sent by clients directly: the RESP service intercepts
+	// MULTI/EXEC/DISCARD and submits the queued commands as one EXEC entry.
+	conf.AddWriteCommand("EXEC", cmdEXEC)
+
+	registerSnapshotSection("keyversions", keyVersions.save, keyVersions.load)
+}
+
+var (
+	errExecAbort      = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	errNestedMulti    = errors.New("ERR MULTI calls can not be nested")
+	errExecNoMulti    = errors.New("ERR EXEC without MULTI")
+	errDiscardNoMulti = errors.New("ERR DISCARD without MULTI")
+	errWatchInMulti   = errors.New("ERR WATCH inside MULTI is not allowed")
+	errNotInTx        = errors.New("ERR Command not allowed inside a transaction")
+	errNoConnection   = errors.New("ERR command requires a client connection")
+)
+
+const keyVersionSlotBits = 16
+
+// versionTable tracks the last modification of keys for WATCH. Keys are hashed
+// into a fixed number of slots, so a collision can abort a transaction that
+// did not strictly need it, but a modification is never missed. The table is
+// only changed by write commands inside Apply, which keeps it identical on
+// every node, and it is carried by snapshots.
+type versionTable struct {
+	seq     uint64 // bumped by every write that modifies keys
+	flushed uint64 // seq of the last FLUSHALL/FLUSHDB
+	slots   [1 << keyVersionSlotBits]uint64
+}
+
+var keyVersions = new(versionTable)
+
+func keySlot(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() & (1<<keyVersionSlotBits - 1))
+}
+
+func (t *versionTable) touch(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	t.seq++
+	for _, key := range keys {
+		t.slots[keySlot(key)] = t.seq
+	}
+}
+
+func (t *versionTable) flush() {
+	t.seq++
+	t.flushed = t.seq
+}
+
+// modifiedSince returns true if any of keys may have been modified after seq.
+func (t *versionTable) modifiedSince(seq uint64, keys []string) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	if t.flushed > seq {
+		return true
+	}
+	for _, key := range keys {
+		if t.slots[keySlot(key)] > seq {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *versionTable) save() []byte {
+	data := binary.AppendUvarint(nil, t.seq)
+	data = binary.AppendUvarint(data, t.flushed)
+	for _, v := range t.slots {
+		data = binary.AppendUvarint(data, v)
+	}
+	return data
+}
+
+func (t *versionTable) load(data []byte) error {
+	*t = versionTable{}
+	if data == nil {
+		return nil
+	}
+	vals := make([]uint64, 0, len(t.slots)+2)
+	for len(data) > 0 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return uhaha.ErrCorrupt
+		}
+		vals = append(vals, v)
+		data = data[n:]
+	}
+	if len(vals) != len(t.slots)+2 {
+		return uhaha.ErrCorrupt
+	}
+	t.seq, t.flushed = vals[0], vals[1]
+	copy(t.slots[:], vals[2:])
+	return nil
+}
+
+// txState is the MULTI/WATCH state of a client connection.
+type txState struct {
+	multi    bool
+	dirty    bool // a queued command was rejected, EXEC must abort
+	queue    [][]string
+	watchSeq uint64
+	watched  []string
+}
+
+func (tx *txState) reset() {
+	*tx = txState{}
+}
+
+// txCommand handles the transaction commands and the queuing of commands
+// between MULTI and EXEC. It returns nil for commands that must be sent to the
+// service as usual.
+func (c *respConn) txCommand(s uhaha.Service, args []string) uhaha.Receiver {
+	tx := &c.tx
+	reply := func(v interface{}, err error) uhaha.Receiver {
+		return uhaha.Response(args, v, 0, err)
+	}
+	switch args[0] {
+	case "multi":
+		if len(args) != 1 {
+			return reply(nil, uhaha.ErrWrongNumArgs)
+		}
+		if tx.multi {
+			return reply(nil, errNestedMulti)
+		}
+		tx.multi = true
+		return reply(redcon.SimpleString("OK"), nil)
+	case "discard":
+		if len(args) != 1 {
+			return reply(nil, uhaha.ErrWrongNumArgs)
+		}
+		if !tx.multi {
+			return reply(nil, errDiscardNoMulti)
+		}
+		tx.reset()
+		return reply(redcon.SimpleString("OK"), nil)
+	case "unwatch":
+		if len(args) != 1 {
+			return reply(nil, uhaha.ErrWrongNumArgs)
+		}
+		if !tx.multi {
+			tx.watchSeq, tx.watched = 0, nil
+		}
+		return reply(redcon.SimpleString("OK"), nil)
+	case "watch":
+		if tx.multi {
+			return reply(nil, errWatchInMulti)
+		}
+		return nil
+	case "exec":
+		if len(args) != 1 {
+			return reply(nil, uhaha.ErrWrongNumArgs)
+		}
+		if !tx.multi {
+			return reply(nil, errExecNoMulti)
+		}
+		defer tx.reset()
+		if tx.dirty {
+			return reply(nil, errExecAbort)
+		}
+		for _, cmd := range tx.queue {
+			clientPause.wait(cmd)
+		}
+		r := s.Send(c.entryArgs(encodeExec(tx)), &c.opts)
+		// the queued SELECT commands change the database of the connection
+		for _, cmd := range tx.queue {
+			if cmd[0] == "select" {
+				c.db, _ = parseDBIndex(cmd[1])
+			}
+		}
+		return r
+	}
+	if !tx.multi {
+		return nil
+	}
+	if cmd, ok := commands[args[0]]; !ok || cmd.name == "exec" || cmd.name == "migrate" {
+		tx.dirty = true
+		return reply(nil, errNotInTx)
+	}
+	if args[0] == "select" {
+		// only the SELECT of the connection can be queued, not an entry
+		if len(args) != 2 {
+			tx.dirty = true
+			return reply(nil, uhaha.ErrWrongNumArgs)
+		}
+		if _, err := parseDBIndex(args[1]); err != nil {
+			tx.dirty = true
+			return reply(nil, err)
+		}
+	}
+	if args[0] == "acl" && len(args) > 1 && strings.EqualFold(args[1], "setuser") {
+		// the queue goes to the log in the EXEC entry
+		args = hashPasswordRules(args)
+	}
+	tx.queue = append(tx.queue, args)
+	return reply(redcon.SimpleString("QUEUED"), nil)
+}
+
+// encodeExec flattens the watched keys and the queued commands into the
+// arguments of a single EXEC write entry:
+//
+//	EXEC watchseq numkeys [key ...] numargs arg [arg ...] ...
+func encodeExec(tx *txState) []string {
+	args := []string{"exec", strconv.FormatUint(tx.watchSeq, 10),
+		strconv.Itoa(len(tx.watched))}
+	args = append(args, tx.watched...)
+	for _, cmd := range tx.queue {
+		args = append(args, strconv.Itoa(len(cmd)))
+		args = append(args, cmd...)
+	}
+	return args
+}
+
+// cmdWATCH records the keys and the current key version sequence in the
+// client connection. EXEC aborts if any of the keys is modified afterwards.
+func cmdWATCH(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	c, ok := m.Context().(*respConn)
+	if !ok {
+		return nil, errNoConnection
+	}
+	if len(c.tx.watched) == 0 {
+		c.tx.watchSeq = keyVersions.seq
+	}
+	c.tx.watched = append(c.tx.watched, args[1:]...)
+	return redcon.SimpleString("OK"), nil
+}
+
+// cmdEXEC applies a whole transaction in one Raft entry. Since Apply runs one
+// entry at a time, no other command can interleave with the queued ones.
+// It replies with a null array if a watched key was modified.
+func cmdEXEC(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	watchSeq, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, uhaha.ErrInvalid
+	}
+	nkeys, err := strconv.Atoi(args[2])
+	if err != nil || nkeys < 0 || 3+nkeys > len(args) {
+		return nil, uhaha.ErrInvalid
+	}
+	watched := args[3 : 3+nkeys]
+	var queue [][]string
+	for i := 3 + nkeys; i < len(args); {
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n < 1 || i+1+n > len(args) {
+			return nil, uhaha.ErrInvalid
+		}
+		queue = append(queue, args[i+1:i+1+n])
+		i += 1 + n
+	}
+
+	if keyVersions.modifiedSince(watchSeq, watched) {
+		return nil, nil
+	}
+	// the queued writes are staged and committed in one write batch, a
+	// failure before the commit leaves the store untouched
+	stage, _ := ldb.GetSDB().GetDriver().(*stagedDB)
+	if stage != nil {
+		stage.begin()
+		defer stage.abort()
+	}
+	resps := make([]interface{}, len(queue))
+	for i, cmdArgs := range queue {
+		cmd, ok := commands[strings.ToLower(cmdArgs[0])]
+		if !ok || cmd.name == "exec" || cmd.name == "watch" {
+			resps[i] = errNotInTx
+			continue
+		}
+		if !cmd.write {
+			// the writes expire their keys themselves
+			if err := expireIfNeeded(m, commandKeys(cmdArgs)); err != nil {
+				return nil, err
+			}
+		}
+		v, err := cmd.fn(m, cmdArgs)
+		if err != nil {
+			resps[i] = err
+		} else {
+			resps[i] = v
+		}
+	}
+	if stage != nil {
+		if err := stage.commit(); err != nil {
+			return nil, err
+		}
+	}
+	return resps, nil
+}
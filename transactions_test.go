@@ -0,0 +1,402 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	lediscfg "github.com/ledisdb/ledisdb/config"
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMultiExec(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	var incr *redis.IntCmd
+	cmds, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, "tx_hash", "field", "value")
+		pipe.ZAdd(ctx, "tx_zset", redis.Z{Score: 1, Member: "m"})
+		incr = pipe.Incr(ctx, "tx_counter")
+		pipe.Get(ctx, "tx_counter")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 4 {
+		t.Fatalf("expected 4 replies, got %d", len(cmds))
+	}
+	if incr.Val() != 1 {
+		t.Fatal(incr.Val())
+	}
+	if v := cmds[3].(*redis.StringCmd).Val(); v != "1" {
+		t.Fatal(v)
+	}
+	if v, err := c.HGet(ctx, "tx_hash", "field").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "value" {
+		t.Fatal(v)
+	}
+
+	// errors of single commands do not abort the others
+	cmds, err = c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "tx_string", "abc", 0)
+		pipe.Incr(ctx, "tx_string")
+		pipe.Incr(ctx, "tx_counter")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected the error of INCR on a non integer")
+	}
+	if cmds[1].Err() == nil || cmds[0].Err() != nil || cmds[2].Err() != nil {
+		t.Fatal(cmds)
+	}
+
+	conn := c.Conn()
+	defer conn.Close()
+	if err := conn.Do(ctx, "EXEC").Err(); err == nil {
+		t.Fatal("EXEC without MULTI must fail")
+	}
+	if err := conn.Do(ctx, "DISCARD").Err(); err == nil {
+		t.Fatal("DISCARD without MULTI must fail")
+	}
+	if err := conn.Do(ctx, "MULTI").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := conn.Do(ctx, "SET", "tx_discarded", "1").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "QUEUED" {
+		t.Fatal(v)
+	}
+	if err := conn.Do(ctx, "DISCARD").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Exists(ctx, "tx_discarded").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("discarded command was applied")
+	}
+
+	// a rejected command aborts the whole transaction
+	if err := conn.Do(ctx, "MULTI").Err(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Do(ctx, "SET", "tx_aborted", "1")
+	if err := conn.Do(ctx, "NOSUCHCOMMAND").Err(); err == nil {
+		t.Fatal("expected unknown command error")
+	}
+	if err := conn.Do(ctx, "EXEC").Err(); err == nil {
+		t.Fatal("expected EXECABORT")
+	}
+	if n, err := c.Exists(ctx, "tx_aborted").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("aborted transaction was applied")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "watch_key", "1", 0)
+
+	// untouched watched key: EXEC succeeds
+	err := c.Watch(ctx, func(tx *redis.Tx) error {
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "watch_key", "2", 0)
+			return nil
+		})
+		return err
+	}, "watch_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// watched key modified by another client: EXEC fails
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		if err := c.Set(ctx, "watch_key", "3", 0).Err(); err != nil {
+			return err
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "watch_key", "4", 0)
+			return nil
+		})
+		return err
+	}, "watch_key")
+	if err != redis.TxFailedErr {
+		t.Fatalf("expected %v, got %v", redis.TxFailedErr, err)
+	}
+	if v, err := c.Get(ctx, "watch_key").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "3" {
+		t.Fatal(v)
+	}
+
+	// FLUSHALL touches every watched key
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		if err := c.FlushAll(ctx).Err(); err != nil {
+			return err
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "watch_key", "5", 0)
+			return nil
+		})
+		return err
+	}, "watch_key")
+	if err != redis.TxFailedErr {
+		t.Fatalf("expected %v, got %v", redis.TxFailedErr, err)
+	}
+}
+
+func TestExecStaged(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.HSet(ctx, "tx_staged_hash", "a", "1", "b", "2", "c", "3")
+	c.Set(ctx, "tx_staged_string", "old", 0)
+
+	// the queued commands read the writes of the previous ones, through the
+	// lookups and the iterators of the stage
+	cmds, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, "tx_staged_hash", "b")
+		pipe.HSet(ctx, "tx_staged_hash", "c", "30", "d", "4")
+		pipe.HGetAll(ctx, "tx_staged_hash")
+		pipe.Set(ctx, "tx_staged_string", "new", 0)
+		pipe.Incr(ctx, "tx_staged_string")
+		pipe.Append(ctx, "tx_staged_string", "er")
+		pipe.RPush(ctx, "tx_staged_list", "x", "y", "z")
+		pipe.LRange(ctx, "tx_staged_list", 0, -1)
+		return nil
+	})
+	if err == nil || cmds[4].Err() == nil {
+		t.Fatal("expected the error of INCR on a non integer", err)
+	}
+	want := map[string]string{"a": "1", "c": "30", "d": "4"}
+	if v := cmds[2].(*redis.MapStringStringCmd).Val(); !reflect.DeepEqual(v, want) {
+		t.Fatal(v)
+	}
+	if v := cmds[7].(*redis.StringSliceCmd).Val(); !reflect.DeepEqual(v, []string{"x", "y", "z"}) {
+		t.Fatal(v)
+	}
+
+	// the commands around the failed one are all committed
+	if v, err := c.HGetAll(ctx, "tx_staged_hash").Result(); err != nil || !reflect.DeepEqual(v, want) {
+		t.Fatal(v, err)
+	}
+	if v, err := c.Get(ctx, "tx_staged_string").Result(); err != nil || v != "newer" {
+		t.Fatal(v, err)
+	}
+	if n, err := c.LLen(ctx, "tx_staged_list").Result(); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+}
+
+// openStagedTestDB opens a ledis database on a stagedDB.
+func openStagedTestDB(t *testing.T) *stagedDB {
+	cfg := lediscfg.NewConfigDefault()
+	cfg.DataDir = t.TempDir()
+	cfg.Databases = 1
+	cfg.DBName = os.Getenv("DRIVER")
+	l, err := openLedis(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Close)
+	db, err := l.Select(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db.GetSDB().GetDriver().(*stagedDB)
+}
+
+func TestStagedDBAbort(t *testing.T) {
+	db := openStagedTestDB(t)
+	db.Put([]byte("k1"), []byte("v1"))
+
+	// a failure in the middle of EXEC aborts the stage, nothing it wrote
+	// reaches the store
+	db.begin()
+	wb := db.NewWriteBatch()
+	wb.Put([]byte("k2"), []byte("v2"))
+	wb.Delete([]byte("k1"))
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.Get([]byte("k2")); string(v) != "v2" {
+		t.Fatal("a staged write is not visible", v)
+	}
+	if v, _ := db.Get([]byte("k1")); v != nil {
+		t.Fatal("a staged delete is not visible", v)
+	}
+	db.abort()
+	if v, _ := db.Get([]byte("k1")); string(v) != "v1" {
+		t.Fatal(v)
+	}
+	if v, _ := db.Get([]byte("k2")); v != nil {
+		t.Fatal(v)
+	}
+
+	db.begin()
+	wb.Put([]byte("k3"), []byte("v3"))
+	wb.Commit()
+	db.Delete([]byte("k1"))
+	if err := db.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.IDB.Get([]byte("k3")); string(v) != "v3" {
+		t.Fatal(v)
+	}
+	if v, _ := db.IDB.Get([]byte("k1")); v != nil {
+		t.Fatal(v)
+	}
+}
+
+func TestStagedDBIterator(t *testing.T) {
+	db := openStagedTestDB(t)
+	// s_ and u_ bound the keys of the test
+	for _, k := range []string{"s_", "t_a", "t_c", "t_e", "t_g", "u_"} {
+		db.Put([]byte(k), []byte(k))
+	}
+	db.begin()
+	defer db.abort()
+	db.Put([]byte("t_b"), []byte("staged"))
+	db.Delete([]byte("t_c"))
+	db.Put([]byte("t_e"), []byte("staged"))
+	db.Delete([]byte("t_f"))
+	db.Delete([]byte("t_g"))
+
+	collect := func(it interface {
+		Valid() bool
+		Key() []byte
+		Value() []byte
+	}, move func()) []string {
+		var kvs []string
+		for ; it.Valid() && string(it.Key()) > "s_" && string(it.Key()) < "u_"; move() {
+			kvs = append(kvs, string(it.Key())+"="+string(it.Value()))
+		}
+		return kvs
+	}
+	it := db.NewIterator()
+	defer it.Close()
+	it.Seek([]byte("t_"))
+	if v := collect(it, it.Next); !reflect.DeepEqual(v, []string{"t_a=t_a", "t_b=staged", "t_e=staged"}) {
+		t.Fatal(v)
+	}
+	it.Seek([]byte("u_"))
+	it.Prev()
+	if v := collect(it, it.Prev); !reflect.DeepEqual(v, []string{"t_e=staged", "t_b=staged", "t_a=t_a"}) {
+		t.Fatal(v)
+	}
+
+	// switching the direction
+	it.Seek([]byte("t_c"))
+	if string(it.Key()) != "t_e" {
+		t.Fatal(string(it.Key()))
+	}
+	it.Prev()
+	if string(it.Key()) != "t_b" {
+		t.Fatal(string(it.Key()))
+	}
+	it.Prev()
+	it.Next()
+	if string(it.Key()) != "t_b" {
+		t.Fatal(string(it.Key()))
+	}
+	it.Next()
+	if string(it.Key()) != "t_e" {
+		t.Fatal(string(it.Key()))
+	}
+}
+
+func TestStagedDBCounts(t *testing.T) {
+	cfg := lediscfg.NewConfigDefault()
+	cfg.DataDir = t.TempDir()
+	cfg.Databases = 2
+	cfg.DBName = os.Getenv("DRIVER")
+	open := func() (*ledis.Ledis, *ledis.DB, *stagedDB) {
+		l, err := openLedis(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := l.Select(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l, db, db.GetSDB().GetDriver().(*stagedDB)
+	}
+	l, db, sdb := open()
+	db.Set([]byte("a"), []byte("v"))
+	db.HSet([]byte("a"), []byte("f"), []byte("v"))
+	db.RPush([]byte("b"), []byte("v"))
+	expect := func(sdb *stagedDB, keys, strings, hashes int64) {
+		t.Helper()
+		if n := sdb.keyCount(0, -1); n != 0 {
+			t.Fatal(n)
+		}
+		if n := sdb.keyCount(1, -1); n != keys {
+			t.Fatal(n)
+		}
+		if n := sdb.keyCount(1, 0); n != strings {
+			t.Fatal(n)
+		}
+		if n := sdb.keyCount(1, 4); n != hashes {
+			t.Fatal(n)
+		}
+	}
+	expect(sdb, 2, 1, 1)
+
+	// a stage counts apart until committed
+	sdb.begin()
+	db.Del([]byte("a"))
+	db.HDel([]byte("a"), []byte("f"))
+	expect(sdb, 1, 0, 0)
+	sdb.abort()
+	expect(sdb, 2, 1, 1)
+
+	// the counts are made again when the store is opened
+	l.Close()
+	l, db, sdb = open()
+	expect(sdb, 2, 1, 1)
+
+	// and once a snapshot is restored
+	snap, err := newSnapshot(db.GetSDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = snap.Persist(&buf)
+	snap.Done("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("c"), []byte("v"))
+	expect(sdb, 3, 2, 1)
+	if _, err := restoreSnapshot(db.GetSDB(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	expect(sdb, 2, 1, 1)
+	l.Close()
+
+	// --no-key-counts keeps no counts, the writes still go through
+	keyCounts = false
+	defer func() { keyCounts = true }()
+	l, db, sdb = open()
+	defer l.Close()
+	if sdb.counts != nil {
+		t.Fatal("counted the keys")
+	}
+	if err := db.Set([]byte("c"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if sdb.isMetaKey(rawMetaKey(1, 0, []byte("c"))) {
+		t.Fatal("a meta key is counted")
+	}
+}
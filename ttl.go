@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/ledisdb/ledisdb/store"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+func init() {
+	conf.AddWriteCommand("PEXPIRE", cmdPEXPIRE)
+	conf.AddWriteCommand("PEXPIREAT", cmdPEXPIREAT)
+	conf.AddReadCommand("PTTL", cmdPTTL)
+	conf.AddReadCommand("EXPIRETIME", cmdEXPIRETIME)
+	conf.AddReadCommand("PEXPIRETIME", cmdPEXPIRETIME)
+	conf.AddWriteCommand("EXPIRED", cmdEXPIRED)
+
+	conf.Tick = expireTick
+}
+
+// Expire times are kept in the ledis TTL keys, in whole seconds, so that the
+// ledis commands that drop or overwrite a value (DEL, SET, LCLEAR...) also
+// drop its TTL. The exact time in milliseconds is stored next to them:
+//
+//	db|expireMsType|type|key -> unix time in ms
+//
+// It only applies while it rounds up to the ledis second, an entry left behind
+// by a ledis command that removed the TTL is ignored and overwritten by the
+// next expire of the key. Keys that only have the ledis second, e.g. written
+// before millisecond TTLs existed, expire at that second.
+const expireMsType byte = 34
+
+// Expired keys are removed by the leader: every tick of the Raft log wakes the
+// reaper, which looks for the keys expired at the tick time and proposes an
+// EXPIRED entry for them. EXPIRED checks the expire times again against its
+// own m.Now(), so every node deletes the same keys, whether it applies the
+// entry live, replays the log or restores a snapshot. The proposals of the
+// followers fail and are dropped.
+
+// ledisTTLCheckInterval turns off the ledis TTL checker, which deletes the
+// expired keys on every node by its own clock.
+const ledisTTLCheckInterval = math.MaxInt32
+
+// expireReapLimit is the maximum number of keys of an EXPIRED entry.
+const expireReapLimit = 256
+
+var (
+	expireTickTime int64 // unix time in ms of the last tick, atomic
+	expireWake     = make(chan struct{}, 1)
+
+	// expireReaperPaused stops the reaper, for the tests of the expired keys
+	// and fields it did not remove yet.
+	expireReaperPaused atomic.Bool
+)
+
+var errExpireOptions = errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+
+func expireMsKey(typ byte, key []byte) []byte {
+	return append(append(streamDBPrefix(), expireMsType, typ), key...)
+}
+
+// msToUnixCeil converts a unix time in milliseconds to seconds, rounding up so
+// that a key never expires before the requested time.
+func msToUnixCeil(ms int64) int64 {
+	return (ms + 999) / 1000
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// keyPExpireAt returns the expire time of the key type as a unix time in
+// milliseconds, -1 if it has none.
+func keyPExpireAt(kt *keyType, key []byte) (int64, error) {
+	sdb := ldb.GetSDB()
+	v, err := sdb.Get(expMetaKey(kt.expType, key))
+	if err != nil || v == nil {
+		return -1, err
+	}
+	when, err := ledis.Int64(v, nil)
+	if err != nil {
+		return -1, err
+	}
+	v, err = sdb.Get(expireMsKey(kt.expType, key))
+	if err != nil {
+		return -1, err
+	}
+	if len(v) == 8 {
+		if ms := int64(binary.BigEndian.Uint64(v)); msToUnixCeil(ms) == when {
+			return ms, nil
+		}
+	}
+	return when * 1000, nil
+}
+
+// setKeyPExpireAt adds the expire time ms, a unix time in milliseconds, of the
+// key type to wb.
+func setKeyPExpireAt(wb *store.WriteBatch, kt *keyType, key []byte, ms int64) error {
+	if _, err := removeKeyExpire(wb, kt, key); err != nil {
+		return err
+	}
+	when := msToUnixCeil(ms)
+	wb.Put(expMetaKey(kt.expType, key), ledis.PutInt64(when))
+	wb.Put(expTimeKey(kt.expType, key, when), expMetaKey(kt.expType, key))
+	wb.Put(expireMsKey(kt.expType, key), binary.BigEndian.AppendUint64(nil, uint64(ms)))
+	return nil
+}
+
+// removeKeyExpire adds the removal of the expire time of the key type to wb.
+// It returns true if the key type had one.
+func removeKeyExpire(wb *store.WriteBatch, kt *keyType, key []byte) (bool, error) {
+	v, err := ldb.GetSDB().Get(expMetaKey(kt.expType, key))
+	if err != nil || v == nil {
+		return false, err
+	}
+	when, err := ledis.Int64(v, nil)
+	if err != nil {
+		return false, err
+	}
+	wb.Delete(expMetaKey(kt.expType, key))
+	wb.Delete(expTimeKey(kt.expType, key, when))
+	wb.Delete(expireMsKey(kt.expType, key))
+	return true, nil
+}
+
+// expireOptions are the NX, XX, GT and LT options of the EXPIRE commands.
+type expireOptions struct {
+	nx, xx, gt, lt bool
+}
+
+func parseExpireOptions(args []string) (opts expireOptions, err error) {
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GT":
+			opts.gt = true
+		case "LT":
+			opts.lt = true
+		default:
+			return opts, uhaha.ErrSyntax
+		}
+	}
+	if opts.nx && (opts.xx || opts.gt || opts.lt) {
+		return opts, errExpireOptions
+	}
+	if opts.gt && opts.lt {
+		return opts, errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+	return opts, nil
+}
+
+// allow reports whether the options allow to replace the expire time cur
+// (-1 for none) with ms.
+func (opts expireOptions) allow(cur, ms int64) bool {
+	switch {
+	case opts.nx:
+		return cur == -1
+	case opts.xx && cur == -1:
+		return false
+	case opts.gt:
+		// no expire time is an infinite TTL
+		return cur != -1 && ms > cur
+	case opts.lt:
+		return cur == -1 || ms < cur
+	}
+	return true
+}
+
+// expireKey sets the expire time ms, a unix time in milliseconds, of every type
+// of key. A time that is not after m.Now() deletes the key, so the decision
+// is the same on every node. It returns 1 if the expire time was set, 0 if the
+// key does not exist or the options did not allow it.
+func expireKey(m uhaha.Machine, key []byte, ms int64, opts expireOptions) (interface{}, error) {
+	types, err := keyTypesOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		return redcon.SimpleInt(0), nil
+	}
+	cur, err := keyPExpireAt(types[0], key)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.allow(cur, ms) {
+		return redcon.SimpleInt(0), nil
+	}
+
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if ms <= unixMilli(m.Now()) {
+		if _, err := deleteKeyAllTypes(wb, key); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, kt := range types {
+			if err := setKeyPExpireAt(wb, kt, key, ms); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(1), nil
+}
+
+// expireKeyType sets the expire time ms, a unix time in milliseconds, of the
+// key type only, like the ledis XEXPIRE commands. A time that is not after
+// m.Now() deletes the value. It returns 1 if the expire time was set.
+func expireKeyType(m uhaha.Machine, kt *keyType, key []byte, ms int64) (interface{}, error) {
+	if ok, err := kt.exists(key); err != nil || !ok {
+		return redcon.SimpleInt(0), err
+	}
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	var n int64
+	if ms <= unixMilli(m.Now()) {
+		if err := kt.deleteKey(wb, key); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := setKeyPExpireAt(wb, kt, key, ms); err != nil {
+			return nil, err
+		}
+		n = 1
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// keyTypeTTL returns the remaining time to live of the key type in seconds,
+// rounded up, -1 if it has none or does not exist, like the ledis XTTL
+// commands.
+func keyTypeTTL(kt *keyType, key []byte, now time.Time) (interface{}, error) {
+	ms, err := keyPExpireAt(kt, key)
+	if err != nil || ms == -1 {
+		return redcon.SimpleInt(-1), err
+	}
+	ttl := ms - unixMilli(now)
+	if ttl <= 0 {
+		return redcon.SimpleInt(-1), nil
+	}
+	return redcon.SimpleInt(msToUnixCeil(ttl)), nil
+}
+
+// keyPTTL returns the remaining time to live of key in milliseconds at now,
+// -1 if it has no expire time and -2 if it does not exist.
+func keyPTTL(key []byte, now time.Time) (int64, error) {
+	types, err := keyTypesOf(key)
+	if err != nil || len(types) == 0 {
+		return -2, err
+	}
+	ms, err := keyPExpireAt(types[0], key)
+	if err != nil || ms == -1 {
+		return -1, err
+	}
+	ttl := ms - unixMilli(now)
+	if ttl <= 0 {
+		// expired, waiting to be removed
+		return -2, nil
+	}
+	return ttl, nil
+}
+
+// parseExpireArgs parses "key time [NX|XX|GT|LT]" of the EXPIRE commands,
+// the time is converted by expireAtMs.
+func parseExpireArgs(args []string, unit, base int64) (key []byte, ms int64, opts expireOptions, err error) {
+	if len(args) < 3 {
+		return nil, 0, opts, uhaha.ErrWrongNumArgs
+	}
+	v, err := ledis.StrInt64([]byte(args[2]), nil)
+	if err != nil {
+		return nil, 0, opts, errors.New("ERR value is not an integer or out of range")
+	}
+	ms, ok := expireAtMs(v, unit, base)
+	if !ok {
+		return nil, 0, opts, errExpireTime(args[0])
+	}
+	opts, err = parseExpireOptions(args[3:])
+	return []byte(args[1]), ms, opts, err
+}
+
+// expireAtMs converts the time v of a command, counted in unit milliseconds
+// from base, to a unix time in milliseconds. base is 0 for the unix times and
+// the machine time for the times to live. ok is false when the result does
+// not fit in an int64, instead of wrapping to a time in the past.
+func expireAtMs(v, unit, base int64) (ms int64, ok bool) {
+	if v > (math.MaxInt64-base)/unit || v < math.MinInt64/unit {
+		return 0, false
+	}
+	return base + v*unit, true
+}
+
+func errExpireTime(cmd string) error {
+	return fmt.Errorf("ERR invalid expire time in '%s' command", strings.ToLower(cmd))
+}
+
+// cmdPEXPIRE sets a time to live in milliseconds on key.
+// Syntax: PEXPIRE key milliseconds [NX | XX | GT | LT]
+func cmdPEXPIRE(m uhaha.Machine, args []string) (interface{}, error) {
+	key, ms, opts, err := parseExpireArgs(args, 1, unixMilli(m.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return expireKey(m, key, ms, opts)
+}
+
+// cmdPEXPIREAT sets the expire time of key as a unix time in milliseconds.
+// Syntax: PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+func cmdPEXPIREAT(m uhaha.Machine, args []string) (interface{}, error) {
+	key, ms, opts, err := parseExpireArgs(args, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	return expireKey(m, key, ms, opts)
+}
+
+// cmdPTTL returns the remaining time to live of key in milliseconds.
+// Syntax: PTTL key
+func cmdPTTL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	ttl, err := keyPTTL([]byte(args[1]), m.Now())
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(ttl), nil
+}
+
+// cmdEXPIRETIME returns the expire time of key as a unix time in seconds.
+// Syntax: EXPIRETIME key
+func cmdEXPIRETIME(m uhaha.Machine, args []string) (interface{}, error) {
+	return expireTime(args, 1000)
+}
+
+// cmdPEXPIRETIME returns the expire time of key as a unix time in milliseconds.
+// Syntax: PEXPIRETIME key
+func cmdPEXPIRETIME(m uhaha.Machine, args []string) (interface{}, error) {
+	return expireTime(args, 1)
+}
+
+func expireTime(args []string, unit int64) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	key := []byte(args[1])
+	types, err := keyTypesOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		return redcon.SimpleInt(-2), nil
+	}
+	ms, err := keyPExpireAt(types[0], key)
+	if err != nil || ms == -1 {
+		return redcon.SimpleInt(-1), err
+	}
+	return redcon.SimpleInt(ms / unit), nil
+}
+
+// expireTick is the conf.Tick function, it runs in the Raft log on every node.
+func expireTick(m uhaha.Machine) {
+	atomic.StoreInt64(&expireTickTime, unixMilli(m.Now()))
+	select {
+	case expireWake <- struct{}{}:
+	default:
+	}
+}
+
+// runExpireReaper proposes the deletion of the expired keys and hash fields
+// of every database through s after every tick.
+func runExpireReaper(s uhaha.Service) {
+	for range expireWake {
+		if expireReaperPaused.Load() {
+			continue
+		}
+		now := atomic.LoadInt64(&expireTickTime)
+		for index := range ldbs {
+			var keys, fields []string
+			var err error
+			dbMu.Lock()
+			useDB(index)
+			if keys, err = expiredKeys(now, expireReapLimit); err == nil {
+				fields = expiredHashFields(now, expireReapLimit)
+			}
+			useDB(0)
+			dbMu.Unlock()
+			if err != nil {
+				s.Log().Warningf("expire: %v", err)
+				continue
+			}
+			if len(keys) > 0 {
+				s.Send(dbEntry(index, append([]string{"expired"}, keys...)), nil).Recv()
+			}
+			if len(fields) > 0 {
+				s.Send(dbEntry(index, append([]string{"hexpired"}, fields...)), nil).Recv()
+			}
+		}
+	}
+}
+
+// expiredKeys returns up to limit keys whose expire time is not after now, a
+// unix time in milliseconds. It walks the ledis time index, which is sorted by
+// second.
+func expiredKeys(now int64, limit int) ([]string, error) {
+	prefix := append(streamDBPrefix(), ledis.ExpTimeType)
+	end := binary.BigEndian.AppendUint64(append([]byte(nil), prefix...), uint64(msToUnixCeil(now)+1))
+	it := ldb.GetSDB().RangeIterator(prefix, end, store.RangeROpen)
+	defer it.Close()
+	seen := make(map[string]bool)
+	var keys []string
+	for ; it.Valid() && len(keys) < limit; it.Next() {
+		// when|type|key
+		tk := it.RawKey()[len(prefix):]
+		if len(tk) < 9 {
+			continue
+		}
+		kt, key := keyTypeByExp(tk[8]), tk[9:]
+		if kt == nil || seen[string(key)] {
+			continue
+		}
+		ms, err := keyPExpireAt(kt, key)
+		if err != nil {
+			return nil, err
+		}
+		if ms != -1 && ms <= now {
+			seen[string(key)] = true
+			keys = append(keys, string(key))
+		}
+	}
+	return keys, nil
+}
+
+// unreapedKeys returns the keys of the current db missing at now, a unix time
+// in milliseconds, that the reaper did not remove yet: all their types
+// expired, or they are hashes whose fields all expired.
+func unreapedKeys(now int64) (map[string]bool, error) {
+	keys, err := expiredKeys(now, math.MaxInt)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]int64) // the expired fields of the hashes
+	scanExpiredHFields(now, func(key, field []byte, ms int64) bool {
+		if cur, _ := hFieldPExpireAt(key, field); cur == ms {
+			if fields[string(key)] == 0 {
+				keys = append(keys, string(key))
+			}
+			fields[string(key)]++
+		}
+		return true
+	})
+	missing := make(map[string]bool)
+	for _, key := range keys {
+		if missing[key] {
+			continue
+		}
+		types, err := keyTypesOf([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		live := false
+		for _, kt := range types {
+			ms, err := keyPExpireAt(kt, []byte(key))
+			if err != nil {
+				return nil, err
+			}
+			if ms != -1 && ms <= now {
+				continue
+			}
+			if kt.expType == ledis.HashType && fields[key] > 0 {
+				if n, err := ldb.HLen([]byte(key)); err != nil {
+					return nil, err
+				} else if n <= fields[key] {
+					continue
+				}
+			}
+			live = true
+			break
+		}
+		if len(types) > 0 && !live {
+			missing[key] = true
+		}
+	}
+	return missing, nil
+}
+
+// cmdEXPIRED deletes the keys whose expire time is not after m.Now(), the
+// others are left untouched. It is proposed by the expire reaper.
+// Syntax: EXPIRED key [key ...]
+func cmdEXPIRED(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	expired, err := expireKeys(wb, args[1:], unixMilli(m.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(len(expired)), nil
+}
+
+// expireKeys adds the deletion of the types of keys whose expire time is not
+// after now, a unix time in milliseconds, to wb. It returns the keys that
+// expired.
+func expireKeys(wb *store.WriteBatch, keys []string, now int64) ([]string, error) {
+	var expired []string
+	seen := make(map[string]bool)
+	for _, arg := range keys {
+		key := []byte(arg)
+		if seen[arg] {
+			continue
+		}
+		seen[arg] = true
+		n := len(expired)
+		for i := range keyTypes {
+			kt := &keyTypes[i]
+			ms, err := keyPExpireAt(kt, key)
+			if err != nil {
+				return nil, err
+			}
+			if ms == -1 || ms > now {
+				continue
+			}
+			if err := kt.deleteKey(wb, key); err != nil {
+				return nil, err
+			}
+			if len(expired) == n {
+				expired = append(expired, arg)
+			}
+		}
+	}
+	return expired, nil
+}
+
+// Keys and hash fields expired but not yet removed by the reaper are missing
+// for the commands, like in Redis. A write first deletes the expired keys and
+// fields it names, in its log entry, so every node deletes the same ones. A
+// read cannot write, it runs against a stage of the store in which they are
+// deleted, and the stage is dropped once it replied.
+
+// expireIfNeeded deletes the keys and hash fields expired at m.Now() before a
+// command of the log runs. The deletions bump the versions of the keys and
+// notify "expired" and "hexpired".
+func expireIfNeeded(m uhaha.Machine, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	now := unixMilli(m.Now())
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	expired, err := expireKeys(wb, keys, now)
+	if err != nil {
+		return err
+	}
+	if len(expired) > 0 {
+		if err := wb.Commit(); err != nil {
+			return err
+		}
+		keyVersions.touch(expired...)
+		for _, key := range expired {
+			notifyKeyspaceEvent(notifyExpired, "expired", key)
+		}
+	}
+	if fields := expiredHFieldsOf(keys, now); len(fields) > 0 {
+		_, hashes, err := deleteExpiredHFields(fields, now)
+		if err != nil {
+			return err
+		}
+		keyVersions.touch(hashes...)
+		for _, key := range hashes {
+			notifyKeyspaceEvent(notifyHash, "hexpired", key)
+		}
+	}
+	return nil
+}
+
+// keysExpired reports whether one of keys has a type or a hash field expired
+// at now, a unix time in milliseconds.
+func keysExpired(keys []string, now int64) (bool, error) {
+	for _, key := range keys {
+		for i := range keyTypes {
+			ms, err := keyPExpireAt(&keyTypes[i], []byte(key))
+			if err != nil {
+				return false, err
+			}
+			if ms != -1 && ms <= now {
+				return true, nil
+			}
+		}
+	}
+	return len(expiredHFieldsOf(keys, now)) > 0, nil
+}
+
+// readUnexpired runs the read command fn with the keys and hash fields of args
+// expired at m.Now() deleted in a stage of the store, dropped once fn
+// returned. The caller holds the write lock of dbMu.
+func readUnexpired(fn cmdFunc, m uhaha.Machine, args []string) (interface{}, error) {
+	stage, _ := ldb.GetSDB().GetDriver().(*stagedDB)
+	if stage == nil {
+		return fn(m, args)
+	}
+	stage.begin()
+	defer stage.abort()
+	keys, now := commandKeys(args), unixMilli(m.Now())
+	wb := ldb.GetSDB().NewWriteBatch()
+	defer wb.Close()
+	if _, err := expireKeys(wb, keys, now); err != nil {
+		return nil, err
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	if fields := expiredHFieldsOf(keys, now); len(fields) > 0 {
+		if _, _, err := deleteExpiredHFields(fields, now); err != nil {
+			return nil, err
+		}
+	}
+	return fn(m, args)
+}
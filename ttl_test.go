@@ -0,0 +1,359 @@
+//go:build alltest
+// +build alltest
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestPExpire(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "ttl_string", "v", 0)
+	if ok, err := c.PExpire(ctx, "ttl_string", 1500*time.Millisecond).Result(); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("PEXPIRE failed")
+	}
+	if d, err := c.PTTL(ctx, "ttl_string").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= time.Second || d > 1500*time.Millisecond {
+		t.Fatal(d)
+	}
+	if d, err := c.TTL(ctx, "ttl_string").Result(); err != nil {
+		t.Fatal(err)
+	} else if d != time.Second && d != 2*time.Second {
+		t.Fatal(d)
+	}
+
+	// NX, XX, GT and LT compare with the current expire time
+	if ok, err := c.ExpireNX(ctx, "ttl_string", time.Hour).Result(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("NX replaced the expire time")
+	}
+	if ok, err := c.ExpireLT(ctx, "ttl_string", time.Hour).Result(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("LT raised the expire time")
+	}
+	if ok, err := c.ExpireGT(ctx, "ttl_string", time.Hour).Result(); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("GT failed")
+	}
+	if ok, err := c.ExpireXX(ctx, "ttl_none", time.Hour).Result(); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("XX set the expire time of a missing key")
+	}
+	if err := c.Do(ctx, "expire", "ttl_string", 10, "NX", "XX").Err(); err == nil {
+		t.Fatal("expected an options error")
+	}
+
+	at := time.Now().Add(time.Hour).UnixMilli()
+	if err := c.PExpireAt(ctx, "ttl_string", time.UnixMilli(at)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do(ctx, "pexpiretime", "ttl_string").Int64(); err != nil {
+		t.Fatal(err)
+	} else if v != at {
+		t.Fatal(v, at)
+	}
+	if v, err := c.ExpireTime(ctx, "ttl_string").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != time.Duration(at/1000)*time.Second {
+		t.Fatal(v)
+	}
+
+	// a time in the past deletes the key
+	if err := c.PExpireAt(ctx, "ttl_string", time.Now().Add(-time.Second)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.PTTL(ctx, "ttl_string").Result(); err != nil {
+		t.Fatal(err)
+	} else if d != -2 {
+		t.Fatal(d)
+	}
+
+	// second based expire times keep working for every type
+	c.RPush(ctx, "ttl_list", "a")
+	if err := c.Do(ctx, "lexpire", "ttl_list", 100).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.PTTL(ctx, "ttl_list").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 99*time.Second || d > 100*time.Second {
+		t.Fatal(d)
+	}
+	if err := c.PExpire(ctx, "ttl_list", 200*time.Millisecond).Err(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if d, err := c.PTTL(ctx, "ttl_list").Result(); err != nil {
+		t.Fatal(err)
+	} else if d != -2 {
+		t.Fatal(d)
+	}
+}
+
+func TestPSetEx(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	if err := c.Do(ctx, "psetex", "ttl_psetex", 100000, "v").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.PTTL(ctx, "ttl_psetex").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 99*time.Second || d > 100*time.Second {
+		t.Fatal(d)
+	}
+	if err := c.Do(ctx, "psetex", "ttl_psetex", 0, "v").Err(); err == nil {
+		t.Fatal("expected an invalid expire time")
+	}
+
+	if err := c.Set(ctx, "ttl_px", "v", 1200*time.Millisecond).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.PTTL(ctx, "ttl_px").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= time.Second || d > 1200*time.Millisecond {
+		t.Fatal(d)
+	}
+	if err := c.SetEx(ctx, "ttl_px", "v", 10*time.Second).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.PTTL(ctx, "ttl_px").Result(); err != nil {
+		t.Fatal(err)
+	} else if d <= 9*time.Second || d > 10*time.Second {
+		t.Fatal(d)
+	}
+
+	// SET without an expire time drops the millisecond one too
+	c.Set(ctx, "ttl_px", "v", 0)
+	if d, err := c.PTTL(ctx, "ttl_px").Result(); err != nil {
+		t.Fatal(err)
+	} else if d != -1 {
+		t.Fatal(d)
+	}
+}
+
+func TestExpireReaper(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	c.Set(ctx, "reap_string", "v", 100*time.Millisecond)
+	c.RPush(ctx, "reap_list", "a")
+	c.HSet(ctx, "reap_hash", "f", "v")
+	c.XAdd(ctx, &redis.XAddArgs{Stream: "reap_stream", ID: "1-1", Values: []string{"f", "v"}})
+	c.Set(ctx, "reap_alive", "v", time.Hour)
+	for _, key := range []string{"reap_list", "reap_hash", "reap_stream"} {
+		if err := c.PExpire(ctx, key, 100*time.Millisecond).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Do(ctx, "hexpire", "reap_hash", 1).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do(ctx, "httl", "reap_hash").Int64(); err != nil {
+		t.Fatal(err)
+	} else if v != 1 {
+		t.Fatal(v)
+	}
+
+	// EXPIRED leaves the keys that did not expire
+	if n, err := c.Do(ctx, "expired", "reap_alive", "reap_none").Int64(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if err := c.Get(ctx, "reap_string").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if n, err := c.LLen(ctx, "reap_list").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.HLen(ctx, "reap_hash").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if n, err := c.XLen(ctx, "reap_stream").Result(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal(n)
+	}
+	if v, err := c.Get(ctx, "reap_alive").Result(); err != nil {
+		t.Fatal(err)
+	} else if v != "v" {
+		t.Fatal(v)
+	}
+}
+
+// expireUnindexed gives key of the database index an expire time in the past,
+// without the entry of the ledis time index, so the reaper never removes it.
+func expireUnindexed(t *testing.T, index int, key string) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	err := inDB(index, func() error {
+		types, err := keyTypesOf([]byte(key))
+		if err != nil || len(types) == 0 {
+			return err
+		}
+		ms := unixMilli(time.Now()) - 1000
+		wb := ldb.GetSDB().NewWriteBatch()
+		defer wb.Close()
+		for _, kt := range types {
+			wb.Put(expMetaKey(kt.expType, []byte(key)), ledis.PutInt64(msToUnixCeil(ms)))
+			wb.Put(expireMsKey(kt.expType, []byte(key)), binary.BigEndian.AppendUint64(nil, uint64(ms)))
+		}
+		return wb.Commit()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedKey reports whether key of the database 0 is still in the store.
+func storedKey(t *testing.T, key string) bool {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	types, err := keyTypesOf([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(types) > 0
+}
+
+func TestLazyExpire(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+
+	// the reads reply as if the key was missing and leave it to the reaper
+	c.Set(ctx, "lazy_str", "v", 0)
+	expireUnindexed(t, 0, "lazy_str")
+	if err := c.Get(ctx, "lazy_str").Err(); err != redis.Nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Exists(ctx, "lazy_str").Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if v, err := c.Type(ctx, "lazy_str").Result(); err != nil || v != "none" {
+		t.Fatal(v, err)
+	}
+	if d, err := c.PTTL(ctx, "lazy_str").Result(); err != nil || d != -2 {
+		t.Fatal(d, err)
+	}
+	if !storedKey(t, "lazy_str") {
+		t.Fatal("a read deleted the key")
+	}
+
+	// the writes delete it first
+	if v, err := c.Eval(ctx, "return redis.call('get', KEYS[1])", []string{"lazy_str"}).Result(); err != redis.Nil || storedKey(t, "lazy_str") {
+		t.Fatal(v, err)
+	}
+	if ok, err := c.SetNX(ctx, "lazy_str", "new", 0).Result(); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if v, err := c.Get(ctx, "lazy_str").Result(); err != nil || v != "new" {
+		t.Fatal(v, err)
+	}
+	if d, err := c.PTTL(ctx, "lazy_str").Result(); err != nil || d != -1 {
+		t.Fatal(d, err)
+	}
+	c.Set(ctx, "lazy_cnt", "10", 0)
+	expireUnindexed(t, 0, "lazy_cnt")
+	if n, err := c.Incr(ctx, "lazy_cnt").Result(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	c.RPush(ctx, "lazy_list", "a", "b")
+	expireUnindexed(t, 0, "lazy_list")
+	if n, err := c.LPush(ctx, "lazy_list", "c").Result(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+
+	// so do the transactions and scripts, for the commands they read
+	c.Set(ctx, "lazy_tx", "v", 0)
+	expireUnindexed(t, 0, "lazy_tx")
+	cmds, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Get(ctx, "lazy_tx")
+		p.Exists(ctx, "lazy_tx")
+		return nil
+	})
+	if err != redis.Nil || cmds[0].Err() != redis.Nil || cmds[1].(*redis.IntCmd).Val() != 0 {
+		t.Fatal(cmds, err)
+	}
+	if storedKey(t, "lazy_tx") {
+		t.Fatal("EXEC left the expired key")
+	}
+	c.Set(ctx, "lazy_lua", "v", 0)
+	expireUnindexed(t, 0, "lazy_lua")
+	if v, err := c.Eval(ctx, "redis.call('set', KEYS[1], 'x') return redis.call('exists', ARGV[1])",
+		[]string{"lazy_lua_other"}, "lazy_lua").Int(); err != nil || v != 0 {
+		t.Fatal(v, err)
+	}
+
+	// in another database
+	conn := dbConn(t, 2)
+	conn.HSet(ctx, "lazy_hash", "f", "v")
+	expireUnindexed(t, 2, "lazy_hash")
+	if n, err := conn.HLen(ctx, "lazy_hash").Result(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if ok, err := conn.HSetNX(ctx, "lazy_hash", "f", "new").Result(); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+}
+
+func TestExpireOverflow(t *testing.T) {
+	c := getTestConn()
+	ctx := context.Background()
+	c.Set(ctx, "ttl_overflow", "v", 0)
+
+	// a time that does not fit in milliseconds is rejected, it does not wrap
+	// to a time in the past that deletes the key
+	for _, args := range [][]interface{}{
+		{"expire", "ttl_overflow", int64(math.MaxInt64)},
+		{"expire", "ttl_overflow", int64(math.MinInt64)},
+		{"pexpire", "ttl_overflow", int64(math.MaxInt64)},
+		{"expireat", "ttl_overflow", int64(math.MaxInt64)},
+		{"set", "ttl_overflow", "w", "ex", int64(math.MaxInt64)},
+		{"set", "ttl_overflow", "w", "px", int64(math.MaxInt64)},
+		{"set", "ttl_overflow", "w", "exat", int64(math.MaxInt64)},
+		{"setex", "ttl_overflow", int64(math.MaxInt64), "w"},
+		{"psetex", "ttl_overflow", int64(math.MaxInt64), "w"},
+	} {
+		want := fmt.Sprintf("ERR invalid expire time in '%s' command", args[0])
+		if err := c.Do(ctx, args...).Err(); err == nil || err.Error() != want {
+			t.Fatal(args, err)
+		}
+	}
+	if v, err := c.Get(ctx, "ttl_overflow").Result(); err != nil || v != "v" {
+		t.Fatal(v, err)
+	}
+	if d, err := c.TTL(ctx, "ttl_overflow").Result(); err != nil || d != -1 {
+		t.Fatal(d, err)
+	}
+	// the largest time that fits is accepted
+	if err := c.Do(ctx, "pexpireat", "ttl_overflow", int64(math.MaxInt64)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, "ttl_overflow").Err(); err != nil {
+		t.Fatal(err)
+	}
+}
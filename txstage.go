@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"sync/atomic"
+
+	lediscfg "github.com/ledisdb/ledisdb/config"
+	"github.com/ledisdb/ledisdb/ledis"
+	"github.com/ledisdb/ledisdb/store/driver"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+)
+
+// The store of ledis is wrapped by a stagedDB, so EXEC can run its queued
+// commands against a stage: the writes of the commands go to an in-memory
+// overlay, read back by the following commands, and the overlay is written
+// to the store in one write batch once all the commands ran. A failure in the
+// middle of EXEC discards the stage and leaves the store as it was.
+func init() {
+	driver.Register(stagedStore)
+}
+
+// stagedStoreName is the ledis DBName of the wrapper, openLedis opens the
+// configured backend under it.
+const stagedStoreName = "icefiredb_staged"
+
+type stagedDriver struct {
+	base driver.Store // the backend opened by the next Open
+}
+
+var stagedStore = &stagedDriver{}
+
+func (s *stagedDriver) String() string { return stagedStoreName }
+
+func (s *stagedDriver) Open(path string, cfg *lediscfg.Config) (driver.IDB, error) {
+	db, err := s.base.Open(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	sdb := &stagedDB{IDB: db}
+	if !keyCounts {
+		return sdb, nil
+	}
+	sdb.counts = make([]atomic.Int64, cfg.Databases*countSlots())
+	if err := sdb.countKeys(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sdb, nil
+}
+
+func (s *stagedDriver) Repair(path string, cfg *lediscfg.Config) error {
+	return s.base.Repair(path, cfg)
+}
+
+// openLedis opens ledis like ledis.Open, with the store of cfg.DBName wrapped
+// by the stagedDB used by EXEC. The data stays in the path of the backend.
+func openLedis(cfg *lediscfg.Config) (*ledis.Ledis, error) {
+	base, err := driver.GetStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DBPath == "" {
+		cfg.DBPath = path.Join(cfg.DataDir, cfg.DBName+"_data")
+	}
+	name := cfg.DBName
+	stagedStore.base = base
+	cfg.DBName = stagedStoreName
+	defer func() { cfg.DBName = name }()
+	return ledis.Open(cfg)
+}
+
+// baseDriver returns the backend of db, unwrapping the stagedDB.
+func baseDriver(db driver.IDB) driver.IDB {
+	if s, ok := db.(*stagedDB); ok {
+		return s.IDB
+	}
+	return db
+}
+
+// The values of the overlay start with a flag telling a put from a delete.
+const (
+	stagedDelete = 0
+	stagedPut    = 1
+)
+
+// stagedDB passes everything to the backend, except while a stage is begun:
+// then the writes go to the overlay and the reads see the overlay first. It
+// also keeps the key counts, see keycount.go.
+// The stage is only begun by EXEC and by the reads of expired keys, which
+// hold the write lock of dbMu.
+type stagedDB struct {
+	driver.IDB
+	overlay atomic.Pointer[memdb.DB]
+
+	counts       []atomic.Int64 // by db, see countSlots, nil without key counts
+	stageCounts  countDelta     // the moves of the counts made by the stage
+	countsPaused atomic.Bool    // set by withoutCounts
+}
+
+// begin starts a stage, the following writes are held by the overlay.
+func (db *stagedDB) begin() {
+	db.stageCounts = make(countDelta)
+	db.overlay.Store(memdb.New(comparer.DefaultComparer, 0))
+}
+
+// abort drops the writes made since begin.
+func (db *stagedDB) abort() {
+	db.overlay.Store(nil)
+	db.stageCounts = nil
+}
+
+// commit writes the overlay to the backend in one write batch.
+func (db *stagedDB) commit() error {
+	mem, counts := db.overlay.Swap(nil), db.stageCounts
+	db.stageCounts = nil
+	if mem == nil || mem.Len() == 0 {
+		return nil
+	}
+	wb := db.IDB.NewWriteBatch()
+	defer wb.Close()
+	it := mem.NewIterator(nil)
+	defer it.Release()
+	for it.Next() {
+		if v := it.Value(); v[0] == stagedPut {
+			wb.Put(it.Key(), v[1:])
+		} else {
+			wb.Delete(it.Key())
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	db.addCounts(counts)
+	return nil
+}
+
+func stagePut(mem *memdb.DB, key, value []byte) {
+	v := make([]byte, 1+len(value))
+	v[0] = stagedPut
+	copy(v[1:], value)
+	mem.Put(key, v)
+}
+
+func stageOp(mem *memdb.DB, op stagedOp) {
+	if op.del {
+		mem.Put(op.key, []byte{stagedDelete})
+	} else {
+		stagePut(mem, op.key, op.value)
+	}
+}
+
+func (db *stagedDB) Get(key []byte) ([]byte, error) {
+	if mem := db.overlay.Load(); mem != nil {
+		if v, err := mem.Get(key); err == nil {
+			if v[0] == stagedDelete {
+				return nil, nil
+			}
+			return append([]byte{}, v[1:]...), nil
+		}
+	}
+	return db.IDB.Get(key)
+}
+
+func (db *stagedDB) Put(key, value []byte) error {
+	return db.write(stagedOp{key: key, value: value}, db.IDB.Put)
+}
+
+func (db *stagedDB) Delete(key []byte) error {
+	return db.write(stagedOp{key: key, del: true}, func(key, _ []byte) error {
+		return db.IDB.Delete(key)
+	})
+}
+
+func (db *stagedDB) SyncPut(key, value []byte) error {
+	return db.write(stagedOp{key: key, value: value}, db.IDB.SyncPut)
+}
+
+func (db *stagedDB) SyncDelete(key []byte) error {
+	return db.write(stagedOp{key: key, del: true}, func(key, _ []byte) error {
+		return db.IDB.SyncDelete(key)
+	})
+}
+
+// write applies a single write to the overlay when staged, with base
+// otherwise, and moves the key counts.
+func (db *stagedDB) write(op stagedOp, base func(key, value []byte) error) error {
+	var ops []stagedOp
+	if db.isMetaKey(op.key) {
+		ops = []stagedOp{op}
+	}
+	counts, err := db.countOps(ops)
+	if err != nil {
+		return err
+	}
+	if mem := db.overlay.Load(); mem != nil {
+		stageOp(mem, op)
+	} else if err := base(op.key, op.value); err != nil {
+		return err
+	}
+	db.addCounts(counts)
+	return nil
+}
+
+func (db *stagedDB) NewWriteBatch() driver.IWriteBatch {
+	return &stagedBatch{db: db, IWriteBatch: db.IDB.NewWriteBatch()}
+}
+
+func (db *stagedDB) NewIterator() driver.IIterator {
+	it := db.IDB.NewIterator()
+	mem := db.overlay.Load()
+	if mem == nil {
+		return it
+	}
+	return &stagedIterator{base: it, over: mem.NewIterator(nil)}
+}
+
+// stagedBatch is a write batch of the stagedDB. ledis keeps its batches for
+// the life of the DB, so whether a batch goes to the overlay is decided by
+// each write and commit.
+type stagedBatch struct {
+	driver.IWriteBatch
+	db  *stagedDB
+	ops []stagedOp // the writes made while staged, else those of meta keys
+}
+
+type stagedOp struct {
+	key, value []byte
+	del        bool
+}
+
+func (wb *stagedBatch) Put(key, value []byte) {
+	if wb.db.overlay.Load() != nil || wb.db.isMetaKey(key) {
+		wb.ops = append(wb.ops, stagedOp{key: append([]byte(nil), key...),
+			value: append([]byte(nil), value...)})
+	}
+	wb.IWriteBatch.Put(key, value)
+}
+
+func (wb *stagedBatch) Delete(key []byte) {
+	if wb.db.overlay.Load() != nil || wb.db.isMetaKey(key) {
+		wb.ops = append(wb.ops, stagedOp{key: append([]byte(nil), key...), del: true})
+	}
+	wb.IWriteBatch.Delete(key)
+}
+
+func (wb *stagedBatch) Commit() error {
+	return wb.commit(wb.IWriteBatch.Commit)
+}
+
+func (wb *stagedBatch) SyncCommit() error {
+	return wb.commit(wb.IWriteBatch.SyncCommit)
+}
+
+// commit applies the batch to the overlay when staged, with base otherwise,
+// and moves the key counts.
+func (wb *stagedBatch) commit(base func() error) error {
+	ops := wb.ops
+	wb.ops = nil
+	counts, err := wb.db.countOps(ops)
+	if err != nil {
+		wb.IWriteBatch.Rollback()
+		return err
+	}
+	if mem := wb.db.overlay.Load(); mem != nil {
+		for _, op := range ops {
+			stageOp(mem, op)
+		}
+		if err := wb.IWriteBatch.Rollback(); err != nil {
+			return err
+		}
+	} else if err := base(); err != nil {
+		return err
+	}
+	wb.db.addCounts(counts)
+	return nil
+}
+
+func (wb *stagedBatch) Rollback() error {
+	wb.ops = nil
+	return wb.IWriteBatch.Rollback()
+}
+
+// stagedIterator merges an iterator of the backend with one of the overlay.
+// The overlay wins on equal keys and its deletes hide the keys of the
+// backend.
+type stagedIterator struct {
+	base    driver.IIterator
+	over    iterator.Iterator
+	reverse bool
+	cur     int // curBase or curOver, curNone past the end
+}
+
+const (
+	curNone = iota
+	curBase
+	curOver
+)
+
+func (it *stagedIterator) Close() error {
+	it.over.Release()
+	return it.base.Close()
+}
+
+func (it *stagedIterator) First() {
+	it.base.First()
+	it.over.First()
+	it.reverse = false
+	it.settle()
+}
+
+func (it *stagedIterator) Last() {
+	it.base.Last()
+	it.over.Last()
+	it.reverse = true
+	it.settle()
+}
+
+func (it *stagedIterator) Seek(key []byte) {
+	it.base.Seek(key)
+	it.over.Seek(key)
+	it.reverse = false
+	it.settle()
+}
+
+func (it *stagedIterator) Next() {
+	if it.cur == curNone {
+		return
+	}
+	key := append([]byte(nil), it.Key()...)
+	if it.reverse {
+		// both move to the first key >= key, the ones at key are skipped below
+		it.base.Seek(key)
+		it.over.Seek(key)
+		it.reverse = false
+	}
+	it.step(key)
+	it.settle()
+}
+
+func (it *stagedIterator) Prev() {
+	if it.cur == curNone {
+		return
+	}
+	key := append([]byte(nil), it.Key()...)
+	if !it.reverse {
+		// both move to the last key < key
+		it.base.Seek(key)
+		if it.base.Valid() {
+			it.base.Prev()
+		} else {
+			it.base.Last()
+		}
+		it.over.Seek(key)
+		if it.over.Valid() {
+			it.over.Prev()
+		} else {
+			it.over.Last()
+		}
+		it.reverse = true
+		it.settle()
+		return
+	}
+	it.step(key)
+	it.settle()
+}
+
+// step moves the iterators at key one step in the direction.
+func (it *stagedIterator) step(key []byte) {
+	if it.base.Valid() && bytes.Equal(it.base.Key(), key) {
+		if it.reverse {
+			it.base.Prev()
+		} else {
+			it.base.Next()
+		}
+	}
+	if it.over.Valid() && bytes.Equal(it.over.Key(), key) {
+		if it.reverse {
+			it.over.Prev()
+		} else {
+			it.over.Next()
+		}
+	}
+}
+
+// settle picks the current iterator, skipping the deletes of the overlay.
+func (it *stagedIterator) settle() {
+	for {
+		baseOK, overOK := it.base.Valid(), it.over.Valid()
+		switch {
+		case !baseOK && !overOK:
+			it.cur = curNone
+			return
+		case !overOK:
+			it.cur = curBase
+			return
+		case !baseOK:
+			it.cur = curOver
+		default:
+			c := bytes.Compare(it.base.Key(), it.over.Key())
+			if it.reverse {
+				c = -c
+			}
+			if c < 0 {
+				it.cur = curBase
+				return
+			}
+			it.cur = curOver
+		}
+		if it.over.Value()[0] != stagedDelete {
+			return
+		}
+		it.step(append([]byte(nil), it.over.Key()...))
+	}
+}
+
+func (it *stagedIterator) Valid() bool {
+	return it.cur != curNone
+}
+
+func (it *stagedIterator) Key() []byte {
+	if it.cur == curOver {
+		return it.over.Key()
+	}
+	return it.base.Key()
+}
+
+func (it *stagedIterator) Value() []byte {
+	if it.cur == curOver {
+		return it.over.Value()[1:]
+	}
+	return it.base.Value()
+}